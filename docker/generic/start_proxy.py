@@ -182,6 +182,43 @@ environment variable or by passing "-k" flag to this script.
         Cipher suites to use for downstream connections as a comma-separated list.
         Please refer to https://www.envoyproxy.io/docs/envoy/latest/api-v2/api/v2/auth/common.proto#auth-tlsparameters''')
 
+    parser.add_argument('--ssl_downstream_client_root_certs_file', default=None, help='''
+        The file path of root certificates that ESPv2 uses to verify the
+        client certificates, which enables the mutual TLS of the downstream
+        connections. Requires --ssl_server_cert_path.''')
+    parser.add_argument('--ssl_downstream_client_cert_mode', default=None,
+        choices=['require', 'optional'], help='''
+        Whether the client certificates are required, or only validated if
+        presented. The default is "require".''')
+    parser.add_argument('--ssl_downstream_client_allowed_sans', default=None, help='''
+        The subject alternative names, such as SPIFFE IDs, allowed in the
+        client certificates for all the operations, separated by ','. A
+        certificate is allowed if any of its SANs matches. The names ending
+        with '*' are matched by prefix.''')
+    parser.add_argument('--ssl_downstream_client_cert_rules_file', default=None, help='''
+        The file path of a JSON file of the URI subject alternative names,
+        such as SPIFFE IDs, allowed per operation, such as {"rules":
+        [{"selector": "<operation>", "allowed_sans":
+        ["spiffe://example.org/ns/prod/*"]}]}. Unlike
+        --ssl_downstream_client_allowed_sans, only the first URI SAN of a
+        certificate is compared, so its other SANs never allow the operation,
+        and other kinds of SANs are rejected.''')
+    parser.add_argument('--ssl_downstream_client_forward_cert_details', default=None, help='''
+        The client certificate details forwarded to the backends in the
+        x-forwarded-client-cert header, separated by ','. The options are
+        "subject", "uri", "dns", "cert" and "chain". The default is
+        "subject,uri".''')
+
+    parser.add_argument('--enable_sds_certificates', action='store_true',
+        help='''Serve the TLS certificates and root certificates of
+        --ssl_server_cert_path, --ssl_backend_client_cert_path and the root
+        certificates flags to Envoy as SDS secrets. The rotated certificate
+        files are pushed to Envoy without a restart.''')
+    parser.add_argument('--check_tls_certificates_interval', default=None,
+        help='''The interval to check the certificate files for rotation
+        when --enable_sds_certificates is set, such as "30s". The default is
+        "10s".''')
+
     parser.add_argument('--ssl_backend_client_cert_path', default=None, help='''
         Proxy's client cert path. When configured, ESPv2 enables TLS mutual
         authentication for HTTPS backends. Requires the certificate and
@@ -212,6 +249,36 @@ environment variable or by passing "-k" flag to this script.
         with value "max-age=31536000; includeSubdomains;" is added for all responses from local backend.
         Not valid for remote backends.''')
 
+    parser.add_argument('--enable_security_headers', action='store_true',
+        help='''Add the security headers to all the responses, including the
+        ones generated by ESPv2, unless the backends set them. The headers are
+        Strict-Transport-Security, X-Content-Type-Options: nosniff,
+        X-Frame-Options, Referrer-Policy and Content-Security-Policy. It
+        replaces the header of --enable_strict_transport_security.''')
+    parser.add_argument('--security_headers_hsts_max_age', default=None,
+        help='''The max-age of the Strict-Transport-Security header in whole
+        seconds, such as "63072000s". The default is one year. The header
+        always includes subdomains.''')
+    parser.add_argument('--security_headers_hsts_preload', action='store_true',
+        help='''Add the preload directive to the Strict-Transport-Security
+        header, which requires --security_headers_hsts_max_age of at least one
+        year.''')
+    parser.add_argument('--security_headers_frame_options', default=None,
+        help='''The value of the X-Frame-Options header, "DENY" or
+        "SAMEORIGIN". The default is "DENY". The header is not added if
+        empty.''')
+    parser.add_argument('--security_headers_referrer_policy', default=None,
+        help='''The value of the Referrer-Policy header. The default is
+        "strict-origin-when-cross-origin". The header is not added if
+        empty.''')
+    parser.add_argument('--security_headers_content_security_policy', default=None,
+        help='''The value of the Content-Security-Policy header. By default,
+        this header is not added.''')
+    parser.add_argument('--security_headers_strip', default=None,
+        help='''The backend response headers removed, separated by ','. The
+        default is "server,x-powered-by". ESPv2 does not add its own Server
+        header if "server" is removed.''')
+
     parser.add_argument('--generate_self_signed_cert', action='store_true',
         help='''Generate a self-signed certificate and key at start, then
         store them in /tmp/ssl/endpoints/server.crt and /tmp/ssl/endponts/server.key.
@@ -227,6 +294,14 @@ environment variable or by passing "-k" flag to this script.
         don't use any paths conflicting with your normal requests.
         Default: not used.''')
 
+    parser.add_argument('--openapi_doc_path', default=None, help='''Define a
+        path on the same ports as the application backend to serve the OpenAPI
+        v3 document generated from the service config. For example,
+        "--openapi_doc_path=/openapi.json" makes ESPv2 return the document for
+        location "/openapi.json", instead of forwarding the request to the
+        backend. Please don't use any paths conflicting with your normal
+        requests. Default: not used.''')
+
     parser.add_argument('--add_request_header', default=None, action='append', help='''
         Add a HTTP header to the request before sent to the upstream backend.
         If the header is already in the request, its value will be replaced with the new one.
@@ -340,6 +415,53 @@ environment variable or by passing "-k" flag to this script.
         Only works when --cors_preset is in use. Enable the CORS header
         Access-Control-Allow-Credentials. By default, this header is disabled.
         ''')
+    parser.add_argument(
+        '--cors_allow_origins',
+        default="",
+        help='''
+        Only works when --cors_preset is in use. A list of origins separated by
+        ',', such as "https://a.example.com,https://b.example.com". The CORS
+        header Access-Control-Allow-Origin is set to the matched origin, in
+        addition to the one of --cors_allow_origin or --cors_allow_origin_regex.
+        ''')
+    parser.add_argument(
+        '--cors_allow_origin_suffixes',
+        default="",
+        help='''
+        Only works when --cors_preset is in use. A list of origin suffixes
+        separated by ',', such as ".example.com". Each suffix must start with
+        '.'. The CORS header Access-Control-Allow-Origin is set to the origins
+        ending with one of the suffixes.
+        ''')
+    parser.add_argument(
+        '--cors_max_age',
+        default=None,
+        help='''
+        Only works when --cors_preset is in use. Configures the CORS header
+        Access-Control-Max-Age in whole seconds, such as "600s", so the
+        browsers cache the preflight responses. By default, this header is
+        not set.
+        ''')
+    parser.add_argument(
+        '--cors_allow_private_network',
+        action='store_true',
+        help='''
+        Only works when --cors_preset is in use. Enable the CORS header
+        Access-Control-Allow-Private-Network in the preflight responses
+        requesting the private network access. By default, this header is
+        disabled.
+        ''')
+    parser.add_argument(
+        '--cors_policies_file',
+        default=None,
+        help='''
+        Path to a JSON file of the CORS policies per operation, overriding the
+        one of --cors_preset. For example {"policies": [{"selector":
+        "endpoints.examples.bookstore.Bookstore.CreateBook", "allow_origin":
+        "https://app.example.com", "allow_credentials": true}]}. Works with or
+        without --cors_preset. The operations on the same path must have the
+        same policy, as their preflight requests are the same.
+        ''')
     parser.add_argument(
         '--check_metadata',
         action='store_true',
@@ -414,6 +536,54 @@ environment variable or by passing "-k" flag to this script.
         help='''
         Specify JWT public key cache duration in seconds. The default is 5 minutes.'''
     )
+    parser.add_argument(
+        '--jwks_local_files',
+        default=None,
+        help='''
+        Read the JWKS of authentication providers from local files instead of
+        their jwks_uri, for air-gapped deployments. Multiple providers are
+        separated by ';', for example
+        provider1=/etc/jwks/provider1.json;provider2=/etc/jwks/provider2.json.
+        The files are watched for key rotation.'''
+    )
+    parser.add_argument(
+        '--jwt_cookie_locations',
+        default=None,
+        help='''
+        Extract the JWT of authentication providers from cookies, in addition
+        to their jwt_locations, for browser-facing APIs. Multiple cookies are
+        separated by ';', for example
+        provider1=session_token;provider2=id_token. The cookie names are
+        matched exactly.'''
+    )
+    parser.add_argument(
+        '--jwt_claim_rules_file',
+        default=None,
+        help='''
+        Path to a JSON file of the JWT claims required to call the operations,
+        enforced after JWT authentication. A claim matches with one of
+        "values", the word or list item in "contains", or the value of the
+        single-segment "path_variable" of the request path.'''
+    )
+    parser.add_argument(
+        '--jwt_claims_to_headers',
+        default=None,
+        help='''
+        Forward claims of the verified JWT to the backend as request headers,
+        for the operations requiring authentication. Multiple claims are
+        separated by ';', for example
+        sub=X-Endpoint-Sub;org.id=X-Endpoint-Org-Id, where nested claims are
+        separated by '.'. Client-supplied headers with the same names are
+        removed from all requests to prevent spoofing.'''
+    )
+    parser.add_argument(
+        '--jwt_provider_claims_to_headers',
+        default=None,
+        help='''
+        Same as --jwt_claims_to_headers, but only for the operations requiring
+        the provider of the claim, for example
+        google_id_token:email=X-Endpoint-Email.'''
+    )
     parser.add_argument(
         '--http_request_timeout_s',
         default=None, type=int,
@@ -465,6 +635,102 @@ environment variable or by passing "-k" flag to this script.
         Set the retry times for service control Report request.
         Must be >= 0 and the default is 5 if not set.
         ''')
+    parser.add_argument(
+        '--rate_limit_service_address',
+        default=None,
+        help='''
+        The address of an external rate limit service implementing the Envoy
+        RLS v3 API, in format of grpc://HOST:PORT or grpcs://HOST:PORT. If set,
+        ESPv2 sends the operation name and the consumer identity of each
+        request to the service, so the rate limits are shared across all of
+        the ESPv2 instances. Without service control, this is how the quota
+        limits of the service config are enforced per consumer, such as by the
+        rate limit emulator of ESPv2, which has one counter per consumer and
+        quota metric.'''
+    )
+    parser.add_argument(
+        '--rate_limit_consumer',
+        default=None,
+        help='''
+        The consumer identity sent to the rate limit service, one of "api_key",
+        "jwt_subject" or "client_ip". The default is "client_ip". Requests
+        without the identity are not rate limited.'''
+    )
+    parser.add_argument(
+        '--ext_authz_address',
+        default=None,
+        help='''
+        The address of an external authorization service, which must approve
+        the requests after JWT authentication. In format of grpc://HOST:PORT
+        or grpcs://HOST:PORT for the Envoy ext_authz gRPC API, or
+        http(s)://HOST:PORT[/PATH_PREFIX] for an HTTP authorization service.'''
+    )
+    parser.add_argument(
+        '--ext_authz_timeout',
+        default=None,
+        help='''
+        The timeout of the requests to the external authorization service,
+        e.g. 500ms. The default is 200ms.'''
+    )
+    parser.add_argument(
+        '--ext_authz_failure_mode_allow',
+        action='store_true',
+        help='''
+        Allow the requests when the external authorization service fails to
+        respond. The requests are rejected by default.'''
+    )
+    parser.add_argument(
+        '--ext_authz_selectors',
+        default=None,
+        help='''
+        The operation selectors checked by the external authorization service,
+        separated by ','. All of the operations are checked if not set.'''
+    )
+    parser.add_argument(
+        '--ext_authz_allowed_headers',
+        default=None,
+        help='''
+        The request headers forwarded to the HTTP authorization service,
+        separated by ','. The JWT payload header is always forwarded.'''
+    )
+    parser.add_argument(
+        '--enable_request_validation',
+        action='store_true',
+        help='''
+        Validate the JSON request bodies of the HTTP operations against the
+        request types in the service config. Requests with unknown fields,
+        mismatched field types or missing required fields are rejected with
+        400.'''
+    )
+    parser.add_argument(
+        '--request_validation_max_body_bytes',
+        default=None,
+        help='''
+        The size limit of the request bodies validated by
+        --enable_request_validation. Larger request bodies are rejected with
+        413. The default is 1048576.'''
+    )
+    parser.add_argument(
+        '--local_reply_format',
+        default=None,
+        help='''
+        The body format of the error responses generated by ESPv2. The options
+        are "json" for {"code", "message"}, "google_rpc_status" for the
+        google.rpc.Status JSON error envelope and "problem_json" for RFC 7807
+        application/problem+json. The default is "json". The gRPC requests
+        always get the plain error messages in the grpc-message trailers,
+        while the gRPC-Web requests get the HTTP error responses.'''
+    )
+    parser.add_argument(
+        '--local_reply_mappers_file',
+        default=None,
+        help='''
+        Path to a JSON file of the error response formats per status code and
+        request content type, overriding --local_reply_format. For example
+        {"mappers": [{"status_code": 404, "request_content_type": "text/html",
+        "text_format": "<h1>%%LOCAL_REPLY_BODY%%</h1>", "content_type":
+        "text/html"}]}.'''
+    )
     parser.add_argument(
         '--backend_retry_ons',
         default=None,
@@ -484,6 +750,60 @@ environment variable or by passing "-k" flag to this script.
         help='''
         The allowed number of retries. Must be >= 0 and defaults to 1. 
         ''')
+    parser.add_argument(
+        '--backend_retry_mode',
+        default=None,
+        help='''
+        How the retry conditions are chosen, `global` or `idempotent`. The
+        default `global` applies --backend_retry_ons to all the routes.
+        `idempotent` retries the idempotent calls, by HTTP method or by the
+        gRPC idempotency_level option, on resets, 5xx and gRPC UNAVAILABLE,
+        and the other calls only when the request was not sent.
+        ''')
+    parser.add_argument(
+        '--backend_retry_base_interval',
+        default=None,
+        help='''
+        The base interval of the exponential backoff between the backend
+        retries, e.g. `100ms`. Envoy's default of 25ms is used if not set.
+        ''')
+    parser.add_argument(
+        '--backend_retry_max_interval',
+        default=None,
+        help='''
+        The maximum interval between the backend retries, e.g. `1s`. 10 times
+        the base interval if not set.
+        ''')
+    parser.add_argument(
+        '--backend_retriable_status_codes',
+        default=None,
+        help='''
+        The HTTP status codes of the backend responses to retry on, separated
+        by ','. In the `global` mode, they only take effect if
+        --backend_retry_ons includes `retriable-status-codes`.
+        ''')
+    parser.add_argument(
+        '--backend_retry_budget_percent',
+        default=None,
+        help='''
+        The limit of the concurrent retries to each backend, as a percentage
+        of its active requests. No retry budget if not set.
+        ''')
+    parser.add_argument(
+        '--backend_retry_budget_min_concurrency',
+        default=None,
+        help='''
+        The minimum of the concurrent retries allowed by the retry budget.
+        Envoy's default of 3 is used if not set.
+        ''')
+    parser.add_argument(
+        '--backend_retry_previous_hosts',
+        action='store_true',
+        default=False,
+        help='''
+        Retry the backend requests on other hosts than the ones already
+        attempted, if the backends resolve to multiple hosts.
+        ''')
     parser.add_argument(
         '--access_log',
         help='''
@@ -575,6 +895,16 @@ environment variable or by passing "-k" flag to this script.
         This will also disable the following features:
         - Backend authentication
         ''')
+    parser.add_argument(
+        '--anthos_without_metadata_server',
+        action='store_true',
+        default=False,
+        help='''
+        Set it on Anthos clusters outside of GCP, which have no metadata
+        server. The platform is reported as Anthos when the metadata server
+        is not reached on Kubernetes, instead of failing to fetch the GCP
+        attributes.
+        ''')
     parser.add_argument(
         '--service_account_key',
         help='''
@@ -583,6 +913,15 @@ environment variable or by passing "-k" flag to this script.
         the location of the service account credentials JSON file. If the option is
         omitted, the proxy contacts the metadata service to fetch an access token.
         '''.format(creds_key=GOOGLE_CREDS_KEY))
+    parser.add_argument(
+        '--token_agent_socket',
+        default=None,
+        help='''
+        The Unix domain socket the token agent listens on instead of the
+        loopback port, to serve the tokens minted from --service_account_key
+        only to the processes allowed to access the socket file. The socket
+        file is created with mode 0600.
+        ''')
 
     parser.add_argument(
         '--dns_resolver_addresses',
@@ -852,6 +1191,9 @@ def gen_proxy_config(args):
     if args.healthz:
       proxy_conf.extend(["--healthz", args.healthz])
 
+    if args.openapi_doc_path:
+      proxy_conf.extend(["--openapi_doc_path", args.openapi_doc_path])
+
     if args.enable_debug:
         proxy_conf.extend(["--v", "1"])
     else:
@@ -867,6 +1209,21 @@ def gen_proxy_config(args):
     if args.jwks_cache_duration_in_s:
          proxy_conf.extend(["--jwks_cache_duration_in_s", args.jwks_cache_duration_in_s])
 
+    if args.jwks_local_files:
+        proxy_conf.extend(["--jwks_local_files", args.jwks_local_files])
+
+    if args.jwt_cookie_locations:
+        proxy_conf.extend(["--jwt_cookie_locations", args.jwt_cookie_locations])
+
+    if args.jwt_claim_rules_file:
+        proxy_conf.extend(["--jwt_claim_rules_file", args.jwt_claim_rules_file])
+
+    if args.jwt_claims_to_headers:
+        proxy_conf.extend(["--jwt_claims_to_headers", args.jwt_claims_to_headers])
+
+    if args.jwt_provider_claims_to_headers:
+        proxy_conf.extend(["--jwt_provider_claims_to_headers", args.jwt_provider_claims_to_headers])
+
     if args.management:
         proxy_conf.extend(["--service_management_url", args.management])
 
@@ -912,6 +1269,22 @@ def gen_proxy_config(args):
     if args.tls_mutual_auth:
         proxy_conf.extend(["--ssl_backend_client_cert_path", "/etc/nginx/ssl"])
 
+    if args.enable_sds_certificates:
+        proxy_conf.append("--enable_sds_certificates")
+        if args.check_tls_certificates_interval:
+            proxy_conf.extend(["--check_tls_certificates_interval", args.check_tls_certificates_interval])
+
+    if args.ssl_downstream_client_root_certs_file:
+        proxy_conf.extend(["--ssl_downstream_client_root_certs_path", str(args.ssl_downstream_client_root_certs_file)])
+    if args.ssl_downstream_client_cert_mode:
+        proxy_conf.extend(["--ssl_downstream_client_cert_mode", args.ssl_downstream_client_cert_mode])
+    if args.ssl_downstream_client_allowed_sans:
+        proxy_conf.extend(["--ssl_downstream_client_allowed_sans", args.ssl_downstream_client_allowed_sans])
+    if args.ssl_downstream_client_cert_rules_file:
+        proxy_conf.extend(["--ssl_downstream_client_cert_rules_file", str(args.ssl_downstream_client_cert_rules_file)])
+    if args.ssl_downstream_client_forward_cert_details:
+        proxy_conf.extend(["--ssl_downstream_client_forward_cert_details", args.ssl_downstream_client_forward_cert_details])
+
     if args.ssl_minimum_protocol:
         proxy_conf.extend(["--ssl_minimum_protocol", args.ssl_minimum_protocol])
     if args.ssl_maximum_protocol:
@@ -944,6 +1317,22 @@ def gen_proxy_config(args):
     if args.enable_strict_transport_security:
             proxy_conf.append("--enable_strict_transport_security")
 
+    if args.enable_security_headers:
+        proxy_conf.append("--enable_security_headers")
+        if args.security_headers_hsts_max_age:
+            proxy_conf.extend(["--security_headers_hsts_max_age", args.security_headers_hsts_max_age])
+        if args.security_headers_hsts_preload:
+            proxy_conf.append("--security_headers_hsts_preload")
+        # The empty values omit the headers.
+        if args.security_headers_frame_options is not None:
+            proxy_conf.extend(["--security_headers_frame_options", args.security_headers_frame_options])
+        if args.security_headers_referrer_policy is not None:
+            proxy_conf.extend(["--security_headers_referrer_policy", args.security_headers_referrer_policy])
+        if args.security_headers_content_security_policy:
+            proxy_conf.extend(["--security_headers_content_security_policy", args.security_headers_content_security_policy])
+        if args.security_headers_strip is not None:
+            proxy_conf.extend(["--security_headers_strip", args.security_headers_strip])
+
     if args.service:
         proxy_conf.extend(["--service", args.service])
 
@@ -968,6 +1357,39 @@ def gen_proxy_config(args):
             args.service_control_report_retries
         ])
 
+    if args.rate_limit_service_address:
+        proxy_conf.extend(["--rate_limit_service_address", args.rate_limit_service_address])
+
+    if args.rate_limit_consumer:
+        proxy_conf.extend(["--rate_limit_consumer", args.rate_limit_consumer])
+
+    if args.ext_authz_address:
+        proxy_conf.extend(["--ext_authz_address", args.ext_authz_address])
+
+    if args.ext_authz_timeout:
+        proxy_conf.extend(["--ext_authz_timeout", args.ext_authz_timeout])
+
+    if args.ext_authz_failure_mode_allow:
+        proxy_conf.append("--ext_authz_failure_mode_allow")
+
+    if args.ext_authz_selectors:
+        proxy_conf.extend(["--ext_authz_selectors", args.ext_authz_selectors])
+
+    if args.ext_authz_allowed_headers:
+        proxy_conf.extend(["--ext_authz_allowed_headers", args.ext_authz_allowed_headers])
+
+    if args.enable_request_validation:
+        proxy_conf.append("--enable_request_validation")
+
+    if args.request_validation_max_body_bytes:
+        proxy_conf.extend(["--request_validation_max_body_bytes", args.request_validation_max_body_bytes])
+
+    if args.local_reply_format:
+        proxy_conf.extend(["--local_reply_format", args.local_reply_format])
+
+    if args.local_reply_mappers_file:
+        proxy_conf.extend(["--local_reply_mappers_file", args.local_reply_mappers_file])
+
     if args.service_control_check_timeout_ms:
         proxy_conf.extend([
             "--service_control_check_timeout_ms",
@@ -1008,6 +1430,27 @@ def gen_proxy_config(args):
     if args.backend_retry_num:
         proxy_conf.extend(["--backend_retry_num", args.backend_retry_num])
 
+    if args.backend_retry_mode:
+        proxy_conf.extend(["--backend_retry_mode", args.backend_retry_mode])
+
+    if args.backend_retry_base_interval:
+        proxy_conf.extend(["--backend_retry_base_interval", args.backend_retry_base_interval])
+
+    if args.backend_retry_max_interval:
+        proxy_conf.extend(["--backend_retry_max_interval", args.backend_retry_max_interval])
+
+    if args.backend_retriable_status_codes:
+        proxy_conf.extend(["--backend_retriable_status_codes", args.backend_retriable_status_codes])
+
+    if args.backend_retry_budget_percent:
+        proxy_conf.extend(["--backend_retry_budget_percent", args.backend_retry_budget_percent])
+
+    if args.backend_retry_budget_min_concurrency:
+        proxy_conf.extend(["--backend_retry_budget_min_concurrency", args.backend_retry_budget_min_concurrency])
+
+    if args.backend_retry_previous_hosts:
+        proxy_conf.append("--backend_retry_previous_hosts")
+
     if args.access_log:
         proxy_conf.extend(["--access_log",
                            args.access_log])
@@ -1088,6 +1531,17 @@ def gen_proxy_config(args):
         ])
         if args.cors_allow_credentials:
             proxy_conf.append("--cors_allow_credentials")
+        if args.cors_allow_origins:
+            proxy_conf.extend(["--cors_allow_origins", args.cors_allow_origins])
+        if args.cors_allow_origin_suffixes:
+            proxy_conf.extend(["--cors_allow_origin_suffixes", args.cors_allow_origin_suffixes])
+        if args.cors_max_age:
+            proxy_conf.extend(["--cors_max_age", args.cors_max_age])
+        if args.cors_allow_private_network:
+            proxy_conf.append("--cors_allow_private_network")
+
+    if args.cors_policies_file:
+        proxy_conf.extend(["--cors_policies_file", args.cors_policies_file])
 
     # Set credentials file from the environment variable
     if args.service_account_key is None and GOOGLE_CREDS_KEY in os.environ:
@@ -1095,9 +1549,14 @@ def gen_proxy_config(args):
 
     if args.service_account_key:
         proxy_conf.extend(["--service_account_key", args.service_account_key])
+    if args.token_agent_socket:
+        proxy_conf.extend(["--token_agent_socket", args.token_agent_socket])
     if args.non_gcp:
         proxy_conf.append("--non_gcp")
 
+    if args.anthos_without_metadata_server:
+        proxy_conf.append("--anthos_without_metadata_server")
+
     if args.enable_debug:
         proxy_conf.append("--suppress_envoy_headers=false")
 
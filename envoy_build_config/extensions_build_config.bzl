@@ -12,12 +12,17 @@ EXTENSIONS = {
     # All extensions explicitly referenced by config generator and our tests.
     "envoy.access_loggers.file": "//source/extensions/access_loggers/file:config",
     "envoy.filters.http.cors": "//source/extensions/filters/http/cors:config",
+    "envoy.filters.http.ext_authz": "//source/extensions/filters/http/ext_authz:config",
     "envoy.filters.http.grpc_json_transcoder": "//source/extensions/filters/http/grpc_json_transcoder:config",
     "envoy.filters.http.grpc_web": "//source/extensions/filters/http/grpc_web:config",
     "envoy.filters.http.health_check": "//source/extensions/filters/http/health_check:config",
     "envoy.filters.http.jwt_authn": "//source/extensions/filters/http/jwt_authn:config",
+    "envoy.filters.http.lua": "//source/extensions/filters/http/lua:config",
+    "envoy.filters.http.ratelimit": "//source/extensions/filters/http/ratelimit:config",
+    "envoy.filters.http.rbac": "//source/extensions/filters/http/rbac:config",
     "envoy.filters.http.router": "//source/extensions/filters/http/router:config",
     "envoy.filters.network.http_connection_manager": "//source/extensions/filters/network/http_connection_manager:config",
+    "envoy.retry_host_predicates.previous_hosts": "//source/extensions/retry/host/previous_hosts:config",
     "envoy.tracers.opencensus": "//source/extensions/tracers/opencensus:config",
 
     # Implicitly needed for TLS config.
@@ -14,6 +14,7 @@ require (
 	github.com/gorilla/mux v1.6.3-0.20181030152528-3d80bc801bb0
 	github.com/gorilla/websocket v1.4.2
 	github.com/miekg/dns v1.1.29
+	github.com/yuin/gopher-lua v1.1.1
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9 // indirect
@@ -72,6 +72,8 @@ AudienceContext::AudienceContext(
     case FilterConfig::IdTokenInfoCase::kImdsToken: {
       const std::string& uri = filter_config.imds_token().uri();
       const std::string& cluster = filter_config.imds_token().cluster();
+      const token::RequestHeaders& request_headers =
+          filter_config.imds_token().request_headers();
       const std::chrono::seconds fetch_timeout(
           TimeUtil::DurationToSeconds(filter_config.imds_token().timeout()));
       const DependencyErrorBehavior error_behavior =
@@ -80,8 +82,8 @@ AudienceContext::AudienceContext(
           absl::StrCat(uri, "?format=standard&audience=", jwt_audience);
 
       imds_token_sub_ptr_ = token_subscriber_factory.createImdsTokenSubscriber(
-          TokenType::IdentityToken, cluster, real_uri, fetch_timeout,
-          error_behavior, callback);
+          TokenType::IdentityToken, cluster, real_uri, request_headers,
+          fetch_timeout, error_behavior, callback);
     }
       return;
     default:
@@ -101,14 +103,17 @@ FilterConfigParserImpl::FilterConfigParserImpl(
             config.iam_token().access_token().remote_token().cluster();
         const std::string& uri =
             config.iam_token().access_token().remote_token().uri();
+        const token::RequestHeaders& request_headers =
+            config.iam_token().access_token().remote_token().request_headers();
         const std::chrono::seconds fetch_timeout(TimeUtil::DurationToSeconds(
             config.iam_token().access_token().remote_token().timeout()));
         const DependencyErrorBehavior error_behavior =
             config.dep_error_behavior();
         access_token_sub_ptr_ =
             token_subscriber_factory.createImdsTokenSubscriber(
-                TokenType::AccessToken, cluster, uri, fetch_timeout,
-                error_behavior, [this](absl::string_view access_token) {
+                TokenType::AccessToken, cluster, uri, request_headers,
+                fetch_timeout, error_behavior,
+                [this](absl::string_view access_token) {
                   access_token_ = std::string(access_token);
                 });
         break;
@@ -64,10 +64,12 @@ imds_token {
   EXPECT_CALL(mock_token_subscriber_factory_,
               createImdsTokenSubscriber(
                   token::TokenType::IdentityToken, "this-is-cluster",
-                  "this-is-uri?format=standard&audience=audience-foo",
+                  "this-is-uri?format=standard&audience=audience-foo", _,
                   std::chrono::seconds(20), _, _))
       .WillOnce(Invoke([&token_foo](const token::TokenType&, const std::string&,
-                                    const std::string&, std::chrono::seconds,
+                                    const std::string&,
+                                    const token::RequestHeaders&,
+                                    std::chrono::seconds,
                                     DependencyErrorBehavior,
                                     token::UpdateTokenCallback callback)
                            -> token::TokenSubscriberPtr {
@@ -77,10 +79,12 @@ imds_token {
   EXPECT_CALL(mock_token_subscriber_factory_,
               createImdsTokenSubscriber(
                   token::TokenType::IdentityToken, "this-is-cluster",
-                  "this-is-uri?format=standard&audience=audience-bar",
+                  "this-is-uri?format=standard&audience=audience-bar", _,
                   std::chrono::seconds(20), _, _))
       .WillOnce(Invoke([&token_bar](const token::TokenType&, const std::string&,
-                                    const std::string&, std::chrono::seconds,
+                                    const std::string&,
+                                    const token::RequestHeaders&,
+                                    std::chrono::seconds,
                                     DependencyErrorBehavior,
                                     token::UpdateTokenCallback callback)
                            -> token::TokenSubscriberPtr {
@@ -125,10 +129,12 @@ iam_token {
   EXPECT_CALL(mock_token_subscriber_factory_,
               createImdsTokenSubscriber(
                   token::TokenType::AccessToken, "this-is-imds-cluster",
-                  "this-is-imds-uri", std::chrono::seconds(20), _, _))
+                  "this-is-imds-uri", _, std::chrono::seconds(20), _, _))
       .WillOnce(
           Invoke([&access_token](const token::TokenType&, const std::string&,
-                                 const std::string&, std::chrono::seconds,
+                                 const std::string&,
+                                 const token::RequestHeaders&,
+                                 std::chrono::seconds,
                                  DependencyErrorBehavior,
                                  token::UpdateTokenCallback callback)
                      -> token::TokenSubscriberPtr {
@@ -37,13 +37,15 @@ using token::TokenType;
 void ServiceControlCallImpl::createImdsTokenSub() {
   const std::string& token_cluster = filter_config_.imds_token().cluster();
   const std::string& token_uri = filter_config_.imds_token().uri();
+  const token::RequestHeaders& request_headers =
+      filter_config_.imds_token().request_headers();
   const std::chrono::seconds fetch_timeout(
       TimeUtil::DurationToSeconds(filter_config_.imds_token().timeout()));
   const DependencyErrorBehavior error_behavior =
       filter_config_.dep_error_behavior();
   imds_token_sub_ = token_subscriber_factory_.createImdsTokenSubscriber(
-      TokenType::AccessToken, token_cluster, token_uri, fetch_timeout,
-      error_behavior, [this](absl::string_view token) {
+      TokenType::AccessToken, token_cluster, token_uri, request_headers,
+      fetch_timeout, error_behavior, [this](absl::string_view token) {
         TokenSharedPtr new_token = std::make_shared<std::string>(token);
         tls_.runOnAllThreads(
             [new_token](Envoy::OptRef<ThreadLocalCache> object) {
@@ -60,13 +62,18 @@ void ServiceControlCallImpl::createIamTokenSub() {
           filter_config_.iam_token().access_token().remote_token().cluster();
       const std::string& uri =
           filter_config_.iam_token().access_token().remote_token().uri();
+      const token::RequestHeaders& request_headers =
+          filter_config_.iam_token()
+              .access_token()
+              .remote_token()
+              .request_headers();
       const std::chrono::seconds fetch_timeout(TimeUtil::DurationToSeconds(
           filter_config_.iam_token().access_token().remote_token().timeout()));
       const DependencyErrorBehavior error_behavior =
           filter_config_.dep_error_behavior();
       access_token_sub_ = token_subscriber_factory_.createImdsTokenSubscriber(
-          TokenType::AccessToken, cluster, uri, fetch_timeout, error_behavior,
-          [this](absl::string_view access_token) {
+          TokenType::AccessToken, cluster, uri, request_headers, fetch_timeout,
+          error_behavior, [this](absl::string_view access_token) {
             access_token_for_iam_ = std::string(access_token);
           });
       break;
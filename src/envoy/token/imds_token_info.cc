@@ -14,7 +14,11 @@
 
 #include "src/envoy/token/imds_token_info.h"
 
+#include <algorithm>
+
 #include "absl/strings/str_cat.h"
+#include "absl/strings/str_split.h"
+#include "common/common/base64.h"
 #include "common/http/headers.h"
 #include "common/http/message_impl.h"
 #include "common/http/utility.h"
@@ -33,7 +37,8 @@ constexpr char kMetadataFlavor[]{"Google"};
 // Default token expiry time for ID tokens.
 constexpr std::chrono::seconds kDefaultTokenExpiry(3599);
 
-ImdsTokenInfo::ImdsTokenInfo() {}
+ImdsTokenInfo::ImdsTokenInfo(Envoy::TimeSource& time_source)
+    : time_source_(time_source) {}
 
 Envoy::Http::RequestMessagePtr ImdsTokenInfo::prepareRequest(
     absl::string_view token_url) const {
@@ -96,10 +101,42 @@ bool ImdsTokenInfo::parseAccessToken(absl::string_view response,
 }
 
 // Identity token response is just the raw string, no JSON to parse.
+//
+// The token may be served from a cache, e.g. by the token agent, so its
+// expiry is capped by the `exp` claim when the token is a JWT.
 bool ImdsTokenInfo::parseIdentityToken(absl::string_view response,
                                        TokenResult* ret) const {
   ret->token = std::string(response);
   ret->expiry_duration = kDefaultTokenExpiry;
+
+  const std::vector<absl::string_view> segments =
+      absl::StrSplit(response, '.');
+  if (segments.size() != 3) {
+    return true;
+  }
+
+  ::google::protobuf::Struct payload_pb;
+  ::google::protobuf::util::Status parse_status =
+      ::google::protobuf::util::JsonStringToMessage(
+          Envoy::Base64Url::decode(std::string(segments[1])), &payload_pb);
+  if (!parse_status.ok()) {
+    return true;
+  }
+  JsonStruct json_struct(payload_pb);
+
+  int exp;
+  parse_status = json_struct.getInteger("exp", &exp);
+  if (!parse_status.ok()) {
+    return true;
+  }
+
+  const std::chrono::seconds now =
+      std::chrono::duration_cast<std::chrono::seconds>(
+          time_source_.systemTime().time_since_epoch());
+  const std::chrono::seconds expires_in = std::chrono::seconds(exp) - now;
+  if (expires_in < ret->expiry_duration) {
+    ret->expiry_duration = std::max(expires_in, std::chrono::seconds(0));
+  }
   return true;
 }
 
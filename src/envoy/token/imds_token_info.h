@@ -14,6 +14,7 @@
 
 #pragma once
 
+#include "envoy/common/time.h"
 #include "src/envoy/token/token_info.h"
 
 namespace espv2 {
@@ -24,7 +25,7 @@ namespace token {
 // identity and access tokens from the Instance Metadata Server.
 class ImdsTokenInfo : public TokenInfo {
  public:
-  ImdsTokenInfo();
+  ImdsTokenInfo(Envoy::TimeSource& time_source);
 
   Envoy::Http::RequestMessagePtr prepareRequest(
       absl::string_view token_url) const override;
@@ -32,6 +33,9 @@ class ImdsTokenInfo : public TokenInfo {
                         TokenResult* ret) const override;
   bool parseIdentityToken(absl::string_view response,
                           TokenResult* ret) const override;
+
+ private:
+  Envoy::TimeSource& time_source_;
 };
 
 }  // namespace token
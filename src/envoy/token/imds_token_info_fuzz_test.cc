@@ -12,6 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+#include "common/event/real_time_system.h"
 #include "src/envoy/token/imds_token_info.h"
 #include "test/fuzz/fuzz_runner.h"
 #include "test/fuzz/utility.h"
@@ -32,7 +33,8 @@ DEFINE_PROTO_FUZZER(
   try {
     Envoy::TestUtility::validate(input);
 
-    ImdsTokenInfo token_info;
+    Envoy::Event::RealTimeSystem time_system;
+    ImdsTokenInfo token_info(time_system);
 
     // Call functions under test.
     TokenResult ret;
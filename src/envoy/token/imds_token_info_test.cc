@@ -14,8 +14,11 @@
 
 #include "src/envoy/token/imds_token_info.h"
 
+#include "absl/strings/str_cat.h"
+#include "common/common/base64.h"
 #include "common/http/message_impl.h"
 #include "gtest/gtest.h"
+#include "test/test_common/simulated_time_system.h"
 
 namespace espv2 {
 namespace envoy {
@@ -28,8 +31,21 @@ constexpr std::chrono::seconds kDefaultTokenExpiry(3599);
 
 class ImdsTokenInfoTest : public testing::Test {
  protected:
-  void SetUp() override { info_ = std::make_unique<ImdsTokenInfo>(); }
-
+  void SetUp() override {
+    time_system_.setSystemTime(std::chrono::system_clock::from_time_t(1000));
+    info_ = std::make_unique<ImdsTokenInfo>(time_system_);
+  }
+
+  // Makes an unsigned JWT with the payload.
+  std::string makeJwt(const std::string& payload) {
+    const std::string header = R"({"alg":"RS256","typ":"JWT"})";
+    return absl::StrCat(
+        Envoy::Base64Url::encode(header.data(), header.size()), ".",
+        Envoy::Base64Url::encode(payload.data(), payload.size()),
+        ".signature");
+  }
+
+  Envoy::Event::SimulatedTimeSystem time_system_;
   TokenInfoPtr info_;
 };
 
@@ -65,6 +81,49 @@ TEST_F(ImdsTokenInfoTest, IdentityTokenSuccess) {
   EXPECT_EQ(result.expiry_duration, kDefaultTokenExpiry);
 }
 
+TEST_F(ImdsTokenInfoTest, IdentityTokenExpiryFromJwt) {
+  // A cached token that expires before the default expiry.
+  std::string response = makeJwt(R"({"aud":"foo.com","exp":2000})");
+  TokenResult result{};
+
+  bool success = info_->parseIdentityToken(response, &result);
+  EXPECT_TRUE(success);
+  EXPECT_EQ(result.token, response);
+  EXPECT_EQ(result.expiry_duration, std::chrono::seconds(1000));
+}
+
+TEST_F(ImdsTokenInfoTest, IdentityTokenExpiryCappedByDefault) {
+  // The default expiry is kept for a token that outlives it.
+  std::string response = makeJwt(R"({"aud":"foo.com","exp":100000})");
+  TokenResult result{};
+
+  bool success = info_->parseIdentityToken(response, &result);
+  EXPECT_TRUE(success);
+  EXPECT_EQ(result.expiry_duration, kDefaultTokenExpiry);
+}
+
+TEST_F(ImdsTokenInfoTest, IdentityTokenExpired) {
+  std::string response = makeJwt(R"({"aud":"foo.com","exp":500})");
+  TokenResult result{};
+
+  bool success = info_->parseIdentityToken(response, &result);
+  EXPECT_TRUE(success);
+  EXPECT_EQ(result.expiry_duration, std::chrono::seconds(0));
+}
+
+TEST_F(ImdsTokenInfoTest, IdentityTokenWithoutExp) {
+  // Tokens without a parsable `exp` claim use the default expiry.
+  for (const std::string& response :
+       {makeJwt(R"({"aud":"foo.com"})"), makeJwt(R"({"exp":"invalid"})"),
+        makeJwt("non-json-payload"), std::string("a.b.c")}) {
+    TokenResult result{};
+    bool success = info_->parseIdentityToken(response, &result);
+    EXPECT_TRUE(success);
+    EXPECT_EQ(result.token, response);
+    EXPECT_EQ(result.expiry_duration, kDefaultTokenExpiry);
+  }
+}
+
 TEST_F(ImdsTokenInfoTest, InvalidJsonResponse) {
   // Input.
   std::string response = R"({ "key": "value" })";
@@ -29,7 +29,9 @@ class MockTokenSubscriberFactory : public TokenSubscriberFactory {
  public:
   MOCK_METHOD(TokenSubscriberPtr, createImdsTokenSubscriber,
               (const TokenType& token_type, const std::string& token_cluster,
-               const std::string& token_url, std::chrono::seconds fetch_timeout,
+               const std::string& token_url,
+               const RequestHeaders& request_headers,
+               std::chrono::seconds fetch_timeout,
                ::espv2::api::envoy::v9::http::common::DependencyErrorBehavior
                    error_behavior,
                UpdateTokenCallback callback),
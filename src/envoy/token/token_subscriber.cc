@@ -38,9 +38,9 @@ constexpr std::chrono::seconds kRefreshBuffer(5);
 TokenSubscriber::TokenSubscriber(
     Envoy::Server::Configuration::FactoryContext& context,
     const TokenType& token_type, const std::string& token_cluster,
-    const std::string& token_url, std::chrono::seconds fetch_timeout,
-    DependencyErrorBehavior error_behavior, UpdateTokenCallback callback,
-    TokenInfoPtr token_info)
+    const std::string& token_url, const RequestHeaders& request_headers,
+    std::chrono::seconds fetch_timeout, DependencyErrorBehavior error_behavior,
+    UpdateTokenCallback callback, TokenInfoPtr token_info)
     : context_(context),
       token_type_(token_type),
       token_cluster_(token_cluster),
@@ -51,6 +51,10 @@ TokenSubscriber::TokenSubscriber(
       token_info_(std::move(token_info)),
       active_request_(nullptr),
       init_target_(nullptr) {
+  for (const auto& header : request_headers) {
+    request_headers_.emplace_back(Envoy::Http::LowerCaseString(header.first),
+                                  header.second);
+  }
   debug_name_ = absl::StrCat("TokenSubscriber(", token_url_, ")");
 }
 
@@ -118,6 +122,9 @@ void TokenSubscriber::refresh() {
     handleFailResponse();
     return;
   }
+  for (const auto& header : request_headers_) {
+    message->headers().setCopy(header.first, header.second);
+  }
 
   const struct Envoy::Http::AsyncClient::RequestOptions options =
       Envoy::Http::AsyncClient::RequestOptions()
@@ -32,6 +32,9 @@ enum TokenType { AccessToken, IdentityToken };
 
 using UpdateTokenCallback = std::function<void(absl::string_view)>;
 
+// The headers added to the token requests, from HttpUri.request_headers.
+using RequestHeaders = ::google::protobuf::Map<std::string, std::string>;
+
 // `TokenSubscriber` class contains platform logic to initiate token refreshes
 // and callback to the clients.
 //
@@ -44,6 +47,7 @@ class TokenSubscriber
   TokenSubscriber(Envoy::Server::Configuration::FactoryContext& context,
                   const TokenType& token_type, const std::string& token_cluster,
                   const std::string& token_url,
+                  const RequestHeaders& request_headers,
                   std::chrono::seconds fetch_timeout,
                   ::espv2::api::envoy::v9::http::common::DependencyErrorBehavior
                       error_behavior,
@@ -72,6 +76,8 @@ class TokenSubscriber
   const TokenType token_type_;
   const std::string token_cluster_;
   const std::string token_url_;
+  std::vector<std::pair<Envoy::Http::LowerCaseString, std::string>>
+      request_headers_;
   const std::chrono::seconds fetch_timeout_;
   const api::envoy::v9::http::common::DependencyErrorBehavior error_behavior_;
   const UpdateTokenCallback callback_;
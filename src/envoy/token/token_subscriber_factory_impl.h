@@ -32,14 +32,15 @@ class TokenSubscriberFactoryImpl : public TokenSubscriberFactory {
 
   TokenSubscriberPtr createImdsTokenSubscriber(
       const TokenType& token_type, const std::string& token_cluster,
-      const std::string& token_url, std::chrono::seconds fetch_timeout,
+      const std::string& token_url, const RequestHeaders& request_headers,
+      std::chrono::seconds fetch_timeout,
       ::espv2::api::envoy::v9::http::common::DependencyErrorBehavior
           error_behavior,
       UpdateTokenCallback callback) const override {
-    TokenInfoPtr info = std::make_unique<ImdsTokenInfo>();
+    TokenInfoPtr info = std::make_unique<ImdsTokenInfo>(context_.timeSource());
     TokenSubscriberPtr subscriber = std::make_unique<TokenSubscriber>(
-        context_, token_type, token_cluster, token_url, fetch_timeout,
-        error_behavior, callback, std::move(info));
+        context_, token_type, token_cluster, token_url, request_headers,
+        fetch_timeout, error_behavior, callback, std::move(info));
     subscriber->init();
     return subscriber;
   }
@@ -56,8 +57,8 @@ class TokenSubscriberFactoryImpl : public TokenSubscriberFactory {
     TokenInfoPtr info = std::make_unique<IamTokenInfo>(
         delegates, scopes, token_type == IdentityToken, access_token_fn);
     TokenSubscriberPtr subscriber = std::make_unique<TokenSubscriber>(
-        context_, token_type, token_cluster, token_url, fetch_timeout,
-        error_behavior, callback, std::move(info));
+        context_, token_type, token_cluster, token_url, RequestHeaders(),
+        fetch_timeout, error_behavior, callback, std::move(info));
     subscriber->init();
     return subscriber;
   }
@@ -80,7 +80,7 @@ class TokenSubscriberTest : public testing::Test {
 
     // Create token subscriber under test.
     token_sub_ = std::make_unique<TokenSubscriber>(
-        context_, token_type, "token_cluster", token_url_,
+        context_, token_type, "token_cluster", token_url_, request_headers_,
         std::chrono::seconds(5), error_behavior,
         token_callback_.AsStdFunction(), std::move(info_));
     token_sub_->init();
@@ -103,6 +103,7 @@ class TokenSubscriberTest : public testing::Test {
 
   // Params to class under test.
   std::string token_url_ = "http://iam/uri_suffix";
+  RequestHeaders request_headers_;
   MockFunction<int(absl::string_view)> token_callback_;
 
   // Mocks for remote request.
@@ -162,6 +163,29 @@ TEST_F(TokenSubscriberTest, VerifyRemoteRequest) {
   EXPECT_EQ(message_->headers().Host()->value().getStringView(), "TestValue");
 }
 
+TEST_F(TokenSubscriberTest, VerifyRemoteRequestHeaders) {
+  // Setup fake remote request.
+  Envoy::Http::RequestHeaderMapPtr headers(
+      new Envoy::Http::TestRequestHeaderMapImpl(
+          {{":method", "GET"}, {":authority", "TestValue"}}));
+  EXPECT_CALL(*info_, prepareRequest(token_url_))
+      .Times(1)
+      .WillRepeatedly(
+          Return(ByMove(std::make_unique<Envoy::Http::RequestMessageImpl>(
+              std::move(headers)))));
+  request_headers_["X-Token-Agent-Secret"] = "this-is-secret";
+
+  // Start class under test.
+  setUp(TokenType::AccessToken,
+        DependencyErrorBehavior::BLOCK_INIT_ON_ANY_ERROR);
+
+  // Assert the configured headers are added to the remote call.
+  ASSERT_EQ(call_count_, 1);
+  const Envoy::Http::LowerCaseString secret_key("x-token-agent-secret");
+  EXPECT_EQ(message_->headers().get(secret_key)[0]->value().getStringView(),
+            "this-is-secret");
+}
+
 TEST_F(TokenSubscriberTest, ProcessNon200Response) {
   // Setup fake remote request.
   Envoy::Http::RequestHeaderMapPtr req_headers(
@@ -30,6 +30,11 @@ import (
 // id is the service configuration ID. It is generated when deploying
 // service config to ServiceManagement Server, example: 2017-02-13r0.
 func ServiceToBootstrapConfig(serviceConfig *confpb.Service, id string, opts options.ConfigGeneratorOptions) (*bootstrappb.Bootstrap, error) {
+	// The SDS secrets are served by the config manager through ADS.
+	if opts.EnableSdsCertificates {
+		return nil, fmt.Errorf("SDS certificates are not supported by the static bootstrap config")
+	}
+
 	bt := &bootstrappb.Bootstrap{
 		Node:           bootstrap.CreateNode(opts.CommonOptions),
 		Admin:          bootstrap.CreateAdmin(opts.CommonOptions),
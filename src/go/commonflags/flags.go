@@ -55,6 +55,10 @@ var (
 	MetadataURL = flag.String("metadata_url", "http://169.254.169.254", "url of metadata server")
 	IamURL      = flag.String("iam_url", "https://iamcredentials.googleapis.com", "url of iam server")
 
+	MetadataFetchRetries             = flag.Int("metadata_fetch_retries", 3, "Number of retries of a metadata server call on transient errors. Set to 0 to disable retries.")
+	MetadataFetchRetryBaseIntervalMs = flag.Int("metadata_fetch_retry_base_interval_ms", 100, "Initial interval in milliseconds between retries of a metadata server call. It grows exponentially with jitter on each retry, up to 5s.")
+	AnthosWithoutMetadataServer      = flag.Bool("anthos_without_metadata_server", false, "Set it on Anthos clusters outside of GCP, which have no metadata server. The platform is reported as Anthos when the metadata server is not reached on Kubernetes, instead of failing to fetch the GCP attributes.")
+
 	ServiceControlIamServiceAccount = flag.String("service_control_iam_service_account", "", "The service account used to fetch access token for the Service Control from Google Cloud IAM")
 	ServiceControlIamDelegates      = flag.String("service_control_iam_delegates", "", "The sequence of service accounts in a delegation chain used to fetch access token for the Service Control from Google Cloud IAM. The multiple delegates should be separated by \",\" and the flag only applies when ServiceControlIamServiceAccount is not empty.")
 
@@ -83,6 +87,10 @@ func DefaultCommonOptionsFromFlags() options.CommonOptions {
 		TracingMaxNumLinks:         *TracingMaxNumLinks,
 		MetadataURL:                *MetadataURL,
 		IamURL:                     *IamURL,
+
+		MetadataFetchRetries:           *MetadataFetchRetries,
+		MetadataFetchRetryBaseInterval: time.Duration(*MetadataFetchRetryBaseIntervalMs) * time.Millisecond,
+		AnthosWithoutMetadataServer:    *AnthosWithoutMetadataServer,
 	}
 	if *BackendAuthIamServiceAccount != "" {
 		opts.BackendAuthCredentials = &options.IAMCredentialsOptions{
@@ -26,6 +26,8 @@ import (
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 // MakeClusters provides dynamic cluster settings for Envoy
@@ -79,6 +81,22 @@ func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
 		clusters = append(clusters, scCluster)
 	}
 
+	rlsCluster, err := makeRateLimitServiceCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if rlsCluster != nil {
+		clusters = append(clusters, rlsCluster)
+	}
+
+	extAuthzCluster, err := makeExtAuthzCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if extAuthzCluster != nil {
+		clusters = append(clusters, extAuthzCluster)
+	}
+
 	brClusters, err := makeRemoteBackendClusters(serviceInfo)
 	if err != nil {
 		return nil, err
@@ -137,7 +155,7 @@ func makeMetadataCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error
 	}
 
 	if scheme == "https" {
-		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "")
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "", serviceInfo.Options.EnableSdsCertificates)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				c.Name, err)
@@ -149,6 +167,11 @@ func makeMetadataCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error
 }
 
 func makeTokenAgentCluster(serviceInfo *sc.ServiceInfo) *clusterpb.Cluster {
+	loadAssignment := util.CreateLoadAssignment(util.LoopbackIPv4Addr, uint32(serviceInfo.Options.TokenAgentPort))
+	if serviceInfo.Options.TokenAgentSocket != "" {
+		loadAssignment = util.CreateUdsLoadAssignment(serviceInfo.Options.TokenAgentSocket)
+	}
+
 	return &clusterpb.Cluster{
 		Name:           util.TokenAgentClusterName,
 		LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
@@ -156,7 +179,7 @@ func makeTokenAgentCluster(serviceInfo *sc.ServiceInfo) *clusterpb.Cluster {
 		ClusterDiscoveryType: &clusterpb.Cluster_Type{
 			Type: clusterpb.Cluster_STATIC,
 		},
-		LoadAssignment: util.CreateLoadAssignment(util.LoopbackIPv4Addr, uint32(serviceInfo.Options.TokenAgentPort)),
+		LoadAssignment: loadAssignment,
 	}
 }
 
@@ -182,7 +205,7 @@ func makeIamCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
 	}
 
 	if scheme == "https" {
-		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "")
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "", serviceInfo.Options.EnableSdsCertificates)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				c.Name, err)
@@ -199,6 +222,11 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster,
 	generatedClusters := map[string]bool{}
 
 	for _, provider := range authn.GetProviders() {
+		// No cluster is needed to fetch local JWKS.
+		if _, ok := serviceInfo.LocalJwks[provider.GetId()]; ok {
+			continue
+		}
+
 		jwksUri := provider.GetJwksUri()
 		addr, err := util.ExtractAddressFromURI(jwksUri)
 		if err != nil {
@@ -228,7 +256,7 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster,
 			LoadAssignment:       util.CreateLoadAssignment(hostname, port),
 		}
 		if scheme == "https" {
-			transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "")
+			transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "", serviceInfo.Options.EnableSdsCertificates)
 			if err != nil {
 				return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 					c.Name, err)
@@ -257,7 +285,7 @@ func makeBackendCluster(opt *options.ConfigGeneratorOptions, brc *sc.BackendRout
 		if isHttp2 {
 			alpnProtocols = []string{"h2"}
 		}
-		transportSocket, err := util.CreateUpstreamTransportSocket(brc.Hostname, opt.SslBackendClientRootCertsPath, opt.SslBackendClientCertPath, alpnProtocols, opt.SslBackendClientCipherSuites)
+		transportSocket, err := util.CreateUpstreamTransportSocket(brc.Hostname, opt.SslBackendClientRootCertsPath, opt.SslBackendClientCertPath, alpnProtocols, opt.SslBackendClientCipherSuites, opt.EnableSdsCertificates)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				brc.ClusterName, err)
@@ -269,6 +297,29 @@ func makeBackendCluster(opt *options.ConfigGeneratorOptions, brc *sc.BackendRout
 		c.Http2ProtocolOptions = &corepb.Http2ProtocolOptions{}
 	}
 
+	if opt.BackendRetryBudgetPercent != 0 {
+		if opt.BackendRetryBudgetPercent < 0 || opt.BackendRetryBudgetPercent > 100 {
+			return nil, fmt.Errorf("invalid backend retry budget percent %v, must be within (0, 100]", opt.BackendRetryBudgetPercent)
+		}
+		retryBudget := &clusterpb.CircuitBreakers_Thresholds_RetryBudget{
+			BudgetPercent: &typepb.Percent{
+				Value: opt.BackendRetryBudgetPercent,
+			},
+		}
+		if opt.BackendRetryBudgetMinConcurrency > 0 {
+			retryBudget.MinRetryConcurrency = &wrapperspb.UInt32Value{
+				Value: uint32(opt.BackendRetryBudgetMinConcurrency),
+			}
+		}
+		c.CircuitBreakers = &clusterpb.CircuitBreakers{
+			Thresholds: []*clusterpb.CircuitBreakers_Thresholds{
+				{
+					RetryBudget: retryBudget,
+				},
+			},
+		}
+	}
+
 	switch opt.BackendDnsLookupFamily {
 	case "auto":
 		c.DnsLookupFamily = clusterpb.Cluster_AUTO
@@ -322,7 +373,93 @@ func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster,
 	}
 
 	if scheme == "https" {
-		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "")
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", nil, "", serviceInfo.Options.EnableSdsCertificates)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
+				c.Name, err)
+		}
+		c.TransportSocket = transportSocket
+	}
+
+	return c, nil
+}
+
+func makeRateLimitServiceCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
+	uri := serviceInfo.Options.RateLimitServiceAddress
+	if uri == "" {
+		return nil, nil
+	}
+
+	scheme, hostname, port, _, err := util.ParseURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse rate limit service URI: %v", err)
+	}
+	protocol, tls, err := util.ParseBackendProtocol(scheme, "")
+	if err != nil || protocol != util.GRPC {
+		return nil, fmt.Errorf("rate limit service URI must have scheme grpc or grpcs, got: %s", uri)
+	}
+
+	c := &clusterpb.Cluster{
+		Name:           util.RateLimitServiceClusterName,
+		LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+		ConnectTimeout: ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout),
+		ClusterDiscoveryType: &clusterpb.Cluster_Type{
+			Type: clusterpb.Cluster_STRICT_DNS,
+		},
+		LoadAssignment:       util.CreateLoadAssignment(hostname, port),
+		Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+	}
+
+	if tls {
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", []string{"h2"}, "", serviceInfo.Options.EnableSdsCertificates)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
+				c.Name, err)
+		}
+		c.TransportSocket = transportSocket
+	}
+
+	return c, nil
+}
+
+func makeExtAuthzCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
+	uri := serviceInfo.Options.ExtAuthzAddress
+	if uri == "" {
+		return nil, nil
+	}
+
+	scheme, hostname, port, path, err := util.ParseURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse ext_authz URI: %v", err)
+	}
+	protocol, tls, err := util.ParseBackendProtocol(scheme, "")
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse ext_authz URI: %v", err)
+	}
+	isGrpc := protocol == util.GRPC
+	if isGrpc && path != "" {
+		return nil, fmt.Errorf("error parsing ext_authz URI: gRPC service should not have path part: %s, %s", uri, path)
+	}
+
+	c := &clusterpb.Cluster{
+		Name:           util.ExtAuthzClusterName,
+		LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+		ConnectTimeout: ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout),
+		ClusterDiscoveryType: &clusterpb.Cluster_Type{
+			Type: clusterpb.Cluster_STRICT_DNS,
+		},
+		LoadAssignment: util.CreateLoadAssignment(hostname, port),
+	}
+	if isGrpc {
+		c.Http2ProtocolOptions = &corepb.Http2ProtocolOptions{}
+	}
+
+	if tls {
+		var alpnProtocols []string
+		if isGrpc {
+			alpnProtocols = []string{"h2"}
+		}
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.SslSidestreamClientRootCertsPath, "", alpnProtocols, "", serviceInfo.Options.EnableSdsCertificates)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				c.Name, err)
@@ -29,6 +29,9 @@ import (
 
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
@@ -42,12 +45,12 @@ var (
 )
 
 func createTransportSocket(hostname string) *corepb.TransportSocket {
-	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", nil, "")
+	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", nil, "", false)
 	return transportSocket
 }
 
 func createH2TransportSocket(hostname string) *corepb.TransportSocket {
-	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", []string{"h2"}, "")
+	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", []string{"h2"}, "", false)
 	return transportSocket
 }
 
@@ -584,6 +587,30 @@ func TestMakeJwtProviderClusters(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "No cluster for Auth Provider with local jwks",
+			fakeProviders: []*confpb.AuthProvider{
+				&confpb.AuthProvider{
+					Id:      "local_provider",
+					Issuer:  "issuer_0",
+					JwksUri: `{"keys": []}`,
+				},
+				&confpb.AuthProvider{
+					Id:      "remote_provider",
+					Issuer:  "issuer_1",
+					JwksUri: "http://metadata.com/pkey",
+				},
+			},
+			wantedClusters: []*clusterpb.Cluster{
+				{
+					Name:                 "jwt-provider-cluster-metadata.com:80",
+					ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+					ClusterDiscoveryType: &clusterpb.Cluster_Type{clusterpb.Cluster_LOGICAL_DNS},
+					DnsLookupFamily:      clusterpb.Cluster_V4_ONLY,
+					LoadAssignment:       util.CreateLoadAssignment("metadata.com", 80),
+				},
+			},
+		},
 	}
 	for i, tc := range testData {
 		fakeServiceConfig := &confpb.Service{
@@ -715,26 +742,275 @@ func TestMakeIamCluster(t *testing.T) {
 }
 
 func TestMakeTokenAgentCluster(t *testing.T) {
-	fakeServiceInfo, _ := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
-		Apis: []*apipb.Api{
-			{
-				Name: testApiName,
+	testData := []struct {
+		desc               string
+		tokenAgentSocket   string
+		wantLoadAssignment *endpointpb.ClusterLoadAssignment
+	}{
+		{
+			desc:               "Token agent listens on the loopback port",
+			wantLoadAssignment: util.CreateLoadAssignment("127.0.0.1", 8791),
+		},
+		{
+			desc:               "Token agent listens on the Unix domain socket",
+			tokenAgentSocket:   "@espv2-token-agent",
+			wantLoadAssignment: util.CreateUdsLoadAssignment("@espv2-token-agent"),
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.TokenAgentSocket = tc.tokenAgentSocket
+		fakeServiceInfo, _ := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+
+		cluster := makeTokenAgentCluster(fakeServiceInfo)
+		wantCluster := &clusterpb.Cluster{
+			Name:           util.TokenAgentClusterName,
+			LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+			ConnectTimeout: ptypes.DurationProto(fakeServiceInfo.Options.ClusterConnectTimeout),
+			ClusterDiscoveryType: &clusterpb.Cluster_Type{
+				Type: clusterpb.Cluster_STATIC,
+			},
+			LoadAssignment: tc.wantLoadAssignment,
+		}
+
+		if !proto.Equal(cluster, wantCluster) {
+			t.Errorf("Test (%s): makeTokenAgentClusters, \ngot: %v,\nwant: %v", tc.desc, cluster, wantCluster)
+		}
+	}
+}
+
+func TestMakeRateLimitServiceCluster(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		rateLimitServiceAddress string
+		wantCluster             *clusterpb.Cluster
+		wantError               string
+	}{
+		{
+			desc: "Success, not generate a rate limit service cluster without the address",
+		},
+		{
+			desc:                    "Success, generate rate limit service cluster with grpc scheme",
+			rateLimitServiceAddress: "grpc://ratelimit:8091",
+			wantCluster: &clusterpb.Cluster{
+				Name:           util.RateLimitServiceClusterName,
+				LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+				ConnectTimeout: ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{
+					Type: clusterpb.Cluster_STRICT_DNS,
+				},
+				LoadAssignment:       util.CreateLoadAssignment("ratelimit", 8091),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+			},
+		},
+		{
+			desc:                    "Success, generate rate limit service cluster with grpcs scheme",
+			rateLimitServiceAddress: "grpcs://ratelimit.example.com",
+			wantCluster: &clusterpb.Cluster{
+				Name:           util.RateLimitServiceClusterName,
+				LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+				ConnectTimeout: ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{
+					Type: clusterpb.Cluster_STRICT_DNS,
+				},
+				LoadAssignment:       util.CreateLoadAssignment("ratelimit.example.com", 443),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+				TransportSocket:      createH2TransportSocket("ratelimit.example.com"),
+			},
+		},
+		{
+			desc:                    "Fail with http scheme",
+			rateLimitServiceAddress: "http://ratelimit:8091",
+			wantError:               "rate limit service URI must have scheme grpc or grpcs",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.RateLimitServiceAddress = tc.rateLimitServiceAddress
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeRateLimitServiceCluster(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+
+		if !proto.Equal(cluster, tc.wantCluster) {
+			t.Errorf("Test (%s): makeRateLimitServiceCluster, \ngot: %v,\nwant: %v", tc.desc, cluster, tc.wantCluster)
+		}
+	}
+}
+
+func TestMakeExtAuthzCluster(t *testing.T) {
+	testData := []struct {
+		desc            string
+		extAuthzAddress string
+		wantCluster     *clusterpb.Cluster
+		wantError       string
+	}{
+		{
+			desc: "Success, not generate an ext_authz cluster without the address",
+		},
+		{
+			desc:            "Success, generate ext_authz cluster with grpc scheme",
+			extAuthzAddress: "grpc://authz:9001",
+			wantCluster: &clusterpb.Cluster{
+				Name:           util.ExtAuthzClusterName,
+				LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+				ConnectTimeout: ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{
+					Type: clusterpb.Cluster_STRICT_DNS,
+				},
+				LoadAssignment:       util.CreateLoadAssignment("authz", 9001),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+			},
+		},
+		{
+			desc:            "Success, generate ext_authz cluster with https scheme and path",
+			extAuthzAddress: "https://authz.example.com/check",
+			wantCluster: &clusterpb.Cluster{
+				Name:           util.ExtAuthzClusterName,
+				LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
+				ConnectTimeout: ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{
+					Type: clusterpb.Cluster_STRICT_DNS,
+				},
+				LoadAssignment:  util.CreateLoadAssignment("authz.example.com", 443),
+				TransportSocket: createTransportSocket("authz.example.com"),
+			},
+		},
+		{
+			desc:            "Fail with grpc scheme and path",
+			extAuthzAddress: "grpc://authz:9001/check",
+			wantError:       "gRPC service should not have path part",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.ExtAuthzAddress = tc.extAuthzAddress
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeExtAuthzCluster(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+
+		if !proto.Equal(cluster, tc.wantCluster) {
+			t.Errorf("Test (%s): makeExtAuthzCluster, \ngot: %v,\nwant: %v", tc.desc, cluster, tc.wantCluster)
+		}
+	}
+}
+
+func TestMakeBackendClusterWithRetryBudget(t *testing.T) {
+	testData := []struct {
+		desc                  string
+		budgetPercent         float64
+		budgetMinConcurrency  uint
+		wantedCircuitBreakers *clusterpb.CircuitBreakers
+		wantedError           string
+	}{
+		{
+			desc: "No retry budget by default",
+		},
+		{
+			desc:          "Retry budget with the default min concurrency",
+			budgetPercent: 25,
+			wantedCircuitBreakers: &clusterpb.CircuitBreakers{
+				Thresholds: []*clusterpb.CircuitBreakers_Thresholds{
+					{
+						RetryBudget: &clusterpb.CircuitBreakers_Thresholds_RetryBudget{
+							BudgetPercent: &typepb.Percent{Value: 25},
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:                 "Retry budget with min concurrency",
+			budgetPercent:        12.5,
+			budgetMinConcurrency: 10,
+			wantedCircuitBreakers: &clusterpb.CircuitBreakers{
+				Thresholds: []*clusterpb.CircuitBreakers_Thresholds{
+					{
+						RetryBudget: &clusterpb.CircuitBreakers_Thresholds_RetryBudget{
+							BudgetPercent:       &typepb.Percent{Value: 12.5},
+							MinRetryConcurrency: &wrapperspb.UInt32Value{Value: 10},
+						},
+					},
+				},
 			},
 		},
-	}, testConfigID, options.DefaultConfigGeneratorOptions())
-
-	cluster := makeTokenAgentCluster(fakeServiceInfo)
-	wantCluster := &clusterpb.Cluster{
-		Name:           util.TokenAgentClusterName,
-		LbPolicy:       clusterpb.Cluster_ROUND_ROBIN,
-		ConnectTimeout: ptypes.DurationProto(fakeServiceInfo.Options.ClusterConnectTimeout),
-		ClusterDiscoveryType: &clusterpb.Cluster_Type{
-			Type: clusterpb.Cluster_STATIC,
+		{
+			desc:          "Failure with budget percent over 100",
+			budgetPercent: 150,
+			wantedError:   "invalid backend retry budget percent 150",
 		},
-		LoadAssignment: util.CreateLoadAssignment("127.0.0.1", uint32(fakeServiceInfo.Options.TokenAgentPort)),
 	}
 
-	if !proto.Equal(cluster, wantCluster) {
-		t.Errorf("Test makeTokenAgentClusters, \ngot: %v,\nwant: %v", cluster, wantCluster)
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendRetryBudgetPercent = tc.budgetPercent
+			opts.BackendRetryBudgetMinConcurrency = tc.budgetMinConcurrency
+
+			cluster, err := makeBackendCluster(&opts, &configinfo.BackendRoutingCluster{
+				ClusterName: "backend-cluster-mybackend.com:443",
+				Hostname:    "mybackend.com",
+				Port:        443,
+			})
+			if tc.wantedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+					t.Fatalf("got err: %v, want err: %s", err, tc.wantedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !proto.Equal(cluster.GetCircuitBreakers(), tc.wantedCircuitBreakers) {
+				t.Errorf("got circuit breakers: %v, want: %v", cluster.GetCircuitBreakers(), tc.wantedCircuitBreakers)
+			}
+		})
 	}
 }
@@ -86,6 +86,13 @@ var baFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*c
 				ServiceAccountEmail: serviceInfo.Options.BackendAuthCredentials.ServiceAccountEmail,
 				Delegates:           serviceInfo.Options.BackendAuthCredentials.Delegates,
 			}}
+	} else if serviceInfo.Options.NonGCP {
+		// Non-GCP will never use IMDS. The token agent serves identity tokens
+		// in the same format as IMDS, minted from the service account key.
+		backendAuthConfig.IdTokenInfo = &bapb.FilterConfig_ImdsToken{
+			// Use http://127.0.0.1:8791/local/identity_token by default.
+			ImdsToken: serviceInfo.TokenAgentHttpUri(util.TokenAgentIdentityTokenPath),
+		}
 	} else {
 		backendAuthConfig.IdTokenInfo = &bapb.FilterConfig_ImdsToken{
 			ImdsToken: &commonpb.HttpUri{
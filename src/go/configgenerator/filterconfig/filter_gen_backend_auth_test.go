@@ -33,6 +33,7 @@ func TestBackendAuthFilter(t *testing.T) {
 	testdata := []struct {
 		desc                  string
 		iamServiceAccount     string
+		nonGCP                bool
 		fakeServiceConfig     *confpb.Service
 		delegates             []string
 		depErrorBehavior      string
@@ -224,6 +225,51 @@ func TestBackendAuthFilter(t *testing.T) {
       "jwtAudienceList":["bar.com"]
    }
 }
+`,
+		},
+		{
+			desc:             "Success, use the token agent for identity tokens on non-GCP",
+			nonGCP:           true,
+			depErrorBehavior: commonpb.DependencyErrorBehavior_BLOCK_INIT_ON_ANY_ERROR.String(),
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapipb",
+						Methods: []*apipb.Method{
+							{
+								Name: "bar",
+							},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector:        "testapipb.bar",
+							Address:         "https://testapipb.com/foo",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication: &confpb.BackendRule_JwtAudience{
+								JwtAudience: "bar.com",
+							},
+						},
+					},
+				},
+			},
+			wantBackendAuthFilter: `
+{
+   "name":"com.google.espv2.filters.http.backend_auth",
+   "typedConfig":{
+      "@type":"type.googleapis.com/espv2.api.envoy.v9.http.backend_auth.FilterConfig",
+      "depErrorBehavior":"BLOCK_INIT_ON_ANY_ERROR",
+      "imdsToken":{
+          "cluster":"token-agent-cluster",
+          "timeout":"30s",
+          "uri":"http://127.0.0.1:8791/local/identity_token"
+      },
+      "jwtAudienceList":["bar.com"]
+   }
+}
 `,
 		},
 		{
@@ -263,6 +309,10 @@ func TestBackendAuthFilter(t *testing.T) {
 			opts := options.DefaultConfigGeneratorOptions()
 			opts.BackendAddress = "grpc://127.0.0.1:80"
 			opts.DependencyErrorBehavior = tc.depErrorBehavior
+			if tc.nonGCP {
+				opts.NonGCP = true
+				opts.ServiceAccountKey = "/path/to/sa-key.json"
+			}
 			if tc.iamServiceAccount != "" {
 				opts.BackendAuthCredentials = &options.IAMCredentialsOptions{
 					ServiceAccountEmail: tc.iamServiceAccount,
@@ -0,0 +1,69 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+// The filter allows the private network access of the CORS preflight
+// requests. It must be before CORS filter, which replies the preflight
+// requests directly, so it sees both the requests and the replies.
+var cpnFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	lua := &luapb.Lua{
+		InlineCode: corsPrivateNetworkLuaCode,
+	}
+
+	l, err := ptypes.MarshalAny(lua)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling cors private network filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.Lua,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{l},
+	}, nil, nil
+}
+
+// The request is marked in the dynamic metadata, since the script globals are
+// shared by all the requests of a worker. Only the allowed preflights, which
+// have the allowed origin in the reply, are granted the access.
+const corsPrivateNetworkLuaCode = `
+function envoy_on_request(request_handle)
+  local headers = request_handle:headers()
+  if headers:get(":method") == "OPTIONS" and
+      headers:get("access-control-request-private-network") == "true" then
+    request_handle:streamInfo():dynamicMetadata():set("espv2.cors", "private_network", "true")
+  end
+end
+
+function envoy_on_response(response_handle)
+  local metadata = response_handle:streamInfo():dynamicMetadata():get("espv2.cors")
+  if metadata == nil or metadata["private_network"] ~= "true" then
+    return
+  end
+  local headers = response_handle:headers()
+  if headers:get("access-control-allow-origin") ~= nil then
+    headers:add("access-control-allow-private-network", "true")
+  end
+end
+`
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestCorsPrivateNetworkFilter(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		corsPreset              string
+		corsAllowPrivateNetwork bool
+		wantFilters             []string
+	}{
+		{
+			desc:        "No CORS",
+			wantFilters: []string{},
+		},
+		{
+			desc:        "CORS without private network access",
+			corsPreset:  "basic",
+			wantFilters: []string{util.CORS},
+		},
+		{
+			desc:                    "CORS with private network access",
+			corsPreset:              "basic",
+			corsAllowPrivateNetwork: true,
+			wantFilters:             []string{util.Lua, util.CORS},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.CorsPreset = tc.corsPreset
+		opts.CorsAllowOrigin = "http://example.com"
+		opts.CorsAllowPrivateNetwork = tc.corsAllowPrivateNetwork
+		opts.SkipJwtAuthnFilter = true
+		opts.SkipServiceControlFilter = true
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: "testapi",
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filterGenerators, err := MakeFilterGenerators(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFilters := []string{}
+		for _, fg := range filterGenerators {
+			if fg.FilterName == util.Lua || fg.FilterName == util.CORS {
+				gotFilters = append(gotFilters, fg.FilterName)
+			}
+		}
+		if strings.Join(gotFilters, ",") != strings.Join(tc.wantFilters, ",") {
+			t.Errorf("Test (%s): got filters %v, want %v", tc.desc, gotFilters, tc.wantFilters)
+		}
+	}
+
+	filter, _, err := cpnFilterGenFunc(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lua := &luapb.Lua{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), lua); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`headers:get("access-control-request-private-network") == "true"`,
+		`headers:add("access-control-allow-private-network", "true")`,
+	} {
+		if !strings.Contains(lua.GetInlineCode(), want) {
+			t.Errorf("got script without %q", want)
+		}
+	}
+}
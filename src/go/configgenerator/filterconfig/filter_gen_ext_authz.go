@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+	"github.com/golang/protobuf/ptypes"
+	anypb "github.com/golang/protobuf/ptypes/any"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extauthzpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcherpb "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+const (
+	// The context extension of the operation selector, sent to the gRPC
+	// authorization service.
+	extAuthzOperationContextKey = "operation"
+)
+
+var extAuthzPerRouteFilterConfigGen = func(method *ci.MethodInfo, httpRule *httppattern.Pattern) (*anypb.Any, error) {
+	perRoute := &extauthzpb.ExtAuthzPerRoute{}
+	if method.RequireExtAuthz {
+		perRoute.Override = &extauthzpb.ExtAuthzPerRoute_CheckSettings{
+			CheckSettings: &extauthzpb.CheckSettings{
+				ContextExtensions: map[string]string{
+					extAuthzOperationContextKey: method.Operation(),
+				},
+			},
+		}
+	} else {
+		perRoute.Override = &extauthzpb.ExtAuthzPerRoute_Disabled{
+			Disabled: true,
+		}
+	}
+
+	extAuthz, err := ptypes.MarshalAny(perRoute)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling ext_authz per-route config to Any: %v", err)
+	}
+	return extAuthz, nil
+}
+
+// MakeExtAuthzDisabledPerRouteConfig disables the filter on the routes not
+// mapped to the operations, such as the catch-all routes, so the unknown
+// requests are not sent to the external authorization service.
+func MakeExtAuthzDisabledPerRouteConfig() (*anypb.Any, error) {
+	extAuthz, err := ptypes.MarshalAny(&extauthzpb.ExtAuthzPerRoute{
+		Override: &extauthzpb.ExtAuthzPerRoute_Disabled{
+			Disabled: true,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling ext_authz per-route config to Any: %v", err)
+	}
+	return extAuthz, nil
+}
+
+// The filter checks the requests with the external authorization service,
+// after JWT authentication so the service receives the JWT payload: as the
+// jwt_authn dynamic metadata in gRPC, or as the payload header in HTTP.
+var extAuthzFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	scheme, _, _, path, err := util.ParseURI(serviceInfo.Options.ExtAuthzAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to parse ext_authz URI: %v", err)
+	}
+	protocol, _, err := util.ParseBackendProtocol(scheme, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to parse ext_authz URI: %v", err)
+	}
+
+	extAuthz := &extauthzpb.ExtAuthz{
+		TransportApiVersion:       corepb.ApiVersion_V3,
+		FailureModeAllow:          serviceInfo.Options.ExtAuthzFailureModeAllow,
+		MetadataContextNamespaces: []string{util.JwtAuthn},
+	}
+	timeout := ptypes.DurationProto(serviceInfo.Options.ExtAuthzTimeout)
+	if protocol == util.GRPC {
+		extAuthz.Services = &extauthzpb.ExtAuthz_GrpcService{
+			GrpcService: &corepb.GrpcService{
+				TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{
+						ClusterName: util.ExtAuthzClusterName,
+					},
+				},
+				Timeout: timeout,
+			},
+		}
+	} else {
+		extAuthz.Services = &extauthzpb.ExtAuthz_HttpService{
+			HttpService: &extauthzpb.HttpService{
+				ServerUri: &corepb.HttpUri{
+					Uri: serviceInfo.Options.ExtAuthzAddress,
+					HttpUpstreamType: &corepb.HttpUri_Cluster{
+						Cluster: util.ExtAuthzClusterName,
+					},
+					Timeout: timeout,
+				},
+				PathPrefix: path,
+				AuthorizationRequest: &extauthzpb.AuthorizationRequest{
+					AllowedHeaders: makeExtAuthzAllowedHeaders(serviceInfo),
+				},
+			},
+		}
+	}
+
+	var perRouteConfigRequiredMethods []*ci.MethodInfo
+	for _, operation := range serviceInfo.Operations {
+		perRouteConfigRequiredMethods = append(perRouteConfigRequiredMethods, serviceInfo.Methods[operation])
+	}
+
+	ea, err := ptypes.MarshalAny(extAuthz)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling ext_authz filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.ExtAuthz,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{ea},
+	}, perRouteConfigRequiredMethods, nil
+}
+
+// The filter removes the JWT payload header sent by the client, so the
+// external authorization service only receives the one set by JWT Authn
+// filter. It must be before JWT Authn filter, as the route config removes the
+// request headers only at the router, after the authorization check.
+var extAuthzPayloadHeaderFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	lua := &luapb.Lua{
+		InlineCode: fmt.Sprintf(extAuthzPayloadHeaderLuaCode, strings.ToLower(serviceInfo.Options.GeneratedHeaderPrefix+util.JwtAuthnForwardPayloadHeaderSuffix)),
+	}
+
+	l, err := ptypes.MarshalAny(lua)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling ext_authz payload header filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.Lua,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{l},
+	}, nil, nil
+}
+
+const extAuthzPayloadHeaderLuaCode = `
+function envoy_on_request(request_handle)
+  request_handle:headers():remove("%s")
+end
+`
+
+func makeExtAuthzAllowedHeaders(serviceInfo *ci.ServiceInfo) *matcherpb.ListStringMatcher {
+	headers := []string{serviceInfo.Options.GeneratedHeaderPrefix + util.JwtAuthnForwardPayloadHeaderSuffix}
+	for _, header := range strings.Split(serviceInfo.Options.ExtAuthzAllowedHeaders, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+
+	allowedHeaders := &matcherpb.ListStringMatcher{}
+	for _, header := range headers {
+		allowedHeaders.Patterns = append(allowedHeaders.Patterns, &matcherpb.StringMatcher{
+			MatchPattern: &matcherpb.StringMatcher_Exact{
+				Exact: strings.ToLower(header),
+			},
+		})
+	}
+	return allowedHeaders
+}
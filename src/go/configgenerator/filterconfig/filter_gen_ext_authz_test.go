@@ -0,0 +1,246 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+
+	extauthzpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestExtAuthzFilter(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "testapi",
+				Methods: []*apipb.Method{
+					{
+						Name: "ListBooks",
+					},
+					{
+						Name: "CreateBook",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                   string
+		extAuthzAddress        string
+		extAuthzSelectors      string
+		extAuthzAllowedHeaders string
+		wantFilter             string
+		wantPerRouteConfigs    map[string]string
+	}{
+		{
+			desc:              "Success with gRPC service for the selected operation",
+			extAuthzAddress:   "grpc://127.0.0.1:9001",
+			extAuthzSelectors: "testapi.CreateBook",
+			wantFilter: `{
+  "name": "envoy.filters.http.ext_authz",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthz",
+    "grpcService": {
+      "envoyGrpc": {
+        "clusterName": "ext-authz-cluster"
+      },
+      "timeout": "0.500s"
+    },
+    "metadataContextNamespaces": ["envoy.filters.http.jwt_authn"],
+    "transportApiVersion": "V3"
+  }
+}`,
+			wantPerRouteConfigs: map[string]string{
+				"ListBooks": `{
+  "disabled": true
+}`,
+				"CreateBook": `{
+  "checkSettings": {
+    "contextExtensions": {
+      "operation": "testapi.CreateBook"
+    }
+  }
+}`,
+			},
+		},
+		{
+			desc:                   "Success with HTTP service for all of the operations",
+			extAuthzAddress:        "https://authz.example.com/check",
+			extAuthzAllowedHeaders: "Authorization, X-Tenant",
+			wantFilter: `{
+  "name": "envoy.filters.http.ext_authz",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthz",
+    "httpService": {
+      "serverUri": {
+        "uri": "https://authz.example.com/check",
+        "cluster": "ext-authz-cluster",
+        "timeout": "0.500s"
+      },
+      "pathPrefix": "/check",
+      "authorizationRequest": {
+        "allowedHeaders": {
+          "patterns": [
+            {
+              "exact": "x-endpoint-api-userinfo"
+            },
+            {
+              "exact": "authorization"
+            },
+            {
+              "exact": "x-tenant"
+            }
+          ]
+        }
+      }
+    },
+    "metadataContextNamespaces": ["envoy.filters.http.jwt_authn"],
+    "transportApiVersion": "V3"
+  }
+}`,
+			wantPerRouteConfigs: map[string]string{
+				"ListBooks": `{
+  "checkSettings": {
+    "contextExtensions": {
+      "operation": "testapi.ListBooks"
+    }
+  }
+}`,
+				"CreateBook": `{
+  "checkSettings": {
+    "contextExtensions": {
+      "operation": "testapi.CreateBook"
+    }
+  }
+}`,
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.ExtAuthzAddress = tc.extAuthzAddress
+		opts.ExtAuthzSelectors = tc.extAuthzSelectors
+		opts.ExtAuthzAllowedHeaders = tc.extAuthzAllowedHeaders
+		opts.ExtAuthzTimeout = 500 * time.Millisecond
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter, methods, err := extAuthzFilterGenFunc(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotFilter, err := marshaler.MarshalToString(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantFilter, gotFilter); err != nil {
+			t.Errorf("Test (%s): makeExtAuthzFilter failed, %s", tc.desc, err)
+		}
+
+		if len(methods) != len(tc.wantPerRouteConfigs) {
+			t.Fatalf("Test (%s): got %d methods requiring per-route config, want %d", tc.desc, len(methods), len(tc.wantPerRouteConfigs))
+		}
+		for _, method := range methods {
+			perRouteConfig, err := extAuthzPerRouteFilterConfigGen(method, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extAuthzPerRoute := &extauthzpb.ExtAuthzPerRoute{}
+			if err := ptypes.UnmarshalAny(perRouteConfig, extAuthzPerRoute); err != nil {
+				t.Fatal(err)
+			}
+			gotPerRouteConfig, err := marshaler.MarshalToString(extAuthzPerRoute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantPerRouteConfigs[method.ShortName], gotPerRouteConfig); err != nil {
+				t.Errorf("Test (%s): makeExtAuthzPerRouteConfig failed for %s, %s", tc.desc, method.ShortName, err)
+			}
+		}
+	}
+}
+
+func TestExtAuthzPayloadHeaderFilter(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.ExtAuthzAddress = "http://127.0.0.1:9001"
+	opts.SkipServiceControlFilter = true
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "testapi",
+			},
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filterGenerators, err := MakeFilterGenerators(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotFilters := []string{}
+	for _, fg := range filterGenerators {
+		if fg.FilterName == util.Lua || fg.FilterName == util.JwtAuthn || fg.FilterName == util.ExtAuthz {
+			gotFilters = append(gotFilters, fg.FilterName)
+		}
+	}
+	wantFilters := []string{util.Lua, util.JwtAuthn, util.ExtAuthz}
+	if strings.Join(gotFilters, ",") != strings.Join(wantFilters, ",") {
+		t.Errorf("got filters %v, want %v", gotFilters, wantFilters)
+	}
+
+	filter, _, err := extAuthzPayloadHeaderFilterGenFunc(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lua := &luapb.Lua{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), lua); err != nil {
+		t.Fatal(err)
+	}
+	gotHeaders, err := runLuaOnRequestHeaders(lua.GetInlineCode(), map[string][]string{
+		"X-Endpoint-API-UserInfo": {"forged-payload"},
+		"X-Other":                 {"value"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHeaders := map[string][]string{
+		"x-other": {"value"},
+	}
+	if !reflect.DeepEqual(gotHeaders, wantHeaders) {
+		t.Errorf("got headers %v, want %v", gotHeaders, wantHeaders)
+	}
+}
@@ -54,38 +54,23 @@ var jaFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*c
 	}
 	providers := make(map[string]*jwtpb.JwtProvider)
 	for _, provider := range auth.GetProviders() {
-		addr, err := util.ExtractAddressFromURI(provider.GetJwksUri())
-		if err != nil {
-			return nil, nil, fmt.Errorf("for provider (%v), failed to parse JWKS URI: %v", provider.Id, err)
-		}
-		clusterName := util.JwtProviderClusterName(addr)
-		fromHeaders, fromParams, err := processJwtLocations(provider)
+		fromHeaders, fromParams, err := processJwtLocations(provider, serviceInfo.JwtCookies[provider.GetId()])
 		if err != nil {
 			return nil, nil, err
 		}
 
 		jp := &jwtpb.JwtProvider{
-			Issuer: provider.GetIssuer(),
-			JwksSourceSpecifier: &jwtpb.JwtProvider_RemoteJwks{
-				RemoteJwks: &jwtpb.RemoteJwks{
-					HttpUri: &corepb.HttpUri{
-						Uri: provider.GetJwksUri(),
-						HttpUpstreamType: &corepb.HttpUri_Cluster{
-							Cluster: clusterName,
-						},
-						Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
-					},
-					CacheDuration: &durationpb.Duration{
-						Seconds: int64(serviceInfo.Options.JwksCacheDurationInS),
-					},
-				},
-			},
+			Issuer:               provider.GetIssuer(),
 			FromHeaders:          fromHeaders,
 			FromParams:           fromParams,
 			ForwardPayloadHeader: serviceInfo.Options.GeneratedHeaderPrefix + util.JwtAuthnForwardPayloadHeaderSuffix,
 			Forward:              true,
 		}
 
+		if err := setJwksSource(jp, serviceInfo, provider); err != nil {
+			return nil, nil, err
+		}
+
 		if len(provider.GetAudiences()) != 0 {
 			for _, a := range strings.Split(provider.GetAudiences(), ",") {
 				jp.Audiences = append(jp.Audiences, strings.TrimSpace(a))
@@ -136,6 +121,42 @@ var jaFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*c
 	return jwtAuthnFilter, perRouteConfigRequiredMethods, nil
 }
 
+// setJwksSource sets the LocalJwks of the provider if its JWKS is local,
+// which is inlined so that a rotated file is pushed to envoy with the new
+// config. Otherwise, the JWKS is fetched from jwks_uri through its cluster.
+func setJwksSource(jp *jwtpb.JwtProvider, serviceInfo *ci.ServiceInfo, provider *confpb.AuthProvider) error {
+	if jwks, ok := serviceInfo.LocalJwks[provider.GetId()]; ok {
+		jp.JwksSourceSpecifier = &jwtpb.JwtProvider_LocalJwks{
+			LocalJwks: &corepb.DataSource{
+				Specifier: &corepb.DataSource_InlineString{
+					InlineString: jwks,
+				},
+			},
+		}
+		return nil
+	}
+
+	addr, err := util.ExtractAddressFromURI(provider.GetJwksUri())
+	if err != nil {
+		return fmt.Errorf("for provider (%v), failed to parse JWKS URI: %v", provider.Id, err)
+	}
+	jp.JwksSourceSpecifier = &jwtpb.JwtProvider_RemoteJwks{
+		RemoteJwks: &jwtpb.RemoteJwks{
+			HttpUri: &corepb.HttpUri{
+				Uri: provider.GetJwksUri(),
+				HttpUpstreamType: &corepb.HttpUri_Cluster{
+					Cluster: util.JwtProviderClusterName(addr),
+				},
+				Timeout: ptypes.DurationProto(serviceInfo.Options.HttpRequestTimeout),
+			},
+			CacheDuration: &durationpb.Duration{
+				Seconds: int64(serviceInfo.Options.JwksCacheDurationInS),
+			},
+		},
+	}
+	return nil
+}
+
 func defaultJwtLocations() ([]*jwtpb.JwtHeader, []string, error) {
 	return []*jwtpb.JwtHeader{
 			{
@@ -150,7 +171,23 @@ func defaultJwtLocations() ([]*jwtpb.JwtHeader, []string, error) {
 		}, nil
 }
 
-func processJwtLocations(provider *confpb.AuthProvider) ([]*jwtpb.JwtHeader, []string, error) {
+func processJwtLocations(provider *confpb.AuthProvider, cookies []string) ([]*jwtpb.JwtHeader, []string, error) {
+	jwtHeaders, jwtParams, err := processServiceConfigJwtLocations(provider)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The JWT Cookie filter copies the cookies to these headers, after
+	// removing the headers sent by the client.
+	for _, cookie := range cookies {
+		jwtHeaders = append(jwtHeaders, &jwtpb.JwtHeader{
+			Name: util.JwtCookieHeaderPrefix + cookie,
+		})
+	}
+	return jwtHeaders, jwtParams, nil
+}
+
+func processServiceConfigJwtLocations(provider *confpb.AuthProvider) ([]*jwtpb.JwtHeader, []string, error) {
 	if len(provider.JwtLocations) == 0 {
 		return defaultJwtLocations()
 	}
@@ -31,6 +31,7 @@ func TestJwtAuthnFilter(t *testing.T) {
 	testData := []struct {
 		desc               string
 		fakeServiceConfig  *confpb.Service
+		jwtCookieLocations string
 		wantJwtAuthnFilter string
 	}{
 		{
@@ -214,11 +215,173 @@ func TestJwtAuthnFilter(t *testing.T) {
     }
 }`,
 		},
+		{
+			desc: "Success. Generate jwt authn filter with local jwks",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+						},
+					},
+				},
+				SourceInfo: &confpb.SourceInfo{
+					SourceFiles: []*anypb.Any{content},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:      "auth_provider",
+							Issuer:  "issuer-0",
+							JwksUri: `{"keys": []}`,
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector: "testapi.foo",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth_provider",
+								},
+							},
+						},
+					},
+				},
+			},
+			wantJwtAuthnFilter: `{
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+        "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+        "providers": {
+            "auth_provider": {
+                "audiences": [
+                    "https://bookstore.endpoints.project123.cloud.goog"
+                ],
+                "forward": true,
+                "forwardPayloadHeader": "X-Endpoint-API-UserInfo",
+                "fromHeaders": [
+                    {
+                        "name": "Authorization",
+                        "valuePrefix": "Bearer "
+                    },
+                    {
+                        "name": "X-Goog-Iap-Jwt-Assertion"
+                    }
+                ],
+                "fromParams": [
+                    "access_token"
+                ],
+                "issuer": "issuer-0",
+                "payloadInMetadata": "jwt_payloads",
+                "localJwks": {
+                    "inlineString": "{\"keys\": []}"
+                }
+            }
+        },
+        "requirementMap": {
+            "testapi.foo": {
+                "providerName": "auth_provider"
+            }
+        }
+    }
+}
+`,
+		},
+		{
+			desc: "Success. Generate jwt authn filter with jwt in cookies",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "testapi",
+						Methods: []*apipb.Method{
+							{
+								Name: "foo",
+							},
+						},
+					},
+				},
+				SourceInfo: &confpb.SourceInfo{
+					SourceFiles: []*anypb.Any{content},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:      "auth_provider",
+							Issuer:  "issuer-0",
+							JwksUri: `{"keys": []}`,
+							JwtLocations: []*confpb.JwtLocation{
+								{
+									In: &confpb.JwtLocation_Header{
+										Header: "Authorization",
+									},
+									ValuePrefix: "Bearer ",
+								},
+							},
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector: "testapi.foo",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth_provider",
+								},
+							},
+						},
+					},
+				},
+			},
+			jwtCookieLocations: "auth_provider=session_token;auth_provider=id_token",
+			wantJwtAuthnFilter: `{
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+        "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+        "providers": {
+            "auth_provider": {
+                "audiences": [
+                    "https://bookstore.endpoints.project123.cloud.goog"
+                ],
+                "forward": true,
+                "forwardPayloadHeader": "X-Endpoint-API-UserInfo",
+                "fromHeaders": [
+                    {
+                        "name": "Authorization",
+                        "valuePrefix": "Bearer "
+                    },
+                    {
+                        "name": "X-Endpoint-Jwt-Cookie-session_token"
+                    },
+                    {
+                        "name": "X-Endpoint-Jwt-Cookie-id_token"
+                    }
+                ],
+                "issuer": "issuer-0",
+                "payloadInMetadata": "jwt_payloads",
+                "localJwks": {
+                    "inlineString": "{\"keys\": []}"
+                }
+            }
+        },
+        "requirementMap": {
+            "testapi.foo": {
+                "providerName": "auth_provider"
+            }
+        }
+    }
+}
+`,
+		},
 	}
 
 	for i, tc := range testData {
 		opts := options.DefaultConfigGeneratorOptions()
 		opts.BackendAddress = "grpc://127.0.0.0:80"
+		opts.JwtCookieLocations = tc.jwtCookieLocations
 		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 		if err != nil {
 			t.Fatal(err)
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+// The filter copies the cookies carrying a JWT to the headers read by JWT
+// Authn filter, which has no cookie locations. It must be before JWT Authn
+// filter.
+var jcFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	lua := &luapb.Lua{
+		InlineCode: makeJwtCookieLuaCode(serviceInfo.JwtCookieNames()),
+	}
+
+	l, err := ptypes.MarshalAny(lua)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling jwt cookie filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.Lua,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{l},
+	}, nil, nil
+}
+
+func makeJwtCookieLuaCode(cookies []string) string {
+	var entries []string
+	for _, cookie := range cookies {
+		entries = append(entries, fmt.Sprintf("  [%q] = %q,", cookie, util.JwtCookieHeaderPrefix+cookie))
+	}
+	return strings.Replace(jwtCookieLuaCode, "{{COOKIE_HEADERS}}", strings.Join(entries, "\n"), 1)
+}
+
+// The headers sent by the client are always removed, so a JWT is only read
+// from them if it came in the cookie. The Cookie header is split into the
+// name=value pairs, and the names are compared exactly. The first cookie of a
+// name is used, like the browsers send the cookie of the most specific path
+// first.
+const jwtCookieLuaCode = `
+local cookie_headers = {
+{{COOKIE_HEADERS}}
+}
+
+function envoy_on_request(request_handle)
+  local headers = request_handle:headers()
+  for _, header in pairs(cookie_headers) do
+    headers:remove(header)
+  end
+  local cookie = headers:get("cookie")
+  if cookie == nil then
+    return
+  end
+  local found = {}
+  for pair in (cookie .. ";"):gmatch("([^;]*);") do
+    local name, value = pair:match("^[ \t]*([^=]-)[ \t]*=[ \t]*(.-)[ \t]*$")
+    local header = name and cookie_headers[name]
+    if header ~= nil and not found[name] then
+      found[name] = true
+      if #value >= 2 and value:sub(1, 1) == '"' and value:sub(-1) == '"' then
+        value = value:sub(2, -2)
+      end
+      if value ~= "" then
+        headers:add(header, value)
+      end
+    end
+  end
+end
+`
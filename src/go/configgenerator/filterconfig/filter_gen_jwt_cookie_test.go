@@ -0,0 +1,219 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	lua "github.com/yuin/gopher-lua"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestJwtCookieFilter(t *testing.T) {
+	testData := []struct {
+		desc               string
+		jwtCookieLocations string
+		wantFilters        []string
+	}{
+		{
+			desc:        "No cookie locations",
+			wantFilters: []string{util.JwtAuthn},
+		},
+		{
+			desc:               "Cookie locations",
+			jwtCookieLocations: "auth_provider=session_token",
+			wantFilters:        []string{util.Lua, util.JwtAuthn},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwtCookieLocations = tc.jwtCookieLocations
+		opts.SkipServiceControlFilter = true
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: "testapi",
+				},
+			},
+			Authentication: &confpb.Authentication{
+				Providers: []*confpb.AuthProvider{
+					{
+						Id:      "auth_provider",
+						Issuer:  "issuer-0",
+						JwksUri: `{"keys": []}`,
+					},
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filterGenerators, err := MakeFilterGenerators(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFilters := []string{}
+		for _, fg := range filterGenerators {
+			if fg.FilterName == util.Lua || fg.FilterName == util.JwtAuthn {
+				gotFilters = append(gotFilters, fg.FilterName)
+			}
+		}
+		if strings.Join(gotFilters, ",") != strings.Join(tc.wantFilters, ",") {
+			t.Errorf("Test (%s): got filters %v, want %v", tc.desc, gotFilters, tc.wantFilters)
+		}
+	}
+}
+
+// The request handle of Envoy's Lua filter with the headers in test_headers,
+// which are lists of values by the lowercase names.
+const testHeadersRequestHandleLuaCode = `
+local handle = {}
+function handle:headers()
+  return {
+    get = function(_, key)
+      local values = test_headers[key:lower()]
+      return values and values[1]
+    end,
+    remove = function(_, key)
+      test_headers[key:lower()] = nil
+    end,
+    add = function(_, key, value)
+      local values = test_headers[key:lower()] or {}
+      values[#values + 1] = value
+      test_headers[key:lower()] = values
+    end,
+  }
+end
+envoy_on_request(handle)
+`
+
+// runLuaOnRequestHeaders runs the script on the request headers, and returns
+// the headers after it.
+func runLuaOnRequestHeaders(code string, headers map[string][]string) (map[string][]string, error) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(code); err != nil {
+		return nil, err
+	}
+
+	table := L.NewTable()
+	for name, values := range headers {
+		list := L.NewTable()
+		for _, value := range values {
+			list.Append(lua.LString(value))
+		}
+		table.RawSetString(strings.ToLower(name), list)
+	}
+	L.SetGlobal("test_headers", table)
+	if err := L.DoString(testHeadersRequestHandleLuaCode); err != nil {
+		return nil, err
+	}
+
+	got := make(map[string][]string)
+	table.ForEach(func(name, values lua.LValue) {
+		values.(*lua.LTable).ForEach(func(_, value lua.LValue) {
+			got[name.String()] = append(got[name.String()], value.String())
+		})
+	})
+	return got, nil
+}
+
+func TestJwtCookieLuaCode(t *testing.T) {
+	code := makeJwtCookieLuaCode([]string{"id_token", "session_token"})
+
+	testData := []struct {
+		desc        string
+		headers     map[string][]string
+		wantHeaders map[string][]string
+	}{
+		{
+			desc:        "No cookie",
+			headers:     map[string][]string{},
+			wantHeaders: map[string][]string{},
+		},
+		{
+			desc: "Cookie among other cookies",
+			headers: map[string][]string{
+				"cookie": {"theme=dark; session_token=jwt-0;lang=en"},
+			},
+			wantHeaders: map[string][]string{
+				"cookie":                              {"theme=dark; session_token=jwt-0;lang=en"},
+				"x-endpoint-jwt-cookie-session_token": {"jwt-0"},
+			},
+		},
+		{
+			desc: "Cookies whose names end or start with the configured ones are not matched",
+			headers: map[string][]string{
+				"cookie": {"old_session_token=jwt-0; session_token_v2=jwt-1; xid_token=jwt-2"},
+			},
+			wantHeaders: map[string][]string{
+				"cookie": {"old_session_token=jwt-0; session_token_v2=jwt-1; xid_token=jwt-2"},
+			},
+		},
+		{
+			desc: "Headers sent by the client are removed",
+			headers: map[string][]string{
+				"X-Endpoint-Jwt-Cookie-session_token": {"forged-0", "forged-1"},
+				"X-Endpoint-Jwt-Cookie-id_token":      {"forged-2"},
+				"cookie":                              {"id_token=jwt-0"},
+			},
+			wantHeaders: map[string][]string{
+				"cookie":                         {"id_token=jwt-0"},
+				"x-endpoint-jwt-cookie-id_token": {"jwt-0"},
+			},
+		},
+		{
+			desc: "The first of the duplicate cookies is used, and quotes are removed",
+			headers: map[string][]string{
+				"cookie": {`session_token="jwt-0"; session_token=jwt-1; id_token = jwt-2 `},
+			},
+			wantHeaders: map[string][]string{
+				"cookie":                              {`session_token="jwt-0"; session_token=jwt-1; id_token = jwt-2 `},
+				"x-endpoint-jwt-cookie-session_token": {"jwt-0"},
+				"x-endpoint-jwt-cookie-id_token":      {"jwt-2"},
+			},
+		},
+		{
+			desc: "Empty cookies and pairs without values are skipped",
+			headers: map[string][]string{
+				"cookie": {"session_token=; id_token; ;lang=en"},
+			},
+			wantHeaders: map[string][]string{
+				"cookie": {"session_token=; id_token; ;lang=en"},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		gotHeaders, err := runLuaOnRequestHeaders(code, tc.headers)
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(gotHeaders, tc.wantHeaders) {
+			t.Errorf("Test (%s): got headers %v, want %v", tc.desc, gotHeaders, tc.wantHeaders)
+		}
+	}
+}
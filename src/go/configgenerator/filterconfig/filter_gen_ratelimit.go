@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	acpb "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v3"
+	rlpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+const (
+	// The message of the quota errors of service control.
+	quotaExceededMessage = "Quota check failed."
+
+	// Runtime key to change the status code of the quota errors.
+	rateLimitStatusCodeRuntimeKey = "rate_limit_status_code"
+)
+
+// The filter calls the rate limit service with the descriptors of the route
+// rate limits, so the limits are shared by all of the ESPv2 instances. The
+// service name is the domain of the descriptors.
+var rlFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	rateLimit := &rlpb.RateLimit{
+		Domain: serviceInfo.Name,
+		RateLimitService: &rlspb.RateLimitServiceConfig{
+			GrpcService: &corepb.GrpcService{
+				TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{
+						ClusterName: util.RateLimitServiceClusterName,
+					},
+				},
+			},
+			TransportApiVersion: corepb.ApiVersion_V3,
+		},
+	}
+	rl, err := ptypes.MarshalAny(rateLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling ratelimit filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.RateLimit,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{rl},
+	}, nil, nil
+}
+
+// MakeRateLimitLocalReplyMappers makes the local reply mappers replacing the
+// message of the requests rejected by the rate limit service, like the quota
+// errors of service control.
+func MakeRateLimitLocalReplyMappers() []*hcmpb.ResponseMapper {
+	return []*hcmpb.ResponseMapper{
+		{
+			Filter: &acpb.AccessLogFilter{
+				FilterSpecifier: &acpb.AccessLogFilter_StatusCodeFilter{
+					StatusCodeFilter: &acpb.StatusCodeFilter{
+						Comparison: &acpb.ComparisonFilter{
+							Op: acpb.ComparisonFilter_EQ,
+							Value: &corepb.RuntimeUInt32{
+								DefaultValue: http.StatusTooManyRequests,
+								RuntimeKey:   rateLimitStatusCodeRuntimeKey,
+							},
+						},
+					},
+				},
+			},
+			Body: &corepb.DataSource{
+				Specifier: &corepb.DataSource_InlineString{
+					InlineString: quotaExceededMessage,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestRateLimitFilter(t *testing.T) {
+	wantFilter := `{
+  "name": "envoy.filters.http.ratelimit",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.ratelimit.v3.RateLimit",
+    "domain": "bookstore.endpoints.project123.cloud.goog",
+    "rateLimitService": {
+      "grpcService": {
+        "envoyGrpc": {
+          "clusterName": "rate-limit-service-cluster"
+        }
+      },
+      "transportApiVersion": "V3"
+    }
+  }
+}`
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.RateLimitServiceAddress = "grpc://127.0.0.1:8091"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "testapi",
+			},
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, methods, err := rlFilterGenFunc(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 0 {
+		t.Errorf("got methods requiring per-route config: %v, want none", methods)
+	}
+
+	marshaler := &jsonpb.Marshaler{}
+	gotFilter, err := marshaler.MarshalToString(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(wantFilter, gotFilter); err != nil {
+		t.Errorf("makeRateLimitFilter failed, %s", err)
+	}
+}
+
+func TestMakeRateLimitLocalReplyMappers(t *testing.T) {
+	wantMappers := []string{
+		`{
+		  "filter": {
+		    "statusCodeFilter": {
+		      "comparison": {
+		        "value": {
+		          "defaultValue": 429,
+		          "runtimeKey": "rate_limit_status_code"
+		        }
+		      }
+		    }
+		  },
+		  "body": {
+		    "inlineString": "Quota check failed."
+		  }
+		}`,
+	}
+
+	mappers := MakeRateLimitLocalReplyMappers()
+	if len(mappers) != len(wantMappers) {
+		t.Fatalf("got %d mappers, want %d", len(mappers), len(wantMappers))
+	}
+	marshaler := &jsonpb.Marshaler{}
+	for i, mapper := range mappers {
+		gotMapper, err := marshaler.MarshalToString(mapper)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(wantMappers[i], gotMapper); err != nil {
+			t.Errorf("MakeRateLimitLocalReplyMappers failed for mapper(%d), %s", i, err)
+		}
+	}
+}
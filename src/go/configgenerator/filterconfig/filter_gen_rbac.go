@@ -0,0 +1,440 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+	"github.com/golang/protobuf/ptypes"
+	anypb "github.com/golang/protobuf/ptypes/any"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	acpb "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	rbacconfigpb "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	rbacpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcherpb "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+const (
+	// The RBAC policies denying the requests, whose IDs are written to the
+	// metadata by the shadow rules for the local reply mappers.
+	insufficientScopePolicyName = "insufficient_scope"
+	jwtClaimsPolicyName         = "jwt_claims"
+	jwtClaimsPathPolicyName     = "jwt_claims_path"
+	clientCertPolicyName        = "client_certificate"
+
+	// The metadata key of the shadow rules for the denying policy.
+	rbacShadowEffectivePolicyIdKey = "shadow_effective_policy_id"
+
+	// A claim matched against a path variable must not have regex special
+	// characters, as it is concatenated into the regex of the request path.
+	pathVariableClaimRegex = `^[0-9A-Za-z_~-]+$`
+
+	// The request path of CEL has the query string.
+	queryStringRegex = `(\?.*)?$`
+)
+
+var (
+	// The JWT claims of OAuth scopes, either a space-separated string or a list.
+	oauthScopeClaims = []string{"scope", "scp"}
+
+	rbacLocalReplyMessages = map[string]string{
+		insufficientScopePolicyName: "Request had insufficient authentication scopes",
+		jwtClaimsPolicyName:         "Jwt claims do not meet the requirements of the operation",
+		jwtClaimsPathPolicyName:     "Jwt claims do not match the request path",
+		clientCertPolicyName:        "Client certificate is not allowed for the operation",
+	}
+)
+
+var rbacPerRouteFilterConfigGen = func(method *ci.MethodInfo, httpRule *httppattern.Pattern) (*anypb.Any, error) {
+	policies, err := makeJwtPolicies(method, httpRule)
+	if err != nil {
+		return nil, err
+	}
+	if len(method.AllowedClientSans) > 0 {
+		policies[clientCertPolicyName] = makeClientCertPolicy(method.AllowedClientSans)
+	}
+
+	rules := &rbacconfigpb.RBAC{
+		Action:   rbacconfigpb.RBAC_DENY,
+		Policies: policies,
+	}
+	rbacPerRoute := &rbacpb.RBACPerRoute{
+		Rbac: &rbacpb.RBAC{
+			Rules: rules,
+			// The same rules in shadow mode tell which policy denies the request.
+			ShadowRules: rules,
+		},
+	}
+	rbac, err := ptypes.MarshalAny(rbacPerRoute)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling rbac per-route config to Any: %v", err)
+	}
+	return rbac, nil
+}
+
+var rbacFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	var perRouteConfigRequiredMethods []*ci.MethodInfo
+	for _, method := range serviceInfo.Methods {
+		if len(method.ClaimRequirements) > 0 || len(method.CanonicalScopes) > 0 || len(method.AllowedClientSans) > 0 {
+			perRouteConfigRequiredMethods = append(perRouteConfigRequiredMethods, method)
+		}
+	}
+	if len(perRouteConfigRequiredMethods) == 0 {
+		return nil, nil, nil
+	}
+
+	// Without rules, the filter allows the requests to the routes without
+	// per-route config.
+	rbac, _ := ptypes.MarshalAny(&rbacpb.RBAC{})
+	return &hcmpb.HttpFilter{
+		Name:       util.RBAC,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{rbac},
+	}, perRouteConfigRequiredMethods, nil
+}
+
+// MakeRbacLocalReplyMappers makes the local reply mappers replacing the
+// message of the requests denied by the RBAC policies.
+func MakeRbacLocalReplyMappers() []*hcmpb.ResponseMapper {
+	var policyNames []string
+	for name := range rbacLocalReplyMessages {
+		policyNames = append(policyNames, name)
+	}
+	sort.Strings(policyNames)
+
+	var mappers []*hcmpb.ResponseMapper
+	for _, name := range policyNames {
+		mappers = append(mappers, &hcmpb.ResponseMapper{
+			Filter: &acpb.AccessLogFilter{
+				FilterSpecifier: &acpb.AccessLogFilter_MetadataFilter{
+					MetadataFilter: &acpb.MetadataFilter{
+						Matcher: &matcherpb.MetadataMatcher{
+							Filter: util.RBAC,
+							Path: []*matcherpb.MetadataMatcher_PathSegment{
+								{
+									Segment: &matcherpb.MetadataMatcher_PathSegment_Key{
+										Key: rbacShadowEffectivePolicyIdKey,
+									},
+								},
+							},
+							Value: &matcherpb.ValueMatcher{
+								MatchPattern: &matcherpb.ValueMatcher_StringMatch{
+									StringMatch: &matcherpb.StringMatcher{
+										MatchPattern: &matcherpb.StringMatcher_Exact{
+											Exact: name,
+										},
+									},
+								},
+							},
+						},
+						MatchIfKeyNotFound: &wrapperspb.BoolValue{Value: false},
+					},
+				},
+			},
+			Body: &corepb.DataSource{
+				Specifier: &corepb.DataSource_InlineString{
+					InlineString: rbacLocalReplyMessages[name],
+				},
+			},
+		})
+	}
+	return mappers
+}
+
+// makeJwtPolicies makes the policies denying requests whose JWT payload,
+// written to the metadata by the JWT Authn filter, does not have the OAuth
+// scopes or the claims required by the method.
+func makeJwtPolicies(method *ci.MethodInfo, httpRule *httppattern.Pattern) (map[string]*rbacconfigpb.Policy, error) {
+	policies := make(map[string]*rbacconfigpb.Policy)
+
+	if len(method.CanonicalScopes) > 0 {
+		var ids []*rbacconfigpb.Principal
+		for _, scope := range method.CanonicalScopes {
+			for _, claim := range oauthScopeClaims {
+				ids = append(ids, makeContainsPrincipals([]string{util.JwtPayloadMetadataName, claim}, scope)...)
+			}
+		}
+		// Requests without JWT are allowed by JWT Authn filter only if the
+		// rule allows them without credential, so they are not denied.
+		policies[insufficientScopePolicyName] = makeDenyPolicy(andPrincipals([]*rbacconfigpb.Principal{
+			makeClaimPrincipal([]string{util.JwtPayloadMetadataName}, &matcherpb.ValueMatcher{
+				MatchPattern: &matcherpb.ValueMatcher_PresentMatch{
+					PresentMatch: true,
+				},
+			}),
+			notPrincipal(orPrincipals(ids)),
+		}), nil)
+	}
+
+	if len(method.ClaimRequirements) == 0 {
+		return policies, nil
+	}
+
+	var principals []*rbacconfigpb.Principal
+	var conditions []*exprpb.Expr
+	b := &celExprBuilder{}
+	for _, claim := range method.ClaimRequirements {
+		path := append([]string{util.JwtPayloadMetadataName}, strings.Split(claim.Name, ".")...)
+		switch {
+		case len(claim.Values) > 0:
+			var ids []*rbacconfigpb.Principal
+			for _, value := range claim.Values {
+				ids = append(ids, makeClaimPrincipal(path, &matcherpb.ValueMatcher{
+					MatchPattern: &matcherpb.ValueMatcher_StringMatch{
+						StringMatch: &matcherpb.StringMatcher{
+							MatchPattern: &matcherpb.StringMatcher_Exact{
+								Exact: value,
+							},
+						},
+					},
+				}))
+			}
+			principals = append(principals, orPrincipals(ids))
+		case claim.Contains != "":
+			principals = append(principals, orPrincipals(makeContainsPrincipals(path, claim.Contains)))
+		case claim.PathVariable != "":
+			prefix, suffix, ok := httpRule.UriTemplate.RegexAroundVariable(claim.PathVariable)
+			if !ok {
+				return nil, fmt.Errorf("for operation (%v), claim (%v) path variable (%v) does not bind a single segment", method.Operation(), claim.Name, claim.PathVariable)
+			}
+			principals = append(principals, makeClaimPrincipal(path, &matcherpb.ValueMatcher{
+				MatchPattern: &matcherpb.ValueMatcher_StringMatch{
+					StringMatch: makeSafeRegexMatcher(pathVariableClaimRegex),
+				},
+			}))
+			// request.path.matches(prefix + claim + suffix)
+			conditions = append(conditions, b.memberCall(b.selectField(b.ident("request"), "path"), "matches",
+				b.call("_+_", b.call("_+_", b.stringConst(prefix), b.claimValue(path)), b.stringConst(suffix+queryStringRegex))))
+		}
+	}
+	policies[jwtClaimsPolicyName] = makeDenyPolicy(notPrincipal(andPrincipals(principals)), nil)
+
+	if len(conditions) > 0 {
+		condition := conditions[0]
+		for _, c := range conditions[1:] {
+			condition = b.call("_&&_", condition, c)
+		}
+		// The condition fails to evaluate without the claims, but such
+		// requests are denied by the policy of the claims.
+		policies[jwtClaimsPathPolicyName] = makeDenyPolicy(&rbacconfigpb.Principal{
+			Identifier: &rbacconfigpb.Principal_Any{
+				Any: true,
+			},
+		}, b.call("!_", condition))
+	}
+	return policies, nil
+}
+
+// makeClientCertPolicy makes the policy denying requests whose validated
+// client certificate is not one of the allowed subject alternative names.
+// Requests without client certificates are denied as well.
+//
+// The principal name of a certificate is its first URI SAN, or its first DNS
+// SAN without URI SANs, or its subject without either, so the other SANs are
+// never compared. The allowed SANs are validated to be URIs for that reason.
+func makeClientCertPolicy(allowedSans []string) *rbacconfigpb.Policy {
+	var ids []*rbacconfigpb.Principal
+	for _, san := range allowedSans {
+		ids = append(ids, &rbacconfigpb.Principal{
+			Identifier: &rbacconfigpb.Principal_Authenticated_{
+				Authenticated: &rbacconfigpb.Principal_Authenticated{
+					PrincipalName: util.MakeSubjectAltNameMatcher(san),
+				},
+			},
+		})
+	}
+	return makeDenyPolicy(notPrincipal(orPrincipals(ids)), nil)
+}
+
+func makeDenyPolicy(principal *rbacconfigpb.Principal, condition *exprpb.Expr) *rbacconfigpb.Policy {
+	return &rbacconfigpb.Policy{
+		Permissions: []*rbacconfigpb.Permission{
+			{
+				Rule: &rbacconfigpb.Permission_Any{
+					Any: true,
+				},
+			},
+		},
+		Principals: []*rbacconfigpb.Principal{principal},
+		Condition:  condition,
+	}
+}
+
+// makeContainsPrincipals matches the claim of a space-separated string
+// containing the word, or a list containing the item.
+func makeContainsPrincipals(path []string, item string) []*rbacconfigpb.Principal {
+	return []*rbacconfigpb.Principal{
+		makeClaimPrincipal(path, &matcherpb.ValueMatcher{
+			MatchPattern: &matcherpb.ValueMatcher_StringMatch{
+				StringMatch: makeSafeRegexMatcher(`(^|\s)` + regexp.QuoteMeta(item) + `(\s|$)`),
+			},
+		}),
+		makeClaimPrincipal(path, &matcherpb.ValueMatcher{
+			MatchPattern: &matcherpb.ValueMatcher_ListMatch{
+				ListMatch: &matcherpb.ListMatcher{
+					MatchPattern: &matcherpb.ListMatcher_OneOf{
+						OneOf: &matcherpb.ValueMatcher{
+							MatchPattern: &matcherpb.ValueMatcher_StringMatch{
+								StringMatch: &matcherpb.StringMatcher{
+									MatchPattern: &matcherpb.StringMatcher_Exact{
+										Exact: item,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}),
+	}
+}
+
+func makeClaimPrincipal(path []string, value *matcherpb.ValueMatcher) *rbacconfigpb.Principal {
+	metadataMatcher := &matcherpb.MetadataMatcher{
+		Filter: util.JwtAuthn,
+		Value:  value,
+	}
+	for _, key := range path {
+		metadataMatcher.Path = append(metadataMatcher.Path, &matcherpb.MetadataMatcher_PathSegment{
+			Segment: &matcherpb.MetadataMatcher_PathSegment_Key{
+				Key: key,
+			},
+		})
+	}
+	return &rbacconfigpb.Principal{
+		Identifier: &rbacconfigpb.Principal_Metadata{
+			Metadata: metadataMatcher,
+		},
+	}
+}
+
+func andPrincipals(ids []*rbacconfigpb.Principal) *rbacconfigpb.Principal {
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	return &rbacconfigpb.Principal{
+		Identifier: &rbacconfigpb.Principal_AndIds{
+			AndIds: &rbacconfigpb.Principal_Set{
+				Ids: ids,
+			},
+		},
+	}
+}
+
+func notPrincipal(id *rbacconfigpb.Principal) *rbacconfigpb.Principal {
+	return &rbacconfigpb.Principal{
+		Identifier: &rbacconfigpb.Principal_NotId{
+			NotId: id,
+		},
+	}
+}
+
+func orPrincipals(ids []*rbacconfigpb.Principal) *rbacconfigpb.Principal {
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	return &rbacconfigpb.Principal{
+		Identifier: &rbacconfigpb.Principal_OrIds{
+			OrIds: &rbacconfigpb.Principal_Set{
+				Ids: ids,
+			},
+		},
+	}
+}
+
+func makeSafeRegexMatcher(regex string) *matcherpb.StringMatcher {
+	return &matcherpb.StringMatcher{
+		MatchPattern: &matcherpb.StringMatcher_SafeRegex{
+			SafeRegex: &matcherpb.RegexMatcher{
+				EngineType: &matcherpb.RegexMatcher_GoogleRe2{
+					GoogleRe2: &matcherpb.RegexMatcher_GoogleRE2{},
+				},
+				Regex: regex,
+			},
+		},
+	}
+}
+
+// celExprBuilder builds the CEL expressions of RBAC conditions, each of which
+// has a unique ID.
+type celExprBuilder struct {
+	lastId int64
+}
+
+func (b *celExprBuilder) nextId() int64 {
+	b.lastId++
+	return b.lastId
+}
+
+func (b *celExprBuilder) ident(name string) *exprpb.Expr {
+	return &exprpb.Expr{
+		Id: b.nextId(),
+		ExprKind: &exprpb.Expr_IdentExpr{
+			IdentExpr: &exprpb.Expr_Ident{Name: name},
+		},
+	}
+}
+
+func (b *celExprBuilder) selectField(operand *exprpb.Expr, field string) *exprpb.Expr {
+	return &exprpb.Expr{
+		Id: b.nextId(),
+		ExprKind: &exprpb.Expr_SelectExpr{
+			SelectExpr: &exprpb.Expr_Select{Operand: operand, Field: field},
+		},
+	}
+}
+
+func (b *celExprBuilder) stringConst(value string) *exprpb.Expr {
+	return &exprpb.Expr{
+		Id: b.nextId(),
+		ExprKind: &exprpb.Expr_ConstExpr{
+			ConstExpr: &exprpb.Constant{
+				ConstantKind: &exprpb.Constant_StringValue{StringValue: value},
+			},
+		},
+	}
+}
+
+func (b *celExprBuilder) call(function string, args ...*exprpb.Expr) *exprpb.Expr {
+	return b.memberCall(nil, function, args...)
+}
+
+func (b *celExprBuilder) memberCall(target *exprpb.Expr, function string, args ...*exprpb.Expr) *exprpb.Expr {
+	return &exprpb.Expr{
+		Id: b.nextId(),
+		ExprKind: &exprpb.Expr_CallExpr{
+			CallExpr: &exprpb.Expr_Call{Target: target, Function: function, Args: args},
+		},
+	}
+}
+
+// claimValue builds metadata.filter_metadata['envoy.filters.http.jwt_authn']['jwt_payloads'][...].
+func (b *celExprBuilder) claimValue(path []string) *exprpb.Expr {
+	e := b.call("_[_]", b.selectField(b.ident("metadata"), "filter_metadata"), b.stringConst(util.JwtAuthn))
+	for _, key := range path {
+		e = b.call("_[_]", e, b.stringConst(key))
+	}
+	return e
+}
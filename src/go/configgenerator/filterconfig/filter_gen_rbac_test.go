@@ -0,0 +1,877 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	rbacpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestRbacPerRouteFilterConfig(t *testing.T) {
+	makeServiceConfig := func(canonicalScopes string) *confpb.Service {
+		return &confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: "testapi",
+					Methods: []*apipb.Method{
+						{
+							Name: "ListBooks",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: "testapi.ListBooks",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/v1/tenants/{tenant}/books",
+						},
+					},
+				},
+			},
+			Authentication: &confpb.Authentication{
+				Providers: []*confpb.AuthProvider{
+					{
+						Id:      "auth_provider",
+						Issuer:  "issuer-0",
+						JwksUri: "https://fake-jwks.com",
+					},
+				},
+				Rules: []*confpb.AuthenticationRule{
+					{
+						Selector: "testapi.ListBooks",
+						Oauth: &confpb.OAuthRequirements{
+							CanonicalScopes: canonicalScopes,
+						},
+						Requirements: []*confpb.AuthRequirement{
+							{
+								ProviderId: "auth_provider",
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	testData := []struct {
+		desc            string
+		canonicalScopes string
+		rules           string
+		certRules       string
+		wantFilter      string
+		wantRules       string
+	}{
+		{
+			desc:  "No filter without claim rules or scopes",
+			rules: `{"rules": []}`,
+		},
+		{
+			desc:      "Client certificate SANs",
+			rules:     `{"rules": []}`,
+			certRules: `{"rules": [{"selector": "testapi.ListBooks", "allowed_sans": ["spiffe://example.org/ns/prod/sa/admin", "spiffe://example.org/ns/ops/*"]}]}`,
+			wantFilter: `{
+  "name": "envoy.filters.http.rbac",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+  }
+}`,
+			wantRules: `{
+  "action": "DENY",
+  "policies": {
+    "client_certificate": {
+      "permissions": [
+        {
+          "any": true
+        }
+      ],
+      "principals": [
+        {
+          "notId": {
+            "orIds": {
+              "ids": [
+                {
+                  "authenticated": {
+                    "principalName": {
+                      "exact": "spiffe://example.org/ns/prod/sa/admin"
+                    }
+                  }
+                },
+                {
+                  "authenticated": {
+                    "principalName": {
+                      "prefix": "spiffe://example.org/ns/ops/"
+                    }
+                  }
+                }
+              ]
+            }
+          }
+        }
+      ]
+    }
+  }
+}`,
+		},
+		{
+			desc:            "Canonical scopes",
+			canonicalScopes: "https://www.googleapis.com/auth/books.read, https://www.googleapis.com/auth/books",
+			rules:           `{"rules": []}`,
+			wantFilter: `{
+  "name": "envoy.filters.http.rbac",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+  }
+}`,
+			wantRules: `{
+  "action": "DENY",
+  "policies": {
+    "insufficient_scope": {
+      "permissions": [
+        {
+          "any": true
+        }
+      ],
+      "principals": [
+        {
+          "andIds": {
+            "ids": [
+              {
+                "metadata": {
+                  "filter": "envoy.filters.http.jwt_authn",
+                  "path": [
+                    {
+                      "key": "jwt_payloads"
+                    }
+                  ],
+                  "value": {
+                    "presentMatch": true
+                  }
+                }
+              },
+              {
+                "notId": {
+                  "orIds": {
+                    "ids": [
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scope"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "safeRegex": {
+                                "googleRe2": {},
+                                "regex": "(^|\\s)https://www\\.googleapis\\.com/auth/books\\.read(\\s|$)"
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scope"
+                            }
+                          ],
+                          "value": {
+                            "listMatch": {
+                              "oneOf": {
+                                "stringMatch": {
+                                  "exact": "https://www.googleapis.com/auth/books.read"
+                                }
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scp"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "safeRegex": {
+                                "googleRe2": {},
+                                "regex": "(^|\\s)https://www\\.googleapis\\.com/auth/books\\.read(\\s|$)"
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scp"
+                            }
+                          ],
+                          "value": {
+                            "listMatch": {
+                              "oneOf": {
+                                "stringMatch": {
+                                  "exact": "https://www.googleapis.com/auth/books.read"
+                                }
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scope"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "safeRegex": {
+                                "googleRe2": {},
+                                "regex": "(^|\\s)https://www\\.googleapis\\.com/auth/books(\\s|$)"
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scope"
+                            }
+                          ],
+                          "value": {
+                            "listMatch": {
+                              "oneOf": {
+                                "stringMatch": {
+                                  "exact": "https://www.googleapis.com/auth/books"
+                                }
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scp"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "safeRegex": {
+                                "googleRe2": {},
+                                "regex": "(^|\\s)https://www\\.googleapis\\.com/auth/books(\\s|$)"
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scp"
+                            }
+                          ],
+                          "value": {
+                            "listMatch": {
+                              "oneOf": {
+                                "stringMatch": {
+                                  "exact": "https://www.googleapis.com/auth/books"
+                                }
+                              }
+                            }
+                          }
+                        }
+                      }
+                    ]
+                  }
+                }
+              }
+            ]
+          }
+        }
+      ]
+    }
+  }
+}`,
+		},
+		{
+			desc: "Claims with values and contains",
+			rules: `{"rules": [{"selector": "testapi.ListBooks", "claims": [
+				{"name": "role", "values": ["admin"]},
+				{"name": "scope", "contains": "books.read"}]}]}`,
+			wantFilter: `{
+  "name": "envoy.filters.http.rbac",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+  }
+}`,
+			wantRules: `{
+  "action": "DENY",
+  "policies": {
+    "jwt_claims": {
+      "permissions": [
+        {
+          "any": true
+        }
+      ],
+      "principals": [
+        {
+          "notId": {
+            "andIds": {
+              "ids": [
+                {
+                  "metadata": {
+                    "filter": "envoy.filters.http.jwt_authn",
+                    "path": [
+                      {
+                        "key": "jwt_payloads"
+                      },
+                      {
+                        "key": "role"
+                      }
+                    ],
+                    "value": {
+                      "stringMatch": {
+                        "exact": "admin"
+                      }
+                    }
+                  }
+                },
+                {
+                  "orIds": {
+                    "ids": [
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scope"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "safeRegex": {
+                                "googleRe2": {},
+                                "regex": "(^|\\s)books\\.read(\\s|$)"
+                              }
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "scope"
+                            }
+                          ],
+                          "value": {
+                            "listMatch": {
+                              "oneOf": {
+                                "stringMatch": {
+                                  "exact": "books.read"
+                                }
+                              }
+                            }
+                          }
+                        }
+                      }
+                    ]
+                  }
+                }
+              ]
+            }
+          }
+        }
+      ]
+    }
+  }
+}`,
+		},
+		{
+			desc: "Claims with values and path variable",
+			rules: `{"rules": [{"selector": "testapi.ListBooks", "claims": [
+				{"name": "org.roles", "values": ["admin", "reader"]},
+				{"name": "tenant", "path_variable": "tenant"}]}]}`,
+			wantFilter: `{
+  "name": "envoy.filters.http.rbac",
+  "typedConfig": {
+    "@type": "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+  }
+}`,
+			wantRules: `{
+  "action": "DENY",
+  "policies": {
+    "jwt_claims": {
+      "permissions": [
+        {
+          "any": true
+        }
+      ],
+      "principals": [
+        {
+          "notId": {
+            "andIds": {
+              "ids": [
+                {
+                  "orIds": {
+                    "ids": [
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "org"
+                            },
+                            {
+                              "key": "roles"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "exact": "admin"
+                            }
+                          }
+                        }
+                      },
+                      {
+                        "metadata": {
+                          "filter": "envoy.filters.http.jwt_authn",
+                          "path": [
+                            {
+                              "key": "jwt_payloads"
+                            },
+                            {
+                              "key": "org"
+                            },
+                            {
+                              "key": "roles"
+                            }
+                          ],
+                          "value": {
+                            "stringMatch": {
+                              "exact": "reader"
+                            }
+                          }
+                        }
+                      }
+                    ]
+                  }
+                },
+                {
+                  "metadata": {
+                    "filter": "envoy.filters.http.jwt_authn",
+                    "path": [
+                      {
+                        "key": "jwt_payloads"
+                      },
+                      {
+                        "key": "tenant"
+                      }
+                    ],
+                    "value": {
+                      "stringMatch": {
+                        "safeRegex": {
+                          "googleRe2": {},
+                          "regex": "^[0-9A-Za-z_~-]+$"
+                        }
+                      }
+                    }
+                  }
+                }
+              ]
+            }
+          }
+        }
+      ]
+    },
+    "jwt_claims_path": {
+      "permissions": [
+        {
+          "any": true
+        }
+      ],
+      "principals": [
+        {
+          "any": true
+        }
+      ],
+      "condition": {
+        "id": "16",
+        "callExpr": {
+          "function": "!_",
+          "args": [
+            {
+              "id": "15",
+              "callExpr": {
+                "target": {
+                  "id": "2",
+                  "selectExpr": {
+                    "operand": {
+                      "id": "1",
+                      "identExpr": {
+                        "name": "request"
+                      }
+                    },
+                    "field": "path"
+                  }
+                },
+                "function": "matches",
+                "args": [
+                  {
+                    "id": "14",
+                    "callExpr": {
+                      "function": "_+_",
+                      "args": [
+                        {
+                          "id": "12",
+                          "callExpr": {
+                            "function": "_+_",
+                            "args": [
+                              {
+                                "id": "3",
+                                "constExpr": {
+                                  "stringValue": "^/v1/tenants/"
+                                }
+                              },
+                              {
+                                "id": "11",
+                                "callExpr": {
+                                  "function": "_[_]",
+                                  "args": [
+                                    {
+                                      "id": "9",
+                                      "callExpr": {
+                                        "function": "_[_]",
+                                        "args": [
+                                          {
+                                            "id": "7",
+                                            "callExpr": {
+                                              "function": "_[_]",
+                                              "args": [
+                                                {
+                                                  "id": "5",
+                                                  "selectExpr": {
+                                                    "operand": {
+                                                      "id": "4",
+                                                      "identExpr": {
+                                                        "name": "metadata"
+                                                      }
+                                                    },
+                                                    "field": "filter_metadata"
+                                                  }
+                                                },
+                                                {
+                                                  "id": "6",
+                                                  "constExpr": {
+                                                    "stringValue": "envoy.filters.http.jwt_authn"
+                                                  }
+                                                }
+                                              ]
+                                            }
+                                          },
+                                          {
+                                            "id": "8",
+                                            "constExpr": {
+                                              "stringValue": "jwt_payloads"
+                                            }
+                                          }
+                                        ]
+                                      }
+                                    },
+                                    {
+                                      "id": "10",
+                                      "constExpr": {
+                                        "stringValue": "tenant"
+                                      }
+                                    }
+                                  ]
+                                }
+                              }
+                            ]
+                          }
+                        },
+                        {
+                          "id": "13",
+                          "constExpr": {
+                            "stringValue": "/books\\/?(\\?.*)?$"
+                          }
+                        }
+                      ]
+                    }
+                  }
+                ]
+              }
+            }
+          ]
+        }
+      }
+    }
+  }
+}`,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "jwt_claim_rules")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	rulesFile := filepath.Join(dir, "rules.json")
+	certRulesFile := filepath.Join(dir, "cert_rules.json")
+
+	for _, tc := range testData {
+		if err := ioutil.WriteFile(rulesFile, []byte(tc.rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwtClaimRulesFile = rulesFile
+		if tc.certRules != "" {
+			if err := ioutil.WriteFile(certRulesFile, []byte(tc.certRules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			opts.SslDownstreamClientRootCertsPath = "/etc/ssl/clients/ca.pem"
+			opts.SslDownstreamClientCertRulesFile = certRulesFile
+		}
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(makeServiceConfig(tc.canonicalScopes), testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter, methods, err := rbacFilterGenFunc(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantFilter == "" {
+			if filter != nil || len(methods) != 0 {
+				t.Errorf("Test (%s): got filter: %v, methods: %v, want no filter", tc.desc, filter, methods)
+			}
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotFilter, err := marshaler.MarshalToString(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantFilter, gotFilter); err != nil {
+			t.Errorf("Test (%s): makeRbacFilter failed, %s", tc.desc, err)
+		}
+
+		if len(methods) != 1 {
+			t.Fatalf("Test (%s): got %d methods requiring per-route config, want 1", tc.desc, len(methods))
+		}
+		perRouteConfig, err := rbacPerRouteFilterConfigGen(methods[0], methods[0].HttpRule[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rbacPerRoute := &rbacpb.RBACPerRoute{}
+		if err := ptypes.UnmarshalAny(perRouteConfig, rbacPerRoute); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(rbacPerRoute.GetRbac().GetRules(), rbacPerRoute.GetRbac().GetShadowRules()) {
+			t.Errorf("Test (%s): got shadow rules: %v, want the same as rules: %v", tc.desc, rbacPerRoute.GetRbac().GetShadowRules(), rbacPerRoute.GetRbac().GetRules())
+		}
+		gotRules, err := marshaler.MarshalToString(rbacPerRoute.GetRbac().GetRules())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantRules, gotRules); err != nil {
+			t.Errorf("Test (%s): makeRbacPerRouteConfig failed, %s", tc.desc, err)
+			println(gotRules)
+		}
+	}
+}
+
+func TestMakeRbacLocalReplyMappers(t *testing.T) {
+	wantMappers := []string{
+		`{
+		  "filter": {
+		    "metadataFilter": {
+		      "matcher": {
+		        "filter": "envoy.filters.http.rbac",
+		        "path": [
+		          {
+		            "key": "shadow_effective_policy_id"
+		          }
+		        ],
+		        "value": {
+		          "stringMatch": {
+		            "exact": "client_certificate"
+		          }
+		        }
+		      },
+		      "matchIfKeyNotFound": false
+		    }
+		  },
+		  "body": {
+		    "inlineString": "Client certificate is not allowed for the operation"
+		  }
+		}`,
+		`{
+		  "filter": {
+		    "metadataFilter": {
+		      "matcher": {
+		        "filter": "envoy.filters.http.rbac",
+		        "path": [
+		          {
+		            "key": "shadow_effective_policy_id"
+		          }
+		        ],
+		        "value": {
+		          "stringMatch": {
+		            "exact": "insufficient_scope"
+		          }
+		        }
+		      },
+		      "matchIfKeyNotFound": false
+		    }
+		  },
+		  "body": {
+		    "inlineString": "Request had insufficient authentication scopes"
+		  }
+		}`,
+		`{
+		  "filter": {
+		    "metadataFilter": {
+		      "matcher": {
+		        "filter": "envoy.filters.http.rbac",
+		        "path": [
+		          {
+		            "key": "shadow_effective_policy_id"
+		          }
+		        ],
+		        "value": {
+		          "stringMatch": {
+		            "exact": "jwt_claims"
+		          }
+		        }
+		      },
+		      "matchIfKeyNotFound": false
+		    }
+		  },
+		  "body": {
+		    "inlineString": "Jwt claims do not meet the requirements of the operation"
+		  }
+		}`,
+		`{
+		  "filter": {
+		    "metadataFilter": {
+		      "matcher": {
+		        "filter": "envoy.filters.http.rbac",
+		        "path": [
+		          {
+		            "key": "shadow_effective_policy_id"
+		          }
+		        ],
+		        "value": {
+		          "stringMatch": {
+		            "exact": "jwt_claims_path"
+		          }
+		        }
+		      },
+		      "matchIfKeyNotFound": false
+		    }
+		  },
+		  "body": {
+		    "inlineString": "Jwt claims do not match the request path"
+		  }
+		}`,
+	}
+
+	mappers := MakeRbacLocalReplyMappers()
+	if len(mappers) != len(wantMappers) {
+		t.Fatalf("got %d mappers, want %d", len(mappers), len(wantMappers))
+	}
+	marshaler := &jsonpb.Marshaler{}
+	for i, mapper := range mappers {
+		gotMapper, err := marshaler.MarshalToString(mapper)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(wantMappers[i], gotMapper); err != nil {
+			t.Errorf("MakeRbacLocalReplyMappers failed for mapper(%d), %s", i, err)
+		}
+	}
+}
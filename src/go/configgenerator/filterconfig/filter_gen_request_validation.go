@@ -0,0 +1,515 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+// The filter validates the JSON request bodies against the schemas in the
+// route metadata, which are generated from the request types. It skips the
+// routes without schemas and the requests of other content types.
+var rvFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	lua := &luapb.Lua{
+		InlineCode: makeRequestValidationLuaCode(serviceInfo.Options.RequestValidationMaxBodyBytes),
+	}
+
+	l, err := ptypes.MarshalAny(lua)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling request validation filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.Lua,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{l},
+	}, nil, nil
+}
+
+func makeRequestValidationLuaCode(maxBodyBytes int) string {
+	return strings.NewReplacer(
+		"{{SCHEMA_KEY}}", util.RequestBodySchemaMetadataKey,
+		"{{MAX_BODY_BYTES}}", fmt.Sprint(maxBodyBytes),
+	).Replace(requestValidationLuaCode)
+}
+
+// The schemas are parsed once per worker and cached by their JSON strings.
+// The errors are the paths of the offending fields in the request body, as
+// sent by the client.
+//
+// The numbers keep their JSON texts, so the 64-bit integers are checked
+// without the precision loss of the Lua numbers. The nesting depth is capped
+// like the JSON parser of protobuf, and the bodies are capped in size.
+const requestValidationLuaCode = `
+local object_mt = {}
+local array_mt = {}
+local number_mt = {}
+local null = setmetatable({}, {})
+local max_errors = 10
+local max_depth = 100
+local max_body_bytes = {{MAX_BODY_BYTES}}
+local schemas = {}
+
+local escapes = {
+  ['"'] = '"', ['\\'] = '\\', ['/'] = '/',
+  b = '\b', f = '\f', n = '\n', r = '\r', t = '\t',
+}
+
+local function skip_whitespace(s, i)
+  return s:find("[^ \t\r\n]", i) or #s + 1
+end
+
+local function utf8_char(code)
+  if code < 0x80 then
+    return string.char(code)
+  elseif code < 0x800 then
+    return string.char(0xC0 + math.floor(code / 0x40), 0x80 + code % 0x40)
+  elseif code < 0x10000 then
+    return string.char(0xE0 + math.floor(code / 0x1000),
+      0x80 + math.floor(code / 0x40) % 0x40, 0x80 + code % 0x40)
+  end
+  return string.char(0xF0 + math.floor(code / 0x40000),
+    0x80 + math.floor(code / 0x1000) % 0x40,
+    0x80 + math.floor(code / 0x40) % 0x40, 0x80 + code % 0x40)
+end
+
+local function decode_hex(s, i)
+  local hex = s:sub(i, i + 3)
+  if not hex:match("^%x%x%x%x$") then
+    error("invalid unicode escape", 0)
+  end
+  return tonumber(hex, 16)
+end
+
+local function decode_string(s, i)
+  local parts = {}
+  local j = i + 1
+  while true do
+    local k = s:find('["\\]', j)
+    if k == nil then
+      error("unterminated string", 0)
+    end
+    local part = s:sub(j, k - 1)
+    if part:find("[%z\1-\31]") then
+      error("unescaped control character in string", 0)
+    end
+    parts[#parts + 1] = part
+    if s:sub(k, k) == '"' then
+      return table.concat(parts), k + 1
+    end
+    local c = s:sub(k + 1, k + 1)
+    if c == "u" then
+      local code = decode_hex(s, k + 2)
+      j = k + 6
+      if code >= 0xD800 and code <= 0xDBFF then
+        -- A high surrogate must be followed by a low one.
+        local low = s:sub(j, j + 1) == "\\u" and decode_hex(s, j + 2)
+        if not low or low < 0xDC00 or low > 0xDFFF then
+          error("invalid unicode surrogate pair", 0)
+        end
+        code = 0x10000 + (code - 0xD800) * 0x400 + (low - 0xDC00)
+        j = j + 6
+      elseif code >= 0xDC00 and code <= 0xDFFF then
+        error("invalid unicode surrogate pair", 0)
+      end
+      parts[#parts + 1] = utf8_char(code)
+    elseif escapes[c] ~= nil then
+      parts[#parts + 1] = escapes[c]
+      j = k + 2
+    else
+      error("invalid escape in string", 0)
+    end
+  end
+end
+
+local decode_value
+
+local function decode_object(s, i, depth)
+  local obj = setmetatable({}, object_mt)
+  i = skip_whitespace(s, i + 1)
+  if s:sub(i, i) == "}" then
+    return obj, i + 1
+  end
+  while true do
+    if s:sub(i, i) ~= '"' then
+      error("expected string for object key", 0)
+    end
+    local key, value
+    key, i = decode_string(s, i)
+    i = skip_whitespace(s, i)
+    if s:sub(i, i) ~= ":" then
+      error("expected ':' after object key", 0)
+    end
+    value, i = decode_value(s, i + 1, depth)
+    obj[key] = value
+    i = skip_whitespace(s, i)
+    local c = s:sub(i, i)
+    if c == "}" then
+      return obj, i + 1
+    elseif c ~= "," then
+      error("expected ',' or '}' in object", 0)
+    end
+    i = skip_whitespace(s, i + 1)
+  end
+end
+
+local function decode_array(s, i, depth)
+  local arr = setmetatable({}, array_mt)
+  i = skip_whitespace(s, i + 1)
+  if s:sub(i, i) == "]" then
+    return arr, i + 1
+  end
+  while true do
+    local value
+    value, i = decode_value(s, i, depth)
+    arr[#arr + 1] = value
+    i = skip_whitespace(s, i)
+    local c = s:sub(i, i)
+    if c == "]" then
+      return arr, i + 1
+    elseif c ~= "," then
+      error("expected ',' or ']' in array", 0)
+    end
+    i = i + 1
+  end
+end
+
+-- Returns the position after the JSON number at i, or nil if there is none.
+local function scan_number(s, i)
+  local j = s:match("^-?()", i)
+  if s:sub(j, j) == "0" then
+    j = j + 1
+  else
+    j = s:match("^[1-9]%d*()", j)
+    if j == nil then
+      return nil
+    end
+  end
+  if s:sub(j, j) == "." then
+    j = s:match("^%d+()", j + 1)
+    if j == nil then
+      return nil
+    end
+  end
+  local c = s:sub(j, j)
+  if c == "e" or c == "E" then
+    j = s:match("^[-+]?%d+()", j + 1)
+  end
+  return j
+end
+
+local literals = { ["true"] = true, ["false"] = false, ["null"] = null }
+
+decode_value = function(s, i, depth)
+  i = skip_whitespace(s, i)
+  local c = s:sub(i, i)
+  if c == "{" or c == "[" then
+    if depth >= max_depth then
+      error("nested deeper than " .. max_depth .. " levels", 0)
+    end
+    if c == "{" then
+      return decode_object(s, i, depth + 1)
+    end
+    return decode_array(s, i, depth + 1)
+  elseif c == '"' then
+    return decode_string(s, i)
+  end
+  for literal, value in pairs(literals) do
+    if s:sub(i, i + #literal - 1) == literal then
+      return value, i + #literal
+    end
+  end
+  local j = scan_number(s, i)
+  if j == nil then
+    error("unexpected character at position " .. i, 0)
+  end
+  return setmetatable({ text = s:sub(i, j - 1) }, number_mt), j
+end
+
+local function decode(s)
+  local ok, value, i = pcall(decode_value, s, 1, 0)
+  if not ok then
+    return nil, value
+  end
+  if skip_whitespace(s, i) <= #s then
+    return nil, "unexpected data after the JSON value"
+  end
+  return value
+end
+
+local function compile(schema_json)
+  local schema = decode(schema_json)
+  local compiled = {
+    body = schema.body,
+    path_fields = {},
+    messages = {},
+    enums = {},
+  }
+  for _, path in ipairs(schema.pathFields or {}) do
+    compiled.path_fields[path] = true
+  end
+  for name, fields in pairs(schema.types or {}) do
+    local by_name = {}
+    for _, field in ipairs(fields) do
+      by_name[field.name] = field
+      by_name[field.jsonName] = field
+    end
+    compiled.messages[name] = { fields = fields, by_name = by_name }
+  end
+  for name, values in pairs(schema.enums or {}) do
+    local set = {}
+    for _, value in ipairs(values) do
+      set[value] = true
+    end
+    compiled.enums[name] = set
+  end
+  return compiled
+end
+
+-- The bounds of the negative and the positive values of the integer kinds,
+-- as decimal strings to compare the 64-bit integers exactly.
+local int_bounds = {
+  int32 = { "2147483648", "2147483647" },
+  uint32 = { "0", "4294967295" },
+  int64 = { "9223372036854775808", "9223372036854775807" },
+  uint64 = { "0", "18446744073709551615" },
+}
+
+local max_floats = {
+  float = 3.4028234663852886e38,
+  double = 1.7976931348623157e308,
+}
+
+-- Returns the JSON text of the number, which may also be a string in the
+-- proto3 JSON mapping.
+local function number_text(v)
+  if getmetatable(v) == number_mt then
+    return v.text
+  elseif type(v) == "string" and scan_number(v, 1) == #v + 1 then
+    return v
+  end
+  return nil
+end
+
+-- Returns the value of the JSON number text. The exponent is applied
+-- separately, as tonumber does not take it in every Lua implementation.
+local function number_value(text)
+  local mantissa, exponent = text:match("^([^eE]*)[eE]?(.*)$")
+  local n = tonumber(mantissa)
+  if exponent ~= "" then
+    n = n * 10 ^ tonumber((exponent:gsub("^%+", "")))
+  end
+  return n
+end
+
+local function check_integer(kind, text)
+  local sign, digits = text:match("^(-?)(%d+)$")
+  if digits == nil then
+    -- The integers with fractions or exponents, such as 1.0 or 1e3, are
+    -- only exact as doubles up to 2^53.
+    local n = number_value(text)
+    if n % 1 ~= 0 or math.abs(n) > 2 ^ 53 then
+      return false
+    end
+    sign = n < 0 and "-" or ""
+    digits = string.format("%.0f", math.abs(n))
+  end
+  digits = digits:match("^0*(%d+)$")
+  local bound = int_bounds[kind][2]
+  if sign == "-" and digits ~= "0" then
+    bound = int_bounds[kind][1]
+  end
+  return #digits < #bound or (#digits == #bound and digits <= bound)
+end
+
+local function check_kind(schema, field, v)
+  local kind = field.kind
+  if kind == "string" or kind == "bytes" then
+    return type(v) == "string"
+  elseif kind == "bool" then
+    return type(v) == "boolean"
+  elseif max_floats[kind] ~= nil then
+    if v == "NaN" or v == "Infinity" or v == "-Infinity" then
+      return true
+    end
+    local text = number_text(v)
+    return text ~= nil and math.abs(number_value(text)) <= max_floats[kind]
+  elseif int_bounds[kind] ~= nil then
+    local text = number_text(v)
+    return text ~= nil and check_integer(kind, text)
+  elseif kind == "enum" then
+    if type(v) == "string" then
+      return schema.enums[field.type] ~= nil and schema.enums[field.type][v] == true
+    end
+    return getmetatable(v) == number_mt and check_integer("int32", v.text)
+  elseif kind == "object" then
+    return getmetatable(v) == object_mt
+  elseif kind == "array" then
+    return getmetatable(v) == array_mt
+  end
+  return kind == "any"
+end
+
+local function join(path, name)
+  if path == "" then
+    return name
+  end
+  return path .. "." .. name
+end
+
+local function add_error(errors, path, message)
+  if #errors < max_errors then
+    if path == "" then
+      errors[#errors + 1] = "the request body " .. message
+    else
+      errors[#errors + 1] = "\"" .. path .. "\" " .. message
+    end
+  end
+end
+
+local validate_message
+
+-- Null values are the defaults of the fields.
+local function validate_value(schema, field, v, path, proto_path, errors)
+  if v == null then
+    return
+  elseif field.kind == "message" then
+    if getmetatable(v) ~= object_mt then
+      add_error(errors, path, "must be an object")
+    else
+      validate_message(schema, field.type, v, path, proto_path, errors)
+    end
+  elseif not check_kind(schema, field, v) then
+    add_error(errors, path, "must be of type " .. field.kind)
+  end
+end
+
+local function validate_field(schema, field, v, path, proto_path, errors)
+  if v == null then
+    return
+  elseif field.mapValue ~= nil then
+    if getmetatable(v) ~= object_mt then
+      add_error(errors, path, "must be an object")
+      return
+    end
+    for key, value in pairs(v) do
+      validate_value(schema, field.mapValue, value, join(path, key), proto_path, errors)
+    end
+  elseif field.repeated then
+    if getmetatable(v) ~= array_mt then
+      add_error(errors, path, "must be an array")
+      return
+    end
+    for i, value in ipairs(v) do
+      validate_value(schema, field, value, path .. "[" .. (i - 1) .. "]", proto_path, errors)
+    end
+  else
+    validate_value(schema, field, v, path, proto_path, errors)
+  end
+end
+
+validate_message = function(schema, type_name, obj, path, proto_path, errors)
+  local message = schema.messages[type_name]
+  if message == nil then
+    return
+  end
+  for key, value in pairs(obj) do
+    local field = message.by_name[key]
+    if field == nil then
+      add_error(errors, join(path, key), "is an unknown field")
+    else
+      validate_field(schema, field, value, join(path, key), join(proto_path, field.name), errors)
+    end
+  end
+  for _, field in ipairs(message.fields) do
+    if field.required and not schema.path_fields[join(proto_path, field.name)] then
+      local value = obj[field.jsonName]
+      if value == nil or value == null then
+        value = obj[field.name]
+      end
+      if value == nil or value == null then
+        add_error(errors, join(path, field.jsonName), "is required")
+      end
+    end
+  end
+end
+
+local function reject_too_large(request_handle)
+  request_handle:respond({ [":status"] = "413" },
+    "Request body validation failed: the request body is larger than " .. max_body_bytes .. " bytes")
+end
+
+function envoy_on_request(request_handle)
+  local schema_json = request_handle:metadata():get("{{SCHEMA_KEY}}")
+  if schema_json == nil then
+    return
+  end
+  local content_type = request_handle:headers():get("content-type")
+  if content_type ~= nil and not content_type:lower():find("application/json", 1, true) then
+    return
+  end
+
+  local schema = schemas[schema_json]
+  if schema == nil then
+    schema = compile(schema_json)
+    schemas[schema_json] = schema
+  end
+
+  -- The body is checked against the limit before and after buffering it, as
+  -- the chunked requests have no content length.
+  local content_length = tonumber(request_handle:headers():get("content-length") or "")
+  if content_length ~= nil and content_length > max_body_bytes then
+    reject_too_large(request_handle)
+    return
+  end
+  local buffer = request_handle:body()
+  local body = ""
+  if buffer ~= nil then
+    if buffer:length() > max_body_bytes then
+      reject_too_large(request_handle)
+      return
+    end
+    body = buffer:getBytes(0, buffer:length())
+  end
+
+  local errors = {}
+  if body:find("[^ \t\r\n]") == nil then
+    -- An empty body is the default message.
+    if schema.body.kind ~= "message" then
+      return
+    end
+    body = "{}"
+  end
+  local value, err = decode(body)
+  if value == nil then
+    add_error(errors, "", "is not valid JSON: " .. err)
+  else
+    validate_field(schema, schema.body, value, "", "", errors)
+  end
+
+  if #errors > 0 then
+    table.sort(errors)
+    request_handle:respond({ [":status"] = "400" },
+      "Request body validation failed: " .. table.concat(errors, "; "))
+  end
+end
+`
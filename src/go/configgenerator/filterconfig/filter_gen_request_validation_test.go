@@ -0,0 +1,312 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+	lua "github.com/yuin/gopher-lua"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestRequestValidationFilter(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.EnableRequestValidation = true
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "testapi",
+			},
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, methods, err := rvFilterGenFunc(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 0 {
+		t.Errorf("got methods requiring per-route config: %v, want none", methods)
+	}
+	if filter.GetName() != util.Lua {
+		t.Errorf("got filter name %s, want %s", filter.GetName(), util.Lua)
+	}
+
+	lua := &luapb.Lua{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), lua); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(lua.GetInlineCode(), "{{") {
+		t.Errorf("got a placeholder in the script")
+	}
+	for _, want := range []string{
+		`request_handle:metadata():get("request_body_schema")`,
+		"local max_body_bytes = 1048576",
+		"function envoy_on_request(request_handle)",
+	} {
+		if !strings.Contains(lua.GetInlineCode(), want) {
+			t.Errorf("got script without %q", want)
+		}
+	}
+}
+
+// The schema of a Shelf request body, as generated from the service config.
+const testShelfSchema = `{
+	"body": {"kind": "message", "type": "Shelf"},
+	"pathFields": ["name"],
+	"types": {
+		"Shelf": [
+			{"name": "name", "jsonName": "name", "kind": "string", "required": true},
+			{"name": "theme", "jsonName": "theme", "kind": "string", "required": true},
+			{"name": "shelf_id", "jsonName": "shelfId", "kind": "int64"},
+			{"name": "size", "jsonName": "size", "kind": "uint32"},
+			{"name": "big_size", "jsonName": "bigSize", "kind": "uint64"},
+			{"name": "rating", "jsonName": "rating", "kind": "float"},
+			{"name": "genre", "jsonName": "genre", "kind": "enum", "type": "Genre"},
+			{"name": "books", "jsonName": "books", "kind": "message", "type": "Book", "repeated": true},
+			{"name": "labels", "jsonName": "labels", "kind": "message", "type": "LabelsEntry", "mapValue": {"kind": "int32"}}
+		],
+		"Book": [
+			{"name": "title", "jsonName": "title", "kind": "string", "required": true},
+			{"name": "next", "jsonName": "next", "kind": "message", "type": "Book"}
+		]
+	},
+	"enums": {
+		"Genre": ["GENRE_UNSPECIFIED", "FICTION"]
+	}
+}`
+
+// The request handle of Envoy's Lua filter, which records the local reply in
+// the globals.
+const testRequestHandleLuaCode = `
+local handle = {}
+function handle:metadata()
+  return { get = function(_, key)
+    if key == "request_body_schema" then
+      return test_schema
+    end
+  end }
+end
+function handle:headers()
+  return { get = function(_, key)
+    return test_headers[key]
+  end }
+end
+function handle:body()
+  return {
+    length = function() return #test_body end,
+    getBytes = function(_, start, length) return test_body:sub(start + 1, start + length) end,
+  }
+end
+function handle:respond(headers, body)
+  test_status = headers[":status"]
+  test_response = body
+end
+envoy_on_request(handle)
+`
+
+// runRequestValidation runs the request validation script on the request, and
+// returns the status and the body of the local reply, if any.
+func runRequestValidation(code, contentType, body string) (string, string, error) {
+	// The validation of the deepest bodies takes 3 calls per level, beyond
+	// the default call stack size of gopher-lua.
+	L := lua.NewState(lua.Options{CallStackSize: 1024})
+	defer L.Close()
+	if err := L.DoString(code); err != nil {
+		return "", "", err
+	}
+
+	headers := L.NewTable()
+	if contentType != "" {
+		headers.RawSetString("content-type", lua.LString(contentType))
+	}
+	L.SetGlobal("test_headers", headers)
+	L.SetGlobal("test_schema", lua.LString(testShelfSchema))
+	L.SetGlobal("test_body", lua.LString(body))
+	if err := L.DoString(testRequestHandleLuaCode); err != nil {
+		return "", "", err
+	}
+	return lua.LVAsString(L.GetGlobal("test_status")), lua.LVAsString(L.GetGlobal("test_response")), nil
+}
+
+func TestRequestValidationLuaCode(t *testing.T) {
+	code := makeRequestValidationLuaCode(4096)
+
+	testData := []struct {
+		desc         string
+		contentType  string
+		body         string
+		wantStatus   string
+		wantResponse string
+	}{
+		{
+			desc:        "Valid body",
+			contentType: "application/json",
+			body:        `{"theme": "Kids", "shelfId": "9223372036854775807", "size": 4294967295, "bigSize": 18446744073709551615, "rating": 4.5e0, "genre": "FICTION", "books": [{"title": "A", "next": {"title": "B"}}], "labels": {"a": -2147483648}}`,
+		},
+		{
+			desc:        "Valid body with proto field names, strings of numbers and integral exponents",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"theme": "Kids", "shelf_id": "-9223372036854775808", "size": "1e3", "rating": "NaN", "genre": 1, "big_size": "0"}`,
+		},
+		{
+			desc:        "Valid strings with escapes and surrogate pairs",
+			contentType: "application/json",
+			body:        `{"theme": "\u00e9\u4e2d\ud83d\ude00\n\"\/"}`,
+		},
+		{
+			desc:        "Other content types are not validated",
+			contentType: "text/plain",
+			body:        `not json`,
+		},
+		{
+			desc:         "Validated without content type",
+			body:         `not json`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: unexpected character at position 1`,
+		},
+		{
+			desc:         "Empty body misses the required fields",
+			contentType:  "application/json",
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "theme" is required`,
+		},
+		{
+			desc:         "Unknown field",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "color": "red", "books": [{"title": "A", "author": "B"}]}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "books[0].author" is an unknown field; "color" is an unknown field`,
+		},
+		{
+			desc:         "Wrong types",
+			contentType:  "application/json",
+			body:         `{"theme": 1, "size": -1, "genre": "DRAMA", "books": {"title": "A"}, "labels": {"a": "b"}, "rating": true}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "books" must be an array; "genre" must be of type enum; "labels.a" must be of type int32; "rating" must be of type float; "size" must be of type uint32; "theme" must be of type string`,
+		},
+		{
+			desc:         "Missing required fields of nested messages",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "books": [{"next": {}}]}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "books[0].next.title" is required; "books[0].title" is required`,
+		},
+		{
+			desc:         "64-bit integers out of range by one",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "shelfId": 9223372036854775808, "bigSize": "18446744073709551616"}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "bigSize" must be of type uint64; "shelfId" must be of type int64`,
+		},
+		{
+			desc:         "Integers with fractions or beyond the exact doubles",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "size": 1.5, "shelfId": 1e19, "bigSize": -1}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "bigSize" must be of type uint64; "shelfId" must be of type int64; "size" must be of type uint32`,
+		},
+		{
+			desc:         "Float out of range",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "rating": 1e39}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "rating" must be of type float`,
+		},
+		{
+			desc:         "Number with leading zero",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "size": 01}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: expected ',' or '}' in object`,
+		},
+		{
+			desc:         "Number without digits after the decimal point",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "size": 1.}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: unexpected character at position 27`,
+		},
+		{
+			desc:         "Number strings must be JSON numbers",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "size": "1e", "rating": "-"}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: "rating" must be of type float; "size" must be of type uint32`,
+		},
+		{
+			desc:         "Lone high surrogate",
+			contentType:  "application/json",
+			body:         `{"theme": "\ud83d"}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: invalid unicode surrogate pair`,
+		},
+		{
+			desc:         "Lone low surrogate",
+			contentType:  "application/json",
+			body:         `{"theme": "\ude00\ud83d"}`,
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: invalid unicode surrogate pair`,
+		},
+		{
+			desc:         "Unescaped control character",
+			contentType:  "application/json",
+			body:         "{\"theme\": \"a\tb\"}",
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: unescaped control character in string`,
+		},
+		{
+			desc:         "Nested deeper than the limit",
+			contentType:  "application/json",
+			body:         strings.Repeat("[", 101) + strings.Repeat("]", 101),
+			wantStatus:   "400",
+			wantResponse: `Request body validation failed: the request body is not valid JSON: nested deeper than 100 levels`,
+		},
+		{
+			desc:         "Nested up to the limit",
+			contentType:  "application/json",
+			body:         `{"theme": "Kids", "books": [` + strings.Repeat(`{"title": "A", "next": `, 97) + `{"title": "A"}` + strings.Repeat("}", 97) + `]}`,
+		},
+		{
+			desc:         "Body larger than the limit",
+			contentType:  "application/json",
+			body:         `{"theme": "` + strings.Repeat("a", 4096) + `"}`,
+			wantStatus:   "413",
+			wantResponse: `Request body validation failed: the request body is larger than 4096 bytes`,
+		},
+	}
+
+	for _, tc := range testData {
+		gotStatus, gotResponse, err := runRequestValidation(code, tc.contentType, tc.body)
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+		if gotStatus != tc.wantStatus || gotResponse != tc.wantResponse {
+			t.Errorf("Test (%s): got status: %q, response: %q, want status: %q, response: %q", tc.desc, gotStatus, gotResponse, tc.wantStatus, tc.wantResponse)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	ci "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+const (
+	// The minimum max-age of the HSTS preload list.
+	hstsPreloadMinMaxAge = 365 * 24 * time.Hour
+)
+
+var (
+	frameOptions = map[string]bool{
+		"DENY":       true,
+		"SAMEORIGIN": true,
+	}
+
+	referrerPolicies = map[string]bool{
+		"no-referrer":                     true,
+		"no-referrer-when-downgrade":      true,
+		"origin":                          true,
+		"origin-when-cross-origin":        true,
+		"same-origin":                     true,
+		"strict-origin":                   true,
+		"strict-origin-when-cross-origin": true,
+		"unsafe-url":                      true,
+	}
+)
+
+// The filter adds the security headers to all the responses and removes the
+// backend headers leaking the implementation. It must be the first filter, so
+// it sees the responses generated by all the other filters, such as the CORS
+// preflight responses and the local replies.
+var shFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
+	headersToAdd, err := makeSecurityHeaders(serviceInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var luaHeadersToAdd, luaHeadersToRemove []string
+	for _, header := range headersToAdd {
+		luaHeadersToAdd = append(luaHeadersToAdd, fmt.Sprintf("  { %s, %s },", strconv.Quote(header[0]), strconv.Quote(header[1])))
+	}
+	for _, name := range SecurityHeadersToStrip(serviceInfo.Options.SecurityHeadersStrip) {
+		luaHeadersToRemove = append(luaHeadersToRemove, fmt.Sprintf("  %s,", strconv.Quote(name)))
+	}
+
+	code := strings.NewReplacer(
+		"{{HEADERS_TO_ADD}}", strings.Join(luaHeadersToAdd, "\n"),
+		"{{HEADERS_TO_REMOVE}}", strings.Join(luaHeadersToRemove, "\n"),
+	).Replace(securityHeadersLuaCode)
+	lua := &luapb.Lua{
+		InlineCode: code,
+	}
+
+	l, err := ptypes.MarshalAny(lua)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling security headers filter config to Any: %v", err)
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.Lua,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{l},
+	}, nil, nil
+}
+
+// makeSecurityHeaders validates the security header options and returns the
+// headers to add, as lowercase name and value pairs.
+func makeSecurityHeaders(serviceInfo *ci.ServiceInfo) ([][2]string, error) {
+	opts := serviceInfo.Options
+
+	maxAge := opts.SecurityHeadersHstsMaxAge
+	if maxAge < 0 || maxAge%time.Second != 0 {
+		return nil, fmt.Errorf("security_headers_hsts_max_age must be a non-negative number of whole seconds, got %v", maxAge)
+	}
+	if opts.SecurityHeadersHstsPreload && maxAge < hstsPreloadMinMaxAge {
+		return nil, fmt.Errorf("security_headers_hsts_max_age must be at least %v with security_headers_hsts_preload, got %v", hstsPreloadMinMaxAge, maxAge)
+	}
+	hsts := fmt.Sprintf("max-age=%d; includeSubDomains", int64(maxAge/time.Second))
+	if opts.SecurityHeadersHstsPreload {
+		hsts += "; preload"
+	}
+
+	headers := [][2]string{
+		{"strict-transport-security", hsts},
+		{"x-content-type-options", "nosniff"},
+	}
+
+	if frameOption := strings.ToUpper(opts.SecurityHeadersFrameOptions); frameOption != "" {
+		if !frameOptions[frameOption] {
+			return nil, fmt.Errorf(`security_headers_frame_options must be "DENY" or "SAMEORIGIN", got %q`, opts.SecurityHeadersFrameOptions)
+		}
+		headers = append(headers, [2]string{"x-frame-options", frameOption})
+	}
+
+	if policy := opts.SecurityHeadersReferrerPolicy; policy != "" {
+		if !referrerPolicies[policy] {
+			return nil, fmt.Errorf("security_headers_referrer_policy has invalid policy %q", policy)
+		}
+		headers = append(headers, [2]string{"referrer-policy", policy})
+	}
+
+	if policy := opts.SecurityHeadersContentSecurityPolicy; policy != "" {
+		if !isVisibleASCII(policy) {
+			return nil, fmt.Errorf("security_headers_content_security_policy must only have visible ASCII characters, got %q", policy)
+		}
+		headers = append(headers, [2]string{"content-security-policy", policy})
+	}
+	return headers, nil
+}
+
+// SecurityHeadersToStrip returns the lowercase names of the backend response
+// headers to remove, from the list separated by ','.
+func SecurityHeadersToStrip(headers string) []string {
+	var names []string
+	for _, name := range strings.Split(headers, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isVisibleASCII checks the header value, which is quoted into the script
+// as is.
+func isVisibleASCII(s string) bool {
+	for _, c := range s {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// The headers set by the backends are kept, except the removed ones.
+const securityHeadersLuaCode = `
+local headers_to_add = {
+{{HEADERS_TO_ADD}}
+}
+
+local headers_to_remove = {
+{{HEADERS_TO_REMOVE}}
+}
+
+function envoy_on_response(response_handle)
+  local headers = response_handle:headers()
+  for _, name in ipairs(headers_to_remove) do
+    headers:remove(name)
+  end
+  for _, header in ipairs(headers_to_add) do
+    if headers:get(header[1]) == nil then
+      headers:add(header[1], header[2])
+    end
+  end
+end
+`
@@ -0,0 +1,190 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	luapb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/lua/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestSecurityHeadersFilter(t *testing.T) {
+	testData := []struct {
+		desc             string
+		setOptions       func(opts *options.ConfigGeneratorOptions)
+		wantLines        []string
+		wantMissingLines []string
+		wantError        string
+	}{
+		{
+			desc:       "Default security headers",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {},
+			wantLines: []string{
+				`  { "strict-transport-security", "max-age=31536000; includeSubDomains" },`,
+				`  { "x-content-type-options", "nosniff" },`,
+				`  { "x-frame-options", "DENY" },`,
+				`  { "referrer-policy", "strict-origin-when-cross-origin" },`,
+				`  "server",`,
+				`  "x-powered-by",`,
+			},
+			wantMissingLines: []string{
+				`"content-security-policy"`,
+			},
+		},
+		{
+			desc: "Custom security headers",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SecurityHeadersHstsMaxAge = 2 * 365 * 24 * time.Hour
+				opts.SecurityHeadersHstsPreload = true
+				opts.SecurityHeadersFrameOptions = "sameorigin"
+				opts.SecurityHeadersReferrerPolicy = ""
+				opts.SecurityHeadersContentSecurityPolicy = `default-src 'self'; img-src "https:"`
+				opts.SecurityHeadersStrip = " X-AspNet-Version ,"
+			},
+			wantLines: []string{
+				`  { "strict-transport-security", "max-age=63072000; includeSubDomains; preload" },`,
+				`  { "x-frame-options", "SAMEORIGIN" },`,
+				`  { "content-security-policy", "default-src 'self'; img-src \"https:\"" },`,
+				`  "x-aspnet-version",`,
+			},
+			wantMissingLines: []string{
+				`"referrer-policy"`,
+				`"server"`,
+			},
+		},
+		{
+			desc: "HSTS max age in fractions of seconds",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SecurityHeadersHstsMaxAge = 1500 * time.Millisecond
+			},
+			wantError: "security_headers_hsts_max_age must be a non-negative number of whole seconds",
+		},
+		{
+			desc: "HSTS preload with short max age",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SecurityHeadersHstsMaxAge = time.Hour
+				opts.SecurityHeadersHstsPreload = true
+			},
+			wantError: "security_headers_hsts_max_age must be at least 8760h0m0s with security_headers_hsts_preload",
+		},
+		{
+			desc: "Invalid frame options",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SecurityHeadersFrameOptions = "ALLOW-FROM https://example.com"
+			},
+			wantError: `security_headers_frame_options must be "DENY" or "SAMEORIGIN"`,
+		},
+		{
+			desc: "Invalid referrer policy",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SecurityHeadersReferrerPolicy = "never"
+			},
+			wantError: `security_headers_referrer_policy has invalid policy "never"`,
+		},
+		{
+			desc: "Content security policy with control characters",
+			setOptions: func(opts *options.ConfigGeneratorOptions) {
+				opts.SecurityHeadersContentSecurityPolicy = "default-src 'self'\nscript-src 'none'"
+			},
+			wantError: "security_headers_content_security_policy must only have visible ASCII characters",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.EnableSecurityHeaders = true
+		tc.setOptions(&opts)
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: "testapi",
+				},
+			},
+		}, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter, _, err := shFilterGenFunc(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+		if filter.GetName() != util.Lua {
+			t.Errorf("Test (%s): got filter name %s, want %s", tc.desc, filter.GetName(), util.Lua)
+		}
+
+		lua := &luapb.Lua{}
+		if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), lua); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(lua.GetInlineCode(), "\n")
+		for _, want := range tc.wantLines {
+			found := false
+			for _, line := range lines {
+				if line == want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Test (%s): got script without line %q", tc.desc, want)
+			}
+		}
+		for _, missing := range tc.wantMissingLines {
+			if strings.Contains(lua.GetInlineCode(), missing) {
+				t.Errorf("Test (%s): got script with %q", tc.desc, missing)
+			}
+		}
+	}
+
+	// The filter is the first one, before CORS filter.
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.EnableSecurityHeaders = true
+	opts.CorsPreset = "basic"
+	opts.CorsAllowOrigin = "http://example.com"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "testapi",
+			},
+		},
+	}, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterGenerators, err := MakeFilterGenerators(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filterGenerators) < 2 || filterGenerators[0].FilterName != util.Lua || filterGenerators[1].FilterName != util.CORS {
+		t.Errorf("got security headers filter not the first one before CORS filter")
+	}
+}
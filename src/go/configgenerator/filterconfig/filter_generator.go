@@ -57,7 +57,22 @@ type FilterGenFunc func(sc *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo
 func MakeFilterGenerators(serviceInfo *ci.ServiceInfo) ([]*FilterGenerator, error) {
 	filterGenerators := []*FilterGenerator{}
 
-	if serviceInfo.Options.CorsPreset == "basic" || serviceInfo.Options.CorsPreset == "cors_with_regex" {
+	// Add Security Headers filter first, so it sees all the responses.
+	if serviceInfo.Options.EnableSecurityHeaders {
+		filterGenerators = append(filterGenerators, &FilterGenerator{
+			FilterName:    util.Lua,
+			FilterGenFunc: shFilterGenFunc,
+		})
+	}
+
+	if serviceInfo.Options.CorsPreset == "basic" || serviceInfo.Options.CorsPreset == "cors_with_regex" || serviceInfo.HasCorsPolicies {
+		if serviceInfo.Options.CorsAllowPrivateNetwork {
+			filterGenerators = append(filterGenerators, &FilterGenerator{
+				FilterName:    util.Lua,
+				FilterGenFunc: cpnFilterGenFunc,
+			})
+		}
+
 		filterGenerators = append(filterGenerators, &FilterGenerator{
 			FilterName: util.CORS,
 			FilterGenFunc: func(sc *ci.ServiceInfo) (*hcmpb.HttpFilter, []*ci.MethodInfo, error) {
@@ -84,8 +99,26 @@ func MakeFilterGenerators(serviceInfo *ci.ServiceInfo) ([]*FilterGenerator, erro
 		})
 	}
 
+	// Remove the JWT payload header sent by the client before JWT Authn filter,
+	// which only sets it for the verified JWT, as the header is forwarded to
+	// the external authorization service.
+	if serviceInfo.Options.ExtAuthzAddress != "" {
+		filterGenerators = append(filterGenerators, &FilterGenerator{
+			FilterName:    util.Lua,
+			FilterGenFunc: extAuthzPayloadHeaderFilterGenFunc,
+		})
+	}
+
 	// Add JWT Authn filter if needed.
 	if !serviceInfo.Options.SkipJwtAuthnFilter {
+		// Add JWT Cookie filter before it to extract the JWT from the cookies.
+		if len(serviceInfo.JwtCookies) != 0 {
+			filterGenerators = append(filterGenerators, &FilterGenerator{
+				FilterName:    util.Lua,
+				FilterGenFunc: jcFilterGenFunc,
+			})
+		}
+
 		// TODO(b/176432170): Handle errors here, prevent startup.
 		filterGenerators = append(filterGenerators, &FilterGenerator{
 			FilterName:            util.JwtAuthn,
@@ -94,6 +127,27 @@ func MakeFilterGenerators(serviceInfo *ci.ServiceInfo) ([]*FilterGenerator, erro
 		})
 	}
 
+	// Add RBAC filter for the JWT claims required per operation, which are
+	// read from the JWT payloads written to the metadata by JWT Authn filter,
+	// and for the client certificates allowed per operation.
+	if !serviceInfo.Options.SkipJwtAuthnFilter || serviceInfo.Options.SslDownstreamClientRootCertsPath != "" {
+		filterGenerators = append(filterGenerators, &FilterGenerator{
+			FilterName:            util.RBAC,
+			FilterGenFunc:         rbacFilterGenFunc,
+			PerRouteConfigGenFunc: rbacPerRouteFilterConfigGen,
+		})
+	}
+
+	// Add External Authorization filter if needed. It must be behind JWT Authn
+	// filter to forward the JWT payload to the authorization service.
+	if serviceInfo.Options.ExtAuthzAddress != "" {
+		filterGenerators = append(filterGenerators, &FilterGenerator{
+			FilterName:            util.ExtAuthz,
+			FilterGenFunc:         extAuthzFilterGenFunc,
+			PerRouteConfigGenFunc: extAuthzPerRouteFilterConfigGen,
+		})
+	}
+
 	// Add Service Control filter if needed.
 	if !serviceInfo.Options.SkipServiceControlFilter {
 		filterGenerators = append(filterGenerators, &FilterGenerator{
@@ -103,6 +157,24 @@ func MakeFilterGenerators(serviceInfo *ci.ServiceInfo) ([]*FilterGenerator, erro
 		})
 	}
 
+	// Add Rate Limit filter to enforce the rate limits shared across the
+	// proxies. It must be behind JWT Authn filter to read the JWT subject.
+	if serviceInfo.Options.RateLimitServiceAddress != "" {
+		filterGenerators = append(filterGenerators, &FilterGenerator{
+			FilterName:    util.RateLimit,
+			FilterGenFunc: rlFilterGenFunc,
+		})
+	}
+
+	// Add Request Validation filter before gRPC Transcoder filter, so the
+	// JSON request bodies are validated before transcoding.
+	if serviceInfo.Options.EnableRequestValidation {
+		filterGenerators = append(filterGenerators, &FilterGenerator{
+			FilterName:    util.Lua,
+			FilterGenFunc: rvFilterGenFunc,
+		})
+	}
+
 	// Add gRPC Transcoder filter and gRPCWeb filter configs for gRPC backend.
 	if serviceInfo.GrpcSupportRequired {
 		// grpc-web filter should be before grpc transcoder filter.
@@ -16,12 +16,18 @@ package configgenerator
 
 import (
 	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator/filterconfig"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/tracing"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
@@ -32,10 +38,40 @@ import (
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	facpb "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 	structpb "github.com/golang/protobuf/ptypes/struct"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	codepb "google.golang.org/genproto/googleapis/rpc/code"
 )
 
+// The local reply formats, by the flag values.
+const (
+	jsonLocalReplyFormat            = "json"
+	googleRpcStatusLocalReplyFormat = "google_rpc_status"
+	problemJsonLocalReplyFormat     = "problem_json"
+
+	// The content types of the gRPC requests, as Envoy matches them. The
+	// gRPC-Web requests get the local replies as plain HTTP responses, so
+	// they are not matched.
+	grpcContentTypeRegex = `^application/grpc(\+.*)?$`
+)
+
+// The canonical codes of the HTTP status codes, following the mapping in
+// google/rpc/code.proto. The other status codes are UNKNOWN.
+var httpStatusCanonicalCodes = map[uint32]codepb.Code{
+	http.StatusBadRequest:          codepb.Code_INVALID_ARGUMENT,
+	http.StatusUnauthorized:        codepb.Code_UNAUTHENTICATED,
+	http.StatusForbidden:           codepb.Code_PERMISSION_DENIED,
+	http.StatusNotFound:            codepb.Code_NOT_FOUND,
+	http.StatusConflict:            codepb.Code_ABORTED,
+	http.StatusTooManyRequests:     codepb.Code_RESOURCE_EXHAUSTED,
+	499:                            codepb.Code_CANCELLED,
+	http.StatusInternalServerError: codepb.Code_INTERNAL,
+	http.StatusNotImplemented:      codepb.Code_UNIMPLEMENTED,
+	http.StatusServiceUnavailable:  codepb.Code_UNAVAILABLE,
+	http.StatusGatewayTimeout:      codepb.Code_DEADLINE_EXCEEDED,
+}
+
 // MakeListeners provides dynamic listeners for Envoy
 func MakeListeners(serviceInfo *sc.ServiceInfo) ([]*listenerpb.Listener, error) {
 	filterGenerators, err := filterconfig.MakeFilterGenerators(serviceInfo)
@@ -67,6 +103,8 @@ func addPerRouteConfigGenToMethods(methods []*sc.MethodInfo, filterGen *filterco
 // MakeListener provides a dynamic listener for Envoy
 func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.FilterGenerator) (*listenerpb.Listener, error) {
 	httpFilters := []*hcmpb.HttpFilter{}
+	hasRbacFilter := false
+	hasRateLimitFilter := false
 	for _, filterGenerator := range filterGenerators {
 		filter, perRouteConfigRequiredMethods, err := filterGenerator.FilterGenFunc(serviceInfo)
 		if err != nil {
@@ -76,6 +114,12 @@ func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.
 			jsonStr, _ := util.ProtoToJson(filter)
 			glog.Infof("adding filter config of %s : %v", filterGenerator.FilterName, jsonStr)
 			httpFilters = append(httpFilters, filter)
+			if filter.Name == util.RBAC {
+				hasRbacFilter = true
+			}
+			if filter.Name == util.RateLimit {
+				hasRateLimitFilter = true
+			}
 
 			if len(perRouteConfigRequiredMethods) > 0 {
 				if err := addPerRouteConfigGenToMethods(perRouteConfigRequiredMethods, filterGenerator); err != nil {
@@ -96,6 +140,11 @@ func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.
 		return nil, fmt.Errorf("makeHttpConnectionManager got err: %s", err)
 	}
 
+	httpConMgr.LocalReplyConfig.Mappers, err = makeLocalReplyMappers(serviceInfo, hasRbacFilter, hasRateLimitFilter)
+	if err != nil {
+		return nil, err
+	}
+
 	jsonStr, _ := util.ProtoToJson(httpConMgr)
 	glog.Infof("adding Http Connection Manager config: %v", jsonStr)
 	httpConMgr.HttpFilters = httpFilters
@@ -115,12 +164,21 @@ func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.
 		},
 	}
 
+	requireClientCert, allowedClientSans, err := makeDownstreamClientCertOptions(&serviceInfo.Options)
+	if err != nil {
+		return nil, err
+	}
+
 	if serviceInfo.Options.SslServerCertPath != "" {
 		transportSocket, err := util.CreateDownstreamTransportSocket(
 			serviceInfo.Options.SslServerCertPath,
 			serviceInfo.Options.SslMinimumProtocol,
 			serviceInfo.Options.SslMaximumProtocol,
 			serviceInfo.Options.SslServerCipherSuites,
+			serviceInfo.Options.SslDownstreamClientRootCertsPath,
+			requireClientCert,
+			allowedClientSans,
+			serviceInfo.Options.EnableSdsCertificates,
 		)
 		if err != nil {
 			return nil, err
@@ -152,43 +210,408 @@ func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.
 	return listener, nil
 }
 
-func makeHttpConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteConfiguration) (*hcmpb.HttpConnectionManager, error) {
-	httpConMgr := &hcmpb.HttpConnectionManager{
-		UpgradeConfigs: []*hcmpb.HttpConnectionManager_UpgradeConfig{
-			{
-				UpgradeType: "websocket",
-			},
-		},
-		CodecType:  hcmpb.HttpConnectionManager_AUTO,
-		StatPrefix: util.StatPrefix,
-		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
-			RouteConfig: route,
+// makeDownstreamClientCertOptions checks the downstream mutual TLS options,
+// and returns whether the client certificates are required and the SANs
+// allowed for all the operations.
+func makeDownstreamClientCertOptions(opts *options.ConfigGeneratorOptions) (bool, []string, error) {
+	var allowedSans []string
+	for _, san := range strings.Split(opts.SslDownstreamClientAllowedSans, ",") {
+		if san = strings.TrimSpace(san); san != "" {
+			allowedSans = append(allowedSans, san)
+		}
+	}
+
+	if opts.SslDownstreamClientRootCertsPath == "" {
+		if len(allowedSans) > 0 || opts.SslDownstreamClientCertRulesFile != "" {
+			return false, nil, fmt.Errorf("ssl_downstream_client_root_certs_path is required to allow the client certificates by subject alternative names")
+		}
+		return false, nil, nil
+	}
+	if opts.SslServerCertPath == "" {
+		return false, nil, fmt.Errorf("ssl_server_cert_path is required for the mutual TLS of the downstream connections")
+	}
+
+	switch opts.SslDownstreamClientCertMode {
+	case "require":
+		return true, allowedSans, nil
+	case "optional":
+		return false, allowedSans, nil
+	default:
+		return false, nil, fmt.Errorf(`invalid ssl_downstream_client_cert_mode (%s), must be "require" or "optional"`, opts.SslDownstreamClientCertMode)
+	}
+}
+
+// makeForwardClientCertDetails makes the client certificate details set in
+// the x-forwarded-client-cert header.
+func makeForwardClientCertDetails(details string) (*hcmpb.HttpConnectionManager_SetCurrentClientCertDetails, error) {
+	certDetails := &hcmpb.HttpConnectionManager_SetCurrentClientCertDetails{}
+	for _, detail := range strings.Split(details, ",") {
+		switch strings.TrimSpace(detail) {
+		case "":
+		case "subject":
+			certDetails.Subject = &wrapperspb.BoolValue{Value: true}
+		case "uri":
+			certDetails.Uri = true
+		case "dns":
+			certDetails.Dns = true
+		case "cert":
+			certDetails.Cert = true
+		case "chain":
+			certDetails.Chain = true
+		default:
+			return nil, fmt.Errorf(`invalid client certificate detail (%s) in ssl_downstream_client_forward_cert_details, must be one of "subject", "uri", "dns", "cert" and "chain"`, detail)
+		}
+	}
+	return certDetails, nil
+}
+
+// makeLocalReplyMappers makes the local reply mappers in the order of
+// matching, where the first matched one applies:
+//   - the OpenAPI document, which only matches the status code 200
+//   - the messages of the gRPC requests, sent in the grpc-message trailers
+//     instead of the bodies, so gRPC clients get the plain messages
+//   - the mappers from LocalReplyMappersFile
+//   - the messages of the filters, in the local reply format
+//   - the local reply format of the status codes
+func makeLocalReplyMappers(serviceInfo *sc.ServiceInfo, hasRbacFilter, hasRateLimitFilter bool) ([]*hcmpb.ResponseMapper, error) {
+	format := serviceInfo.Options.LocalReplyFormat
+
+	// The mappers of the filter messages, by their status codes.
+	var messageMappers []*hcmpb.ResponseMapper
+	var messageStatusCodes []uint32
+	if hasRbacFilter {
+		for _, mapper := range filterconfig.MakeRbacLocalReplyMappers() {
+			messageMappers = append(messageMappers, mapper)
+			messageStatusCodes = append(messageStatusCodes, http.StatusForbidden)
+		}
+	}
+	// The rate limits reply 429 like the quota errors of service control.
+	if hasRateLimitFilter {
+		for _, mapper := range filterconfig.MakeRateLimitLocalReplyMappers() {
+			messageMappers = append(messageMappers, mapper)
+			messageStatusCodes = append(messageStatusCodes, http.StatusTooManyRequests)
+		}
+	}
+
+	var mappers []*hcmpb.ResponseMapper
+	if serviceInfo.OpenApiDoc != "" {
+		mappers = append(mappers, makeOpenApiDocLocalReplyMapper(serviceInfo))
+	}
+
+	grpcBodyFormat := &corepb.SubstitutionFormatString{
+		Format: &corepb.SubstitutionFormatString_TextFormat{
+			TextFormat: "%LOCAL_REPLY_BODY%",
 		},
-		UseRemoteAddress:  &wrapperspb.BoolValue{Value: opts.EnvoyUseRemoteAddress},
-		XffNumTrustedHops: uint32(opts.EnvoyXffNumTrustedHops),
-		// Converting the error message for requests rejected by Envoy to JSON format:
-		//
+	}
+	for _, messageMapper := range messageMappers {
+		mapper := proto.Clone(messageMapper).(*hcmpb.ResponseMapper)
+		mapper.Filter = makeAndLocalReplyFilter(makeGrpcRequestFilter(), messageMapper.Filter)
+		mapper.BodyFormatOverride = grpcBodyFormat
+		mappers = append(mappers, mapper)
+	}
+	mappers = append(mappers, &hcmpb.ResponseMapper{
+		Filter:             makeGrpcRequestFilter(),
+		BodyFormatOverride: grpcBodyFormat,
+	})
+
+	for i, localReplyMapper := range serviceInfo.LocalReplyMappers {
+		mapper, err := makeCustomLocalReplyMapper(localReplyMapper)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make local reply mapper %d: %v", i, err)
+		}
+		mappers = append(mappers, mapper)
+	}
+
+	// The default format is the one of all the local replies.
+	if format == "" || format == jsonLocalReplyFormat {
+		return append(mappers, messageMappers...), nil
+	}
+
+	for i, mapper := range messageMappers {
+		bodyFormat, err := makeLocalReplyBodyFormat(format, messageStatusCodes[i])
+		if err != nil {
+			return nil, err
+		}
+		mapper.BodyFormatOverride = bodyFormat
+		mappers = append(mappers, mapper)
+	}
+
+	var statusCodes []uint32
+	for statusCode := range httpStatusCanonicalCodes {
+		statusCodes = append(statusCodes, statusCode)
+	}
+	sort.Slice(statusCodes, func(i, j int) bool { return statusCodes[i] < statusCodes[j] })
+	for _, statusCode := range statusCodes {
+		bodyFormat, err := makeLocalReplyBodyFormat(format, statusCode)
+		if err != nil {
+			return nil, err
+		}
+		mappers = append(mappers, &hcmpb.ResponseMapper{
+			Filter:             makeStatusCodeFilter(statusCode),
+			BodyFormatOverride: bodyFormat,
+		})
+	}
+	return mappers, nil
+}
+
+// makeLocalReplyBodyFormat makes the body format of the local replies with
+// the status code, or of all the local replies if it is 0.
+func makeLocalReplyBodyFormat(format string, statusCode uint32) (*corepb.SubstitutionFormatString, error) {
+	var fields map[string]*structpb.Value
+	contentType := ""
+	switch format {
+	case "", jsonLocalReplyFormat:
 		//    {
 		//       "code": "http-status-code",
 		//       "message": "the error message",
 		//    }
+		fields = map[string]*structpb.Value{
+			"code":    makeStringValue("%RESPONSE_CODE%"),
+			"message": makeStringValue("%LOCAL_REPLY_BODY%"),
+		}
+	case googleRpcStatusLocalReplyFormat:
+		// The JSON error envelope of google.rpc.Status over HTTP, where the
+		// code is the HTTP status code and the status is the canonical code.
 		//
-		LocalReplyConfig: &hcmpb.LocalReplyConfig{
-			BodyFormat: &corepb.SubstitutionFormatString{
-				Format: &corepb.SubstitutionFormatString_JsonFormat{
-					JsonFormat: &structpb.Struct{
+		//    {
+		//       "error": {
+		//          "code": http-status-code,
+		//          "message": "the error message",
+		//          "status": "the canonical code"
+		//       }
+		//    }
+		code, ok := httpStatusCanonicalCodes[statusCode]
+		if !ok {
+			code = codepb.Code_UNKNOWN
+		}
+		fields = map[string]*structpb.Value{
+			"error": {
+				Kind: &structpb.Value_StructValue{
+					StructValue: &structpb.Struct{
 						Fields: map[string]*structpb.Value{
-							"code": {
-								Kind: &structpb.Value_StringValue{StringValue: "%RESPONSE_CODE%"},
+							"code":    makeStringValue("%RESPONSE_CODE%"),
+							"message": makeStringValue("%LOCAL_REPLY_BODY%"),
+							"status":  makeStringValue(code.String()),
+						},
+					},
+				},
+			},
+		}
+	case problemJsonLocalReplyFormat:
+		// The problem details of RFC 7807, with the status text as the title.
+		fields = map[string]*structpb.Value{
+			"type":   makeStringValue("about:blank"),
+			"status": makeStringValue("%RESPONSE_CODE%"),
+			"detail": makeStringValue("%LOCAL_REPLY_BODY%"),
+		}
+		if title := http.StatusText(int(statusCode)); title != "" {
+			fields["title"] = makeStringValue(title)
+		}
+		contentType = "application/problem+json"
+	default:
+		return nil, fmt.Errorf(`invalid local_reply_format %q, must be one of "json", "google_rpc_status" or "problem_json"`, format)
+	}
+
+	return &corepb.SubstitutionFormatString{
+		Format: &corepb.SubstitutionFormatString_JsonFormat{
+			JsonFormat: &structpb.Struct{
+				Fields: fields,
+			},
+		},
+		ContentType: contentType,
+	}, nil
+}
+
+// makeCustomLocalReplyMapper makes the mapper of the local replies with the
+// status code and the request content type of the LocalReplyMapper.
+func makeCustomLocalReplyMapper(localReplyMapper *sc.LocalReplyMapper) (*hcmpb.ResponseMapper, error) {
+	var filters []*acpb.AccessLogFilter
+	if localReplyMapper.StatusCode != 0 {
+		filters = append(filters, makeStatusCodeFilter(localReplyMapper.StatusCode))
+	}
+	if localReplyMapper.RequestContentType != "" {
+		filters = append(filters, makeRequestContentTypeFilter(localReplyMapper.RequestContentType))
+	}
+
+	bodyFormat := &corepb.SubstitutionFormatString{
+		ContentType: localReplyMapper.ContentType,
+	}
+	if localReplyMapper.TextFormat != "" {
+		bodyFormat.Format = &corepb.SubstitutionFormatString_TextFormat{
+			TextFormat: localReplyMapper.TextFormat,
+		}
+	} else {
+		jsonFormat := &structpb.Struct{}
+		if err := jsonpb.UnmarshalString(string(localReplyMapper.JsonFormat), jsonFormat); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal json_format: %v", err)
+		}
+		bodyFormat.Format = &corepb.SubstitutionFormatString_JsonFormat{
+			JsonFormat: jsonFormat,
+		}
+	}
+
+	return &hcmpb.ResponseMapper{
+		Filter:             makeAndLocalReplyFilter(filters...),
+		BodyFormatOverride: bodyFormat,
+	}, nil
+}
+
+func makeStatusCodeFilter(statusCode uint32) *acpb.AccessLogFilter {
+	return &acpb.AccessLogFilter{
+		FilterSpecifier: &acpb.AccessLogFilter_StatusCodeFilter{
+			StatusCodeFilter: &acpb.StatusCodeFilter{
+				Comparison: &acpb.ComparisonFilter{
+					Op: acpb.ComparisonFilter_EQ,
+					Value: &corepb.RuntimeUInt32{
+						DefaultValue: statusCode,
+						RuntimeKey:   fmt.Sprintf("local_reply_%d_status_code", statusCode),
+					},
+				},
+			},
+		},
+	}
+}
+
+// makeRequestContentTypeFilter matches the prefix of the request content
+// type, so the parameters and the subtypes such as "application/grpc+proto"
+// are matched as well.
+func makeRequestContentTypeFilter(contentTypePrefix string) *acpb.AccessLogFilter {
+	return &acpb.AccessLogFilter{
+		FilterSpecifier: &acpb.AccessLogFilter_HeaderFilter{
+			HeaderFilter: &acpb.HeaderFilter{
+				Header: &routepb.HeaderMatcher{
+					Name: "content-type",
+					HeaderMatchSpecifier: &routepb.HeaderMatcher_PrefixMatch{
+						PrefixMatch: contentTypePrefix,
+					},
+				},
+			},
+		},
+	}
+}
+
+// makeGrpcRequestFilter matches the gRPC requests, but not the gRPC-Web ones.
+func makeGrpcRequestFilter() *acpb.AccessLogFilter {
+	return &acpb.AccessLogFilter{
+		FilterSpecifier: &acpb.AccessLogFilter_HeaderFilter{
+			HeaderFilter: &acpb.HeaderFilter{
+				Header: &routepb.HeaderMatcher{
+					Name: "content-type",
+					HeaderMatchSpecifier: &routepb.HeaderMatcher_SafeRegexMatch{
+						SafeRegexMatch: &matcher.RegexMatcher{
+							EngineType: &matcher.RegexMatcher_GoogleRe2{
+								GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
 							},
-							"message": {
-								Kind: &structpb.Value_StringValue{StringValue: "%LOCAL_REPLY_BODY%"},
+							Regex: grpcContentTypeRegex,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// makeAndLocalReplyFilter matches all of the filters, which must not be empty.
+func makeAndLocalReplyFilter(filters ...*acpb.AccessLogFilter) *acpb.AccessLogFilter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return &acpb.AccessLogFilter{
+		FilterSpecifier: &acpb.AccessLogFilter_AndFilter{
+			AndFilter: &acpb.AndFilter{
+				Filters: filters,
+			},
+		},
+	}
+}
+
+func makeStringValue(s string) *structpb.Value {
+	return &structpb.Value{
+		Kind: &structpb.Value_StringValue{StringValue: s},
+	}
+}
+
+// makeOpenApiDocLocalReplyMapper sets the OpenAPI document as the body of
+// the direct responses of the OpenApiDoc routes, matched by their paths.
+func makeOpenApiDocLocalReplyMapper(serviceInfo *sc.ServiceInfo) *hcmpb.ResponseMapper {
+	return &hcmpb.ResponseMapper{
+		Filter: &acpb.AccessLogFilter{
+			FilterSpecifier: &acpb.AccessLogFilter_AndFilter{
+				AndFilter: &acpb.AndFilter{
+					Filters: []*acpb.AccessLogFilter{
+						{
+							FilterSpecifier: &acpb.AccessLogFilter_StatusCodeFilter{
+								StatusCodeFilter: &acpb.StatusCodeFilter{
+									Comparison: &acpb.ComparisonFilter{
+										Op: acpb.ComparisonFilter_EQ,
+										Value: &corepb.RuntimeUInt32{
+											DefaultValue: http.StatusOK,
+											RuntimeKey:   "openapi_doc_status_code",
+										},
+									},
+								},
+							},
+						},
+						{
+							FilterSpecifier: &acpb.AccessLogFilter_HeaderFilter{
+								HeaderFilter: &acpb.HeaderFilter{
+									Header: &routepb.HeaderMatcher{
+										Name: ":path",
+										HeaderMatchSpecifier: &routepb.HeaderMatcher_SafeRegexMatch{
+											SafeRegexMatch: &matcher.RegexMatcher{
+												EngineType: &matcher.RegexMatcher_GoogleRe2{
+													GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+												},
+												Regex: fmt.Sprintf(`^%s/?(\?.*)?$`, regexp.QuoteMeta(serviceInfo.Options.OpenApiDocPath)),
+											},
+										},
+									},
+								},
 							},
 						},
 					},
 				},
 			},
 		},
+		Body: &corepb.DataSource{
+			Specifier: &corepb.DataSource_InlineString{
+				InlineString: serviceInfo.OpenApiDoc,
+			},
+		},
+		// Not wrapped in the JSON error body of the other local replies.
+		BodyFormatOverride: &corepb.SubstitutionFormatString{
+			Format: &corepb.SubstitutionFormatString_TextFormat{
+				TextFormat: "%LOCAL_REPLY_BODY%",
+			},
+			ContentType: "application/json",
+		},
+	}
+}
+
+func makeHttpConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteConfiguration) (*hcmpb.HttpConnectionManager, error) {
+	httpConMgr := &hcmpb.HttpConnectionManager{
+		UpgradeConfigs: []*hcmpb.HttpConnectionManager_UpgradeConfig{
+			{
+				UpgradeType: "websocket",
+			},
+		},
+		CodecType:  hcmpb.HttpConnectionManager_AUTO,
+		StatPrefix: util.StatPrefix,
+		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
+			RouteConfig: route,
+		},
+		UseRemoteAddress:  &wrapperspb.BoolValue{Value: opts.EnvoyUseRemoteAddress},
+		XffNumTrustedHops: uint32(opts.EnvoyXffNumTrustedHops),
+	}
+
+	// Converting the error message for requests rejected by Envoy to the
+	// local reply format.
+	bodyFormat, err := makeLocalReplyBodyFormat(opts.LocalReplyFormat, 0)
+	if err != nil {
+		return nil, err
+	}
+	httpConMgr.LocalReplyConfig = &hcmpb.LocalReplyConfig{
+		BodyFormat: bodyFormat,
 	}
 
 	if opts.AccessLog != "" {
@@ -237,6 +660,27 @@ func makeHttpConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteCo
 		}
 	}
 
+	// Otherwise the Server header removed from the backend responses is added
+	// back with the proxy name.
+	if opts.EnableSecurityHeaders {
+		for _, name := range filterconfig.SecurityHeadersToStrip(opts.SecurityHeadersStrip) {
+			if name == "server" {
+				httpConMgr.ServerHeaderTransformation = hcmpb.HttpConnectionManager_PASS_THROUGH
+			}
+		}
+	}
+
+	// The header sent by the clients is replaced by the validated peer
+	// identity, and removed from the requests without client certificates.
+	if opts.SslDownstreamClientRootCertsPath != "" {
+		certDetails, err := makeForwardClientCertDetails(opts.SslDownstreamClientForwardCertDetails)
+		if err != nil {
+			return nil, err
+		}
+		httpConMgr.ForwardClientCertDetails = hcmpb.HttpConnectionManager_SANITIZE_SET
+		httpConMgr.SetCurrentClientCertDetails = certDetails
+	}
+
 	if opts.EnableGrpcForHttp1 {
 		// Retain gRPC trailers if downstream is using http1.
 		httpConMgr.HttpProtocolOptions = &corepb.Http1ProtocolOptions{
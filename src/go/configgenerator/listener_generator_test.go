@@ -13,6 +13,8 @@
 package configgenerator
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
@@ -21,6 +23,7 @@ import (
 	"github.com/golang/protobuf/jsonpb"
 
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
 )
@@ -85,7 +88,25 @@ func TestMakeListeners(t *testing.T) {
                   "code": "%RESPONSE_CODE%",
                   "message": "%LOCAL_REPLY_BODY%"
                 }
-              }
+              },
+              "mappers": [
+                {
+                  "bodyFormatOverride": {
+                    "textFormat": "%LOCAL_REPLY_BODY%"
+                  },
+                  "filter": {
+                    "headerFilter": {
+                      "header": {
+                        "name": "content-type",
+                        "safeRegexMatch": {
+                          "googleRe2": {},
+                          "regex": "^application/grpc(\\+.*)?$"
+                        }
+                      }
+                    }
+                  }
+                }
+              ]
             },
             "routeConfig": {
               "name": "local_route",
@@ -270,6 +291,79 @@ func TestMakeHttpConMgr(t *testing.T) {
 				}
 				`,
 		},
+		{
+			desc: "Generate HttpConMgr when the server header is stripped by security headers",
+			opts: options.ConfigGeneratorOptions{
+				EnableSecurityHeaders: true,
+				SecurityHeadersStrip:  "Server, X-Powered-By",
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantHttpConnMgr: `
+				{
+					"commonHttpProtocolOptions": {
+						"headersWithUnderscoresAction": "REJECT_REQUEST"
+					},
+					"localReplyConfig": {
+						"bodyFormat": {
+							"jsonFormat": {
+								"code": "%RESPONSE_CODE%",
+								"message": "%LOCAL_REPLY_BODY%"
+							}
+						}
+					},
+					"routeConfig": {},
+					"serverHeaderTransformation": "PASS_THROUGH",
+					"statPrefix": "ingress_http",
+					"upgradeConfigs": [
+						{
+							"upgradeType": "websocket"
+						}
+					],
+					"useRemoteAddress": false
+				}
+				`,
+		},
+		{
+			desc: "Generate HttpConMgr when downstream mutual TLS is enabled",
+			opts: options.ConfigGeneratorOptions{
+				SslDownstreamClientRootCertsPath:      "/etc/ssl/clients/ca.pem",
+				SslDownstreamClientForwardCertDetails: "subject, uri,dns",
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+				},
+			},
+			wantHttpConnMgr: `
+				{
+					"commonHttpProtocolOptions": {
+						"headersWithUnderscoresAction": "REJECT_REQUEST"
+					},
+					"forwardClientCertDetails": "SANITIZE_SET",
+					"localReplyConfig": {
+						"bodyFormat": {
+							"jsonFormat": {
+								"code": "%RESPONSE_CODE%",
+								"message": "%LOCAL_REPLY_BODY%"
+							}
+						}
+					},
+					"routeConfig": {},
+					"setCurrentClientCertDetails": {
+						"dns": true,
+						"subject": true,
+						"uri": true
+					},
+					"statPrefix": "ingress_http",
+					"upgradeConfigs": [
+						{
+							"upgradeType": "websocket"
+						}
+					],
+					"useRemoteAddress": false
+				}
+				`,
+		},
 		{
 			desc: "Generate HttpConMgr when tracing is enabled",
 			opts: options.ConfigGeneratorOptions{
@@ -400,3 +494,373 @@ func TestMakeHttpConMgr(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeDownstreamClientCertOptions(t *testing.T) {
+	testData := []struct {
+		desc                  string
+		opts                  options.ConfigGeneratorOptions
+		wantRequireClientCert bool
+		wantAllowedClientSans []string
+		wantErr               string
+	}{
+		{
+			desc: "Success without mutual TLS",
+			opts: options.ConfigGeneratorOptions{
+				SslServerCertPath:           "/etc/ssl/endpoints/",
+				SslDownstreamClientCertMode: "require",
+			},
+		},
+		{
+			desc: "Success with required client certificates and allowed SANs",
+			opts: options.ConfigGeneratorOptions{
+				SslServerCertPath:                "/etc/ssl/endpoints/",
+				SslDownstreamClientRootCertsPath: "/etc/ssl/clients/ca.pem",
+				SslDownstreamClientCertMode:      "require",
+				SslDownstreamClientAllowedSans:   "spiffe://example.org/ns/prod/*, client.example.com",
+			},
+			wantRequireClientCert: true,
+			wantAllowedClientSans: []string{"spiffe://example.org/ns/prod/*", "client.example.com"},
+		},
+		{
+			desc: "Success with optional client certificates",
+			opts: options.ConfigGeneratorOptions{
+				SslServerCertPath:                "/etc/ssl/endpoints/",
+				SslDownstreamClientRootCertsPath: "/etc/ssl/clients/ca.pem",
+				SslDownstreamClientCertMode:      "optional",
+			},
+		},
+		{
+			desc: "Fail with invalid mode",
+			opts: options.ConfigGeneratorOptions{
+				SslServerCertPath:                "/etc/ssl/endpoints/",
+				SslDownstreamClientRootCertsPath: "/etc/ssl/clients/ca.pem",
+				SslDownstreamClientCertMode:      "request",
+			},
+			wantErr: `invalid ssl_downstream_client_cert_mode (request), must be "require" or "optional"`,
+		},
+		{
+			desc: "Fail without server certificate",
+			opts: options.ConfigGeneratorOptions{
+				SslDownstreamClientRootCertsPath: "/etc/ssl/clients/ca.pem",
+				SslDownstreamClientCertMode:      "require",
+			},
+			wantErr: "ssl_server_cert_path is required for the mutual TLS of the downstream connections",
+		},
+		{
+			desc: "Fail with allowed SANs but without root certificates",
+			opts: options.ConfigGeneratorOptions{
+				SslServerCertPath:              "/etc/ssl/endpoints/",
+				SslDownstreamClientAllowedSans: "client.example.com",
+			},
+			wantErr: "ssl_downstream_client_root_certs_path is required to allow the client certificates by subject alternative names",
+		},
+	}
+
+	for _, tc := range testData {
+		requireClientCert, allowedClientSans, err := makeDownstreamClientCertOptions(&tc.opts)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+		if requireClientCert != tc.wantRequireClientCert {
+			t.Errorf("Test (%s): got requireClientCert: %v, want: %v", tc.desc, requireClientCert, tc.wantRequireClientCert)
+		}
+		if !reflect.DeepEqual(allowedClientSans, tc.wantAllowedClientSans) {
+			t.Errorf("Test (%s): got allowedClientSans: %v, want: %v", tc.desc, allowedClientSans, tc.wantAllowedClientSans)
+		}
+	}
+}
+
+func TestMakeOpenApiDocLocalReplyMapper(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.OpenApiDocPath = "/openapi.json"
+	serviceInfo := &configinfo.ServiceInfo{
+		Options:    opts,
+		OpenApiDoc: `{"openapi":"3.0.3"}`,
+	}
+
+	marshaler := &jsonpb.Marshaler{}
+	gotMapper, err := marshaler.MarshalToString(makeOpenApiDocLocalReplyMapper(serviceInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantMapper := `
+		{
+			"filter": {
+				"andFilter": {
+					"filters": [
+						{
+							"statusCodeFilter": {
+								"comparison": {
+									"value": {
+										"defaultValue": 200,
+										"runtimeKey": "openapi_doc_status_code"
+									}
+								}
+							}
+						},
+						{
+							"headerFilter": {
+								"header": {
+									"name": ":path",
+									"safeRegexMatch": {
+										"googleRe2": {},
+										"regex": "^/openapi\\.json/?(\\?.*)?$"
+									}
+								}
+							}
+						}
+					]
+				}
+			},
+			"body": {
+				"inlineString": "{\"openapi\":\"3.0.3\"}"
+			},
+			"bodyFormatOverride": {
+				"textFormat": "%LOCAL_REPLY_BODY%",
+				"contentType": "application/json"
+			}
+		}`
+	if err := util.JsonEqual(wantMapper, gotMapper); err != nil {
+		t.Errorf("got different local reply mapper, %v", err)
+	}
+}
+
+func TestMakeLocalReplyMappers(t *testing.T) {
+	grpcMapper := `
+		{
+			"bodyFormatOverride": {
+				"textFormat": "%LOCAL_REPLY_BODY%"
+			},
+			"filter": {
+				"headerFilter": {
+					"header": {
+						"name": "content-type",
+						"safeRegexMatch": {
+							"googleRe2": {},
+							"regex": "^application/grpc(\\+.*)?$"
+						}
+					}
+				}
+			}
+		}`
+
+	testData := []struct {
+		desc               string
+		localReplyFormat   string
+		localReplyMappers  []*configinfo.LocalReplyMapper
+		hasRateLimitFilter bool
+		wantMappers        string
+		wantMapperCount    int
+		wantError          string
+	}{
+		{
+			desc:        "Default format only maps the gRPC requests",
+			wantMappers: `[` + grpcMapper + `]`,
+		},
+		{
+			desc: "Mappers from the file are behind the gRPC requests",
+			localReplyMappers: []*configinfo.LocalReplyMapper{
+				{
+					StatusCode:         404,
+					RequestContentType: "text/html",
+					TextFormat:         "<h1>%LOCAL_REPLY_BODY%</h1>",
+					ContentType:        "text/html",
+				},
+				{
+					StatusCode: 503,
+					JsonFormat: []byte(`{"error": {"message": "%LOCAL_REPLY_BODY%"}}`),
+				},
+			},
+			wantMappers: `[` + grpcMapper + `,
+				{
+					"bodyFormatOverride": {
+						"contentType": "text/html",
+						"textFormat": "<h1>%LOCAL_REPLY_BODY%</h1>"
+					},
+					"filter": {
+						"andFilter": {
+							"filters": [
+								{
+									"statusCodeFilter": {
+										"comparison": {
+											"value": {
+												"defaultValue": 404,
+												"runtimeKey": "local_reply_404_status_code"
+											}
+										}
+									}
+								},
+								{
+									"headerFilter": {
+										"header": {
+											"name": "content-type",
+											"prefixMatch": "text/html"
+										}
+									}
+								}
+							]
+						}
+					}
+				},
+				{
+					"bodyFormatOverride": {
+						"jsonFormat": {
+							"error": {
+								"message": "%LOCAL_REPLY_BODY%"
+							}
+						}
+					},
+					"filter": {
+						"statusCodeFilter": {
+							"comparison": {
+								"value": {
+									"defaultValue": 503,
+									"runtimeKey": "local_reply_503_status_code"
+								}
+							}
+						}
+					}
+				}
+			]`,
+		},
+		{
+			desc:               "Filter messages and status codes in google.rpc.Status format",
+			localReplyFormat:   "google_rpc_status",
+			hasRateLimitFilter: true,
+			// The gRPC quota message, the gRPC requests, the quota message and
+			// the status codes.
+			wantMapperCount: 3 + len(httpStatusCanonicalCodes),
+		},
+		{
+			desc:             "Invalid format",
+			localReplyFormat: "xml",
+			wantError:        `invalid local_reply_format "xml"`,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.LocalReplyFormat = tc.localReplyFormat
+		serviceInfo := &configinfo.ServiceInfo{
+			Name:              "test-api",
+			Options:           opts,
+			LocalReplyMappers: tc.localReplyMappers,
+		}
+
+		gotMappers, err := makeLocalReplyMappers(serviceInfo, false, tc.hasRateLimitFilter)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+
+		if tc.wantMapperCount != 0 {
+			if len(gotMappers) != tc.wantMapperCount {
+				t.Errorf("Test (%s): got %d mappers, want %d", tc.desc, len(gotMappers), tc.wantMapperCount)
+				continue
+			}
+			// The quota message is in the format of its status code.
+			gotStatus := gotMappers[2].GetBodyFormatOverride().GetJsonFormat().GetFields()["error"].GetStructValue().GetFields()["status"].GetStringValue()
+			if gotStatus != "RESOURCE_EXHAUSTED" {
+				t.Errorf("Test (%s): got quota message status %q, want RESOURCE_EXHAUSTED", tc.desc, gotStatus)
+			}
+			if gotMappers[0].GetFilter().GetAndFilter() == nil {
+				t.Errorf("Test (%s): got gRPC quota message without the gRPC request filter", tc.desc)
+			}
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotMappersJson, err := marshaler.MarshalToString(&hcmpb.LocalReplyConfig{
+			Mappers: gotMappers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(`{"mappers": `+tc.wantMappers+`}`, gotMappersJson); err != nil {
+			t.Errorf("Test (%s): got different local reply mappers, %v", tc.desc, err)
+		}
+	}
+}
+
+func TestMakeLocalReplyBodyFormat(t *testing.T) {
+	testData := []struct {
+		desc           string
+		format         string
+		statusCode     uint32
+		wantBodyFormat string
+	}{
+		{
+			desc:       "google.rpc.Status format of an unmapped status code",
+			format:     "google_rpc_status",
+			statusCode: 0,
+			wantBodyFormat: `
+				{
+					"jsonFormat": {
+						"error": {
+							"code": "%RESPONSE_CODE%",
+							"message": "%LOCAL_REPLY_BODY%",
+							"status": "UNKNOWN"
+						}
+					}
+				}`,
+		},
+		{
+			desc:       "google.rpc.Status format of a mapped status code",
+			format:     "google_rpc_status",
+			statusCode: 404,
+			wantBodyFormat: `
+				{
+					"jsonFormat": {
+						"error": {
+							"code": "%RESPONSE_CODE%",
+							"message": "%LOCAL_REPLY_BODY%",
+							"status": "NOT_FOUND"
+						}
+					}
+				}`,
+		},
+		{
+			desc:       "Problem details format with the status text",
+			format:     "problem_json",
+			statusCode: 404,
+			wantBodyFormat: `
+				{
+					"contentType": "application/problem+json",
+					"jsonFormat": {
+						"detail": "%LOCAL_REPLY_BODY%",
+						"status": "%RESPONSE_CODE%",
+						"title": "Not Found",
+						"type": "about:blank"
+					}
+				}`,
+		},
+	}
+
+	for _, tc := range testData {
+		bodyFormat, err := makeLocalReplyBodyFormat(tc.format, tc.statusCode)
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+		marshaler := &jsonpb.Marshaler{}
+		gotBodyFormat, err := marshaler.MarshalToString(bodyFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantBodyFormat, gotBodyFormat); err != nil {
+			t.Errorf("Test (%s): got different body format, %v", tc.desc, err)
+		}
+	}
+}
@@ -15,10 +15,14 @@
 package configgenerator
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator/filterconfig"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
@@ -29,13 +33,35 @@ import (
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	metadatapb "github.com/envoyproxy/go-control-plane/envoy/type/metadata/v3"
 	anypb "github.com/golang/protobuf/ptypes/any"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 const (
 	routeName       = "local_route"
 	virtualHostName = "backend"
+
+	// The retry conditions of the "idempotent" retry mode. The calls which are
+	// not idempotent are only retried if they have not reached the backend.
+	idempotentRetryOns    = "reset,connect-failure,refused-stream,5xx,unavailable"
+	nonIdempotentRetryOns = "connect-failure,refused-stream"
+
+	// How many times a host is selected again when the previous hosts are
+	// rejected for a retry.
+	previousHostsSelectionMaxAttempts = 5
+)
+
+var (
+	// The HTTP methods of the idempotent calls, by the HTTP semantics.
+	idempotentHttpMethods = map[string]bool{
+		util.GET:     true,
+		"HEAD":       true,
+		util.OPTIONS: true,
+		util.PUT:     true,
+		util.DELETE:  true,
+	}
 )
 
 func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfiguration, error) {
@@ -78,6 +104,21 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 
 	host.Routes = append(host.Routes, makeCatchAllNotFoundRoute())
 
+	// The ext_authz filter is enabled for all the routes without per-route
+	// config, so it is disabled on the routes other than the backend ones.
+	if serviceInfo.Options.ExtAuthzAddress != "" {
+		for _, r := range host.Routes[len(backendRoutes):] {
+			extAuthzDisabled, err := filterconfig.MakeExtAuthzDisabledPerRouteConfig()
+			if err != nil {
+				return nil, err
+			}
+			if r.TypedPerFilterConfig == nil {
+				r.TypedPerFilterConfig = make(map[string]*anypb.Any)
+			}
+			r.TypedPerFilterConfig[util.ExtAuthz] = extAuthzDisabled
+		}
+	}
+
 	virtualHosts = append(virtualHosts, &host)
 
 	requestHeaders, err := makeRequestHeadersToAdd(serviceInfo)
@@ -157,17 +198,12 @@ func makeRouteCors(serviceInfo *configinfo.ServiceInfo) (*routepb.CorsPolicy, []
 	switch serviceInfo.Options.CorsPreset {
 	case "basic":
 		org := serviceInfo.Options.CorsAllowOrigin
-		if org == "" {
-			return nil, nil, fmt.Errorf("cors_allow_origin cannot be empty when cors_preset=basic")
+		if org == "" && serviceInfo.Options.CorsAllowOrigins == "" && serviceInfo.Options.CorsAllowOriginSuffixes == "" {
+			return nil, nil, fmt.Errorf("cors_allow_origin cannot be empty when cors_preset=basic, unless cors_allow_origins or cors_allow_origin_suffixes is set")
 		}
-		cors = &routepb.CorsPolicy{
-			AllowOriginStringMatch: []*matcher.StringMatcher{
-				{
-					MatchPattern: &matcher.StringMatcher_Exact{
-						Exact: org,
-					},
-				},
-			},
+		cors = &routepb.CorsPolicy{}
+		if org != "" {
+			cors.AllowOriginStringMatch = makeCorsOriginMatchers(org, "")
 		}
 	case "cors_with_regex":
 		orgReg := serviceInfo.Options.CorsAllowOriginRegex
@@ -178,22 +214,13 @@ func makeRouteCors(serviceInfo *configinfo.ServiceInfo) (*routepb.CorsPolicy, []
 			return nil, nil, fmt.Errorf("invalid cors origin regex: %v", err)
 		}
 		cors = &routepb.CorsPolicy{
-			AllowOriginStringMatch: []*matcher.StringMatcher{
-				{
-					MatchPattern: &matcher.StringMatcher_SafeRegex{
-						SafeRegex: &matcher.RegexMatcher{
-							EngineType: &matcher.RegexMatcher_GoogleRe2{
-								GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
-							},
-							Regex: orgReg,
-						},
-					},
-				},
-			},
+			AllowOriginStringMatch: makeCorsOriginMatchers("", orgReg),
 		}
 	case "":
 		if serviceInfo.Options.CorsAllowMethods != "" || serviceInfo.Options.CorsAllowHeaders != "" ||
-			serviceInfo.Options.CorsExposeHeaders != "" || serviceInfo.Options.CorsAllowCredentials {
+			serviceInfo.Options.CorsExposeHeaders != "" || serviceInfo.Options.CorsAllowCredentials ||
+			serviceInfo.Options.CorsAllowOrigins != "" || serviceInfo.Options.CorsAllowOriginSuffixes != "" ||
+			serviceInfo.Options.CorsMaxAge != 0 || serviceInfo.Options.CorsAllowPrivateNetwork {
 			return nil, nil, fmt.Errorf("cors_preset must be set in order to enable CORS support")
 		}
 	default:
@@ -203,6 +230,30 @@ func makeRouteCors(serviceInfo *configinfo.ServiceInfo) (*routepb.CorsPolicy, []
 	if cors == nil {
 		return nil, nil, nil
 	}
+
+	// The origin lists apply to both presets, in addition to their origins.
+	for _, origin := range splitCorsList(serviceInfo.Options.CorsAllowOrigins) {
+		cors.AllowOriginStringMatch = append(cors.AllowOriginStringMatch, makeCorsOriginMatchers(origin, "")...)
+	}
+	for _, suffix := range splitCorsList(serviceInfo.Options.CorsAllowOriginSuffixes) {
+		// Otherwise "evil-example.com" would match "example.com".
+		if !strings.HasPrefix(suffix, ".") {
+			return nil, nil, fmt.Errorf("cors_allow_origin_suffixes must start with '.', got %q", suffix)
+		}
+		cors.AllowOriginStringMatch = append(cors.AllowOriginStringMatch, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Suffix{
+				Suffix: suffix,
+			},
+		})
+	}
+
+	if maxAge := serviceInfo.Options.CorsMaxAge; maxAge != 0 {
+		if maxAge < 0 || maxAge%time.Second != 0 {
+			return nil, nil, fmt.Errorf("cors_max_age must be a positive number of whole seconds, got %v", maxAge)
+		}
+		cors.MaxAge = strconv.FormatInt(int64(maxAge/time.Second), 10)
+	}
+
 	cors.AllowMethods = serviceInfo.Options.CorsAllowMethods
 	cors.AllowHeaders = serviceInfo.Options.CorsAllowHeaders
 	cors.ExposeHeaders = serviceInfo.Options.CorsExposeHeaders
@@ -248,6 +299,7 @@ func makeRouteCors(serviceInfo *configinfo.ServiceInfo) (*routepb.CorsPolicy, []
 		Decorator: &routepb.Decorator{
 			Operation: util.SpanNamePrefix,
 		},
+		RequestHeadersToRemove: serviceInfo.ClaimHeaderNames,
 	}
 
 	// Try to catch malformed preflight CORS requests. They are still OPTIONS,
@@ -289,6 +341,56 @@ func makeRouteCors(serviceInfo *configinfo.ServiceInfo) (*routepb.CorsPolicy, []
 	return cors, corsRoutes, nil
 }
 
+// splitCorsList splits the comma-separated list of the flag, skipping the
+// empty items.
+func splitCorsList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// makeCorsOriginMatchers matches the allowed origin, either exactly or by the
+// regex.
+func makeCorsOriginMatchers(origin, originRegex string) []*matcher.StringMatcher {
+	if originRegex != "" {
+		return []*matcher.StringMatcher{
+			{
+				MatchPattern: &matcher.StringMatcher_SafeRegex{
+					SafeRegex: &matcher.RegexMatcher{
+						EngineType: &matcher.RegexMatcher_GoogleRe2{
+							GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+						},
+						Regex: originRegex,
+					},
+				},
+			},
+		}
+	}
+	return []*matcher.StringMatcher{
+		{
+			MatchPattern: &matcher.StringMatcher_Exact{
+				Exact: origin,
+			},
+		},
+	}
+}
+
+// makeOperationCorsPolicy makes the per-route CORS policy of an operation,
+// which overrides the one of the virtual host.
+func makeOperationCorsPolicy(policy *configinfo.CorsPolicy) *routepb.CorsPolicy {
+	return &routepb.CorsPolicy{
+		AllowOriginStringMatch: makeCorsOriginMatchers(policy.AllowOrigin, policy.AllowOriginRegex),
+		AllowMethods:           policy.AllowMethods,
+		AllowHeaders:           policy.AllowHeaders,
+		ExposeHeaders:          policy.ExposeHeaders,
+		AllowCredentials:       &wrapperspb.BoolValue{Value: policy.AllowCredentials},
+	}
+}
+
 func makePerRouteFilterConfig(operation string, method *configinfo.MethodInfo, httpRule *httppattern.Pattern) (map[string]*anypb.Any, error) {
 	perFilterConfig := make(map[string]*anypb.Any)
 
@@ -343,6 +445,30 @@ func makeRouteTable(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, []*r
 				return nil, nil, fmt.Errorf("fail to make per-route filter config for operation (%v): %v", operation, err)
 			}
 
+			r.GetRoute().RetryPolicy, err = makeRetryPolicy(serviceInfo, method, httpRule.HttpMethod)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fail to make retry policy for operation (%v): %v", operation, err)
+			}
+
+			if err := addClaimHeaders(r, serviceInfo, method); err != nil {
+				return nil, nil, fmt.Errorf("fail to make JWT claim headers for operation (%v): %v", operation, err)
+			}
+
+			if serviceInfo.Options.RateLimitServiceAddress != "" {
+				r.GetRoute().RateLimits, err = makeRateLimits(serviceInfo, method)
+				if err != nil {
+					return nil, nil, fmt.Errorf("fail to make rate limits for operation (%v): %v", operation, err)
+				}
+			}
+
+			if method.CorsPolicy != nil {
+				r.GetRoute().Cors = makeOperationCorsPolicy(method.CorsPolicy)
+			}
+
+			if method.RequestBodySchema != "" {
+				r.Metadata = makeRequestBodySchemaMetadata(method.RequestBodySchema)
+			}
+
 			if method.BackendInfo.Hostname != "" {
 				// For routing to remote backends.
 				r.GetRoute().HostRewriteSpecifier = &routepb.RouteAction_HostRewriteLiteral{
@@ -350,7 +476,9 @@ func makeRouteTable(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, []*r
 				}
 			}
 
-			if serviceInfo.Options.EnableHSTS {
+			// The security headers have their own HSTS header for all the
+			// responses.
+			if serviceInfo.Options.EnableHSTS && !serviceInfo.Options.EnableSecurityHeaders {
 				r.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
 					{
 						Header: &corepb.HeaderValue{
@@ -360,6 +488,15 @@ func makeRouteTable(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, []*r
 					},
 				}
 			}
+			if operation == serviceInfo.OpenApiDocOperation {
+				// Direct response bodies are limited to 4KB, so the document is
+				// set as the body by the local reply mapper of the listener.
+				r.Action = &routepb.Route_DirectResponse{
+					DirectResponse: &routepb.DirectResponseAction{
+						Status: http.StatusOK,
+					},
+				}
+			}
 			backendRoutes = append(backendRoutes, r)
 
 			jsonStr, err := util.ProtoToJson(r)
@@ -373,6 +510,210 @@ func makeRouteTable(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, []*r
 	return backendRoutes, methodNotAllowedRoutes, nil
 }
 
+// makeRequestBodySchemaMetadata sets the request body schema for the request
+// validation script, which reads the route metadata of the Lua filter.
+func makeRequestBodySchemaMetadata(schema string) *corepb.Metadata {
+	return &corepb.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{
+			util.Lua: {
+				Fields: map[string]*structpb.Value{
+					util.RequestBodySchemaMetadataKey: {
+						Kind: &structpb.Value_StringValue{StringValue: schema},
+					},
+				},
+			},
+		},
+	}
+}
+
+// addClaimHeaders appends the JWT claim headers to the headers of the route,
+// removing the ones sent by the client. Envoy removes the headers before
+// adding them on the same route.
+func addClaimHeaders(r *routepb.Route, serviceInfo *configinfo.ServiceInfo, method *configinfo.MethodInfo) error {
+	if len(serviceInfo.ClaimHeaderNames) == 0 {
+		return nil
+	}
+	headersToAdd, err := makeClaimHeadersToAdd(method)
+	if err != nil {
+		return err
+	}
+	r.RequestHeadersToRemove = append(r.RequestHeadersToRemove, serviceInfo.ClaimHeaderNames...)
+	r.RequestHeadersToAdd = append(r.RequestHeadersToAdd, headersToAdd...)
+	return nil
+}
+
+// makeClaimHeadersToAdd sets the headers from the JWT payload that jwt_authn
+// writes to the dynamic metadata. Envoy skips the headers of missing claims.
+func makeClaimHeadersToAdd(method *configinfo.MethodInfo) ([]*corepb.HeaderValueOption, error) {
+	var l []*corepb.HeaderValueOption
+	for _, claim := range method.ClaimsToHeaders {
+		metadataPath, err := json.Marshal(append([]string{util.JwtAuthn, util.JwtPayloadMetadataName}, strings.Split(claim.ClaimName, ".")...))
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, &corepb.HeaderValueOption{
+			Header: &corepb.HeaderValue{
+				Key:   claim.HeaderName,
+				Value: fmt.Sprintf("%%DYNAMIC_METADATA(%s)%%", metadataPath),
+			},
+			Append: &wrapperspb.BoolValue{
+				Value: false,
+			},
+		})
+	}
+	return l, nil
+}
+
+// makeRateLimits sets the descriptors sent to the rate limit service, made of
+// the operation name and the consumer identity. Envoy skips a descriptor if the
+// request does not have the identity, so the request is not rate limited.
+func makeRateLimits(serviceInfo *configinfo.ServiceInfo, method *configinfo.MethodInfo) ([]*routepb.RateLimit, error) {
+	operationAction := &routepb.RateLimit_Action{
+		ActionSpecifier: &routepb.RateLimit_Action_GenericKey_{
+			GenericKey: &routepb.RateLimit_Action_GenericKey{
+				DescriptorKey:   util.RateLimitOperationDescriptorKey,
+				DescriptorValue: method.Operation(),
+			},
+		},
+	}
+
+	var consumerActions []*routepb.RateLimit_Action
+	switch serviceInfo.Options.RateLimitConsumer {
+	case "api_key":
+		// Envoy can only read the API key from the headers, the API keys in the
+		// query parameters are not rate limited.
+		headerNames := []string{util.DefaultApiKeyHeaderName}
+		if len(method.ApiKeyLocations) > 0 {
+			headerNames = nil
+			for _, location := range method.ApiKeyLocations {
+				if header := location.GetHeader(); header != "" {
+					headerNames = append(headerNames, header)
+				}
+			}
+		}
+		for _, headerName := range headerNames {
+			consumerActions = append(consumerActions, &routepb.RateLimit_Action{
+				ActionSpecifier: &routepb.RateLimit_Action_RequestHeaders_{
+					RequestHeaders: &routepb.RateLimit_Action_RequestHeaders{
+						HeaderName:    headerName,
+						DescriptorKey: util.RateLimitApiKeyDescriptorKey,
+					},
+				},
+			})
+		}
+	case "jwt_subject":
+		consumerActions = append(consumerActions, &routepb.RateLimit_Action{
+			ActionSpecifier: &routepb.RateLimit_Action_Metadata{
+				Metadata: &routepb.RateLimit_Action_MetaData{
+					DescriptorKey: util.RateLimitJwtSubjectDescriptorKey,
+					MetadataKey: &metadatapb.MetadataKey{
+						Key: util.JwtAuthn,
+						Path: []*metadatapb.MetadataKey_PathSegment{
+							{
+								Segment: &metadatapb.MetadataKey_PathSegment_Key{
+									Key: util.JwtPayloadMetadataName,
+								},
+							},
+							{
+								Segment: &metadatapb.MetadataKey_PathSegment_Key{
+									Key: "sub",
+								},
+							},
+						},
+					},
+					Source: routepb.RateLimit_Action_MetaData_DYNAMIC,
+				},
+			},
+		})
+	case "client_ip":
+		consumerActions = append(consumerActions, &routepb.RateLimit_Action{
+			ActionSpecifier: &routepb.RateLimit_Action_RemoteAddress_{
+				RemoteAddress: &routepb.RateLimit_Action_RemoteAddress{},
+			},
+		})
+	default:
+		return nil, fmt.Errorf(`rate_limit_consumer must be one of "api_key", "jwt_subject" or "client_ip", got %q`, serviceInfo.Options.RateLimitConsumer)
+	}
+
+	var rateLimits []*routepb.RateLimit
+	for _, consumerAction := range consumerActions {
+		rateLimits = append(rateLimits, &routepb.RateLimit{
+			Actions: []*routepb.RateLimit_Action{
+				operationAction,
+				consumerAction,
+			},
+		})
+	}
+	return rateLimits, nil
+}
+
+// makeRetryPolicy makes the retry policy of a route of the method. In the
+// "idempotent" mode, only the idempotent calls are retried once they may have
+// reached the backend.
+func makeRetryPolicy(serviceInfo *configinfo.ServiceInfo, method *configinfo.MethodInfo, httpMethod string) (*routepb.RetryPolicy, error) {
+	opts := serviceInfo.Options
+	retryOn := method.BackendInfo.RetryOns
+	switch opts.BackendRetryMode {
+	case "", "global":
+	case "idempotent":
+		if method.IsIdempotent || idempotentHttpMethods[httpMethod] {
+			retryOn = idempotentRetryOns
+		} else {
+			retryOn = nonIdempotentRetryOns
+		}
+		if opts.BackendRetriableStatusCodes != "" && retryOn == idempotentRetryOns {
+			retryOn += ",retriable-status-codes"
+		}
+	default:
+		return nil, fmt.Errorf(`backend_retry_mode must be either "global" or "idempotent", got %q`, opts.BackendRetryMode)
+	}
+
+	retryPolicy := &routepb.RetryPolicy{
+		RetryOn: retryOn,
+		NumRetries: &wrapperspb.UInt32Value{
+			Value: uint32(method.BackendInfo.RetryNum),
+		},
+	}
+
+	if opts.BackendRetriableStatusCodes != "" {
+		for _, code := range strings.Split(opts.BackendRetriableStatusCodes, ",") {
+			statusCode, err := strconv.ParseUint(strings.TrimSpace(code), 10, 32)
+			if err != nil || statusCode < 100 || statusCode > 599 {
+				return nil, fmt.Errorf("invalid retriable status code %q in backend_retriable_status_codes", code)
+			}
+			retryPolicy.RetriableStatusCodes = append(retryPolicy.RetriableStatusCodes, uint32(statusCode))
+		}
+	}
+
+	if opts.BackendRetryBaseInterval < 0 || opts.BackendRetryMaxInterval < 0 {
+		return nil, fmt.Errorf("backend retry intervals must not be negative, got base interval %v and max interval %v", opts.BackendRetryBaseInterval, opts.BackendRetryMaxInterval)
+	}
+	if opts.BackendRetryMaxInterval > 0 && opts.BackendRetryBaseInterval == 0 {
+		return nil, fmt.Errorf("backend_retry_max_interval requires backend_retry_base_interval")
+	}
+	if opts.BackendRetryBaseInterval > 0 {
+		if opts.BackendRetryMaxInterval > 0 && opts.BackendRetryMaxInterval < opts.BackendRetryBaseInterval {
+			return nil, fmt.Errorf("backend_retry_max_interval (%v) must not be less than backend_retry_base_interval (%v)", opts.BackendRetryMaxInterval, opts.BackendRetryBaseInterval)
+		}
+		retryPolicy.RetryBackOff = &routepb.RetryPolicy_RetryBackOff{
+			BaseInterval: ptypes.DurationProto(opts.BackendRetryBaseInterval),
+		}
+		if opts.BackendRetryMaxInterval > 0 {
+			retryPolicy.RetryBackOff.MaxInterval = ptypes.DurationProto(opts.BackendRetryMaxInterval)
+		}
+	}
+
+	if opts.BackendRetryPreviousHosts {
+		retryPolicy.RetryHostPredicate = []*routepb.RetryPolicy_RetryHostPredicate{
+			{
+				Name: util.PreviousHostsRetryPredicate,
+			},
+		}
+		retryPolicy.HostSelectionRetryMaxAttempts = previousHostsSelectionMaxAttempts
+	}
+	return retryPolicy, nil
+}
+
 func makeRoute(routeMatcher *routepb.RouteMatch, method *configinfo.MethodInfo) *routepb.Route {
 	return &routepb.Route{
 		Match: routeMatcher,
@@ -383,12 +724,6 @@ func makeRoute(routeMatcher *routepb.RouteMatch, method *configinfo.MethodInfo)
 				},
 				Timeout:     ptypes.DurationProto(method.BackendInfo.Deadline),
 				IdleTimeout: ptypes.DurationProto(method.BackendInfo.IdleTimeout),
-				RetryPolicy: &routepb.RetryPolicy{
-					RetryOn: method.BackendInfo.RetryOns,
-					NumRetries: &wrapperspb.UInt32Value{
-						Value: uint32(method.BackendInfo.RetryNum),
-					},
-				},
 			},
 		},
 		Decorator: &routepb.Decorator{
@@ -16,22 +16,31 @@ package configgenerator
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	metadatapb "github.com/envoyproxy/go-control-plane/envoy/type/metadata/v3"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
+	ptypepb "google.golang.org/genproto/protobuf/ptype"
 )
 
 func TestMakeRouteConfig(t *testing.T) {
@@ -2391,6 +2400,72 @@ func TestMakeRouteConfig(t *testing.T) {
 	}
 }
 
+func TestSecurityHeadersReplaceHsts(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "Echo",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{Rules: []*annotationspb.HttpRule{
+			{
+				Selector: fmt.Sprintf("%s.Echo", testApiName),
+				Pattern: &annotationspb.HttpRule_Get{
+					Get: "/echo",
+				},
+			},
+		},
+		},
+	}
+
+	testData := []struct {
+		desc                  string
+		enableSecurityHeaders bool
+		wantHstsHeader        bool
+	}{
+		{
+			desc:           "HSTS header in the backend routes",
+			wantHstsHeader: true,
+		},
+		{
+			desc:                  "HSTS header of the security headers",
+			enableSecurityHeaders: true,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.EnableHSTS = true
+		opts.EnableSecurityHeaders = tc.enableSecurityHeaders
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotHstsHeader := false
+		for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+			for _, header := range route.GetResponseHeadersToAdd() {
+				if header.GetHeader().GetKey() == util.HSTSHeaderKey {
+					gotHstsHeader = true
+				}
+			}
+		}
+		if gotHstsHeader != tc.wantHstsHeader {
+			t.Errorf("Test (%s): got HSTS header in routes: %v, want: %v", tc.desc, gotHstsHeader, tc.wantHstsHeader)
+		}
+	}
+}
+
 func TestMakeFallbackRoute(t *testing.T) {
 	testData := []struct {
 		desc              string
@@ -3323,6 +3398,134 @@ func TestMakeRouteConfigForCors(t *testing.T) {
 	}
 }
 
+func TestMakeRouteConfigForCorsOriginLists(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		corsPreset              string
+		corsAllowOrigin         string
+		corsAllowOrigins        string
+		corsAllowOriginSuffixes string
+		corsMaxAge              time.Duration
+		corsAllowPrivateNetwork bool
+		wantedError             string
+		wantCorsPolicy          *routepb.CorsPolicy
+	}{
+		{
+			desc:             "Origin lists without cors_preset",
+			corsAllowOrigins: "http://example.com",
+			wantedError:      "cors_preset must be set",
+		},
+		{
+			desc:                    "Private network access without cors_preset",
+			corsAllowPrivateNetwork: true,
+			wantedError:             "cors_preset must be set",
+		},
+		{
+			desc:        "Basic preset without any origin",
+			corsPreset:  "basic",
+			wantedError: "cors_allow_origin cannot be empty when cors_preset=basic",
+		},
+		{
+			desc:                    "Origin suffix without leading dot",
+			corsPreset:              "basic",
+			corsAllowOriginSuffixes: "example.com",
+			wantedError:             `cors_allow_origin_suffixes must start with '.', got "example.com"`,
+		},
+		{
+			desc:             "Negative max age",
+			corsPreset:       "basic",
+			corsAllowOrigins: "http://example.com",
+			corsMaxAge:       -time.Second,
+			wantedError:      "cors_max_age must be a positive number of whole seconds",
+		},
+		{
+			desc:             "Max age in fractions of seconds",
+			corsPreset:       "basic",
+			corsAllowOrigins: "http://example.com",
+			corsMaxAge:       1500 * time.Millisecond,
+			wantedError:      "cors_max_age must be a positive number of whole seconds",
+		},
+		{
+			desc:                    "Basic preset with origin lists and max age",
+			corsPreset:              "basic",
+			corsAllowOrigin:         "http://example.com",
+			corsAllowOrigins:        "http://a.com, http://b.com,",
+			corsAllowOriginSuffixes: ".example.org",
+			corsMaxAge:              10 * time.Minute,
+			wantCorsPolicy: &routepb.CorsPolicy{
+				AllowOriginStringMatch: []*matcher.StringMatcher{
+					{
+						MatchPattern: &matcher.StringMatcher_Exact{
+							Exact: "http://example.com",
+						},
+					},
+					{
+						MatchPattern: &matcher.StringMatcher_Exact{
+							Exact: "http://a.com",
+						},
+					},
+					{
+						MatchPattern: &matcher.StringMatcher_Exact{
+							Exact: "http://b.com",
+						},
+					},
+					{
+						MatchPattern: &matcher.StringMatcher_Suffix{
+							Suffix: ".example.org",
+						},
+					},
+				},
+				MaxAge:           "600",
+				AllowCredentials: &wrapperspb.BoolValue{},
+			},
+		},
+		{
+			desc:                    "Basic preset with only origin suffixes",
+			corsPreset:              "basic",
+			corsAllowOriginSuffixes: ".example.org",
+			wantCorsPolicy: &routepb.CorsPolicy{
+				AllowOriginStringMatch: []*matcher.StringMatcher{
+					{
+						MatchPattern: &matcher.StringMatcher_Suffix{
+							Suffix: ".example.org",
+						},
+					},
+				},
+				AllowCredentials: &wrapperspb.BoolValue{},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.CorsPreset = tc.corsPreset
+		opts.CorsAllowOrigin = tc.corsAllowOrigin
+		opts.CorsAllowOrigins = tc.corsAllowOrigins
+		opts.CorsAllowOriginSuffixes = tc.corsAllowOriginSuffixes
+		opts.CorsMaxAge = tc.corsMaxAge
+		opts.CorsAllowPrivateNetwork = tc.corsAllowPrivateNetwork
+
+		gotRoute, err := MakeRouteConfig(&configinfo.ServiceInfo{
+			Name:    "test-api",
+			Options: opts,
+		})
+		if tc.wantedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+
+		gotCors := gotRoute.GetVirtualHosts()[0].GetCors()
+		if !proto.Equal(gotCors, tc.wantCorsPolicy) {
+			t.Errorf("Test (%v): makeRouteConfig failed, got Cors: %v, want: %v", tc.desc, gotCors, tc.wantCorsPolicy)
+		}
+	}
+}
+
 func TestHeadersToAdd(t *testing.T) {
 	testData := []struct {
 		desc                  string
@@ -3467,6 +3670,388 @@ func TestHeadersToAdd(t *testing.T) {
 	}
 }
 
+func TestClaimHeaders(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+					{
+						Name: "GetShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.GetShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves/{shelf}",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "provider_1",
+					Issuer:  "issuer_1",
+					JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+				},
+				{
+					Id:      "provider_2",
+					Issuer:  "issuer_2",
+					JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "provider_1",
+						},
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "provider_2",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	makeClaimHeader := func(header, metadataPath string) *corepb.HeaderValueOption {
+		return &corepb.HeaderValueOption{
+			Header: &corepb.HeaderValue{
+				Key:   header,
+				Value: fmt.Sprintf(`%%DYNAMIC_METADATA(["envoy.filters.http.jwt_authn","jwt_payloads",%s])%%`, metadataPath),
+			},
+			Append: &wrapperspb.BoolValue{
+				Value: false,
+			},
+		}
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.JwtClaimsToHeaders = "sub=X-Endpoint-Sub;org.id=X-Endpoint-Org-Id"
+	opts.JwtProviderClaimsToHeaders = "provider_1:email=X-Endpoint-Email"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatalf("MakeRouteConfig got error: %v", err)
+	}
+
+	wantRequestHeadersToRemove := []string{"X-Endpoint-Sub", "X-Endpoint-Org-Id", "X-Endpoint-Email"}
+	wantRequestHeadersToAdd := map[string][]*corepb.HeaderValueOption{
+		"ListShelves": {
+			makeClaimHeader("X-Endpoint-Sub", `"sub"`),
+			makeClaimHeader("X-Endpoint-Org-Id", `"org","id"`),
+			makeClaimHeader("X-Endpoint-Email", `"email"`),
+		},
+		"CreateShelf": {
+			makeClaimHeader("X-Endpoint-Sub", `"sub"`),
+			makeClaimHeader("X-Endpoint-Org-Id", `"org","id"`),
+		},
+		"GetShelf": nil,
+	}
+
+	for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+		if route.GetRoute() == nil {
+			continue
+		}
+		shortName := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+		wantHeaders, ok := wantRequestHeadersToAdd[shortName]
+		if !ok {
+			t.Errorf("got unexpected route for operation (%v)", route.GetDecorator().GetOperation())
+			continue
+		}
+		if !reflect.DeepEqual(route.GetRequestHeadersToRemove(), wantRequestHeadersToRemove) {
+			t.Errorf("Test (%v): got RequestHeadersToRemove: %v, want: %v", shortName, route.GetRequestHeadersToRemove(), wantRequestHeadersToRemove)
+		}
+		if len(route.GetRequestHeadersToAdd()) != len(wantHeaders) {
+			t.Errorf("Test (%v): got RequestHeadersToAdd: %v, want: %v", shortName, route.GetRequestHeadersToAdd(), wantHeaders)
+			continue
+		}
+		for idx, want := range wantHeaders {
+			if !proto.Equal(route.GetRequestHeadersToAdd()[idx], want) {
+				t.Errorf("Test (%v): got RequestHeadersToAdd(%v): %v, want: %v", shortName, idx, route.GetRequestHeadersToAdd()[idx], want)
+			}
+		}
+	}
+}
+
+func TestAddClaimHeadersKeepsRouteHeaders(t *testing.T) {
+	serviceInfo := &configinfo.ServiceInfo{
+		ClaimHeaderNames: []string{"X-Endpoint-Sub"},
+	}
+	method := &configinfo.MethodInfo{
+		ClaimsToHeaders: []*configinfo.ClaimToHeader{
+			{
+				ClaimName:  "sub",
+				HeaderName: "X-Endpoint-Sub",
+			},
+		},
+	}
+	routeHeader := &corepb.HeaderValueOption{
+		Header: &corepb.HeaderValue{
+			Key:   "X-Route-Header",
+			Value: "route-value",
+		},
+	}
+	r := &routepb.Route{
+		RequestHeadersToAdd:    []*corepb.HeaderValueOption{routeHeader},
+		RequestHeadersToRemove: []string{"X-Route-Removed"},
+	}
+
+	if err := addClaimHeaders(r, serviceInfo, method); err != nil {
+		t.Fatalf("addClaimHeaders got error: %v", err)
+	}
+
+	wantRequestHeadersToRemove := []string{"X-Route-Removed", "X-Endpoint-Sub"}
+	if !reflect.DeepEqual(r.GetRequestHeadersToRemove(), wantRequestHeadersToRemove) {
+		t.Errorf("got RequestHeadersToRemove: %v, want: %v", r.GetRequestHeadersToRemove(), wantRequestHeadersToRemove)
+	}
+	if len(r.GetRequestHeadersToAdd()) != 2 || !proto.Equal(r.GetRequestHeadersToAdd()[0], routeHeader) ||
+		r.GetRequestHeadersToAdd()[1].GetHeader().GetKey() != "X-Endpoint-Sub" {
+		t.Errorf("got RequestHeadersToAdd: %v, want the route header followed by the claim header", r.GetRequestHeadersToAdd())
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves",
+					},
+				},
+			},
+		},
+		SystemParameters: &confpb.SystemParameters{
+			Rules: []*confpb.SystemParameterRule{
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Parameters: []*confpb.SystemParameter{
+						{
+							Name:              "api_key",
+							HttpHeader:        "x-custom-key",
+							UrlQueryParameter: "custom_key",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	makeRateLimit := func(operation string, consumerAction *routepb.RateLimit_Action) *routepb.RateLimit {
+		return &routepb.RateLimit{
+			Actions: []*routepb.RateLimit_Action{
+				{
+					ActionSpecifier: &routepb.RateLimit_Action_GenericKey_{
+						GenericKey: &routepb.RateLimit_Action_GenericKey{
+							DescriptorKey:   "operation",
+							DescriptorValue: fmt.Sprintf("%s.%s", testApiName, operation),
+						},
+					},
+				},
+				consumerAction,
+			},
+		}
+	}
+	makeApiKeyAction := func(header string) *routepb.RateLimit_Action {
+		return &routepb.RateLimit_Action{
+			ActionSpecifier: &routepb.RateLimit_Action_RequestHeaders_{
+				RequestHeaders: &routepb.RateLimit_Action_RequestHeaders{
+					HeaderName:    header,
+					DescriptorKey: "api_key",
+				},
+			},
+		}
+	}
+	jwtSubjectAction := &routepb.RateLimit_Action{
+		ActionSpecifier: &routepb.RateLimit_Action_Metadata{
+			Metadata: &routepb.RateLimit_Action_MetaData{
+				DescriptorKey: "jwt_subject",
+				MetadataKey: &metadatapb.MetadataKey{
+					Key: "envoy.filters.http.jwt_authn",
+					Path: []*metadatapb.MetadataKey_PathSegment{
+						{
+							Segment: &metadatapb.MetadataKey_PathSegment_Key{
+								Key: "jwt_payloads",
+							},
+						},
+						{
+							Segment: &metadatapb.MetadataKey_PathSegment_Key{
+								Key: "sub",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	clientIpAction := &routepb.RateLimit_Action{
+		ActionSpecifier: &routepb.RateLimit_Action_RemoteAddress_{
+			RemoteAddress: &routepb.RateLimit_Action_RemoteAddress{},
+		},
+	}
+
+	testData := []struct {
+		desc                    string
+		rateLimitServiceAddress string
+		rateLimitConsumer       string
+		wantRateLimits          map[string][]*routepb.RateLimit
+		wantError               string
+	}{
+		{
+			desc:              "No rate limits without rate limit service",
+			rateLimitConsumer: "api_key",
+			wantRateLimits: map[string][]*routepb.RateLimit{
+				"ListShelves": nil,
+				"CreateShelf": nil,
+			},
+		},
+		{
+			desc:                    "API key from the default or the custom headers",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8091",
+			rateLimitConsumer:       "api_key",
+			wantRateLimits: map[string][]*routepb.RateLimit{
+				"ListShelves": {
+					makeRateLimit("ListShelves", makeApiKeyAction("x-api-key")),
+				},
+				"CreateShelf": {
+					makeRateLimit("CreateShelf", makeApiKeyAction("x-custom-key")),
+				},
+			},
+		},
+		{
+			desc:                    "JWT subject from the JWT payload",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8091",
+			rateLimitConsumer:       "jwt_subject",
+			wantRateLimits: map[string][]*routepb.RateLimit{
+				"ListShelves": {
+					makeRateLimit("ListShelves", jwtSubjectAction),
+				},
+				"CreateShelf": {
+					makeRateLimit("CreateShelf", jwtSubjectAction),
+				},
+			},
+		},
+		{
+			desc:                    "Client IP from the remote address",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8091",
+			rateLimitConsumer:       "client_ip",
+			wantRateLimits: map[string][]*routepb.RateLimit{
+				"ListShelves": {
+					makeRateLimit("ListShelves", clientIpAction),
+				},
+				"CreateShelf": {
+					makeRateLimit("CreateShelf", clientIpAction),
+				},
+			},
+		},
+		{
+			desc:                    "Fail with unknown consumer",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8091",
+			rateLimitConsumer:       "project",
+			wantError:               `rate_limit_consumer must be one of "api_key", "jwt_subject" or "client_ip", got "project"`,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.RateLimitServiceAddress = tc.rateLimitServiceAddress
+		opts.RateLimitConsumer = tc.rateLimitConsumer
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%s): MakeRouteConfig got error: %v", tc.desc, err)
+		}
+
+		for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+			if route.GetRoute() == nil {
+				continue
+			}
+			shortName := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+			wantRateLimits, ok := tc.wantRateLimits[shortName]
+			if !ok {
+				t.Errorf("Test (%s): got unexpected route for operation (%v)", tc.desc, route.GetDecorator().GetOperation())
+				continue
+			}
+			gotRateLimits := route.GetRoute().GetRateLimits()
+			if len(gotRateLimits) != len(wantRateLimits) {
+				t.Errorf("Test (%s): got RateLimits for %v: %v, want: %v", tc.desc, shortName, gotRateLimits, wantRateLimits)
+				continue
+			}
+			for idx, want := range wantRateLimits {
+				if !proto.Equal(gotRateLimits[idx], want) {
+					t.Errorf("Test (%s): got RateLimits(%v) for %v: %v, want: %v", tc.desc, idx, shortName, gotRateLimits[idx], want)
+				}
+			}
+		}
+	}
+}
+
 // Used to generate a oversize cors origin regex or a oversize wildcard uri template.
 func getOverSizeRegexForTest() string {
 	overSizeRegex := ""
@@ -3476,3 +4061,476 @@ func getOverSizeRegexForTest() string {
 	}
 	return overSizeRegex
 }
+
+func TestRequestBodySchemaMetadata(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:           "ListShelves",
+						RequestTypeUrl: "type.googleapis.com/google.protobuf.Empty",
+					},
+					{
+						Name:           "CreateShelf",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves",
+					},
+					Body: "*",
+				},
+			},
+		},
+		Types: []*ptypepb.Type{
+			{
+				Name: "endpoints.examples.bookstore.Shelf",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "theme",
+						JsonName: "theme",
+						Kind:     ptypepb.Field_TYPE_STRING,
+					},
+				},
+			},
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.EnableRequestValidation = true
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatalf("MakeRouteConfig got error: %v", err)
+	}
+
+	wantSchemas := map[string]string{
+		"ListShelves": "",
+		"CreateShelf": `{"body":{"kind":"message","type":"endpoints.examples.bookstore.Shelf"},"types":{"endpoints.examples.bookstore.Shelf":[{"name":"theme","jsonName":"theme","kind":"string"}]}}`,
+	}
+	for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+		if route.GetRoute() == nil {
+			continue
+		}
+		shortName := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+		wantSchema, ok := wantSchemas[shortName]
+		if !ok {
+			t.Errorf("got unexpected route for operation (%v)", route.GetDecorator().GetOperation())
+			continue
+		}
+		gotSchema := route.GetMetadata().GetFilterMetadata()[util.Lua].GetFields()[util.RequestBodySchemaMetadataKey].GetStringValue()
+		if gotSchema != wantSchema {
+			t.Errorf("Test (%v): got request body schema: %s, want: %s", shortName, gotSchema, wantSchema)
+		}
+	}
+}
+
+func TestOpenApiDocRoute(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+			},
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.OpenApiDocPath = "/openapi.json"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatalf("MakeRouteConfig got error: %v", err)
+	}
+
+	// The fallback routes are direct responses as well, but not 200.
+	var gotPaths []string
+	for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+		if route.GetDirectResponse().GetStatus() != http.StatusOK {
+			continue
+		}
+		if route.GetDirectResponse().GetBody() != nil {
+			t.Errorf("got OpenAPI document route with body: %v, want the body set by the local reply mapper", route.GetDirectResponse().GetBody())
+		}
+		gotPaths = append(gotPaths, route.GetMatch().GetPath())
+	}
+	wantPaths := []string{"/openapi.json", "/openapi.json/"}
+	if !reflect.DeepEqual(gotPaths, wantPaths) {
+		t.Errorf("got OpenAPI document route paths: %v, want: %v", gotPaths, wantPaths)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	idempotentOption, _ := ptypes.MarshalAny(&ptypepb.EnumValue{Name: "IDEMPOTENT", Number: 2})
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+					{
+						Name: "UpdateShelf",
+						Options: []*ptypepb.Option{
+							{
+								Name:  "idempotency_level",
+								Value: idempotentOption,
+							},
+						},
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.UpdateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Patch{
+						Patch: "/v1/shelves/{shelf}",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc              string
+		setOpts           func(opts *options.ConfigGeneratorOptions)
+		wantRetryPolicies map[string]string
+		wantError         string
+	}{
+		{
+			desc:    "Global retry policy by default",
+			setOpts: func(opts *options.ConfigGeneratorOptions) {},
+			wantRetryPolicies: map[string]string{
+				"ListShelves": `{"retryOn":"reset,connect-failure,refused-stream","numRetries":1}`,
+				"CreateShelf": `{"retryOn":"reset,connect-failure,refused-stream","numRetries":1}`,
+				"UpdateShelf": `{"retryOn":"reset,connect-failure,refused-stream","numRetries":1}`,
+			},
+		},
+		{
+			desc: "Retry policies by the idempotency of the calls",
+			setOpts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryMode = "idempotent"
+				opts.BackendRetryNum = 2
+			},
+			wantRetryPolicies: map[string]string{
+				"ListShelves": `{"retryOn":"reset,connect-failure,refused-stream,5xx,unavailable","numRetries":2}`,
+				"CreateShelf": `{"retryOn":"connect-failure,refused-stream","numRetries":2}`,
+				"UpdateShelf": `{"retryOn":"reset,connect-failure,refused-stream,5xx,unavailable","numRetries":2}`,
+			},
+		},
+		{
+			desc: "Retry policies with status codes, backoff and previous hosts",
+			setOpts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryMode = "idempotent"
+				opts.BackendRetriableStatusCodes = "409, 429"
+				opts.BackendRetryBaseInterval = 100 * time.Millisecond
+				opts.BackendRetryMaxInterval = time.Second
+				opts.BackendRetryPreviousHosts = true
+			},
+			wantRetryPolicies: map[string]string{
+				"ListShelves": `{
+					"retryOn":"reset,connect-failure,refused-stream,5xx,unavailable,retriable-status-codes",
+					"numRetries":1,
+					"retriableStatusCodes":[409,429],
+					"retryBackOff":{"baseInterval":"0.100s","maxInterval":"1s"},
+					"retryHostPredicate":[{"name":"envoy.retry_host_predicates.previous_hosts"}],
+					"hostSelectionRetryMaxAttempts":"5"
+				}`,
+				"CreateShelf": `{
+					"retryOn":"connect-failure,refused-stream",
+					"numRetries":1,
+					"retriableStatusCodes":[409,429],
+					"retryBackOff":{"baseInterval":"0.100s","maxInterval":"1s"},
+					"retryHostPredicate":[{"name":"envoy.retry_host_predicates.previous_hosts"}],
+					"hostSelectionRetryMaxAttempts":"5"
+				}`,
+			},
+		},
+		{
+			desc: "Failure with an unknown retry mode",
+			setOpts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryMode = "always"
+			},
+			wantError: `backend_retry_mode must be either "global" or "idempotent", got "always"`,
+		},
+		{
+			desc: "Failure with an invalid status code",
+			setOpts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetriableStatusCodes = "503,5xx"
+			},
+			wantError: `invalid retriable status code "5xx"`,
+		},
+		{
+			desc: "Failure with the max interval less than the base interval",
+			setOpts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryBaseInterval = time.Second
+				opts.BackendRetryMaxInterval = 100 * time.Millisecond
+			},
+			wantError: "backend_retry_max_interval (100ms) must not be less than backend_retry_base_interval (1s)",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		tc.setOpts(&opts)
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatalf("Test (%v): %v", tc.desc, err)
+		}
+
+		gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%v): got err: %v, want err: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test (%v): MakeRouteConfig got error: %v", tc.desc, err)
+		}
+
+		for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+			if route.GetRoute() == nil {
+				continue
+			}
+			shortName := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+			wantRetryPolicy, ok := tc.wantRetryPolicies[shortName]
+			if !ok {
+				continue
+			}
+			gotRetryPolicy, err := util.ProtoToJson(route.GetRoute().GetRetryPolicy())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(wantRetryPolicy, gotRetryPolicy); err != nil {
+				t.Errorf("Test (%v): got different retry policy for %v, %v", tc.desc, shortName, err)
+			}
+		}
+	}
+}
+
+func TestOperationCorsPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cors_policies")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	policiesFile := filepath.Join(dir, "policies.json")
+	policies := `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin": "https://app.example.com", "allow_methods": "POST", "allow_credentials": true}]}`
+	if err := ioutil.WriteFile(policiesFile, []byte(policies), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves/{shelf}",
+					},
+				},
+			},
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.CorsPreset = "basic"
+	opts.CorsAllowOrigin = "*"
+	opts.CorsPoliciesFile = policiesFile
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatalf("MakeRouteConfig got error: %v", err)
+	}
+
+	wantOperationCors := `{
+		"allowOriginStringMatch": [{"exact": "https://app.example.com"}],
+		"allowMethods": "POST",
+		"allowCredentials": true
+	}`
+	wantCors := map[string]string{
+		"ListShelves": "",
+		"CreateShelf": wantOperationCors,
+		fmt.Sprintf("%s_CORS_CreateShelf", util.AutogeneratedOperationPrefix): wantOperationCors,
+	}
+	gotOperations := map[string]bool{}
+	for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+		shortName := strings.TrimPrefix(route.GetDecorator().GetOperation(), util.SpanNamePrefix+" ")
+		want, ok := wantCors[shortName]
+		if !ok || route.GetRoute() == nil {
+			continue
+		}
+		gotOperations[shortName] = true
+
+		if want == "" {
+			if route.GetRoute().GetCors() != nil {
+				t.Errorf("got unexpected CORS policy for %v: %v", shortName, route.GetRoute().GetCors())
+			}
+			continue
+		}
+		gotCors, err := util.ProtoToJson(route.GetRoute().GetCors())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(want, gotCors); err != nil {
+			t.Errorf("got different CORS policy for %v, %v", shortName, err)
+		}
+	}
+	if len(gotOperations) != len(wantCors) {
+		t.Errorf("got routes of operations: %v, want routes of: %v", gotOperations, wantCors)
+	}
+
+	// The global policy stays on the virtual host.
+	gotHostCors, _ := util.ProtoToJson(gotRoute.GetVirtualHosts()[0].GetCors())
+	if err := util.JsonEqual(`{"allowOriginStringMatch": [{"exact": "*"}], "allowCredentials": false}`, gotHostCors); err != nil {
+		t.Errorf("got different virtual host CORS policy, %v", err)
+	}
+}
+
+func TestMakeRouteConfigForExtAuthz(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+			},
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.CorsPreset = "basic"
+	opts.CorsAllowOrigin = "*"
+	opts.ExtAuthzAddress = "grpc://authz.example.com:8080"
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatalf("MakeRouteConfig got error: %v", err)
+	}
+
+	// The backend routes get the per-route config of the operations from the
+	// filter generators, while the CORS, 405 and 404 routes have it disabled.
+	wantDisabled := `{
+		"@type": "type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthzPerRoute",
+		"disabled": true
+	}`
+	catchAllRoutes := 0
+	for _, route := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+		extAuthz := route.GetTypedPerFilterConfig()[util.ExtAuthz]
+		if route.GetDecorator().GetOperation() == fmt.Sprintf("%s ListShelves", util.SpanNamePrefix) {
+			if extAuthz != nil {
+				t.Errorf("got ext_authz per-route config: %v on the backend route", extAuthz)
+			}
+			continue
+		}
+		catchAllRoutes++
+		gotExtAuthz, err := util.ProtoToJson(extAuthz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(wantDisabled, gotExtAuthz); err != nil {
+			t.Errorf("got different ext_authz per-route config for route %v, %v", route.GetMatch(), err)
+		}
+	}
+	// The CORS preflight, malformed preflight, two 405 (with and without the
+	// trailing slash) and 404 routes.
+	if catchAllRoutes != 5 {
+		t.Errorf("got %d routes other than the backend one, want 5", catchAllRoutes)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+// MakeSecrets loads the SDS secrets referenced by the transport sockets of the
+// clusters and the listeners, sorted by name.
+func MakeSecrets(clusters []*clusterpb.Cluster, listeners []*listenerpb.Listener) ([]*tlspb.Secret, error) {
+	var transportSockets []*corepb.TransportSocket
+	for _, cluster := range clusters {
+		if cluster.GetTransportSocket() != nil {
+			transportSockets = append(transportSockets, cluster.GetTransportSocket())
+		}
+	}
+	for _, listener := range listeners {
+		for _, filterChain := range listener.GetFilterChains() {
+			if filterChain.GetTransportSocket() != nil {
+				transportSockets = append(transportSockets, filterChain.GetTransportSocket())
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, transportSocket := range transportSockets {
+		socketNames, err := util.SdsSecretNames(transportSocket)
+		if err != nil {
+			return nil, fmt.Errorf("fail to get SDS secret names: %v", err)
+		}
+		for _, name := range socketNames {
+			names[name] = true
+		}
+	}
+
+	var sortedNames []string
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	var secrets []*tlspb.Secret
+	for _, name := range sortedNames {
+		secret, err := util.MakeSdsSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
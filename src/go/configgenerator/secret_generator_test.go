@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+)
+
+func TestMakeSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"server.crt", "server.key", "client.crt", "client.key", "ca.pem"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootCertsPath := filepath.Join(dir, "ca.pem")
+
+	makeCluster := func(sslClientPath string, useSds bool) *clusterpb.Cluster {
+		transportSocket, err := util.CreateUpstreamTransportSocket("example.com", rootCertsPath, sslClientPath, nil, "", useSds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &clusterpb.Cluster{TransportSocket: transportSocket}
+	}
+	makeListener := func(sslServerPath string) *listenerpb.Listener {
+		transportSocket, err := util.CreateDownstreamTransportSocket(sslServerPath, "", "", "", "", false, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &listenerpb.Listener{
+			FilterChains: []*listenerpb.FilterChain{
+				{TransportSocket: transportSocket},
+			},
+		}
+	}
+
+	testData := []struct {
+		desc      string
+		clusters  []*clusterpb.Cluster
+		listeners []*listenerpb.Listener
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			desc:     "No secrets without SDS",
+			clusters: []*clusterpb.Cluster{makeCluster("", false), {}},
+		},
+		{
+			desc:      "Secrets shared by the clusters are loaded once",
+			clusters:  []*clusterpb.Cluster{makeCluster("", true), makeCluster(dir, true), {}},
+			listeners: []*listenerpb.Listener{makeListener(dir)},
+			wantNames: []string{
+				util.TlsCertificateSecretName(filepath.Join(dir, "client")),
+				util.TlsCertificateSecretName(filepath.Join(dir, "server")),
+				util.ValidationContextSecretName(rootCertsPath),
+			},
+		},
+		{
+			desc:      "Fail with missing files",
+			listeners: []*listenerpb.Listener{makeListener(filepath.Join(dir, "missing"))},
+			wantErr:   "fail to read TLS file of SDS secret",
+		},
+	}
+
+	for _, tc := range testData {
+		secrets, err := MakeSecrets(tc.clusters, tc.listeners)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		var gotNames []string
+		for _, secret := range secrets {
+			gotNames = append(gotNames, secret.GetName())
+		}
+		if !reflect.DeepEqual(gotNames, tc.wantNames) {
+			t.Errorf("Test (%s): got secrets: %v, want: %v", tc.desc, gotNames, tc.wantNames)
+		}
+	}
+}
@@ -40,6 +40,27 @@ type MethodInfo struct {
 	MetricCosts        []*scpb.MetricCost
 	// All non-unary gRPC methods are considered streaming.
 	IsStreaming bool
+	// Whether the idempotency_level option of the gRPC method declares it
+	// idempotent or free of side effects, so it is safe to retry.
+	IsIdempotent bool
+
+	// OAuth scopes of the method, one of which the JWT scope or scp claim
+	// must contain.
+	CanonicalScopes []string
+	// JWT claims required to call the method, all of which must match.
+	ClaimRequirements []*ClaimRequirement
+	// JWT claims forwarded to the backend as request headers.
+	ClaimsToHeaders []*ClaimToHeader
+	// The subject alternative names of the client certificates allowed to
+	// call the method, matched by prefix if ending with '*'.
+	AllowedClientSans []string
+	// The CORS policy overriding the global one of the --cors_* flags.
+	CorsPolicy *CorsPolicy
+	// Whether the requests are checked by the external authorization service.
+	RequireExtAuthz bool
+	// The schema of the JSON request body, generated from the request type.
+	// Empty if the request body is not validated.
+	RequestBodySchema string
 
 	// The request type name (not the entire type URL).
 	RequestTypeName string
@@ -74,6 +95,54 @@ type backendInfo struct {
 	RetryNum uint
 }
 
+// ClaimRequirement is a JWT claim required to call a method. The claim
+// matches with exactly one of Values, Contains or PathVariable.
+type ClaimRequirement struct {
+	// Name of the claim. Nested claims are separated by '.', such as "org.id".
+	Name string `json:"name"`
+	// The claim is a string equal to one of the values.
+	Values []string `json:"values"`
+	// The claim is a space-separated string containing the word, such as
+	// "scope", or a list containing the item.
+	Contains string `json:"contains"`
+	// The claim is equal to the variable of the request path, which must bind
+	// a single segment in all of the http rules of the method. The variable
+	// is named by the JSON name of the field, such as "tenantId".
+	PathVariable string `json:"path_variable"`
+}
+
+// CorsPolicy is the CORS policy of an operation, applied to its routes and
+// the routes of its auto-generated OPTIONS method. Exactly one of AllowOrigin
+// and AllowOriginRegex is set.
+type CorsPolicy struct {
+	Selector         string `json:"selector"`
+	AllowOrigin      string `json:"allow_origin"`
+	AllowOriginRegex string `json:"allow_origin_regex"`
+	AllowMethods     string `json:"allow_methods"`
+	AllowHeaders     string `json:"allow_headers"`
+	ExposeHeaders    string `json:"expose_headers"`
+	AllowCredentials bool   `json:"allow_credentials"`
+}
+
+// sameAs tells if the policies allow the same requests, regardless of their
+// selectors. No policy is only the same as no policy.
+func (p *CorsPolicy) sameAs(other *CorsPolicy) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	policy, otherPolicy := *p, *other
+	policy.Selector, otherPolicy.Selector = "", ""
+	return policy == otherPolicy
+}
+
+// ClaimToHeader forwards a claim of the verified JWT to the backend as a
+// request header.
+type ClaimToHeader struct {
+	// Name of the claim. Nested claims are separated by '.', such as "org.id".
+	ClaimName  string
+	HeaderName string
+}
+
 type SnakeToJsonSegments = map[string]string
 
 func (m *MethodInfo) Operation() string {
@@ -0,0 +1,394 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	typepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+const (
+	openApiVersion         = "3.0.3"
+	openApiSchemaRefPrefix = "#/components/schemas/"
+)
+
+var (
+	// uriTemplateVariableRegex matches the variables of the URI templates,
+	// {var} or {var=pattern}, which are only {var} in OpenAPI paths.
+	uriTemplateVariableRegex = regexp.MustCompile(`\{([^}=]+)(=[^}]*)?\}`)
+
+	// The HTTP methods of the OpenAPI path items. HTTP rules of the other
+	// custom methods are not in the document.
+	openApiHttpMethods = map[string]bool{
+		util.GET:     true,
+		util.PUT:     true,
+		util.POST:    true,
+		util.DELETE:  true,
+		util.PATCH:   true,
+		util.OPTIONS: true,
+		"HEAD":       true,
+	}
+)
+
+type openApiObject map[string]interface{}
+
+// processOpenApiDoc generates the OpenAPI v3 document of the HTTP rules of
+// the service, served by the auto-generated OpenApiDoc operation.
+func (s *ServiceInfo) processOpenApiDoc() error {
+	if s.Options.OpenApiDocPath == "" {
+		return nil
+	}
+
+	b := &requestBodySchemaBuilder{
+		typesByTypeName: make(map[string]*typepb.Type),
+		enumsByTypeName: make(map[string]*typepb.Enum),
+		schema: &requestBodySchema{
+			Types: make(map[string][]*fieldSchema),
+			Enums: make(map[string][]string),
+		},
+	}
+	for _, t := range s.ServiceConfig().GetTypes() {
+		b.typesByTypeName[t.GetName()] = t
+	}
+	for _, e := range s.ServiceConfig().GetEnums() {
+		b.enumsByTypeName[e.GetName()] = e
+	}
+
+	responseTypeNames := make(map[string]string)
+	for _, api := range s.ServiceConfig().GetApis() {
+		for _, method := range api.GetMethods() {
+			responseTypeNames[fmt.Sprintf("%s.%s", api.GetName(), method.GetName())] = strings.TrimPrefix(method.GetResponseTypeUrl(), util.TypeUrlPrefix)
+		}
+	}
+
+	providerIdsBySelector := make(map[string][]string)
+	for _, rule := range s.ServiceConfig().GetAuthentication().GetRules() {
+		for _, requirement := range rule.GetRequirements() {
+			providerIdsBySelector[rule.GetSelector()] = append(providerIdsBySelector[rule.GetSelector()], requirement.GetProviderId())
+		}
+	}
+
+	securitySchemes := make(map[string]openApiObject)
+	for _, provider := range s.ServiceConfig().GetAuthentication().GetProviders() {
+		scheme := openApiObject{
+			"type":               "http",
+			"scheme":             "bearer",
+			"bearerFormat":       "JWT",
+			"x-google-issuer":    provider.GetIssuer(),
+			"x-google-jwks_uri":  provider.GetJwksUri(),
+			"x-google-audiences": provider.GetAudiences(),
+		}
+		if provider.GetAudiences() == "" {
+			delete(scheme, "x-google-audiences")
+		}
+		securitySchemes[provider.GetId()] = scheme
+	}
+
+	paths := make(map[string]openApiObject)
+	addRule := func(rule *annotationspb.HttpRule, selector string) error {
+		httpMethod, path, err := httpRuleMethodAndPath(rule)
+		if err != nil {
+			return fmt.Errorf("error processing OpenAPI document for operation (%v): %v", selector, err)
+		}
+		if !openApiHttpMethods[httpMethod] {
+			return nil
+		}
+		method, err := s.getMethod(selector)
+		if err != nil {
+			return fmt.Errorf("error processing OpenAPI document for operation (%v): %v", selector, err)
+		}
+		operation, err := b.makeOpenApiOperation(method, path, rule.GetBody(), responseTypeNames[selector])
+		if err != nil {
+			return fmt.Errorf("error processing OpenAPI document for operation (%v): %v", selector, err)
+		}
+		if security := s.makeOpenApiSecurity(method, providerIdsBySelector[selector], securitySchemes); len(security) > 0 {
+			operation["security"] = security
+		}
+
+		openApiPath := uriTemplateVariableRegex.ReplaceAllString(path, "{$1}")
+		if _, ok := paths[openApiPath]; !ok {
+			paths[openApiPath] = make(openApiObject)
+		}
+		paths[openApiPath][strings.ToLower(httpMethod)] = operation
+		return nil
+	}
+	for _, rule := range s.ServiceConfig().GetHttp().GetRules() {
+		if err := addRule(rule, rule.GetSelector()); err != nil {
+			return err
+		}
+		for _, additionalRule := range rule.GetAdditionalBindings() {
+			if err := addRule(additionalRule, rule.GetSelector()); err != nil {
+				return err
+			}
+		}
+	}
+
+	schemas := make(map[string]openApiObject)
+	for typeName, fields := range b.schema.Types {
+		schemas[typeName] = makeOpenApiMessageSchema(fields, b.schema.Enums)
+	}
+
+	title := s.ServiceConfig().GetTitle()
+	if title == "" {
+		title = s.Name
+	}
+	info := openApiObject{
+		"title":   title,
+		"version": s.ConfigID,
+	}
+	if summary := s.ServiceConfig().GetDocumentation().GetSummary(); summary != "" {
+		info["description"] = summary
+	}
+
+	components := openApiObject{}
+	if len(schemas) > 0 {
+		components["schemas"] = schemas
+	}
+	if len(securitySchemes) > 0 {
+		components["securitySchemes"] = securitySchemes
+	}
+	doc := openApiObject{
+		"openapi": openApiVersion,
+		"info":    info,
+		"paths":   paths,
+	}
+	if len(components) > 0 {
+		doc["components"] = components
+	}
+
+	docJson, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("fail to marshal OpenAPI document: %v", err)
+	}
+	s.OpenApiDoc = string(docJson)
+	return nil
+}
+
+func (b *requestBodySchemaBuilder) makeOpenApiOperation(method *MethodInfo, path, body, responseTypeName string) (openApiObject, error) {
+	operation := openApiObject{
+		"operationId": method.Operation(),
+	}
+
+	requestType := b.typesByTypeName[method.RequestTypeName]
+
+	uriTemplate, err := httppattern.ParseUriTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	var parameters []openApiObject
+	seenParameters := make(map[string]bool)
+	for _, variable := range uriTemplate.Variables {
+		name := strings.Join(variable.FieldPath, ".")
+		if seenParameters[name] {
+			continue
+		}
+		seenParameters[name] = true
+
+		schema := openApiObject{"type": "string"}
+		for _, field := range requestType.GetFields() {
+			if len(variable.FieldPath) == 1 && field.GetName() == name {
+				fs := b.makeFieldSchema(field)
+				schema = makeOpenApiSchema(fs, b.schema.Enums)
+			}
+		}
+		parameters = append(parameters, openApiObject{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   schema,
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	var bodySchema *fieldSchema
+	if body == "*" {
+		bodySchema = b.messageSchema(method.RequestTypeName)
+	} else if body != "" && requestType == nil {
+		// Not able to describe the unknown types.
+		bodySchema = &fieldSchema{Kind: "object"}
+	} else if body != "" {
+		for _, field := range requestType.GetFields() {
+			if field.GetName() == body {
+				bodySchema = b.makeFieldSchema(field)
+			}
+		}
+		if bodySchema == nil {
+			return nil, fmt.Errorf("body field (%s) is not defined in request type (%s)", body, method.RequestTypeName)
+		}
+	}
+	if bodySchema != nil {
+		operation["requestBody"] = openApiObject{
+			"content": openApiObject{
+				"application/json": openApiObject{
+					"schema": makeOpenApiSchema(bodySchema, b.schema.Enums),
+				},
+			},
+		}
+	}
+
+	response := openApiObject{
+		"description": "A successful response.",
+	}
+	if responseTypeName != "" {
+		response["content"] = openApiObject{
+			"application/json": openApiObject{
+				"schema": makeOpenApiSchema(b.messageSchema(responseTypeName), b.schema.Enums),
+			},
+		}
+	}
+	operation["responses"] = openApiObject{
+		"200": response,
+	}
+	return operation, nil
+}
+
+// makeOpenApiSecurity makes the alternatives of the security requirements:
+// a JWT of any of the providers, and an API key at any of the locations
+// unless the operation allows unregistered calls.
+func (s *ServiceInfo) makeOpenApiSecurity(method *MethodInfo, providerIds []string, securitySchemes map[string]openApiObject) []openApiObject {
+	var jwtSchemes []string
+	if method.RequireAuth {
+		jwtSchemes = providerIds
+	}
+
+	var apiKeySchemes []string
+	if !method.AllowUnregisteredCalls && !method.SkipServiceControl && !s.Options.SkipServiceControlFilter {
+		apiKeyLocations := method.ApiKeyLocations
+		if len(apiKeyLocations) == 0 {
+			apiKeyLocations = []*scpb.ApiKeyLocation{
+				{Key: &scpb.ApiKeyLocation_Query{Query: util.DefaultApiKeyQueryParamKey}},
+				{Key: &scpb.ApiKeyLocation_Query{Query: util.DefaultApiKeyQueryParamApiKey}},
+				{Key: &scpb.ApiKeyLocation_Header{Header: util.DefaultApiKeyHeaderName}},
+			}
+		}
+		for _, location := range apiKeyLocations {
+			var in, name string
+			switch location.GetKey().(type) {
+			case *scpb.ApiKeyLocation_Query:
+				in, name = "query", location.GetQuery()
+			case *scpb.ApiKeyLocation_Header:
+				in, name = "header", location.GetHeader()
+			case *scpb.ApiKeyLocation_Cookie:
+				in, name = "cookie", location.GetCookie()
+			default:
+				continue
+			}
+			schemeName := fmt.Sprintf("api_key_%s_%s", in, name)
+			securitySchemes[schemeName] = openApiObject{
+				"type": "apiKey",
+				"in":   in,
+				"name": name,
+			}
+			apiKeySchemes = append(apiKeySchemes, schemeName)
+		}
+	}
+
+	var security []openApiObject
+	switch {
+	case len(jwtSchemes) > 0 && len(apiKeySchemes) > 0:
+		for _, jwtScheme := range jwtSchemes {
+			for _, apiKeyScheme := range apiKeySchemes {
+				security = append(security, openApiObject{
+					jwtScheme:    []string{},
+					apiKeyScheme: []string{},
+				})
+			}
+		}
+	case len(jwtSchemes) > 0:
+		for _, jwtScheme := range jwtSchemes {
+			security = append(security, openApiObject{jwtScheme: []string{}})
+		}
+	case len(apiKeySchemes) > 0:
+		for _, apiKeyScheme := range apiKeySchemes {
+			security = append(security, openApiObject{apiKeyScheme: []string{}})
+		}
+	}
+	return security
+}
+
+// messageSchema makes the schema of a message, not a field.
+func (b *requestBodySchemaBuilder) messageSchema(typeName string) *fieldSchema {
+	fs := &fieldSchema{}
+	b.setMessageKind(fs, typeName)
+	return fs
+}
+
+func makeOpenApiMessageSchema(fields []*fieldSchema, enums map[string][]string) openApiObject {
+	schema := openApiObject{"type": "object"}
+	properties := make(map[string]openApiObject)
+	var required []string
+	for _, field := range fields {
+		properties[field.JsonName] = makeOpenApiSchema(field, enums)
+		if field.Required {
+			required = append(required, field.JsonName)
+		}
+	}
+	if len(properties) > 0 {
+		schema["properties"] = properties
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// makeOpenApiSchema converts the field schema to the OpenAPI schema, which
+// follows the proto3 JSON mapping as well: the 64-bit integers are strings.
+func makeOpenApiSchema(fs *fieldSchema, enums map[string][]string) openApiObject {
+	var schema openApiObject
+	switch fs.Kind {
+	case "message":
+		schema = openApiObject{"$ref": openApiSchemaRefPrefix + fs.Type}
+	case "enum":
+		schema = openApiObject{"type": "string", "enum": enums[fs.Type]}
+	case "object":
+		schema = openApiObject{"type": "object"}
+		if fs.MapValue != nil {
+			schema["additionalProperties"] = makeOpenApiSchema(fs.MapValue, enums)
+		}
+	case "array":
+		schema = openApiObject{"type": "array", "items": openApiObject{}}
+	case "string":
+		schema = openApiObject{"type": "string"}
+	case "bytes":
+		schema = openApiObject{"type": "string", "format": "byte"}
+	case "bool":
+		schema = openApiObject{"type": "boolean"}
+	case "double", "float":
+		schema = openApiObject{"type": "number", "format": fs.Kind}
+	case "int32", "uint32":
+		schema = openApiObject{"type": "integer", "format": fs.Kind}
+	case "int64", "uint64":
+		schema = openApiObject{"type": "string", "format": fs.Kind}
+	default:
+		schema = openApiObject{}
+	}
+
+	if fs.Repeated {
+		return openApiObject{"type": "array", "items": schema}
+	}
+	return schema
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	typepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+const (
+	fieldBehaviorOptionName  = "google.api.field_behavior"
+	fieldBehaviorRequired    = "REQUIRED"
+	fieldBehaviorRequiredNum = 2
+)
+
+var (
+	// The schema kinds of the scalar field kinds, following the proto3 JSON
+	// mapping: the fixed and signed integers are checked as the plain ones.
+	scalarSchemaKinds = map[typepb.Field_Kind]string{
+		typepb.Field_TYPE_DOUBLE:   "double",
+		typepb.Field_TYPE_FLOAT:    "float",
+		typepb.Field_TYPE_INT64:    "int64",
+		typepb.Field_TYPE_UINT64:   "uint64",
+		typepb.Field_TYPE_INT32:    "int32",
+		typepb.Field_TYPE_FIXED64:  "uint64",
+		typepb.Field_TYPE_FIXED32:  "uint32",
+		typepb.Field_TYPE_BOOL:     "bool",
+		typepb.Field_TYPE_STRING:   "string",
+		typepb.Field_TYPE_BYTES:    "bytes",
+		typepb.Field_TYPE_UINT32:   "uint32",
+		typepb.Field_TYPE_SFIXED32: "int32",
+		typepb.Field_TYPE_SFIXED64: "int64",
+		typepb.Field_TYPE_SINT32:   "int32",
+		typepb.Field_TYPE_SINT64:   "int64",
+	}
+
+	// The schema kinds of the well-known types with special JSON
+	// representations. "object", "array" and "any" values are not checked
+	// beyond their JSON types.
+	wellKnownTypeSchemaKinds = map[string]string{
+		"google.protobuf.Any":         "object",
+		"google.protobuf.BoolValue":   "bool",
+		"google.protobuf.BytesValue":  "bytes",
+		"google.protobuf.DoubleValue": "double",
+		"google.protobuf.Duration":    "string",
+		"google.protobuf.Empty":       "object",
+		"google.protobuf.FieldMask":   "string",
+		"google.protobuf.FloatValue":  "float",
+		"google.protobuf.Int32Value":  "int32",
+		"google.protobuf.Int64Value":  "int64",
+		"google.protobuf.ListValue":   "array",
+		"google.protobuf.StringValue": "string",
+		"google.protobuf.Struct":      "object",
+		"google.protobuf.Timestamp":   "string",
+		"google.protobuf.UInt32Value": "uint32",
+		"google.protobuf.UInt64Value": "uint64",
+		"google.protobuf.Value":       "any",
+	}
+)
+
+// requestBodySchema is the schema of a JSON request body, read by the
+// request validation script.
+type requestBodySchema struct {
+	// The schema of the whole body.
+	Body *fieldSchema `json:"body"`
+	// The fields bound by the path variables, in proto names relative to the
+	// body, which are not required in the body.
+	PathFields []string `json:"pathFields,omitempty"`
+	// The message types referenced by the body, by type name.
+	Types map[string][]*fieldSchema `json:"types,omitempty"`
+	// The enum value names, by enum type name.
+	Enums map[string][]string `json:"enums,omitempty"`
+}
+
+type fieldSchema struct {
+	Name     string `json:"name,omitempty"`
+	JsonName string `json:"jsonName,omitempty"`
+	// One of the scalar kinds, "enum", "message", "object", "array" or "any".
+	Kind string `json:"kind"`
+	// The type name of "message" and "enum" kinds.
+	Type     string `json:"type,omitempty"`
+	Repeated bool   `json:"repeated,omitempty"`
+	Required bool   `json:"required,omitempty"`
+	// The schema of the map values. The map keys are always strings in JSON.
+	MapValue *fieldSchema `json:"mapValue,omitempty"`
+}
+
+type requestBodySchemaBuilder struct {
+	typesByTypeName map[string]*typepb.Type
+	enumsByTypeName map[string]*typepb.Enum
+	schema          *requestBodySchema
+}
+
+// makeRequestBodySchema makes the schema of the request body selected by the
+// body field of the HTTP rule, "*" for the whole request message.
+func makeRequestBodySchema(requestType *typepb.Type, body string, pathFields []string, typesByTypeName map[string]*typepb.Type, enumsByTypeName map[string]*typepb.Enum) (string, error) {
+	b := &requestBodySchemaBuilder{
+		typesByTypeName: typesByTypeName,
+		enumsByTypeName: enumsByTypeName,
+		schema: &requestBodySchema{
+			Types: make(map[string][]*fieldSchema),
+			Enums: make(map[string][]string),
+		},
+	}
+
+	if body == "*" {
+		b.schema.Body = &fieldSchema{
+			Kind: "message",
+			Type: requestType.GetName(),
+		}
+		b.addType(requestType)
+		b.schema.PathFields = pathFields
+	} else {
+		for _, field := range requestType.GetFields() {
+			if field.GetName() == body {
+				b.schema.Body = b.makeFieldSchema(field)
+				break
+			}
+		}
+		if b.schema.Body == nil {
+			return "", fmt.Errorf("body field (%s) is not defined in request type (%s)", body, requestType.GetName())
+		}
+		// The body field itself is not in the body.
+		b.schema.Body.Name, b.schema.Body.JsonName, b.schema.Body.Required = "", "", false
+
+		prefix := body + "."
+		for _, pathField := range pathFields {
+			if strings.HasPrefix(pathField, prefix) {
+				b.schema.PathFields = append(b.schema.PathFields, strings.TrimPrefix(pathField, prefix))
+			}
+		}
+	}
+
+	schema, err := json.Marshal(b.schema)
+	if err != nil {
+		return "", fmt.Errorf("fail to marshal request body schema: %v", err)
+	}
+	return string(schema), nil
+}
+
+func (b *requestBodySchemaBuilder) addType(t *typepb.Type) {
+	if _, ok := b.schema.Types[t.GetName()]; ok {
+		return
+	}
+
+	// Added before the fields for the recursive types.
+	fields := []*fieldSchema{}
+	b.schema.Types[t.GetName()] = fields
+	for _, field := range t.GetFields() {
+		fields = append(fields, b.makeFieldSchema(field))
+	}
+	b.schema.Types[t.GetName()] = fields
+}
+
+func (b *requestBodySchemaBuilder) makeFieldSchema(field *typepb.Field) *fieldSchema {
+	fs := &fieldSchema{
+		Name:     field.GetName(),
+		JsonName: field.GetJsonName(),
+		Repeated: field.GetCardinality() == typepb.Field_CARDINALITY_REPEATED,
+		Required: isRequiredField(field),
+	}
+	if fs.JsonName == "" {
+		fs.JsonName = fs.Name
+	}
+
+	typeName := strings.TrimPrefix(field.GetTypeUrl(), util.TypeUrlPrefix)
+	switch field.GetKind() {
+	case typepb.Field_TYPE_ENUM:
+		if enum, ok := b.enumsByTypeName[typeName]; ok {
+			fs.Kind, fs.Type = "enum", typeName
+			if _, ok := b.schema.Enums[typeName]; !ok {
+				values := []string{}
+				for _, value := range enum.GetEnumvalue() {
+					values = append(values, value.GetName())
+				}
+				b.schema.Enums[typeName] = values
+			}
+		} else {
+			// Including google.protobuf.NullValue.
+			fs.Kind = "any"
+		}
+	case typepb.Field_TYPE_MESSAGE:
+		b.setMessageKind(fs, typeName)
+	default:
+		if kind, ok := scalarSchemaKinds[field.GetKind()]; ok {
+			fs.Kind = kind
+		} else {
+			fs.Kind = "any"
+		}
+	}
+	return fs
+}
+
+func (b *requestBodySchemaBuilder) setMessageKind(fs *fieldSchema, typeName string) {
+	if kind, ok := wellKnownTypeSchemaKinds[typeName]; ok {
+		fs.Kind = kind
+		return
+	}
+
+	t, ok := b.typesByTypeName[typeName]
+	if !ok {
+		// Not able to check the unknown types.
+		fs.Kind = "object"
+		return
+	}
+
+	if fs.Repeated && isMapEntry(t) {
+		fs.Repeated = false
+		fs.Kind = "object"
+		for _, entryField := range t.GetFields() {
+			if entryField.GetName() == "value" {
+				fs.MapValue = b.makeFieldSchema(entryField)
+				fs.MapValue.Name, fs.MapValue.JsonName = "", ""
+			}
+		}
+		return
+	}
+
+	fs.Kind, fs.Type = "message", typeName
+	b.addType(t)
+}
+
+func isMapEntry(t *typepb.Type) bool {
+	for _, opt := range t.GetOptions() {
+		if opt.GetName() == "map_entry" || opt.GetName() == "proto2.MessageOptions.map_entry" {
+			v := &wrapperspb.BoolValue{}
+			if err := ptypes.UnmarshalAny(opt.GetValue(), v); err == nil && v.GetValue() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRequiredField checks the google.api.field_behavior annotations of the
+// field, whose values are encoded as either enum names or numbers.
+func isRequiredField(field *typepb.Field) bool {
+	for _, opt := range field.GetOptions() {
+		if opt.GetName() != fieldBehaviorOptionName || opt.GetValue() == nil {
+			continue
+		}
+
+		var v ptypes.DynamicAny
+		if err := ptypes.UnmarshalAny(opt.GetValue(), &v); err != nil {
+			continue
+		}
+		switch m := v.Message.(type) {
+		case *wrapperspb.Int32Value:
+			if m.GetValue() == fieldBehaviorRequiredNum {
+				return true
+			}
+		case *wrapperspb.Int64Value:
+			if m.GetValue() == fieldBehaviorRequiredNum {
+				return true
+			}
+		case *wrapperspb.StringValue:
+			if m.GetValue() == fieldBehaviorRequired {
+				return true
+			}
+		case *typepb.EnumValue:
+			if m.GetName() == fieldBehaviorRequired || m.GetNumber() == fieldBehaviorRequiredNum {
+				return true
+			}
+		case *structpb.Value:
+			if isRequiredFieldBehaviorValue(m) {
+				return true
+			}
+		case *structpb.ListValue:
+			for _, value := range m.GetValues() {
+				if isRequiredFieldBehaviorValue(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func isRequiredFieldBehaviorValue(v *structpb.Value) bool {
+	switch v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return v.GetStringValue() == fieldBehaviorRequired
+	case *structpb.Value_NumberValue:
+		return v.GetNumberValue() == fieldBehaviorRequiredNum
+	case *structpb.Value_ListValue:
+		for _, value := range v.GetListValue().GetValues() {
+			if isRequiredFieldBehaviorValue(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -15,8 +15,14 @@
 package configinfo
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,11 +34,29 @@ import (
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/common"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
 	typepb "google.golang.org/genproto/protobuf/ptype"
 )
 
+const (
+	// The idempotency levels of google.protobuf.MethodOptions safe to retry.
+	idempotencyLevelOptionName  = "idempotency_level"
+	idempotencyNoSideEffects    = "NO_SIDE_EFFECTS"
+	idempotencyNoSideEffectsNum = 1
+	idempotencyIdempotent       = "IDEMPOTENT"
+	idempotencyIdempotentNum    = 2
+)
+
+var (
+	// headerNameRegex matches the HTTP header names allowed for JWT claims.
+	headerNameRegex = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+	// cookieNameRegex matches the cookie names allowed for JWT locations.
+	cookieNameRegex = regexp.MustCompile(`^[0-9A-Za-z_.-]+$`)
+)
+
 // ServiceInfo contains service level information.
 type ServiceInfo struct {
 	Name     string
@@ -69,6 +93,49 @@ type ServiceInfo struct {
 	GrpcSupportRequired   bool
 	LocalBackendCluster   *BackendRoutingCluster
 	RemoteBackendClusters []*BackendRoutingCluster
+
+	// JWKS of the authentication providers served locally instead of fetched
+	// from jwks_uri, provider ID -> JWKS.
+	LocalJwks map[string]string
+	// Files of LocalJwks watched for key rotation, provider ID -> file path.
+	LocalJwksFiles map[string]string
+	// Cookies carrying the JWT of the providers, provider ID -> cookie names.
+	// They are copied to the JwtCookieHeaderPrefix headers read by JWT Authn.
+	JwtCookies map[string][]string
+	// Request headers set from JWT claims, which are removed from the client
+	// requests to prevent spoofing.
+	ClaimHeaderNames []string
+
+	// The OpenAPI document served at OpenApiDocPath by the auto-generated
+	// operation.
+	OpenApiDoc          string
+	OpenApiDocOperation string
+
+	// Whether any operation has its own CORS policy.
+	HasCorsPolicies bool
+
+	// The formats of the local replies read from LocalReplyMappersFile, in
+	// the order of matching.
+	LocalReplyMappers []*LocalReplyMapper
+
+	// Why the service account key cannot mint the ID tokens of backend
+	// authentication, if it cannot.
+	backendAuthKeyErr error
+}
+
+// LocalReplyMapper is the format of the local replies with the status code
+// or the request content type, or both.
+type LocalReplyMapper struct {
+	StatusCode uint32 `json:"status_code"`
+	// Matched as the prefix of the request content-type header.
+	RequestContentType string `json:"request_content_type"`
+	// Exactly one of the text or the JSON object template, in the command
+	// operators of Envoy access logs such as %LOCAL_REPLY_BODY%.
+	TextFormat string          `json:"text_format"`
+	JsonFormat json.RawMessage `json:"json_format"`
+	// The response content type, which defaults to "text/plain" for the text
+	// format and "application/json" for the JSON format.
+	ContentType string `json:"content_type"`
 }
 
 type BackendRoutingCluster struct {
@@ -95,6 +162,9 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 		Options:                          opts,
 		Methods:                          make(map[string]*MethodInfo),
 		AllTranscodingIgnoredQueryParams: make(map[string]bool),
+		LocalJwks:                        make(map[string]string),
+		LocalJwksFiles:                   make(map[string]string),
+		JwtCookies:                       make(map[string][]string),
 	}
 
 	// Calling order is required due to following variable usage
@@ -120,9 +190,16 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	if err := serviceInfo.processQuota(); err != nil {
 		return nil, err
 	}
+	serviceInfo.checkQuotaEnforcement()
 	if err := serviceInfo.processBackendRule(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processCorsPolicies(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processLocalReplyMappers(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processHttpRule(); err != nil {
 		return nil, err
 	}
@@ -134,6 +211,9 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	if err := serviceInfo.processTypes(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processRequestValidation(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.addGrpcHttpRules(); err != nil {
 		return nil, err
 	}
@@ -144,15 +224,37 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 		return nil, err
 	}
 
+	if err := serviceInfo.processLocalJwks(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processEmptyJwksUriByOpenID(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processJwtCookieLocations(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processLocalBackendOperations(); err != nil {
 		return nil, err
 	}
 	if err := serviceInfo.processAuthRequirement(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processJwtClaimRules(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processJwtClaimsToHeaders(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processClientCertRules(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processExtAuthz(); err != nil {
+		return nil, err
+	}
+	// Must be the last, as the document reflects all of the above.
+	if err := serviceInfo.processOpenApiDoc(); err != nil {
+		return nil, err
+	}
 
 	return serviceInfo, nil
 }
@@ -188,9 +290,111 @@ func (s *ServiceInfo) ServiceConfig() *confpb.Service {
 	return s.serviceConfig
 }
 
+// processLocalJwks finds the providers with local JWKS, from the files set by
+// the flag, the file:// jwks_uri, or the inline JWKS object in jwks_uri.
+func (s *ServiceInfo) processLocalJwks() error {
+	jwksFiles := make(map[string]string)
+	if s.Options.JwksLocalFiles != "" {
+		for _, entry := range strings.Split(s.Options.JwksLocalFiles, ";") {
+			kv := strings.SplitN(entry, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+				return fmt.Errorf("invalid jwks_local_files entry %q, must be PROVIDER_ID=FILE_PATH", entry)
+			}
+			jwksFiles[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	authn := s.serviceConfig.GetAuthentication()
+	for _, provider := range authn.GetProviders() {
+		jwksUri := strings.TrimSpace(provider.GetJwksUri())
+		if path, ok := jwksFiles[provider.GetId()]; ok {
+			s.LocalJwksFiles[provider.GetId()] = path
+			delete(jwksFiles, provider.GetId())
+		} else if strings.HasPrefix(jwksUri, util.FileScheme) {
+			s.LocalJwksFiles[provider.GetId()] = strings.TrimPrefix(jwksUri, util.FileScheme)
+		} else if strings.HasPrefix(jwksUri, "{") {
+			if !json.Valid([]byte(jwksUri)) {
+				return fmt.Errorf("error processing authentication provider (%v): inline JWKS in jwks_uri is not valid JSON", provider.Id)
+			}
+			s.LocalJwks[provider.GetId()] = jwksUri
+		}
+	}
+
+	for id := range jwksFiles {
+		return fmt.Errorf("jwks_local_files has provider (%v), which is not found in the service config", id)
+	}
+
+	for id, path := range s.LocalJwksFiles {
+		jwks, err := ReadLocalJwks(path)
+		if err != nil {
+			return fmt.Errorf("error processing authentication provider (%v): %v", id, err)
+		}
+		s.LocalJwks[id] = jwks
+	}
+	return nil
+}
+
+// processJwtCookieLocations finds the cookies carrying the JWT of the
+// providers, set by the flag.
+func (s *ServiceInfo) processJwtCookieLocations() error {
+	if s.Options.JwtCookieLocations == "" {
+		return nil
+	}
+	providers := make(map[string]bool)
+	for _, provider := range s.serviceConfig.GetAuthentication().GetProviders() {
+		providers[provider.GetId()] = true
+	}
+	for _, entry := range strings.Split(s.Options.JwtCookieLocations, ";") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return fmt.Errorf("invalid jwt_cookie_locations entry %q, must be PROVIDER_ID=COOKIE_NAME", entry)
+		}
+		id, cookie := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !providers[id] {
+			return fmt.Errorf("jwt_cookie_locations has provider (%v), which is not found in the service config", id)
+		}
+		if !cookieNameRegex.MatchString(cookie) {
+			return fmt.Errorf("invalid jwt_cookie_locations entry %q, cookie (%v) is not a valid cookie name", entry, cookie)
+		}
+		s.JwtCookies[id] = append(s.JwtCookies[id], cookie)
+	}
+	return nil
+}
+
+// JwtCookieNames returns the sorted names of all the cookies carrying a JWT.
+func (s *ServiceInfo) JwtCookieNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, cookies := range s.JwtCookies {
+		for _, cookie := range cookies {
+			if !seen[cookie] {
+				seen[cookie] = true
+				names = append(names, cookie)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReadLocalJwks reads the JWKS file of a provider.
+func ReadLocalJwks(path string) (string, error) {
+	jwks, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("fail to read JWKS file: %v", err)
+	}
+	if len(bytes.TrimSpace(jwks)) == 0 {
+		return "", fmt.Errorf("JWKS file %s is empty", path)
+	}
+	return string(jwks), nil
+}
+
 func (s *ServiceInfo) processEmptyJwksUriByOpenID() error {
 	authn := s.serviceConfig.GetAuthentication()
 	for _, provider := range authn.GetProviders() {
+		if _, ok := s.LocalJwks[provider.GetId()]; ok {
+			continue
+		}
 		jwksUri := provider.GetJwksUri()
 
 		// Note: When jwksUri is empty, proxy will try to find jwksUri using the
@@ -231,6 +435,7 @@ func (s *ServiceInfo) processApis() error {
 				mi.IsStreaming = true
 			}
 			mi.ApiVersion = api.Version
+			mi.IsIdempotent = isIdempotentMethod(method)
 
 			// Keep track of request type name.
 			if strings.HasPrefix(method.RequestTypeUrl, util.TypeUrlPrefix) {
@@ -244,6 +449,33 @@ func (s *ServiceInfo) processApis() error {
 	return nil
 }
 
+// isIdempotentMethod checks the idempotency_level option of the method, whose
+// value is encoded as either the enum name or number.
+func isIdempotentMethod(method *apipb.Method) bool {
+	for _, opt := range method.GetOptions() {
+		if opt.GetName() != idempotencyLevelOptionName || opt.GetValue() == nil {
+			continue
+		}
+
+		var v ptypes.DynamicAny
+		if err := ptypes.UnmarshalAny(opt.GetValue(), &v); err != nil {
+			continue
+		}
+		switch m := v.Message.(type) {
+		case *wrapperspb.Int32Value:
+			return m.GetValue() == idempotencyNoSideEffectsNum || m.GetValue() == idempotencyIdempotentNum
+		case *wrapperspb.Int64Value:
+			return m.GetValue() == idempotencyNoSideEffectsNum || m.GetValue() == idempotencyIdempotentNum
+		case *wrapperspb.StringValue:
+			return m.GetValue() == idempotencyNoSideEffects || m.GetValue() == idempotencyIdempotent
+		case *typepb.EnumValue:
+			return m.GetName() == idempotencyNoSideEffects || m.GetName() == idempotencyIdempotent ||
+				m.GetNumber() == idempotencyNoSideEffectsNum || m.GetNumber() == idempotencyIdempotentNum
+		}
+	}
+	return false
+}
+
 func (s *ServiceInfo) addGrpcHttpRules() error {
 	// If there is not grpc backend, not to add grpc HttpRules
 	if !s.GrpcSupportRequired {
@@ -277,16 +509,34 @@ func (s *ServiceInfo) addGrpcHttpRules() error {
 	return nil
 }
 
+// TokenAgentHttpUri returns the HttpUri envoy uses to call the token agent at
+// path. The shared secret of the token agent is sent in a request header, so
+// it is kept out of the uri written to the access logs.
+func (s *ServiceInfo) TokenAgentHttpUri(path string) *commonpb.HttpUri {
+	host := fmt.Sprintf("%s:%v", util.LoopbackIPv4Addr, s.Options.TokenAgentPort)
+	if s.Options.TokenAgentSocket != "" {
+		// The host is only used as the authority header over the Unix domain socket.
+		host = "localhost"
+	}
+	httpUri := &commonpb.HttpUri{
+		Uri:     fmt.Sprintf("http://%s%s", host, path),
+		Cluster: util.TokenAgentClusterName,
+		Timeout: ptypes.DurationProto(s.Options.HttpRequestTimeout),
+	}
+	if s.Options.TokenAgentSecret != "" {
+		httpUri.RequestHeaders = map[string]string{
+			util.TokenAgentSecretHeader: s.Options.TokenAgentSecret,
+		}
+	}
+	return httpUri
+}
+
 func (s *ServiceInfo) processAccessToken() {
 	if s.Options.ServiceAccountKey != "" {
 		s.AccessToken = &commonpb.AccessToken{
 			TokenType: &commonpb.AccessToken_RemoteToken{
-				RemoteToken: &commonpb.HttpUri{
-					// Use http://127.0.0.1:8791/local/access_token by default.
-					Uri:     fmt.Sprintf("http://%s:%v%s", util.LoopbackIPv4Addr, s.Options.TokenAgentPort, util.TokenAgentAccessTokenPath),
-					Cluster: util.TokenAgentClusterName,
-					Timeout: ptypes.DurationProto(s.Options.HttpRequestTimeout),
-				},
+				// Use http://127.0.0.1:8791/local/access_token by default.
+				RemoteToken: s.TokenAgentHttpUri(util.TokenAgentAccessTokenPath),
 			},
 		}
 
@@ -325,6 +575,23 @@ func (s *ServiceInfo) processQuota() error {
 	return nil
 }
 
+// serviceControlUnavailable tells if service control, which enforces the
+// quota limits per consumer, is either skipped or not available outside of
+// GCP.
+func (s *ServiceInfo) serviceControlUnavailable() bool {
+	return s.Options.NonGCP || s.Options.SkipServiceControlFilter
+}
+
+// checkQuotaEnforcement warns that the quota limits are not enforced without
+// service control, unless the rate limit service enforces them. Envoy's local
+// rate limit filter cannot enforce them, as it has one token bucket per route
+// instead of a counter per consumer and metric.
+func (s *ServiceInfo) checkQuotaEnforcement() {
+	if s.serviceControlUnavailable() && s.Options.RateLimitServiceAddress == "" && len(s.ServiceConfig().GetQuota().GetLimits()) > 0 {
+		glog.Warningf("The quota limits are not enforced without service control, set --rate_limit_service_address to enforce them per consumer, such as with the rate limit emulator of ESPv2.")
+	}
+}
+
 func (s *ServiceInfo) processEndpoints() {
 	for _, endpoint := range s.ServiceConfig().GetEndpoints() {
 		if endpoint.GetName() == s.ServiceConfig().GetName() && endpoint.GetAllowCors() {
@@ -333,40 +600,33 @@ func (s *ServiceInfo) processEndpoints() {
 	}
 }
 
-func addHttpRule(method *MethodInfo, r *annotationspb.HttpRule, addedRouteMatchWithOptionsSet map[string]bool) error {
-	var path string
-	var uriTemplate *httppattern.UriTemplate
-	var parseError error
-	var httpMethod string
+// httpRuleMethodAndPath returns the HTTP method and the URI template of the
+// HTTP rule.
+func httpRuleMethodAndPath(r *annotationspb.HttpRule) (string, string, error) {
 	switch r.GetPattern().(type) {
 	case *annotationspb.HttpRule_Get:
-		path = r.GetGet()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.GET
+		return util.GET, r.GetGet(), nil
 	case *annotationspb.HttpRule_Put:
-		path = r.GetPut()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.PUT
+		return util.PUT, r.GetPut(), nil
 	case *annotationspb.HttpRule_Post:
-		path = r.GetPost()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.POST
+		return util.POST, r.GetPost(), nil
 	case *annotationspb.HttpRule_Delete:
-		path = r.GetDelete()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.DELETE
+		return util.DELETE, r.GetDelete(), nil
 	case *annotationspb.HttpRule_Patch:
-		path = r.GetPatch()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = util.PATCH
+		return util.PATCH, r.GetPatch(), nil
 	case *annotationspb.HttpRule_Custom:
-		path = r.GetCustom().GetPath()
-		uriTemplate, parseError = httppattern.ParseUriTemplate(path)
-		httpMethod = r.GetCustom().GetKind()
+		return r.GetCustom().GetKind(), r.GetCustom().GetPath(), nil
 	default:
-		return fmt.Errorf("error parsing http rule type for operation (%s): unsupported http method %T", method.Operation(), r.GetPattern())
+		return "", "", fmt.Errorf("unsupported http method %T", r.GetPattern())
 	}
+}
 
+func addHttpRule(method *MethodInfo, r *annotationspb.HttpRule, addedRouteMatchWithOptionsSet map[string]bool) error {
+	httpMethod, path, err := httpRuleMethodAndPath(r)
+	if err != nil {
+		return fmt.Errorf("error parsing http rule type for operation (%s): %v", method.Operation(), err)
+	}
+	uriTemplate, parseError := httppattern.ParseUriTemplate(path)
 	if parseError != nil {
 		return fmt.Errorf("error parsing http rule address for operation (%s): %v", method.Operation(), parseError)
 	}
@@ -411,13 +671,22 @@ func (s *ServiceInfo) processHttpRule() error {
 	}
 
 	// In order to support CORS. HTTP method OPTIONS needs to be added to all
-	// urls except the ones already with options.
-	if s.AllowCors {
+	// urls except the ones already with options. Without AllowCors, only the
+	// urls of the operations with their own CORS policies need them, so the
+	// preflight requests match the routes with the policies.
+	if s.AllowCors || s.HasCorsPolicies {
+		if err := s.checkSharedPathCorsPolicies(addedRouteMatchWithOptionsSet); err != nil {
+			return err
+		}
+
 		for _, r := range s.ServiceConfig().GetHttp().GetRules() {
 			method, err := s.getMethod(r.GetSelector())
 			if err != nil {
 				return fmt.Errorf("error processing http rule for operation (%v): %v", r.GetSelector(), err)
 			}
+			if !s.AllowCors && method.CorsPolicy == nil {
+				continue
+			}
 
 			for _, httpRule := range method.HttpRule {
 				if httpRule.HttpMethod != util.OPTIONS {
@@ -466,6 +735,63 @@ func (s *ServiceInfo) processHttpRule() error {
 		hcMethod.IsGenerated = true
 	}
 
+	// Add HttpRule for OpenApiDoc method, served by the proxy as a direct
+	// response.
+	if s.Options.OpenApiDocPath != "" {
+		methodName := fmt.Sprintf("%s.%s_OpenApiDoc", util.EspOperation, util.AutogeneratedOperationPrefix)
+
+		docMethod, err := s.getOrCreateMethod(methodName)
+		if err != nil {
+			return fmt.Errorf("error creating auto-generated OpenApiDoc http rule for operation (%v): %v", methodName, err)
+		}
+		if !strings.HasPrefix(s.Options.OpenApiDocPath, "/") {
+			s.Options.OpenApiDocPath = fmt.Sprintf("/%s", s.Options.OpenApiDocPath)
+		}
+
+		uriTemplate, err := httppattern.ParseUriTemplate(s.Options.OpenApiDocPath)
+		if err != nil {
+			return fmt.Errorf("error parsing OpenAPI document path (%v): %v", s.Options.OpenApiDocPath, err)
+		}
+		docMethod.HttpRule = append(docMethod.HttpRule, &httppattern.Pattern{
+			UriTemplate: uriTemplate,
+			HttpMethod:  util.GET,
+		})
+		docMethod.SkipServiceControl = true
+		docMethod.IsGenerated = true
+		s.OpenApiDocOperation = methodName
+	}
+
+	return nil
+}
+
+// checkSharedPathCorsPolicies rejects the operations on the same path with
+// different CORS policies. Only one OPTIONS method is generated per path, so
+// the preflight requests of all of them are replied with the policy of the
+// first one, which the browsers then require the actual requests to match.
+// The paths with OPTIONS methods in the http rules are skipped, as the
+// backend replies their preflight requests.
+func (s *ServiceInfo) checkSharedPathCorsPolicies(optionsRouteMatches map[string]bool) error {
+	if !s.HasCorsPolicies {
+		return nil
+	}
+	firstMethods := make(map[string]*MethodInfo)
+	for _, operation := range s.Operations {
+		method := s.Methods[operation]
+		for _, httpRule := range method.HttpRule {
+			routeMatch := httpRule.UriTemplate.Regex()
+			if httpRule.HttpMethod == util.OPTIONS || optionsRouteMatches[routeMatch] {
+				continue
+			}
+			first, ok := firstMethods[routeMatch]
+			if !ok {
+				firstMethods[routeMatch] = method
+				continue
+			}
+			if first != method && !first.CorsPolicy.sameAs(method.CorsPolicy) {
+				return fmt.Errorf("error processing CORS policy for operation (%v): operation (%v) on the same path (%v) has a different CORS policy, the operations on a path must have the same CORS policy, as their preflight requests are the same", method.Operation(), first.Operation(), httpRule.UriTemplate.Origin)
+			}
+		}
+	}
 	return nil
 }
 
@@ -483,6 +809,7 @@ func (s *ServiceInfo) addOptionMethod(originalMethod *MethodInfo, httpRule *http
 
 	method.ApiVersion = originalMethod.ApiVersion
 	method.BackendInfo = originalMethod.BackendInfo
+	method.CorsPolicy = originalMethod.CorsPolicy
 	method.IsGenerated = true
 	method.HttpRule = append(method.HttpRule, httpRule)
 
@@ -493,6 +820,9 @@ func (s *ServiceInfo) addOptionMethod(originalMethod *MethodInfo, httpRule *http
 
 func (s *ServiceInfo) processBackendRule() error {
 	backendRoutingClustersMap := make(map[string]string)
+	if s.Options.CommonOptions.NonGCP && s.Options.ServiceAccountKey != "" {
+		s.backendAuthKeyErr = checkBackendAuthServiceAccountKey(s.Options.ServiceAccountKey)
+	}
 
 	for _, r := range s.ServiceConfig().Backend.GetRules() {
 
@@ -599,18 +929,46 @@ func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme strin
 	}
 
 	jwtAud := s.determineBackendAuthJwtAud(r, scheme, hostname)
-	if jwtAud != "" && s.Options.CommonOptions.NonGCP {
+	// On non-GCP, ID tokens are minted by the local token agent from the service
+	// account key. Without the key there is no way to get them.
+	if jwtAud != "" && s.Options.CommonOptions.NonGCP && s.Options.ServiceAccountKey == "" {
 		glog.Warningf("Backend authentication is enabled for method %v, "+
-			"but ESPv2 is running on non-GCP. To prevent contacting GCP services, "+
+			"but ESPv2 is running on non-GCP without a service account key. To prevent contacting GCP services, "+
 			"backend authentication is automatically being disabled for this method.",
 			r.Selector)
 		jwtAud = ""
 	}
+	if jwtAud != "" && s.backendAuthKeyErr != nil {
+		return fmt.Errorf("backend authentication is enabled, but %v", s.backendAuthKeyErr)
+	}
 	method.BackendInfo.JwtAudience = jwtAud
 
 	return nil
 }
 
+// checkBackendAuthServiceAccountKey checks that the token agent can mint ID
+// tokens from the service account key. Those of external_account credentials
+// are minted by IAM for the impersonated service account, so they must have
+// one. Keys that cannot be read are left to the token agent to report.
+func checkBackendAuthServiceAccountKey(keyFile string) error {
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil
+	}
+	var key struct {
+		Type                           string `json:"type"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(keyData, &key); err != nil {
+		return nil
+	}
+	if key.Type == "external_account" && key.ServiceAccountImpersonationURL == "" {
+		return fmt.Errorf("the external_account credentials in the service account key (%v) do not have a service_account_impersonation_url, "+
+			"which is required to generate ID tokens", keyFile)
+	}
+	return nil
+}
+
 func (s *ServiceInfo) determineBackendAuthJwtAud(r *confpb.BackendRule, scheme string, hostname string) string {
 	//TODO(taoxuy): b/149334660 Check if the scopes for IAM include the path prefix
 	switch r.GetAuthentication().(type) {
@@ -825,6 +1183,85 @@ func (s *ServiceInfo) processTypes() error {
 	return nil
 }
 
+// processRequestValidation makes the schemas of the JSON request bodies of
+// the operations, from the request types and the body fields of HTTP rules.
+func (s *ServiceInfo) processRequestValidation() error {
+	if !s.Options.EnableRequestValidation {
+		return nil
+	}
+
+	typesByTypeName := make(map[string]*typepb.Type)
+	for _, t := range s.ServiceConfig().GetTypes() {
+		typesByTypeName[t.GetName()] = t
+	}
+	enumsByTypeName := make(map[string]*typepb.Enum)
+	for _, e := range s.ServiceConfig().GetEnums() {
+		enumsByTypeName[e.GetName()] = e
+	}
+
+	// The request bodies of the operations by selector. The routes of an
+	// operation share the schema, so the additional bindings must select
+	// the same body.
+	var selectors []string
+	bodiesBySelector := make(map[string]map[string]bool)
+	for _, rule := range s.ServiceConfig().GetHttp().GetRules() {
+		bodies, ok := bodiesBySelector[rule.GetSelector()]
+		if !ok {
+			bodies = make(map[string]bool)
+			bodiesBySelector[rule.GetSelector()] = bodies
+			selectors = append(selectors, rule.GetSelector())
+		}
+		bodies[rule.GetBody()] = true
+		for _, additionalRule := range rule.GetAdditionalBindings() {
+			bodies[additionalRule.GetBody()] = true
+		}
+	}
+
+	for _, selector := range selectors {
+		bodies := bodiesBySelector[selector]
+		if len(bodies) != 1 {
+			glog.Warningf("skip validating the request body of operation (%v): the HTTP rules select different bodies", selector)
+			continue
+		}
+		var body string
+		for b := range bodies {
+			body = b
+		}
+		if body == "" {
+			continue
+		}
+
+		method, err := s.getMethod(selector)
+		if err != nil {
+			return fmt.Errorf("error processing request validation for operation (%v): %v", selector, err)
+		}
+		requestType, ok := typesByTypeName[method.RequestTypeName]
+		if !ok {
+			glog.Warningf("skip validating the request body of operation (%v): could not find request type with name (%v)", selector, method.RequestTypeName)
+			continue
+		}
+
+		// The variable field paths of the HTTP rules are replaced by the JSON
+		// names in processTypes, so parse the original templates again.
+		var pathFields []string
+		for _, httpRule := range method.HttpRule {
+			uriTemplate, err := httppattern.ParseUriTemplate(httpRule.UriTemplate.Origin)
+			if err != nil {
+				return fmt.Errorf("error processing request validation for operation (%v): %v", selector, err)
+			}
+			for _, variable := range uriTemplate.Variables {
+				pathFields = append(pathFields, strings.Join(variable.FieldPath, "."))
+			}
+		}
+
+		method.RequestBodySchema, err = makeRequestBodySchema(requestType, body, pathFields, typesByTypeName, enumsByTypeName)
+		if err != nil {
+			return fmt.Errorf("error processing request validation for operation (%v): %v", selector, err)
+		}
+	}
+	return nil
+}
+
 // Get the MethodInfo by full name. Prefer to use this function when getting methods,
 // as it outputs an actionable error message.
 func (s *ServiceInfo) getMethod(name string) (*MethodInfo, error) {
@@ -866,7 +1303,376 @@ func (s *ServiceInfo) processAuthRequirement() error {
 				return fmt.Errorf("error processing authentication rule for operation (%v): selector not defined in Api.method or Http.rule", rule.GetSelector())
 			}
 			mi.RequireAuth = true
+			for _, scope := range strings.Split(rule.GetOauth().GetCanonicalScopes(), ",") {
+				if scope = strings.TrimSpace(scope); scope != "" {
+					mi.CanonicalScopes = append(mi.CanonicalScopes, scope)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// corsPolicies is the file format of the CORS policies per operation.
+type corsPolicies struct {
+	Policies []*CorsPolicy `json:"policies"`
+}
+
+// processCorsPolicies reads the CORS policies per operation from the file set
+// by the flag.
+func (s *ServiceInfo) processCorsPolicies() error {
+	if s.Options.CorsPoliciesFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.Options.CorsPoliciesFile)
+	if err != nil {
+		return fmt.Errorf("fail to read CORS policies file: %v", err)
+	}
+	policies := &corsPolicies{}
+	if err := json.Unmarshal(data, policies); err != nil {
+		return fmt.Errorf("fail to unmarshal CORS policies file: %v", err)
+	}
+
+	for _, policy := range policies.Policies {
+		mi, err := s.getMethod(policy.Selector)
+		if err != nil {
+			return fmt.Errorf("error processing CORS policy for operation (%v): selector not defined in Api.method or Http.rule", policy.Selector)
+		}
+		if mi.CorsPolicy != nil {
+			return fmt.Errorf("error processing CORS policy for operation (%v): duplicate CORS policies", policy.Selector)
+		}
+		if (policy.AllowOrigin == "") == (policy.AllowOriginRegex == "") {
+			return fmt.Errorf("error processing CORS policy for operation (%v): must have exactly one of allow_origin or allow_origin_regex", policy.Selector)
+		}
+		if policy.AllowOriginRegex != "" {
+			if err := util.ValidateRegexProgramSize(policy.AllowOriginRegex, util.GoogleRE2MaxProgramSize); err != nil {
+				return fmt.Errorf("error processing CORS policy for operation (%v): invalid allow_origin_regex: %v", policy.Selector, err)
+			}
+		}
+		// Browsers reject the credentialed responses allowing any origin.
+		if policy.AllowCredentials && policy.AllowOrigin == "*" {
+			return fmt.Errorf("error processing CORS policy for operation (%v): allow_credentials cannot be used with allow_origin *", policy.Selector)
+		}
+		mi.CorsPolicy = policy
+		s.HasCorsPolicies = true
+	}
+	return nil
+}
+
+// localReplyMappers is the file format of the local reply mappers.
+type localReplyMappers struct {
+	Mappers []*LocalReplyMapper `json:"mappers"`
+}
+
+// processLocalReplyMappers reads the local reply mappers from the file set by
+// the flag.
+func (s *ServiceInfo) processLocalReplyMappers() error {
+	if s.Options.LocalReplyMappersFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.Options.LocalReplyMappersFile)
+	if err != nil {
+		return fmt.Errorf("fail to read local reply mappers file: %v", err)
+	}
+	mappers := &localReplyMappers{}
+	if err := json.Unmarshal(data, mappers); err != nil {
+		return fmt.Errorf("fail to unmarshal local reply mappers file: %v", err)
+	}
+
+	for i, mapper := range mappers.Mappers {
+		if mapper.StatusCode == 0 && mapper.RequestContentType == "" {
+			return fmt.Errorf("error processing local reply mapper %d: must have status_code or request_content_type", i)
+		}
+		if mapper.StatusCode != 0 && (mapper.StatusCode < 100 || mapper.StatusCode > 599) {
+			return fmt.Errorf("error processing local reply mapper %d: invalid status_code %d", i, mapper.StatusCode)
+		}
+		if (mapper.TextFormat == "") == (len(mapper.JsonFormat) == 0) {
+			return fmt.Errorf("error processing local reply mapper %d: must have exactly one of text_format or json_format", i)
+		}
+		if len(mapper.JsonFormat) != 0 {
+			var jsonFormat map[string]interface{}
+			if err := json.Unmarshal(mapper.JsonFormat, &jsonFormat); err != nil || jsonFormat == nil {
+				return fmt.Errorf("error processing local reply mapper %d: json_format must be a JSON object", i)
+			}
+			if err := validateLocalReplyJsonFormat(jsonFormat); err != nil {
+				return fmt.Errorf("error processing local reply mapper %d: %v", i, err)
+			}
+		}
+	}
+	s.LocalReplyMappers = mappers.Mappers
+	return nil
+}
+
+// validateLocalReplyJsonFormat checks the values of the JSON format, which
+// Envoy only supports as strings and nested objects.
+func validateLocalReplyJsonFormat(jsonFormat map[string]interface{}) error {
+	for key, value := range jsonFormat {
+		switch v := value.(type) {
+		case string:
+		case map[string]interface{}:
+			if err := validateLocalReplyJsonFormat(v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("json_format value of %q must be a string or an object", key)
+		}
+	}
+	return nil
+}
+
+// jwtClaimRules is the file format of the JWT claims required per operation.
+type jwtClaimRules struct {
+	Rules []struct {
+		Selector string              `json:"selector"`
+		Claims   []*ClaimRequirement `json:"claims"`
+	} `json:"rules"`
+}
+
+// processJwtClaimRules reads the JWT claims required per operation from the
+// file set by the flag. The operations must require authentication.
+func (s *ServiceInfo) processJwtClaimRules() error {
+	if s.Options.JwtClaimRulesFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.Options.JwtClaimRulesFile)
+	if err != nil {
+		return fmt.Errorf("fail to read JWT claim rules file: %v", err)
+	}
+	claimRules := &jwtClaimRules{}
+	if err := json.Unmarshal(data, claimRules); err != nil {
+		return fmt.Errorf("fail to unmarshal JWT claim rules file: %v", err)
+	}
+
+	for _, rule := range claimRules.Rules {
+		mi, err := s.getMethod(rule.Selector)
+		if err != nil {
+			return fmt.Errorf("error processing JWT claim rule for operation (%v): selector not defined in Api.method or Http.rule", rule.Selector)
+		}
+		if !mi.RequireAuth {
+			return fmt.Errorf("error processing JWT claim rule for operation (%v): operation does not require authentication", rule.Selector)
+		}
+		for _, claim := range rule.Claims {
+			if err := validateClaimRequirement(mi, claim); err != nil {
+				return fmt.Errorf("error processing JWT claim rule for operation (%v): %v", rule.Selector, err)
+			}
+		}
+		mi.ClaimRequirements = append(mi.ClaimRequirements, rule.Claims...)
+	}
+	return nil
+}
+
+func validateClaimRequirement(mi *MethodInfo, claim *ClaimRequirement) error {
+	if claim.Name == "" {
+		return fmt.Errorf("claim name is empty")
+	}
+	matchers := 0
+	if len(claim.Values) > 0 {
+		matchers++
+	}
+	if claim.Contains != "" {
+		matchers++
+	}
+	if claim.PathVariable != "" {
+		matchers++
+		for _, httpRule := range mi.HttpRule {
+			if _, _, ok := httpRule.UriTemplate.RegexAroundVariable(claim.PathVariable); !ok {
+				return fmt.Errorf("claim (%v) path variable (%v) does not bind a single segment of http rule (%v)", claim.Name, claim.PathVariable, httpRule.UriTemplate.Origin)
+			}
+		}
+	}
+	if matchers != 1 {
+		return fmt.Errorf("claim (%v) must have exactly one of values, contains or path_variable", claim.Name)
+	}
+	return nil
+}
+
+// clientCertRules is the file format of the client certificate subject
+// alternative names allowed per operation.
+type clientCertRules struct {
+	Rules []struct {
+		Selector    string   `json:"selector"`
+		AllowedSans []string `json:"allowed_sans"`
+	} `json:"rules"`
+}
+
+// processClientCertRules reads the client certificate subject alternative
+// names allowed per operation from the file set by the flag. Only URI SANs,
+// such as SPIFFE IDs, are allowed, as the RBAC filter compares the first URI
+// SAN of the client certificates, rather than any of their SANs.
+func (s *ServiceInfo) processClientCertRules() error {
+	if s.Options.SslDownstreamClientCertRulesFile == "" {
+		return nil
+	}
+	if s.Options.SslDownstreamClientRootCertsPath == "" {
+		return fmt.Errorf("ssl_downstream_client_cert_rules_file requires ssl_downstream_client_root_certs_path")
+	}
+	data, err := ioutil.ReadFile(s.Options.SslDownstreamClientCertRulesFile)
+	if err != nil {
+		return fmt.Errorf("fail to read client certificate rules file: %v", err)
+	}
+	certRules := &clientCertRules{}
+	if err := json.Unmarshal(data, certRules); err != nil {
+		return fmt.Errorf("fail to unmarshal client certificate rules file: %v", err)
+	}
+
+	for _, rule := range certRules.Rules {
+		mi, err := s.getMethod(rule.Selector)
+		if err != nil {
+			return fmt.Errorf("error processing client certificate rule for operation (%v): selector not defined in Api.method or Http.rule", rule.Selector)
+		}
+		if len(rule.AllowedSans) == 0 {
+			return fmt.Errorf("error processing client certificate rule for operation (%v): allowed_sans is empty", rule.Selector)
+		}
+		for _, san := range rule.AllowedSans {
+			if strings.TrimSpace(san) == "" || san == "*" {
+				return fmt.Errorf("error processing client certificate rule for operation (%v): invalid allowed SAN (%v)", rule.Selector, san)
+			}
+			if u, err := url.Parse(strings.TrimSuffix(san, "*")); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("error processing client certificate rule for operation (%v): allowed SAN (%v) is not a URI, such as a SPIFFE ID", rule.Selector, san)
+			}
+		}
+		mi.AllowedClientSans = append(mi.AllowedClientSans, rule.AllowedSans...)
+	}
+	return nil
+}
+
+// processJwtClaimsToHeaders sets the claims forwarded as headers for the
+// operations requiring authentication. The claims of a provider are only
+// forwarded for the operations requiring the provider.
+func (s *ServiceInfo) processJwtClaimsToHeaders() error {
+	globalClaims, err := parseClaimsToHeaders(s.Options.JwtClaimsToHeaders)
+	if err != nil {
+		return err
+	}
+
+	providerClaims := make(map[string][]*ClaimToHeader)
+	for _, provider := range s.serviceConfig.GetAuthentication().GetProviders() {
+		providerClaims[provider.GetId()] = nil
+	}
+	var allClaims []*ClaimToHeader
+	allClaims = append(allClaims, globalClaims...)
+	for _, entry := range strings.Split(s.Options.JwtProviderClaimsToHeaders, ";") {
+		if entry == "" {
+			continue
+		}
+		idClaim := strings.SplitN(entry, ":", 2)
+		if len(idClaim) != 2 {
+			return fmt.Errorf("invalid JWT provider claim to header: %v, should be in provider_id:claim=header format", entry)
+		}
+		if _, ok := providerClaims[idClaim[0]]; !ok {
+			return fmt.Errorf("invalid JWT provider claim to header: %v, provider (%v) is not defined in Authentication.providers", entry, idClaim[0])
+		}
+		claim, err := parseClaimToHeader(idClaim[1])
+		if err != nil {
+			return err
+		}
+		providerClaims[idClaim[0]] = append(providerClaims[idClaim[0]], claim)
+		allClaims = append(allClaims, claim)
+	}
+	if len(allClaims) == 0 {
+		return nil
+	}
+
+	seenHeaders := make(map[string]bool)
+	for _, claim := range allClaims {
+		if name := strings.ToLower(claim.HeaderName); !seenHeaders[name] {
+			seenHeaders[name] = true
+			s.ClaimHeaderNames = append(s.ClaimHeaderNames, claim.HeaderName)
+		}
+	}
+
+	for _, rule := range s.serviceConfig.GetAuthentication().GetRules() {
+		if len(rule.GetRequirements()) == 0 {
+			continue
+		}
+		mi, err := s.getMethod(rule.GetSelector())
+		if err != nil {
+			return fmt.Errorf("error processing JWT claims to headers for operation (%v): selector not defined in Api.method or Http.rule", rule.GetSelector())
+		}
+
+		claims := append([]*ClaimToHeader{}, globalClaims...)
+		for _, requirement := range rule.GetRequirements() {
+			claims = append(claims, providerClaims[requirement.GetProviderId()]...)
+		}
+		claimByHeader := make(map[string]string)
+		for _, claim := range claims {
+			name := strings.ToLower(claim.HeaderName)
+			if claimName, ok := claimByHeader[name]; ok {
+				if claimName != claim.ClaimName {
+					return fmt.Errorf("error processing JWT claims to headers for operation (%v): header (%v) is set from both claim (%v) and claim (%v)", rule.GetSelector(), claim.HeaderName, claimName, claim.ClaimName)
+				}
+				continue
+			}
+			claimByHeader[name] = claim.ClaimName
+			mi.ClaimsToHeaders = append(mi.ClaimsToHeaders, claim)
+		}
+	}
+	return nil
+}
+
+func parseClaimsToHeaders(claimsToHeaders string) ([]*ClaimToHeader, error) {
+	var claims []*ClaimToHeader
+	for _, entry := range strings.Split(claimsToHeaders, ";") {
+		if entry == "" {
+			continue
+		}
+		claim, err := parseClaimToHeader(entry)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+	return claims, nil
+}
+
+// parseClaimToHeader parses claim=header. The claim may have '=', but not
+// the header.
+func parseClaimToHeader(entry string) (*ClaimToHeader, error) {
+	i := strings.LastIndex(entry, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid JWT claim to header: %v, should be in claim=header format", entry)
+	}
+	claim := &ClaimToHeader{
+		ClaimName:  entry[:i],
+		HeaderName: entry[i+1:],
+	}
+	for _, segment := range strings.Split(claim.ClaimName, ".") {
+		if segment == "" || strings.ContainsAny(segment, `"()%`) {
+			return nil, fmt.Errorf("invalid JWT claim to header: %v, claim (%v) is not a valid claim name", entry, claim.ClaimName)
+		}
+	}
+	if !headerNameRegex.MatchString(claim.HeaderName) {
+		return nil, fmt.Errorf("invalid JWT claim to header: %v, header (%v) is not a valid header name", entry, claim.HeaderName)
+	}
+	return claim, nil
+}
+
+// processExtAuthz sets the operations checked by the external authorization
+// service: the selected ones, or all of the operations defined by the API.
+func (s *ServiceInfo) processExtAuthz() error {
+	if s.Options.ExtAuthzAddress == "" {
+		return nil
+	}
+
+	if s.Options.ExtAuthzSelectors == "" {
+		for _, method := range s.Methods {
+			if !method.IsGenerated {
+				method.RequireExtAuthz = true
+			}
+		}
+		return nil
+	}
+
+	for _, selector := range strings.Split(s.Options.ExtAuthzSelectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		method, err := s.getMethod(selector)
+		if err != nil {
+			return fmt.Errorf("error processing ext_authz_selectors: %v", err)
 		}
+		method.RequireExtAuthz = true
 	}
 	return nil
 }
@@ -17,8 +17,11 @@ package configinfo
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
@@ -36,6 +39,7 @@ import (
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/common"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
@@ -2389,11 +2393,56 @@ func TestProcessBackendRuleForClusterName(t *testing.T) {
 }
 
 func TestProcessBackendRuleForJwtAudience(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend_auth")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKey := func(name, key string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(key), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	impersonatedKey := writeKey("impersonated.json", `{
+  "type": "external_account",
+  "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/sa@project.iam.gserviceaccount.com:generateAccessToken"
+}`)
+	federatedKey := writeKey("federated.json", `{"type": "external_account"}`)
+
+	makeServiceConfig := func() *confpb.Service {
+		return &confpb.Service{
+			Apis: []*apipb.Api{
+				{
+					Name: "abc.com",
+					Methods: []*apipb.Method{
+						{
+							Name: "api",
+						},
+					},
+				},
+			},
+			Backend: &confpb.Backend{
+				Rules: []*confpb.BackendRule{
+					{
+						Address:        "grpc://abc.com/api",
+						Selector:       "abc.com.api",
+						Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: "audience-foo"},
+					},
+				},
+			},
+		}
+	}
+
 	testData := []struct {
 		desc              string
 		fakeServiceConfig *confpb.Service
 		nonGcp            bool
+		serviceAccountKey string
 		wantedJwtAudience map[string]string
+		wantError         string
 	}{
 
 		{
@@ -2567,6 +2616,83 @@ func TestProcessBackendRuleForJwtAudience(t *testing.T) {
 				"abc.com.api": "",
 			},
 		},
+		{
+			desc:              "JwtAudience is set, non-GCP runtime with a service account key keeps backend auth",
+			nonGcp:            true,
+			serviceAccountKey: "/path/to/sa-key.json",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: "abc.com",
+						Methods: []*apipb.Method{
+							{
+								Name: "api",
+							},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Address:        "grpc://abc.com/api",
+							Selector:       "abc.com.api",
+							Deadline:       10.5,
+							Authentication: &confpb.BackendRule_JwtAudience{JwtAudience: "audience-foo"},
+						},
+					},
+				},
+			},
+			wantedJwtAudience: map[string]string{
+				"abc.com.api": "audience-foo",
+			},
+		},
+		{
+			desc:              "JwtAudience is set, non-GCP runtime with impersonating external_account credentials keeps backend auth",
+			nonGcp:            true,
+			serviceAccountKey: impersonatedKey,
+			fakeServiceConfig: makeServiceConfig(),
+			wantedJwtAudience: map[string]string{
+				"abc.com.api": "audience-foo",
+			},
+		},
+		{
+			desc:              "JwtAudience is set, non-GCP runtime with federated external_account credentials fails",
+			nonGcp:            true,
+			serviceAccountKey: federatedKey,
+			fakeServiceConfig: makeServiceConfig(),
+			wantError: fmt.Sprintf("error processing remote backend rule for operation (abc.com.api), backend authentication is enabled, "+
+				"but the external_account credentials in the service account key (%v) do not have a service_account_impersonation_url, "+
+				"which is required to generate ID tokens", federatedKey),
+		},
+		{
+			desc:              "DisableAuth is set, non-GCP runtime with federated external_account credentials succeeds",
+			nonGcp:            true,
+			serviceAccountKey: federatedKey,
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: "abc.com",
+						Methods: []*apipb.Method{
+							{
+								Name: "api",
+							},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Address:        "grpc://abc.com/api",
+							Selector:       "abc.com.api",
+							Authentication: &confpb.BackendRule_DisableAuth{DisableAuth: true},
+						},
+					},
+				},
+			},
+			wantedJwtAudience: map[string]string{
+				"abc.com.api": "",
+			},
+		},
 		{
 			desc: "Mix all Authentication cases",
 			fakeServiceConfig: &confpb.Service{
@@ -2660,8 +2786,15 @@ func TestProcessBackendRuleForJwtAudience(t *testing.T) {
 		t.Run(tc.desc, func(t *testing.T) {
 			opts := options.DefaultConfigGeneratorOptions()
 			opts.NonGCP = tc.nonGcp
+			opts.ServiceAccountKey = tc.serviceAccountKey
 			s, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("got error: %v, want error: %v", err, tc.wantError)
+				}
+				return
+			}
 			if err != nil {
 				t.Fatalf("error not expected, got: %v", err)
 			}
@@ -3004,147 +3137,1891 @@ func TestProcessEmptyJwksUriByOpenID(t *testing.T) {
 	}
 }
 
-func TestProcessApis(t *testing.T) {
-	testData := []struct {
-		desc              string
-		fakeServiceConfig *confpb.Service
-		wantMethods       map[string]*MethodInfo
-		wantApiNames      []string
-	}{
-		{
-			desc: "Succeed, process multiple apis",
-			fakeServiceConfig: &confpb.Service{
-				Apis: []*apipb.Api{
-					{
-						Name: "api-1",
-						Methods: []*apipb.Method{
-							{
-								Name:           "foo",
-								RequestTypeUrl: "type.googleapis.com/google.protobuf.Empty",
-							},
-							{
-								Name:           "bar",
-								RequestTypeUrl: "type.googleapis.com/CreateShelfRequest",
-							},
-						},
-					},
-					{
-						Name: "api-2",
-						Methods: []*apipb.Method{
-							{
-								Name:           "foo",
-								RequestTypeUrl: "type.googleapis.com/CreateBookRequest",
-							},
-							{
-								Name:           "bar",
-								RequestTypeUrl: "type.googleapis.com/CreateShelfRequest",
-							},
-						},
-					},
-					{
-						Name:    "api-3",
-						Methods: []*apipb.Method{},
-					},
-					{
-						Name: "api-4",
-						Methods: []*apipb.Method{
-							{
-								Name: "bar",
-								// Missing request type.
-							},
-							{
-								Name:           "baz",
-								RequestTypeUrl: "types.MALFORMED.com/google.protobuf.Empty",
-							},
-						},
-					},
+func TestProcessLocalJwks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_jwks")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeJwks := `{"keys": [{"kty": "RSA", "kid": "key-1", "n": "abc", "e": "AQAB"}]}`
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, []byte(fakeJwks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.json")
+	if err := ioutil.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	makeServiceConfig := func(jwksUri string) *confpb.Service {
+		return &confpb.Service{
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
 				},
 			},
-			wantMethods: map[string]*MethodInfo{
-				"api-1.foo": {
-					ShortName:       "foo",
-					ApiName:         "api-1",
-					RequestTypeName: "google.protobuf.Empty",
-				},
-				"api-1.bar": {
-					ShortName:       "bar",
-					ApiName:         "api-1",
-					RequestTypeName: "CreateShelfRequest",
-				},
-				"api-2.foo": {
-					ShortName:       "foo",
-					ApiName:         "api-2",
-					RequestTypeName: "CreateBookRequest",
-				},
-				"api-2.bar": {
-					ShortName:       "bar",
-					ApiName:         "api-2",
-					RequestTypeName: "CreateShelfRequest",
-				},
-				"api-4.bar": {
-					ShortName: "bar",
-					ApiName:   "api-4",
-				},
-				"api-4.baz": {
-					ShortName: "baz",
-					ApiName:   "api-4",
+			Authentication: &confpb.Authentication{
+				Providers: []*confpb.AuthProvider{
+					{
+						Id:      "auth_provider",
+						Issuer:  "issuer",
+						JwksUri: jwksUri,
+					},
 				},
 			},
-			wantApiNames: []string{
-				"api-1",
-				"api-2",
-				"api-3",
-				"api-4",
-			},
+		}
+	}
+
+	testData := []struct {
+		desc               string
+		fakeServiceConfig  *confpb.Service
+		jwksLocalFiles     string
+		wantLocalJwks      map[string]string
+		wantLocalJwksFiles map[string]string
+		wantErr            string
+	}{
+		{
+			desc:               "Success, JWKS file set by the flag overrides jwks_uri",
+			fakeServiceConfig:  makeServiceConfig("https://www.googleapis.com/oauth2/v3/certs"),
+			jwksLocalFiles:     "auth_provider=" + jwksFile,
+			wantLocalJwks:      map[string]string{"auth_provider": fakeJwks},
+			wantLocalJwksFiles: map[string]string{"auth_provider": jwksFile},
+		},
+		{
+			desc:               "Success, JWKS file set by the flag skips OpenID Connect Discovery",
+			fakeServiceConfig:  makeServiceConfig(""),
+			jwksLocalFiles:     " auth_provider = " + jwksFile + " ",
+			wantLocalJwks:      map[string]string{"auth_provider": fakeJwks},
+			wantLocalJwksFiles: map[string]string{"auth_provider": jwksFile},
+		},
+		{
+			desc:               "Success, file jwks_uri",
+			fakeServiceConfig:  makeServiceConfig("file://" + jwksFile),
+			wantLocalJwks:      map[string]string{"auth_provider": fakeJwks},
+			wantLocalJwksFiles: map[string]string{"auth_provider": jwksFile},
+		},
+		{
+			desc:               "Success, inline JWKS in jwks_uri",
+			fakeServiceConfig:  makeServiceConfig(fakeJwks),
+			wantLocalJwks:      map[string]string{"auth_provider": fakeJwks},
+			wantLocalJwksFiles: map[string]string{},
+		},
+		{
+			desc:               "Success, remote jwks_uri",
+			fakeServiceConfig:  makeServiceConfig("https://www.googleapis.com/oauth2/v3/certs"),
+			wantLocalJwks:      map[string]string{},
+			wantLocalJwksFiles: map[string]string{},
+		},
+		{
+			desc:              "Fail, invalid inline JWKS",
+			fakeServiceConfig: makeServiceConfig(`{"keys": [`),
+			wantErr:           "error processing authentication provider (auth_provider): inline JWKS in jwks_uri is not valid JSON",
+		},
+		{
+			desc:              "Fail, invalid flag entry",
+			fakeServiceConfig: makeServiceConfig(""),
+			jwksLocalFiles:    "auth_provider",
+			wantErr:           `invalid jwks_local_files entry "auth_provider", must be PROVIDER_ID=FILE_PATH`,
+		},
+		{
+			desc:              "Fail, unknown provider in the flag",
+			fakeServiceConfig: makeServiceConfig("https://www.googleapis.com/oauth2/v3/certs"),
+			jwksLocalFiles:    "other_provider=" + jwksFile,
+			wantErr:           "jwks_local_files has provider (other_provider), which is not found in the service config",
+		},
+		{
+			desc:              "Fail, missing JWKS file",
+			fakeServiceConfig: makeServiceConfig("file://" + filepath.Join(dir, "nonexistent.json")),
+			wantErr:           "error processing authentication provider (auth_provider): fail to read JWKS file",
+		},
+		{
+			desc:              "Fail, empty JWKS file",
+			fakeServiceConfig: makeServiceConfig("file://" + emptyFile),
+			wantErr:           "is empty",
 		},
 	}
 
 	for _, tc := range testData {
-
-		serviceInfo := &ServiceInfo{
-			serviceConfig: tc.fakeServiceConfig,
-			Methods:       make(map[string]*MethodInfo),
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwksLocalFiles = tc.jwksLocalFiles
+		serviceInfo, err := NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
 		}
-		_ = serviceInfo.processApis()
 
-		for key, gotMethod := range serviceInfo.Methods {
-			wantMethod := tc.wantMethods[key]
-			if eq := cmp.Equal(gotMethod, wantMethod, cmp.Comparer(proto.Equal)); !eq {
-				t.Errorf("Test(%v) failed: \n got Method: %v,\nwant Method: %v", tc.desc, gotMethod, wantMethod)
-			}
+		if !reflect.DeepEqual(serviceInfo.LocalJwks, tc.wantLocalJwks) {
+			t.Errorf("Test (%s): got LocalJwks: %v, want: %v", tc.desc, serviceInfo.LocalJwks, tc.wantLocalJwks)
 		}
-		for idx, gotApiName := range serviceInfo.ApiNames {
-			wantApiName := tc.wantApiNames[idx]
-			if gotApiName != wantApiName {
-				t.Errorf("Test(%v) failed: \n got ApiName: %v,\nwant Apiname: %v", tc.desc, gotApiName, wantApiName)
-			}
+		if !reflect.DeepEqual(serviceInfo.LocalJwksFiles, tc.wantLocalJwksFiles) {
+			t.Errorf("Test (%s): got LocalJwksFiles: %v, want: %v", tc.desc, serviceInfo.LocalJwksFiles, tc.wantLocalJwksFiles)
 		}
 	}
 }
 
-func TestProcessApisForGrpc(t *testing.T) {
+func TestProcessJwtCookieLocations(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer",
+					JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+				},
+			},
+		},
+	}
+
 	testData := []struct {
-		desc              string
-		fakeServiceConfig *confpb.Service
-		wantMethods       map[string]*MethodInfo
-		wantApiNames      []string
-		wantError         string
+		desc               string
+		jwtCookieLocations string
+		wantJwtCookies     map[string][]string
+		wantErr            string
 	}{
 		{
-			desc: "Process API with unary and streaming gRPC methods",
-			fakeServiceConfig: &confpb.Service{
-				Apis: []*apipb.Api{
-					{
-						Name: "api-streaming-test",
-						Methods: []*apipb.Method{
-							{
-								Name: "unary",
-							},
-							{
-								Name:             "streaming_request",
-								RequestStreaming: true,
-							},
-							{
+			desc:           "Success without cookie locations",
+			wantJwtCookies: map[string][]string{},
+		},
+		{
+			desc:               "Success with multiple cookies of a provider",
+			jwtCookieLocations: "auth_provider=session_token; auth_provider=id_token",
+			wantJwtCookies: map[string][]string{
+				"auth_provider": {"session_token", "id_token"},
+			},
+		},
+		{
+			desc:               "Fail with wrong format",
+			jwtCookieLocations: "session_token",
+			wantErr:            `invalid jwt_cookie_locations entry "session_token", must be PROVIDER_ID=COOKIE_NAME`,
+		},
+		{
+			desc:               "Fail with unknown provider",
+			jwtCookieLocations: "unknown_provider=session_token",
+			wantErr:            "jwt_cookie_locations has provider (unknown_provider), which is not found in the service config",
+		},
+		{
+			desc:               "Fail with invalid cookie name",
+			jwtCookieLocations: "auth_provider=session;token",
+			wantErr:            `invalid jwt_cookie_locations entry "token", must be PROVIDER_ID=COOKIE_NAME`,
+		},
+		{
+			desc:               "Fail with cookie name of invalid characters",
+			jwtCookieLocations: "auth_provider=session token",
+			wantErr:            "cookie (session token) is not a valid cookie name",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwtCookieLocations = tc.jwtCookieLocations
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(serviceInfo.JwtCookies, tc.wantJwtCookies) {
+			t.Errorf("Test (%s): got JwtCookies: %v, want: %v", tc.desc, serviceInfo.JwtCookies, tc.wantJwtCookies)
+		}
+	}
+}
+
+func TestProcessExtAuthz(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                string
+		extAuthzAddress     string
+		extAuthzSelectors   string
+		wantRequireExtAuthz map[string]bool
+		wantErr             string
+	}{
+		{
+			desc: "No operation is checked without ext_authz",
+			wantRequireExtAuthz: map[string]bool{
+				"ListShelves": false,
+				"CreateShelf": false,
+			},
+		},
+		{
+			desc:            "All of the operations are checked without selectors",
+			extAuthzAddress: "grpc://127.0.0.1:9001",
+			wantRequireExtAuthz: map[string]bool{
+				"ListShelves": true,
+				"CreateShelf": true,
+			},
+		},
+		{
+			desc:              "Only the selected operations are checked",
+			extAuthzAddress:   "grpc://127.0.0.1:9001",
+			extAuthzSelectors: fmt.Sprintf(" %s.CreateShelf ,", testApiName),
+			wantRequireExtAuthz: map[string]bool{
+				"ListShelves": false,
+				"CreateShelf": true,
+			},
+		},
+		{
+			desc:              "Fail with unknown selector",
+			extAuthzAddress:   "grpc://127.0.0.1:9001",
+			extAuthzSelectors: fmt.Sprintf("%s.DeleteShelf", testApiName),
+			wantErr:           "error processing ext_authz_selectors: selector (endpoints.examples.bookstore.Bookstore.DeleteShelf) was not defined in the API",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.ExtAuthzAddress = tc.extAuthzAddress
+		opts.ExtAuthzSelectors = tc.extAuthzSelectors
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+		for name, want := range tc.wantRequireExtAuthz {
+			method := serviceInfo.Methods[fmt.Sprintf("%s.%s", testApiName, name)]
+			if method.RequireExtAuthz != want {
+				t.Errorf("Test (%s): got RequireExtAuthz: %v for %s, want: %v", tc.desc, method.RequireExtAuthz, name, want)
+			}
+		}
+	}
+}
+
+func TestProcessRequestValidation(t *testing.T) {
+	requiredOption, _ := ptypes.MarshalAny(&wrapperspb.Int32Value{Value: 2})
+	mapEntryOption, _ := ptypes.MarshalAny(&wrapperspb.BoolValue{Value: true})
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:           "CreateShelf",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.CreateShelfRequest",
+					},
+					{
+						Name:           "UpdateShelf",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.UpdateShelfRequest",
+					},
+					{
+						Name:           "ListShelves",
+						RequestTypeUrl: "type.googleapis.com/google.protobuf.Empty",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/shelves/{shelf.theme}",
+					},
+					Body: "shelf",
+				},
+				{
+					Selector: fmt.Sprintf("%s.UpdateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Put{
+						Put: "/shelves/{shelf_id}",
+					},
+					Body: "*",
+				},
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+			},
+		},
+		Types: []*ptypepb.Type{
+			{
+				Name: "endpoints.examples.bookstore.CreateShelfRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.UpdateShelfRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf_id",
+						JsonName: "shelfId",
+						Kind:     ptypepb.Field_TYPE_INT64,
+						Options: []*ptypepb.Option{
+							{
+								Name:  "google.api.field_behavior",
+								Value: requiredOption,
+							},
+						},
+					},
+					{
+						Name:        "labels",
+						JsonName:    "labels",
+						Kind:        ptypepb.Field_TYPE_MESSAGE,
+						Cardinality: ptypepb.Field_CARDINALITY_REPEATED,
+						TypeUrl:     "type.googleapis.com/endpoints.examples.bookstore.UpdateShelfRequest.LabelsEntry",
+					},
+					{
+						Name:     "update_time",
+						JsonName: "updateTime",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/google.protobuf.Timestamp",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.UpdateShelfRequest.LabelsEntry",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "key",
+						JsonName: "key",
+						Kind:     ptypepb.Field_TYPE_STRING,
+					},
+					{
+						Name:     "value",
+						JsonName: "value",
+						Kind:     ptypepb.Field_TYPE_STRING,
+					},
+				},
+				Options: []*ptypepb.Option{
+					{
+						Name:  "proto2.MessageOptions.map_entry",
+						Value: mapEntryOption,
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.Shelf",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "theme",
+						JsonName: "theme",
+						Kind:     ptypepb.Field_TYPE_STRING,
+						Options: []*ptypepb.Option{
+							{
+								Name:  "google.api.field_behavior",
+								Value: requiredOption,
+							},
+						},
+					},
+					{
+						Name:        "books",
+						JsonName:    "books",
+						Kind:        ptypepb.Field_TYPE_MESSAGE,
+						Cardinality: ptypepb.Field_CARDINALITY_REPEATED,
+						TypeUrl:     "type.googleapis.com/endpoints.examples.bookstore.Book",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.Book",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "book_genre",
+						JsonName: "bookGenre",
+						Kind:     ptypepb.Field_TYPE_ENUM,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Genre",
+					},
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+					},
+				},
+			},
+		},
+		Enums: []*ptypepb.Enum{
+			{
+				Name: "endpoints.examples.bookstore.Genre",
+				Enumvalue: []*ptypepb.EnumValue{
+					{
+						Name: "GENRE_UNSPECIFIED",
+					},
+					{
+						Name:   "FICTION",
+						Number: 1,
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                    string
+		enableRequestValidation bool
+		wantSchemas             map[string]string
+	}{
+		{
+			desc: "No schema without request validation",
+			wantSchemas: map[string]string{
+				"CreateShelf": "",
+				"UpdateShelf": "",
+				"ListShelves": "",
+			},
+		},
+		{
+			desc:                    "Schemas of the bodies with request validation",
+			enableRequestValidation: true,
+			wantSchemas: map[string]string{
+				"CreateShelf": `{
+  "body": {
+    "kind": "message",
+    "type": "endpoints.examples.bookstore.Shelf"
+  },
+  "pathFields": ["theme"],
+  "types": {
+    "endpoints.examples.bookstore.Book": [
+      {
+        "name": "book_genre",
+        "jsonName": "bookGenre",
+        "kind": "enum",
+        "type": "endpoints.examples.bookstore.Genre"
+      },
+      {
+        "name": "shelf",
+        "jsonName": "shelf",
+        "kind": "message",
+        "type": "endpoints.examples.bookstore.Shelf"
+      }
+    ],
+    "endpoints.examples.bookstore.Shelf": [
+      {
+        "name": "theme",
+        "jsonName": "theme",
+        "kind": "string",
+        "required": true
+      },
+      {
+        "name": "books",
+        "jsonName": "books",
+        "kind": "message",
+        "type": "endpoints.examples.bookstore.Book",
+        "repeated": true
+      }
+    ]
+  },
+  "enums": {
+    "endpoints.examples.bookstore.Genre": ["GENRE_UNSPECIFIED", "FICTION"]
+  }
+}`,
+				"UpdateShelf": `{
+  "body": {
+    "kind": "message",
+    "type": "endpoints.examples.bookstore.UpdateShelfRequest"
+  },
+  "pathFields": ["shelf_id"],
+  "types": {
+    "endpoints.examples.bookstore.UpdateShelfRequest": [
+      {
+        "name": "shelf_id",
+        "jsonName": "shelfId",
+        "kind": "int64",
+        "required": true
+      },
+      {
+        "name": "labels",
+        "jsonName": "labels",
+        "kind": "object",
+        "mapValue": {
+          "kind": "string"
+        }
+      },
+      {
+        "name": "update_time",
+        "jsonName": "updateTime",
+        "kind": "string"
+      }
+    ]
+  }
+}`,
+				"ListShelves": "",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.EnableRequestValidation = tc.enableRequestValidation
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected err: %v", tc.desc, err)
+		}
+
+		for name, wantSchema := range tc.wantSchemas {
+			gotSchema := serviceInfo.Methods[fmt.Sprintf("%s.%s", testApiName, name)].RequestBodySchema
+			if wantSchema == "" || gotSchema == "" {
+				if gotSchema != wantSchema {
+					t.Errorf("Test (%s): got schema %q for %s, want %q", tc.desc, gotSchema, name, wantSchema)
+				}
+				continue
+			}
+			if err := util.JsonEqual(wantSchema, gotSchema); err != nil {
+				t.Errorf("Test (%s): got different schema for %s, %v", tc.desc, name, err)
+			}
+		}
+	}
+}
+
+func TestProcessRequestValidationWithUnknownBodyField(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.EnableRequestValidation = true
+	_, err := NewServiceInfoFromServiceConfig(&confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:           "CreateShelf",
+						RequestTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.CreateShelfRequest",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/shelves",
+					},
+					Body: "book",
+				},
+			},
+		},
+		Types: []*ptypepb.Type{
+			{
+				Name: "endpoints.examples.bookstore.CreateShelfRequest",
+			},
+		},
+	}, testConfigID, opts)
+
+	wantErr := "body field (book) is not defined in request type (endpoints.examples.bookstore.CreateShelfRequest)"
+	if err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("got err: %v, want err: %s", err, wantErr)
+	}
+}
+
+func TestProcessOpenApiDoc(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name:  testProjectName,
+		Title: "Bookstore",
+		Documentation: &confpb.Documentation{
+			Summary: "A simple bookstore.",
+		},
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name:            "GetShelf",
+						RequestTypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.GetShelfRequest",
+						ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+					},
+					{
+						Name:            "CreateShelf",
+						RequestTypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.CreateShelfRequest",
+						ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.GetShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves/{shelf=*}",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves",
+					},
+					Body: "shelf",
+				},
+			},
+		},
+		Usage: &confpb.Usage{
+			Rules: []*confpb.UsageRule{
+				{
+					Selector:               fmt.Sprintf("%s.GetShelf", testApiName),
+					AllowUnregisteredCalls: true,
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer.com",
+					JwksUri: "https://issuer.com/pkey",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+		Types: []*ptypepb.Type{
+			{
+				Name: "endpoints.examples.bookstore.GetShelfRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_INT64,
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.CreateShelfRequest",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf",
+						JsonName: "shelf",
+						Kind:     ptypepb.Field_TYPE_MESSAGE,
+						TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+					},
+				},
+			},
+			{
+				Name: "endpoints.examples.bookstore.Shelf",
+				Fields: []*ptypepb.Field{
+					{
+						Name:     "shelf_theme",
+						JsonName: "shelfTheme",
+						Kind:     ptypepb.Field_TYPE_STRING,
+					},
+					{
+						Name:        "book_ids",
+						JsonName:    "bookIds",
+						Kind:        ptypepb.Field_TYPE_INT32,
+						Cardinality: ptypepb.Field_CARDINALITY_REPEATED,
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc           string
+		openApiDocPath string
+		wantOperation  string
+		wantDoc        string
+	}{
+		{
+			desc: "No document without the path",
+		},
+		{
+			desc:           "Document of the HTTP rules",
+			openApiDocPath: "openapi.json",
+			wantOperation:  "espv2_deployment.ESPv2_Autogenerated_OpenApiDoc",
+			wantDoc: `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Bookstore",
+    "version": "2019-03-02r0",
+    "description": "A simple bookstore."
+  },
+  "paths": {
+    "/v1/shelves/{shelf}": {
+      "get": {
+        "operationId": "endpoints.examples.bookstore.Bookstore.GetShelf",
+        "parameters": [
+          {
+            "name": "shelf",
+            "in": "path",
+            "required": true,
+            "schema": {
+              "type": "string",
+              "format": "int64"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/endpoints.examples.bookstore.Shelf"
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    "/v1/shelves": {
+      "post": {
+        "operationId": "endpoints.examples.bookstore.Bookstore.CreateShelf",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "$ref": "#/components/schemas/endpoints.examples.bookstore.Shelf"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "A successful response.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/endpoints.examples.bookstore.Shelf"
+                }
+              }
+            }
+          }
+        },
+        "security": [
+          {
+            "auth_provider": [],
+            "api_key_query_key": []
+          },
+          {
+            "auth_provider": [],
+            "api_key_query_api_key": []
+          },
+          {
+            "auth_provider": [],
+            "api_key_header_x-api-key": []
+          }
+        ]
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "endpoints.examples.bookstore.Shelf": {
+        "type": "object",
+        "properties": {
+          "shelfTheme": {
+            "type": "string"
+          },
+          "bookIds": {
+            "type": "array",
+            "items": {
+              "type": "integer",
+              "format": "int32"
+            }
+          }
+        }
+      }
+    },
+    "securitySchemes": {
+      "auth_provider": {
+        "type": "http",
+        "scheme": "bearer",
+        "bearerFormat": "JWT",
+        "x-google-issuer": "issuer.com",
+        "x-google-jwks_uri": "https://issuer.com/pkey"
+      },
+      "api_key_query_key": {
+        "type": "apiKey",
+        "in": "query",
+        "name": "key"
+      },
+      "api_key_query_api_key": {
+        "type": "apiKey",
+        "in": "query",
+        "name": "api_key"
+      },
+      "api_key_header_x-api-key": {
+        "type": "apiKey",
+        "in": "header",
+        "name": "x-api-key"
+      }
+    }
+  }
+}`,
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.OpenApiDocPath = tc.openApiDocPath
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected err: %v", tc.desc, err)
+		}
+
+		if serviceInfo.OpenApiDocOperation != tc.wantOperation {
+			t.Errorf("Test (%s): got OpenApiDoc operation %q, want %q", tc.desc, serviceInfo.OpenApiDocOperation, tc.wantOperation)
+		}
+		if tc.wantDoc == "" {
+			if serviceInfo.OpenApiDoc != "" {
+				t.Errorf("Test (%s): got unexpected OpenAPI document %s", tc.desc, serviceInfo.OpenApiDoc)
+			}
+			continue
+		}
+
+		method := serviceInfo.Methods[tc.wantOperation]
+		if method == nil || !method.SkipServiceControl || len(method.HttpRule) != 1 || method.HttpRule[0].UriTemplate.Origin != "/openapi.json" {
+			t.Errorf("Test (%s): got unexpected OpenApiDoc method %+v", tc.desc, method)
+		}
+		if err := util.JsonEqual(tc.wantDoc, serviceInfo.OpenApiDoc); err != nil {
+			t.Errorf("Test (%s): got different OpenAPI document, %v", tc.desc, err)
+		}
+	}
+}
+
+func TestProcessCanonicalScopes(t *testing.T) {
+	testData := []struct {
+		desc                string
+		canonicalScopes     string
+		wantCanonicalScopes []string
+	}{
+		{
+			desc: "Success without oauth requirement",
+		},
+		{
+			desc:                "Success with a single scope",
+			canonicalScopes:     "https://www.googleapis.com/auth/books.read",
+			wantCanonicalScopes: []string{"https://www.googleapis.com/auth/books.read"},
+		},
+		{
+			desc:            "Success with comma separated scopes and spaces",
+			canonicalScopes: " https://www.googleapis.com/auth/books.read, https://www.googleapis.com/auth/books.write ,",
+			wantCanonicalScopes: []string{
+				"https://www.googleapis.com/auth/books.read",
+				"https://www.googleapis.com/auth/books.write",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		fakeServiceConfig := &confpb.Service{
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+					Methods: []*apipb.Method{
+						{
+							Name: "ListShelves",
+						},
+					},
+				},
+			},
+			Authentication: &confpb.Authentication{
+				Providers: []*confpb.AuthProvider{
+					{
+						Id:      "auth_provider",
+						Issuer:  "issuer",
+						JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+					},
+				},
+				Rules: []*confpb.AuthenticationRule{
+					{
+						Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+						Oauth: &confpb.OAuthRequirements{
+							CanonicalScopes: tc.canonicalScopes,
+						},
+						Requirements: []*confpb.AuthRequirement{
+							{
+								ProviderId: "auth_provider",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, options.DefaultConfigGeneratorOptions())
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		got := serviceInfo.Methods[fmt.Sprintf("%s.ListShelves", testApiName)].CanonicalScopes
+		if !reflect.DeepEqual(got, tc.wantCanonicalScopes) {
+			t.Errorf("Test (%s): got CanonicalScopes: %v, want: %v", tc.desc, got, tc.wantCanonicalScopes)
+		}
+	}
+}
+
+func TestProcessCorsPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cors_policies")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicies := func(name, policies string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(policies), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+					{
+						Name: "CreateShelf",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.CreateShelf", testApiName),
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/v1/shelves/{shelf}",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc           string
+		policies       string
+		wantCorsPolicy *CorsPolicy
+		wantErr        string
+	}{
+		{
+			desc:     "Success with a policy of an exact origin",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin": "https://app.example.com", "allow_methods": "POST", "allow_credentials": true}]}`,
+			wantCorsPolicy: &CorsPolicy{
+				Selector:         "endpoints.examples.bookstore.Bookstore.CreateShelf",
+				AllowOrigin:      "https://app.example.com",
+				AllowMethods:     "POST",
+				AllowCredentials: true,
+			},
+		},
+		{
+			desc:     "Success with a policy of an origin regex",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin_regex": "https://.*\\.example\\.com"}]}`,
+			wantCorsPolicy: &CorsPolicy{
+				Selector:         "endpoints.examples.bookstore.Bookstore.CreateShelf",
+				AllowOriginRegex: `https://.*\.example\.com`,
+			},
+		},
+		{
+			desc:     "Fail with unknown selector",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.GetShelf", "allow_origin": "*"}]}`,
+			wantErr:  "error processing CORS policy for operation (endpoints.examples.bookstore.Bookstore.GetShelf): selector not defined",
+		},
+		{
+			desc:     "Fail with no origin",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_methods": "POST"}]}`,
+			wantErr:  "must have exactly one of allow_origin or allow_origin_regex",
+		},
+		{
+			desc:     "Fail with both origin and origin regex",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin": "*", "allow_origin_regex": ".*"}]}`,
+			wantErr:  "must have exactly one of allow_origin or allow_origin_regex",
+		},
+		{
+			desc:     "Fail with credentials for any origin",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin": "*", "allow_credentials": true}]}`,
+			wantErr:  "allow_credentials cannot be used with allow_origin *",
+		},
+		{
+			desc: "Fail with duplicate policies",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin": "*"},
+				{"selector": "endpoints.examples.bookstore.Bookstore.CreateShelf", "allow_origin": "https://app.example.com"}]}`,
+			wantErr: "duplicate CORS policies",
+		},
+		{
+			desc:     "Fail with invalid JSON",
+			policies: `{"policies": [`,
+			wantErr:  "fail to unmarshal CORS policies file",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.CorsPoliciesFile = writePolicies(fmt.Sprintf("policies-%d.json", i), tc.policies)
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		got := serviceInfo.Methods[fmt.Sprintf("%s.CreateShelf", testApiName)].CorsPolicy
+		if !reflect.DeepEqual(got, tc.wantCorsPolicy) {
+			t.Errorf("Test (%s): got CorsPolicy: %+v, want: %+v", tc.desc, got, tc.wantCorsPolicy)
+		}
+		if serviceInfo.Methods[fmt.Sprintf("%s.ListShelves", testApiName)].CorsPolicy != nil {
+			t.Errorf("Test (%s): got unexpected CorsPolicy for ListShelves", tc.desc)
+		}
+
+		// Only the operation with the policy gets the auto-generated OPTIONS
+		// method, with the same policy.
+		corsMethod := serviceInfo.Methods[fmt.Sprintf("%s.%s_CORS_CreateShelf", testApiName, util.AutogeneratedOperationPrefix)]
+		if corsMethod == nil || corsMethod.CorsPolicy != got || len(corsMethod.HttpRule) != 1 || corsMethod.HttpRule[0].HttpMethod != util.OPTIONS {
+			t.Errorf("Test (%s): got unexpected auto-generated CORS method: %+v", tc.desc, corsMethod)
+		}
+		if _, ok := serviceInfo.Methods[fmt.Sprintf("%s.%s_CORS_ListShelves", testApiName, util.AutogeneratedOperationPrefix)]; ok {
+			t.Errorf("Test (%s): got unexpected auto-generated CORS method for ListShelves", tc.desc)
+		}
+	}
+}
+
+func TestSharedPathCorsPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared_path_cors_policies")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	makeServiceConfig := func(withOptionsRule bool) *confpb.Service {
+		serviceConfig := &confpb.Service{
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+					Methods: []*apipb.Method{
+						{
+							Name: "ListBooks",
+						},
+						{
+							Name: "CreateBook",
+						},
+						{
+							Name: "BooksOptions",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: fmt.Sprintf("%s.ListBooks", testApiName),
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/v1/books",
+						},
+					},
+					{
+						Selector: fmt.Sprintf("%s.CreateBook", testApiName),
+						Pattern: &annotationspb.HttpRule_Post{
+							Post: "/v1/books",
+						},
+					},
+				},
+			},
+		}
+		if withOptionsRule {
+			serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, &annotationspb.HttpRule{
+				Selector: fmt.Sprintf("%s.BooksOptions", testApiName),
+				Pattern: &annotationspb.HttpRule_Custom{
+					Custom: &annotationspb.CustomHttpPattern{
+						Kind: "OPTIONS",
+						Path: "/v1/books",
+					},
+				},
+			})
+		}
+		return serviceConfig
+	}
+
+	testData := []struct {
+		desc            string
+		policies        string
+		withOptionsRule bool
+		wantCorsMethod  bool
+		wantErr         string
+	}{
+		{
+			desc: "Success with the same policy for the operations on the path",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "allow_origin": "https://app.example.com", "allow_credentials": true},
+				{"selector": "endpoints.examples.bookstore.Bookstore.CreateBook", "allow_origin": "https://app.example.com", "allow_credentials": true}]}`,
+			wantCorsMethod: true,
+		},
+		{
+			desc: "Success with different policies on a path with an OPTIONS http rule",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "allow_origin": "*"},
+				{"selector": "endpoints.examples.bookstore.Bookstore.CreateBook", "allow_origin": "https://app.example.com", "allow_credentials": true}]}`,
+			withOptionsRule: true,
+		},
+		{
+			desc: "Fail with a public GET and a credentialed POST on the path",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "allow_origin": "*"},
+				{"selector": "endpoints.examples.bookstore.Bookstore.CreateBook", "allow_origin": "https://app.example.com", "allow_credentials": true}]}`,
+			wantErr: "error processing CORS policy for operation (endpoints.examples.bookstore.Bookstore.CreateBook): operation (endpoints.examples.bookstore.Bookstore.ListBooks) on the same path (/v1/books) has a different CORS policy",
+		},
+		{
+			desc:     "Fail with a policy for only one of the operations on the path",
+			policies: `{"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateBook", "allow_origin": "https://app.example.com"}]}`,
+			wantErr:  "operation (endpoints.examples.bookstore.Bookstore.ListBooks) on the same path (/v1/books) has a different CORS policy",
+		},
+	}
+
+	for i, tc := range testData {
+		path := filepath.Join(dir, fmt.Sprintf("policies-%d.json", i))
+		if err := ioutil.WriteFile(path, []byte(tc.policies), 0644); err != nil {
+			t.Fatal(err)
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.CorsPoliciesFile = path
+		serviceInfo, err := NewServiceInfoFromServiceConfig(makeServiceConfig(tc.withOptionsRule), testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		// One OPTIONS method is generated for the path, with the shared policy.
+		var corsMethods []*MethodInfo
+		for _, name := range []string{"ListBooks", "CreateBook"} {
+			if corsMethod, ok := serviceInfo.Methods[fmt.Sprintf("%s.%s_CORS_%s", testApiName, util.AutogeneratedOperationPrefix, name)]; ok {
+				corsMethods = append(corsMethods, corsMethod)
+			}
+		}
+		if !tc.wantCorsMethod {
+			if len(corsMethods) != 0 {
+				t.Errorf("Test (%s): got unexpected auto-generated CORS methods: %+v", tc.desc, corsMethods)
+			}
+			continue
+		}
+		createPolicy := serviceInfo.Methods[fmt.Sprintf("%s.CreateBook", testApiName)].CorsPolicy
+		if len(corsMethods) != 1 || !corsMethods[0].CorsPolicy.sameAs(createPolicy) {
+			t.Errorf("Test (%s): got auto-generated CORS methods: %+v, want one with policy: %+v", tc.desc, corsMethods, createPolicy)
+		}
+	}
+}
+
+func TestProcessLocalReplyMappers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_reply_mappers")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeMappers := func(name, mappers string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(mappers), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+	}
+
+	testData := []struct {
+		desc        string
+		mappers     string
+		wantMappers []*LocalReplyMapper
+		wantErr     string
+	}{
+		{
+			desc: "Success with text and JSON formats",
+			mappers: `{"mappers": [{"status_code": 404, "request_content_type": "text/html", "text_format": "<h1>%LOCAL_REPLY_BODY%</h1>", "content_type": "text/html"},
+				{"status_code": 503, "json_format": {"error": {"message": "%LOCAL_REPLY_BODY%"}}}]}`,
+			wantMappers: []*LocalReplyMapper{
+				{
+					StatusCode:         404,
+					RequestContentType: "text/html",
+					TextFormat:         "<h1>%LOCAL_REPLY_BODY%</h1>",
+					ContentType:        "text/html",
+				},
+				{
+					StatusCode: 503,
+					JsonFormat: []byte(`{"error": {"message": "%LOCAL_REPLY_BODY%"}}`),
+				},
+			},
+		},
+		{
+			desc:    "Fail without status code or request content type",
+			mappers: `{"mappers": [{"text_format": "%LOCAL_REPLY_BODY%"}]}`,
+			wantErr: "error processing local reply mapper 0: must have status_code or request_content_type",
+		},
+		{
+			desc:    "Fail with invalid status code",
+			mappers: `{"mappers": [{"status_code": 50, "text_format": "%LOCAL_REPLY_BODY%"}]}`,
+			wantErr: "invalid status_code 50",
+		},
+		{
+			desc:    "Fail with both text and JSON formats",
+			mappers: `{"mappers": [{"status_code": 404, "text_format": "%LOCAL_REPLY_BODY%", "json_format": {"message": "%LOCAL_REPLY_BODY%"}}]}`,
+			wantErr: "must have exactly one of text_format or json_format",
+		},
+		{
+			desc:    "Fail with JSON format of an array",
+			mappers: `{"mappers": [{"status_code": 404, "json_format": ["%LOCAL_REPLY_BODY%"]}]}`,
+			wantErr: "json_format must be a JSON object",
+		},
+		{
+			desc:    "Fail with JSON format of a number value",
+			mappers: `{"mappers": [{"status_code": 404, "json_format": {"error": {"code": 404}}}]}`,
+			wantErr: `json_format value of "code" must be a string or an object`,
+		},
+		{
+			desc:    "Fail with invalid JSON",
+			mappers: `{"mappers": [`,
+			wantErr: "fail to unmarshal local reply mappers file",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.LocalReplyMappersFile = writeMappers(fmt.Sprintf("mappers-%d.json", i), tc.mappers)
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(serviceInfo.LocalReplyMappers, tc.wantMappers) {
+			t.Errorf("Test (%s): got LocalReplyMappers: %+v, want: %+v", tc.desc, serviceInfo.LocalReplyMappers, tc.wantMappers)
+		}
+	}
+}
+
+func TestProcessJwtClaimRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt_claim_rules")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeRules := func(name, rules string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListBooks",
+					},
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: fmt.Sprintf("%s.ListBooks", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/tenants/{tenant}/books",
+					},
+				},
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/v1/shelves",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "auth_provider",
+					Issuer:  "issuer",
+					JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: fmt.Sprintf("%s.ListBooks", testApiName),
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "auth_provider",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                  string
+		rules                 string
+		wantClaimRequirements []*ClaimRequirement
+		wantErr               string
+	}{
+		{
+			desc: "Success with claims of all kinds",
+			rules: `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "claims": [
+				{"name": "scope", "contains": "books.read"},
+				{"name": "role", "values": ["admin", "reader"]},
+				{"name": "tenant", "path_variable": "tenant"}]}]}`,
+			wantClaimRequirements: []*ClaimRequirement{
+				{Name: "scope", Contains: "books.read"},
+				{Name: "role", Values: []string{"admin", "reader"}},
+				{Name: "tenant", PathVariable: "tenant"},
+			},
+		},
+		{
+			desc:    "Fail with unknown selector",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.GetBook", "claims": [{"name": "scope", "contains": "books.read"}]}]}`,
+			wantErr: "error processing JWT claim rule for operation (endpoints.examples.bookstore.Bookstore.GetBook): selector not defined",
+		},
+		{
+			desc:    "Fail with operation not requiring authentication",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.ListShelves", "claims": [{"name": "scope", "contains": "books.read"}]}]}`,
+			wantErr: "operation does not require authentication",
+		},
+		{
+			desc:    "Fail with claim of no matcher",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "claims": [{"name": "scope"}]}]}`,
+			wantErr: "claim (scope) must have exactly one of values, contains or path_variable",
+		},
+		{
+			desc:    "Fail with claim of multiple matchers",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "claims": [{"name": "scope", "contains": "books.read", "values": ["books.read"]}]}]}`,
+			wantErr: "claim (scope) must have exactly one of values, contains or path_variable",
+		},
+		{
+			desc:    "Fail with unknown path variable",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.ListBooks", "claims": [{"name": "tenant", "path_variable": "shelf"}]}]}`,
+			wantErr: "claim (tenant) path variable (shelf) does not bind a single segment of http rule (/v1/tenants/{tenant}/books)",
+		},
+		{
+			desc:    "Fail with invalid JSON",
+			rules:   `{"rules": [`,
+			wantErr: "fail to unmarshal JWT claim rules file",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwtClaimRulesFile = writeRules(fmt.Sprintf("rules-%d.json", i), tc.rules)
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		got := serviceInfo.Methods[fmt.Sprintf("%s.ListBooks", testApiName)].ClaimRequirements
+		if !reflect.DeepEqual(got, tc.wantClaimRequirements) {
+			t.Errorf("Test (%s): got ClaimRequirements: %v, want: %v", tc.desc, got, tc.wantClaimRequirements)
+		}
+	}
+}
+
+func TestProcessClientCertRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client_cert_rules")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeRules := func(name, rules string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "DeleteShelf",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                  string
+		rules                 string
+		noRootCerts           bool
+		wantAllowedClientSans []string
+		wantErr               string
+	}{
+		{
+			desc:                  "Success with exact and prefix SANs",
+			rules:                 `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.DeleteShelf", "allowed_sans": ["spiffe://example.org/ns/prod/sa/admin", "spiffe://example.org/ns/ops/*"]}]}`,
+			wantAllowedClientSans: []string{"spiffe://example.org/ns/prod/sa/admin", "spiffe://example.org/ns/ops/*"},
+		},
+		{
+			desc:    "Fail with unknown selector",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.GetShelf", "allowed_sans": ["spiffe://example.org/ns/prod/sa/admin"]}]}`,
+			wantErr: "error processing client certificate rule for operation (endpoints.examples.bookstore.Bookstore.GetShelf): selector not defined",
+		},
+		{
+			desc:    "Fail with empty allowed SANs",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.DeleteShelf"}]}`,
+			wantErr: "allowed_sans is empty",
+		},
+		{
+			desc:    "Fail with wildcard of all SANs",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.DeleteShelf", "allowed_sans": ["*"]}]}`,
+			wantErr: "invalid allowed SAN (*)",
+		},
+		{
+			desc:    "Fail with DNS SAN, as only the first URI SAN of the certificates is compared",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.DeleteShelf", "allowed_sans": ["client.example.com"]}]}`,
+			wantErr: "allowed SAN (client.example.com) is not a URI, such as a SPIFFE ID",
+		},
+		{
+			desc:    "Fail with prefix of URI scheme only",
+			rules:   `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.DeleteShelf", "allowed_sans": ["spiffe://*"]}]}`,
+			wantErr: "allowed SAN (spiffe://*) is not a URI, such as a SPIFFE ID",
+		},
+		{
+			desc:        "Fail without root certs",
+			rules:       `{"rules": []}`,
+			noRootCerts: true,
+			wantErr:     "ssl_downstream_client_cert_rules_file requires ssl_downstream_client_root_certs_path",
+		},
+		{
+			desc:    "Fail with invalid JSON",
+			rules:   `{"rules": [`,
+			wantErr: "fail to unmarshal client certificate rules file",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.SslDownstreamClientCertRulesFile = writeRules(fmt.Sprintf("rules-%d.json", i), tc.rules)
+		if !tc.noRootCerts {
+			opts.SslDownstreamClientRootCertsPath = "/etc/ssl/clients/ca.pem"
+		}
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		got := serviceInfo.Methods[fmt.Sprintf("%s.DeleteShelf", testApiName)].AllowedClientSans
+		if !reflect.DeepEqual(got, tc.wantAllowedClientSans) {
+			t.Errorf("Test (%s): got AllowedClientSans: %v, want: %v", tc.desc, got, tc.wantAllowedClientSans)
+		}
+	}
+}
+
+func TestProcessJwtClaimsToHeaders(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		Authentication: &confpb.Authentication{
+			Providers: []*confpb.AuthProvider{
+				{
+					Id:      "provider_1",
+					Issuer:  "issuer_1",
+					JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+				},
+				{
+					Id:      "provider_2",
+					Issuer:  "issuer_2",
+					JwksUri: "https://www.googleapis.com/oauth2/v3/certs",
+				},
+			},
+			Rules: []*confpb.AuthenticationRule{
+				{
+					Selector: fmt.Sprintf("%s.ListShelves", testApiName),
+					Requirements: []*confpb.AuthRequirement{
+						{
+							ProviderId: "provider_1",
+						},
+						{
+							ProviderId: "provider_2",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                       string
+		jwtClaimsToHeaders         string
+		jwtProviderClaimsToHeaders string
+		wantClaimsToHeaders        []*ClaimToHeader
+		wantClaimHeaderNames       []string
+		wantErr                    string
+	}{
+		{
+			desc: "Success without claims to headers",
+		},
+		{
+			desc:                       "Success with global and provider claims",
+			jwtClaimsToHeaders:         "sub=X-Endpoint-Sub;org.id=X-Endpoint-Org-Id",
+			jwtProviderClaimsToHeaders: "provider_1:email=X-Endpoint-Email;provider_2:email=x-endpoint-email",
+			wantClaimsToHeaders: []*ClaimToHeader{
+				{ClaimName: "sub", HeaderName: "X-Endpoint-Sub"},
+				{ClaimName: "org.id", HeaderName: "X-Endpoint-Org-Id"},
+				{ClaimName: "email", HeaderName: "X-Endpoint-Email"},
+			},
+			wantClaimHeaderNames: []string{"X-Endpoint-Sub", "X-Endpoint-Org-Id", "X-Endpoint-Email"},
+		},
+		{
+			desc:               "Fail with wrong format",
+			jwtClaimsToHeaders: "sub",
+			wantErr:            "invalid JWT claim to header: sub, should be in claim=header format",
+		},
+		{
+			desc:               "Fail with invalid header name",
+			jwtClaimsToHeaders: "sub=X Sub",
+			wantErr:            "invalid JWT claim to header: sub=X Sub, header (X Sub) is not a valid header name",
+		},
+		{
+			desc:               "Fail with empty nested claim",
+			jwtClaimsToHeaders: "org..id=X-Org-Id",
+			wantErr:            "invalid JWT claim to header: org..id=X-Org-Id, claim (org..id) is not a valid claim name",
+		},
+		{
+			desc:                       "Fail with provider claim without provider",
+			jwtProviderClaimsToHeaders: "email=X-Endpoint-Email",
+			wantErr:                    "should be in provider_id:claim=header format",
+		},
+		{
+			desc:                       "Fail with unknown provider",
+			jwtProviderClaimsToHeaders: "provider_3:email=X-Endpoint-Email",
+			wantErr:                    "provider (provider_3) is not defined in Authentication.providers",
+		},
+		{
+			desc:                       "Fail with header set from different claims",
+			jwtClaimsToHeaders:         "sub=X-Endpoint-User",
+			jwtProviderClaimsToHeaders: "provider_2:email=X-Endpoint-User",
+			wantErr:                    "header (X-Endpoint-User) is set from both claim (sub) and claim (email)",
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.JwtClaimsToHeaders = tc.jwtClaimsToHeaders
+		opts.JwtProviderClaimsToHeaders = tc.jwtProviderClaimsToHeaders
+		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		got := serviceInfo.Methods[fmt.Sprintf("%s.ListShelves", testApiName)].ClaimsToHeaders
+		if !reflect.DeepEqual(got, tc.wantClaimsToHeaders) {
+			t.Errorf("Test (%s): got ClaimsToHeaders: %v, want: %v", tc.desc, got, tc.wantClaimsToHeaders)
+		}
+		if !reflect.DeepEqual(serviceInfo.ClaimHeaderNames, tc.wantClaimHeaderNames) {
+			t.Errorf("Test (%s): got ClaimHeaderNames: %v, want: %v", tc.desc, serviceInfo.ClaimHeaderNames, tc.wantClaimHeaderNames)
+		}
+	}
+}
+
+func TestProcessApisIdempotency(t *testing.T) {
+	enumOption, _ := ptypes.MarshalAny(&ptypepb.EnumValue{Name: "NO_SIDE_EFFECTS", Number: 1})
+	numberOption, _ := ptypes.MarshalAny(&wrapperspb.Int32Value{Value: 2})
+	unknownOption, _ := ptypes.MarshalAny(&wrapperspb.StringValue{Value: "IDEMPOTENCY_UNKNOWN"})
+	fakeServiceConfig := &confpb.Service{
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{
+						Name: "GetShelf",
+						Options: []*ptypepb.Option{
+							{
+								Name:  "idempotency_level",
+								Value: enumOption,
+							},
+						},
+					},
+					{
+						Name: "UpdateShelf",
+						Options: []*ptypepb.Option{
+							{
+								Name:  "idempotency_level",
+								Value: numberOption,
+							},
+						},
+					},
+					{
+						Name: "CreateShelf",
+						Options: []*ptypepb.Option{
+							{
+								Name:  "idempotency_level",
+								Value: unknownOption,
+							},
+						},
+					},
+					{
+						Name: "DeleteShelf",
+					},
+				},
+			},
+		},
+	}
+
+	serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, options.DefaultConfigGeneratorOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantIdempotent := map[string]bool{
+		"GetShelf":    true,
+		"UpdateShelf": true,
+		"CreateShelf": false,
+		"DeleteShelf": false,
+	}
+	for name, want := range wantIdempotent {
+		if got := serviceInfo.Methods[fmt.Sprintf("%s.%s", testApiName, name)].IsIdempotent; got != want {
+			t.Errorf("got IsIdempotent %v for %s, want %v", got, name, want)
+		}
+	}
+}
+
+func TestProcessApis(t *testing.T) {
+	testData := []struct {
+		desc              string
+		fakeServiceConfig *confpb.Service
+		wantMethods       map[string]*MethodInfo
+		wantApiNames      []string
+	}{
+		{
+			desc: "Succeed, process multiple apis",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: "api-1",
+						Methods: []*apipb.Method{
+							{
+								Name:           "foo",
+								RequestTypeUrl: "type.googleapis.com/google.protobuf.Empty",
+							},
+							{
+								Name:           "bar",
+								RequestTypeUrl: "type.googleapis.com/CreateShelfRequest",
+							},
+						},
+					},
+					{
+						Name: "api-2",
+						Methods: []*apipb.Method{
+							{
+								Name:           "foo",
+								RequestTypeUrl: "type.googleapis.com/CreateBookRequest",
+							},
+							{
+								Name:           "bar",
+								RequestTypeUrl: "type.googleapis.com/CreateShelfRequest",
+							},
+						},
+					},
+					{
+						Name:    "api-3",
+						Methods: []*apipb.Method{},
+					},
+					{
+						Name: "api-4",
+						Methods: []*apipb.Method{
+							{
+								Name: "bar",
+								// Missing request type.
+							},
+							{
+								Name:           "baz",
+								RequestTypeUrl: "types.MALFORMED.com/google.protobuf.Empty",
+							},
+						},
+					},
+				},
+			},
+			wantMethods: map[string]*MethodInfo{
+				"api-1.foo": {
+					ShortName:       "foo",
+					ApiName:         "api-1",
+					RequestTypeName: "google.protobuf.Empty",
+				},
+				"api-1.bar": {
+					ShortName:       "bar",
+					ApiName:         "api-1",
+					RequestTypeName: "CreateShelfRequest",
+				},
+				"api-2.foo": {
+					ShortName:       "foo",
+					ApiName:         "api-2",
+					RequestTypeName: "CreateBookRequest",
+				},
+				"api-2.bar": {
+					ShortName:       "bar",
+					ApiName:         "api-2",
+					RequestTypeName: "CreateShelfRequest",
+				},
+				"api-4.bar": {
+					ShortName: "bar",
+					ApiName:   "api-4",
+				},
+				"api-4.baz": {
+					ShortName: "baz",
+					ApiName:   "api-4",
+				},
+			},
+			wantApiNames: []string{
+				"api-1",
+				"api-2",
+				"api-3",
+				"api-4",
+			},
+		},
+	}
+
+	for _, tc := range testData {
+
+		serviceInfo := &ServiceInfo{
+			serviceConfig: tc.fakeServiceConfig,
+			Methods:       make(map[string]*MethodInfo),
+		}
+		_ = serviceInfo.processApis()
+
+		for key, gotMethod := range serviceInfo.Methods {
+			wantMethod := tc.wantMethods[key]
+			if eq := cmp.Equal(gotMethod, wantMethod, cmp.Comparer(proto.Equal)); !eq {
+				t.Errorf("Test(%v) failed: \n got Method: %v,\nwant Method: %v", tc.desc, gotMethod, wantMethod)
+			}
+		}
+		for idx, gotApiName := range serviceInfo.ApiNames {
+			wantApiName := tc.wantApiNames[idx]
+			if gotApiName != wantApiName {
+				t.Errorf("Test(%v) failed: \n got ApiName: %v,\nwant Apiname: %v", tc.desc, gotApiName, wantApiName)
+			}
+		}
+	}
+}
+
+func TestProcessApisForGrpc(t *testing.T) {
+	testData := []struct {
+		desc              string
+		fakeServiceConfig *confpb.Service
+		wantMethods       map[string]*MethodInfo
+		wantApiNames      []string
+		wantError         string
+	}{
+		{
+			desc: "Process API with unary and streaming gRPC methods",
+			fakeServiceConfig: &confpb.Service{
+				Apis: []*apipb.Api{
+					{
+						Name: "api-streaming-test",
+						Methods: []*apipb.Method{
+							{
+								Name: "unary",
+							},
+							{
+								Name:             "streaming_request",
+								RequestStreaming: true,
+							},
+							{
 								Name:              "streaming_response",
 								ResponseStreaming: true,
 							},
@@ -3517,6 +5394,8 @@ func TestProcessAccessToken(t *testing.T) {
 	testCases := []struct {
 		desc              string
 		serviceAccountKey string
+		tokenAgentSocket  string
+		tokenAgentSecret  string
 		wantAccessToken   *commonpb.AccessToken
 	}{
 		{
@@ -3544,11 +5423,44 @@ func TestProcessAccessToken(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc:              "get access token from lmds with the shared secret",
+			serviceAccountKey: "this-is-service-account-key",
+			tokenAgentSecret:  "this-is-secret",
+			wantAccessToken: &commonpb.AccessToken{
+				TokenType: &commonpb.AccessToken_RemoteToken{
+					RemoteToken: &commonpb.HttpUri{
+						Uri:     "http://127.0.0.1:8791/local/access_token",
+						Cluster: "token-agent-cluster",
+						Timeout: ptypes.DurationProto(30 * time.Second),
+						RequestHeaders: map[string]string{
+							"X-Token-Agent-Secret": "this-is-secret",
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:              "get access token from lmds over the Unix domain socket",
+			serviceAccountKey: "this-is-service-account-key",
+			tokenAgentSocket:  "/tmp/token-agent.sock",
+			wantAccessToken: &commonpb.AccessToken{
+				TokenType: &commonpb.AccessToken_RemoteToken{
+					RemoteToken: &commonpb.HttpUri{
+						Uri:     "http://localhost/local/access_token",
+						Cluster: "token-agent-cluster",
+						Timeout: ptypes.DurationProto(30 * time.Second),
+					},
+				},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		opts := options.DefaultConfigGeneratorOptions()
 		opts.ServiceAccountKey = tc.serviceAccountKey
+		opts.TokenAgentSocket = tc.tokenAgentSocket
+		opts.TokenAgentSecret = tc.tokenAgentSecret
 		serviceInfo, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, "ConfigID", opts)
 		if err != nil {
 			t.Fatal(err)
@@ -16,12 +16,14 @@ package configmanager
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
@@ -32,16 +34,20 @@ import (
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 
 	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 )
 
 var (
 	// These flags are used by config manage only.
 	checkNewRolloutInterval = flag.Duration("check_rollout_interval", 60*time.Second, `the interval periodically to call servicemanagment to check the latest rolloutil.`)
+	checkLocalJwksInterval  = flag.Duration("check_local_jwks_interval", 10*time.Second, `the interval periodically to check the local JWKS files for key rotation.`)
+	checkTlsCertsInterval   = flag.Duration("check_tls_certificates_interval", 10*time.Second, `the interval periodically to check the TLS files of the SDS secrets for certificate rotation.`)
 	CheckMetadata           = flag.Bool("check_metadata", false, `enable fetching service name, config ID and rollout strategy from service metadata server`)
 	RolloutStrategy         = flag.String("rollout_strategy", "fixed", `service config rollout strategy, must be either "managed" or "fixed"`)
 	ServiceConfigId         = flag.String("service_config_id", "", "initial service config id")
@@ -56,6 +62,9 @@ var (
 // Config Manager handles service configuration fetching and updating.
 // TODO(jilinxia): handles multi service name.
 type ConfigManager struct {
+	// Cancels the calls to fetch the service configs, and stops the rollout
+	// detection.
+	ctx                context.Context
 	serviceName        string
 	envoyConfigOptions options.ConfigGeneratorOptions
 	serviceInfo        *configinfo.ServiceInfo
@@ -66,12 +75,25 @@ type ConfigManager struct {
 	rolloutIdChangeDetector *sc.RolloutIdChangeDetector
 
 	curServiceConfig *confpb.Service
+
+	// Guards applying service configs, from the rollout detector and the
+	// local JWKS watcher.
+	applyMux sync.Mutex
+	// The times the current config is re-applied for rotated local JWKS.
+	localJwksReloads   int
+	localJwksWatchOnce sync.Once
+	// The SDS secrets of the current snapshot, and the times they are
+	// reloaded for rotated TLS files.
+	secrets          []*tlspb.Secret
+	secretsReloads   int
+	secretsWatchOnce sync.Once
 }
 
 // NewConfigManager creates new instance of Config Manager.
 // mf is set to nil on non-gcp deployments
-func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) (*ConfigManager, error) {
+func NewConfigManager(ctx context.Context, mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) (*ConfigManager, error) {
 	m := &ConfigManager{
+		ctx:                ctx,
 		metadataFetcher:    mf,
 		envoyConfigOptions: opts,
 	}
@@ -165,7 +187,7 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 			}
 		}
 	} else if rolloutStrategy == util.ManagedRolloutStrategy {
-		configId, err = m.serviceConfigFetcher.LoadConfigIdFromRollouts()
+		configId, err = m.serviceConfigFetcher.LoadConfigIdFromRollouts(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -177,8 +199,8 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 
 	if rolloutStrategy == util.ManagedRolloutStrategy {
 		m.rolloutIdChangeDetector = sc.NewRolloutIdChangeDetector(client, opts.ServiceControlURL, m.serviceName, accessToken)
-		m.rolloutIdChangeDetector.SetDetectRolloutIdChangeTimer(*checkNewRolloutInterval, func() {
-			latestConfigId, err := m.serviceConfigFetcher.LoadConfigIdFromRollouts()
+		m.rolloutIdChangeDetector.SetDetectRolloutIdChangeTimer(ctx, *checkNewRolloutInterval, func() {
+			latestConfigId, err := m.serviceConfigFetcher.LoadConfigIdFromRollouts(ctx)
 			if err != nil {
 				glog.Errorf("error occurred when getting configId by fetching rollout, %v", err)
 				return
@@ -201,7 +223,7 @@ func (m *ConfigManager) fetchAndApplyServiceConfig(latestConfigId string) error
 		return nil
 	}
 
-	serviceConfig, err := m.serviceConfigFetcher.FetchConfig(latestConfigId)
+	serviceConfig, err := m.serviceConfigFetcher.FetchConfig(m.ctx, latestConfigId)
 	if err != nil {
 		return err
 	}
@@ -228,6 +250,8 @@ func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error
 	if serviceConfig == nil {
 		return fmt.Errorf("applid service config is empty")
 	}
+	m.applyMux.Lock()
+	defer m.applyMux.Unlock()
 
 	var err error
 	m.curServiceConfig = serviceConfig
@@ -245,6 +269,105 @@ func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error
 		}
 	}
 
+	snapshot, err := m.makeSnapshot()
+	if err != nil {
+		return fmt.Errorf("fail to make a snapshot, %s", err)
+	}
+	if err := m.cache.SetSnapshot(m.envoyConfigOptions.Node, *snapshot); err != nil {
+		return err
+	}
+
+	if len(m.serviceInfo.LocalJwksFiles) != 0 {
+		m.localJwksWatchOnce.Do(func() {
+			m.watchLocalJwks(*checkLocalJwksInterval)
+		})
+	}
+	if len(m.secrets) != 0 {
+		m.secretsWatchOnce.Do(func() {
+			m.watchSecrets(*checkTlsCertsInterval)
+		})
+	}
+	return nil
+}
+
+// watchLocalJwks periodically checks the local JWKS files, and re-applies the
+// current service config with the new keys when any of them is changed.
+func (m *ConfigManager) watchLocalJwks(interval time.Duration) {
+	go func() {
+		glog.Infof("start checking local JWKS files every %v", interval)
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			changed, err := m.localJwksChanged()
+			if err != nil {
+				glog.Errorf("error occurred when checking local JWKS files, keep the current ones: %v", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			m.applyMux.Lock()
+			m.localJwksReloads += 1
+			serviceConfig := m.curServiceConfig
+			m.applyMux.Unlock()
+			if err := m.applyServiceConfig(serviceConfig); err != nil {
+				glog.Errorf("error occurred when applying rotated local JWKS, %v", err)
+			}
+		}
+	}()
+}
+
+func (m *ConfigManager) localJwksChanged() (bool, error) {
+	m.applyMux.Lock()
+	defer m.applyMux.Unlock()
+
+	for id, path := range m.serviceInfo.LocalJwksFiles {
+		jwks, err := configinfo.ReadLocalJwks(path)
+		if err != nil {
+			return false, fmt.Errorf("provider (%v): %v", id, err)
+		}
+		if jwks != m.serviceInfo.LocalJwks[id] {
+			glog.Infof("JWKS file %s of provider (%v) is changed", path, id)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// watchSecrets periodically reloads the SDS secrets from their TLS files, and
+// pushes the secrets with a new version when any of them is changed.
+func (m *ConfigManager) watchSecrets(interval time.Duration) {
+	go func() {
+		glog.Infof("start checking TLS files of SDS secrets every %v", interval)
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := m.reloadSecrets(); err != nil {
+				glog.Errorf("error occurred when reloading SDS secrets, keep the current ones: %v", err)
+			}
+		}
+	}()
+}
+
+func (m *ConfigManager) reloadSecrets() error {
+	m.applyMux.Lock()
+	defer m.applyMux.Unlock()
+
+	changed := false
+	for _, secret := range m.secrets {
+		newSecret, err := util.MakeSdsSecret(secret.GetName())
+		if err != nil {
+			return err
+		}
+		if !proto.Equal(newSecret, secret) {
+			glog.Infof("TLS files of SDS secret (%v) are changed", secret.GetName())
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	m.secretsReloads += 1
 	snapshot, err := m.makeSnapshot()
 	if err != nil {
 		return fmt.Errorf("fail to make a snapshot, %s", err)
@@ -273,7 +396,18 @@ func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
 		listenerResources = append(listenerResources, lis)
 	}
 
-	snapshot := cache.NewSnapshot(m.curConfigId(), endpoints, clusterResources, routes, listenerResources, runtimes, secrets)
+	m.secrets, err = gen.MakeSecrets(clusters, listeners)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range m.secrets {
+		secrets = append(secrets, secret)
+	}
+
+	snapshot := cache.NewSnapshot(m.snapshotVersion(), endpoints, clusterResources, routes, listenerResources, runtimes, secrets)
+	// The secrets have their own version, so that the rotated certificates are
+	// pushed without updating the clusters and listeners.
+	snapshot.Resources[types.Secret] = cache.NewResources(m.secretsVersion(), secrets)
 	m.Infof("Envoy Dynamic Configuration is cached for service: %v", m.serviceName)
 	return &snapshot, nil
 }
@@ -285,6 +419,24 @@ func (m *ConfigManager) curConfigId() string {
 	return m.curServiceConfig.Id
 }
 
+// snapshotVersion is the config id, suffixed when the config is re-applied
+// for rotated local JWKS so that envoy picks up the new snapshot.
+func (m *ConfigManager) snapshotVersion() string {
+	if m.localJwksReloads == 0 {
+		return m.curConfigId()
+	}
+	return fmt.Sprintf("%s-jwks%d", m.curConfigId(), m.localJwksReloads)
+}
+
+// secretsVersion is the snapshot version, suffixed when the secrets are
+// reloaded for rotated TLS files.
+func (m *ConfigManager) secretsVersion() string {
+	if m.secretsReloads == 0 {
+		return m.snapshotVersion()
+	}
+	return fmt.Sprintf("%s-certs%d", m.snapshotVersion(), m.secretsReloads)
+}
+
 func (m *ConfigManager) ID(node *corepb.Node) string {
 	return node.GetId()
 }
@@ -17,8 +17,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -28,7 +31,6 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/testdata"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
-	"github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
@@ -40,6 +42,7 @@ import (
 
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	servicecontrolpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
@@ -194,45 +197,44 @@ func TestRetryCallServiceManagement(t *testing.T) {
 		}))
 	}
 
+	originalPolicy := util.ServiceManagementRetryPolicy
+	defer func() { util.ServiceManagementRetryPolicy = originalPolicy }()
+
+	// The retry intervals are randomized by +/-50%.
 	var testData = []struct {
-		desc          string
-		retryNum      int
-		retryInterval int
-		retryConfigs  map[int]util.RetryConfig
-		wantedError   string
+		desc        string
+		retryPolicy *util.RetryPolicy
+		wantedError string
 	}{
 		{
 			desc: "fail, retryInterval is too short",
-			retryConfigs: map[int]util.RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      3,
-					RetryInterval: time.Millisecond * 100,
-				},
+			retryPolicy: &util.RetryPolicy{
+				MaxRetries:      3,
+				InitialInterval: time.Millisecond * 10,
+				MaxInterval:     time.Millisecond * 20,
 			},
 			wantedError: "fail to fetch and apply the startup service config",
 		},
 		{
 			desc: "fail, insufficient retryNum",
-			retryConfigs: map[int]util.RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      2,
-					RetryInterval: time.Millisecond * 200,
-				},
+			retryPolicy: &util.RetryPolicy{
+				MaxRetries:      2,
+				InitialInterval: time.Millisecond * 400,
+				MaxInterval:     time.Second,
 			},
 			wantedError: "fail to fetch and apply the startup service config",
 		},
 		{
 			desc: "Success, sufficient retryNum and long enough retryInterval",
-			retryConfigs: map[int]util.RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      3,
-					RetryInterval: time.Millisecond * 200,
-				},
+			retryPolicy: &util.RetryPolicy{
+				MaxRetries:      3,
+				InitialInterval: time.Millisecond * 400,
+				MaxInterval:     time.Second,
 			},
 		},
 	}
 	for _, tc := range testData {
-		serviceconfig.SmRetryConfigs = tc.retryConfigs
+		util.ServiceManagementRetryPolicy = tc.retryPolicy
 
 		setFlags(testdata.TestFetchListenersProjectName, testdata.TestFetchListenersConfigID, util.FixedRolloutStrategy, "100ms", "")
 
@@ -309,7 +311,7 @@ func TestFixedModeDynamicRouting(t *testing.T) {
 
 		_ = flag.Set("service_json_path", tc.serviceConfigPath)
 
-		manager, err := NewConfigManager(nil, opts)
+		manager, err := NewConfigManager(context.Background(), nil, opts)
 		if err != nil {
 			t.Fatal("fail to initialize Config Manager: ", err)
 		}
@@ -398,6 +400,189 @@ func TestFixedModeDynamicRouting(t *testing.T) {
 	}
 }
 
+func TestLocalJwksRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_jwks")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, []byte(`{"keys": [{"kid": "key-1"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	serviceConfigFile := filepath.Join(dir, "service.json")
+	if err := ioutil.WriteFile(serviceConfigFile, []byte(fmt.Sprintf(`{
+  "name": "%s",
+  "id": "%s",
+  "apis": [{"name": "endpoints.examples.bookstore.Bookstore", "methods": [{"name": "ListShelves"}]}],
+  "authentication": {"providers": [{"id": "local_provider", "issuer": "issuer", "jwksUri": "file://%s"}]}
+}`, testdata.TestFetchListenersProjectName, testdata.TestFetchListenersConfigID, jwksFile)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = flag.Set("service_json_path", serviceConfigFile)
+	_ = flag.Set("check_local_jwks_interval", "50ms")
+	defer func() {
+		_ = flag.Set("service_json_path", "")
+		_ = flag.Set("check_local_jwks_interval", "10s")
+	}()
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	manager, err := NewConfigManager(context.Background(), nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	_, resp, gotListeners, err := getListeners(manager, opts)
+	if err != nil {
+		t.Fatalf("fail to get listeners: %v", err)
+	}
+	if version, _ := resp.GetVersion(); version != testdata.TestFetchListenersConfigID {
+		t.Errorf("got snapshot version: %s, want: %s", version, testdata.TestFetchListenersConfigID)
+	}
+	if !strings.Contains(gotListeners, "key-1") {
+		t.Errorf("got listeners without the local JWKS: %s", gotListeners)
+	}
+
+	// The rotated JWKS is pushed with a new snapshot version.
+	if err := ioutil.WriteFile(jwksFile, []byte(`{"keys": [{"kid": "key-2"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, resp, gotListeners, err = getListeners(manager, opts)
+		if err == nil && strings.Contains(gotListeners, "key-2") {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !strings.Contains(gotListeners, "key-2") {
+		t.Fatalf("got listeners without the rotated JWKS: %s", gotListeners)
+	}
+	if version, _ := resp.GetVersion(); version == testdata.TestFetchListenersConfigID {
+		t.Errorf("got unchanged snapshot version: %s after the JWKS rotation", version)
+	}
+
+	// A broken JWKS file keeps the current keys.
+	if err := ioutil.WriteFile(jwksFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, _, gotListeners, err = getListeners(manager, opts); err != nil || !strings.Contains(gotListeners, "key-2") {
+		t.Errorf("got listeners: %s, error: %v, want the current JWKS kept", gotListeners, err)
+	}
+}
+
+func TestSdsSecretsRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sds_secrets")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"server.crt": "cert-1",
+		"server.key": "key-1",
+		"ca.pem":     "root-certs",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serviceConfigFile := filepath.Join(dir, "service.json")
+	if err := ioutil.WriteFile(serviceConfigFile, []byte(fmt.Sprintf(`{
+  "name": "%s",
+  "id": "%s",
+  "apis": [{"name": "endpoints.examples.bookstore.Bookstore", "methods": [{"name": "ListShelves"}]}]
+}`, testdata.TestFetchListenersProjectName, testdata.TestFetchListenersConfigID)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = flag.Set("service_json_path", serviceConfigFile)
+	_ = flag.Set("check_tls_certificates_interval", "50ms")
+	defer func() {
+		_ = flag.Set("service_json_path", "")
+		_ = flag.Set("check_tls_certificates_interval", "10s")
+	}()
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	opts.EnableSdsCertificates = true
+	opts.SslServerCertPath = dir
+	opts.SslSidestreamClientRootCertsPath = filepath.Join(dir, "ca.pem")
+	opts.SslBackendClientRootCertsPath = filepath.Join(dir, "ca.pem")
+	manager, err := NewConfigManager(context.Background(), nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	serverCertSecretName := util.TlsCertificateSecretName(filepath.Join(dir, "server"))
+	getServerCert := func() (string, string) {
+		resp, err := manager.cache.Fetch(context.Background(), &discoverypb.DiscoveryRequest{
+			Node: &corepb.Node{
+				Id: opts.Node,
+			},
+			TypeUrl:       resource.SecretType,
+			ResourceNames: []string{serverCertSecretName},
+		})
+		if err != nil {
+			t.Fatalf("fail to get secrets: %v", err)
+		}
+		discoveryResp, err := resp.GetDiscoveryResponse()
+		if err != nil || len(discoveryResp.Resources) != 1 {
+			t.Fatalf("got secrets: %v, error: %v, want the server certificate", discoveryResp, err)
+		}
+		secret := &tlspb.Secret{}
+		if err := ptypes.UnmarshalAny(discoveryResp.Resources[0], secret); err != nil {
+			t.Fatal(err)
+		}
+		return discoveryResp.VersionInfo, string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+	}
+
+	version, cert := getServerCert()
+	if version != testdata.TestFetchListenersConfigID || cert != "cert-1" {
+		t.Errorf("got secret version: %s, certificate: %s, want: %s, cert-1", version, cert, testdata.TestFetchListenersConfigID)
+	}
+	_, resp, _, err := getListeners(manager, opts)
+	if err != nil {
+		t.Fatalf("fail to get listeners: %v", err)
+	}
+	listenerVersion, _ := resp.GetVersion()
+
+	// The rotated certificate is pushed with a new secret version, while the
+	// listeners are unchanged.
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.crt"), []byte("cert-2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if version, cert = getServerCert(); cert == "cert-2" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if cert != "cert-2" || version == testdata.TestFetchListenersConfigID {
+		t.Fatalf("got secret version: %s, certificate: %s, want the rotated certificate with a new version", version, cert)
+	}
+	if _, resp, _, err = getListeners(manager, opts); err != nil {
+		t.Fatalf("fail to get listeners: %v", err)
+	}
+	if gotVersion, _ := resp.GetVersion(); gotVersion != listenerVersion {
+		t.Errorf("got listener version: %s, want unchanged: %s", gotVersion, listenerVersion)
+	}
+
+	// A missing key file keeps the current secrets.
+	if err := os.Remove(filepath.Join(dir, "server.key")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, cert = getServerCert(); cert != "cert-2" {
+		t.Errorf("got certificate: %s, want the current one kept", cert)
+	}
+}
+
 func TestServiceConfigAutoUpdate(t *testing.T) {
 	var fakeConfig, fakeScReport, fakeRollouts safeData
 
@@ -626,7 +811,7 @@ func runTest(t *testing.T, fakeScReport, fakeRollouts, fakeConfig *safeData, opt
 
 	opts.SslSidestreamClientRootCertsPath = platform.GetFilePath(platform.TestRootCaCerts)
 
-	f(NewConfigManager(metadataFetcher, opts))
+	f(NewConfigManager(context.Background(), metadataFetcher, opts))
 }
 
 type safeData struct {
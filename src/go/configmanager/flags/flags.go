@@ -40,6 +40,15 @@ var (
 	CorsAllowOriginRegex = flag.String("cors_allow_origin_regex", "", "set Access-Control-Allow-Origin to a regular expression")
 	CorsExposeHeaders    = flag.String("cors_expose_headers", "", "set Access-Control-Expose-Headers to the specified headers")
 	CorsPreset           = flag.String("cors_preset", "", `enable CORS support, must be either "basic" or "cors_with_regex"`)
+	CorsPoliciesFile     = flag.String("cors_policies_file", "", `Path to a JSON file of the CORS policies per operation, overriding the one of the --cors_* flags.
+	For example {"policies": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateBook", "allow_origin": "https://app.example.com", "allow_credentials": true}]}.
+	A policy has exactly one of "allow_origin" or "allow_origin_regex", and optionally "allow_methods", "allow_headers", "expose_headers" and "allow_credentials".
+	The preflight requests to the paths of the operations are answered with their policies, so the operations on the same path must have the same policy.`)
+
+	CorsAllowOrigins        = flag.String("cors_allow_origins", "", "set Access-Control-Allow-Origin to one of the specified origins, separated by ','")
+	CorsAllowOriginSuffixes = flag.String("cors_allow_origin_suffixes", "", `set Access-Control-Allow-Origin to the origins ending with one of the specified suffixes, separated by ','. Each suffix must start with '.', such as ".example.com"`)
+	CorsMaxAge              = flag.Duration("cors_max_age", 0, "set Access-Control-Max-Age to the specified duration in whole seconds, so the browsers cache the preflight responses")
+	CorsAllowPrivateNetwork = flag.Bool("cors_allow_private_network", false, "include the Access-Control-Allow-Private-Network header with the value true in the preflight responses requesting private network access")
 
 	// Backend routing configurations.
 	BackendDnsLookupFamily = flag.String("backend_dns_lookup_family", "auto", `Define the dns lookup family for all backends. The options are "auto", "v4only" and "v6only". The default is "auto".`)
@@ -54,8 +63,9 @@ var (
 	ServiceControlURL            = flag.String("service_control_url", "https://servicecontrol.googleapis.com", "url of service control server")
 	EnableBackendAddressOverride = flag.Bool("enable_backend_address_override", false, "Allow the --backend flag to override the backend.rule.address for all operations.")
 
-	ListenerPort = flag.Int("listener_port", 8080, "listener port")
-	Healthz      = flag.String("healthz", "", "path for health check of ESPv2 proxy itself")
+	ListenerPort   = flag.Int("listener_port", 8080, "listener port")
+	Healthz        = flag.String("healthz", "", "path for health check of ESPv2 proxy itself")
+	OpenApiDocPath = flag.String("openapi_doc_path", "", "path to serve the OpenAPI v3 document generated from the service config, e.g. /openapi.json")
 
 	SslServerCertPath                = flag.String("ssl_server_cert_path", "", "Path to the certificate and key that ESPv2 uses to act as a HTTPS server")
 	SslServerCipherSuites            = flag.String("ssl_server_cipher_suites", "", "Cipher suites to use for downstream connections as a comma-separated list.")
@@ -68,6 +78,26 @@ var (
 	EnableHSTS                       = flag.Bool("enable_strict_transport_security", false, "Enable HSTS (HTTP Strict Transport Security).")
 	DnsResolverAddresses             = flag.String("dns_resolver_addresses", "", `The addresses of dns resolvers. Each address should be in format of either IP_ADDR or IP_ADDR:PORT and they are separated by ';'.`)
 
+	SslDownstreamClientRootCertsPath = flag.String("ssl_downstream_client_root_certs_path", "", "Path to the root certificates of the client certificates, which enables the mutual TLS of the downstream connections. It requires --ssl_server_cert_path.")
+	SslDownstreamClientCertMode      = flag.String("ssl_downstream_client_cert_mode", "require", `Whether the client certificates are "require"d or "optional". The optional client certificates are still validated if presented.`)
+	SslDownstreamClientAllowedSans   = flag.String("ssl_downstream_client_allowed_sans", "", `The subject alternative names allowed in the client certificates for all the operations, separated by ','. A certificate is allowed if any of its SANs matches.
+	The names ending with '*' are matched by prefix, such as "spiffe://example.org/ns/prod/*".`)
+	SslDownstreamClientCertRulesFile = flag.String("ssl_downstream_client_cert_rules_file", "", `Path to a JSON file of the URI subject alternative names, such as SPIFFE IDs, allowed per operation. The names ending with '*' are matched by prefix.
+	Unlike --ssl_downstream_client_allowed_sans, only the first URI SAN of a certificate is compared, so its other SANs never allow the operation, and other kinds of SANs are rejected.
+	For example {"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.DeleteShelf", "allowed_sans": ["spiffe://example.org/ns/prod/sa/admin"]}]}.`)
+	SslDownstreamClientForwardCertDetails = flag.String("ssl_downstream_client_forward_cert_details", "subject,uri", `The client certificate details forwarded to the backends in the x-forwarded-client-cert header, separated by ','. The options are "subject", "uri", "dns", "cert" and "chain". The header sent by the clients is always replaced.`)
+
+	EnableSdsCertificates = flag.Bool("enable_sds_certificates", false, `Serve the TLS certificates and root certificates as SDS secrets, which are pushed to Envoy when the files are changed. The files are checked every --check_tls_certificates_interval.`)
+
+	EnableSecurityHeaders = flag.Bool("enable_security_headers", false, `Add the security headers to all the responses, including the ones generated by the proxy, unless the backends set them. The headers are Strict-Transport-Security, X-Content-Type-Options: nosniff, X-Frame-Options, Referrer-Policy and Content-Security-Policy.
+	It replaces the Strict-Transport-Security header of --enable_strict_transport_security.`)
+	SecurityHeadersHstsMaxAge            = flag.Duration("security_headers_hsts_max_age", 365*24*time.Hour, "The max-age of the Strict-Transport-Security header in whole seconds, which always includes subdomains.")
+	SecurityHeadersHstsPreload           = flag.Bool("security_headers_hsts_preload", false, "Add the preload directive to the Strict-Transport-Security header, which requires --security_headers_hsts_max_age of at least one year.")
+	SecurityHeadersFrameOptions          = flag.String("security_headers_frame_options", "DENY", `The value of the X-Frame-Options header, "DENY" or "SAMEORIGIN". The header is not added if empty.`)
+	SecurityHeadersReferrerPolicy        = flag.String("security_headers_referrer_policy", "strict-origin-when-cross-origin", "The value of the Referrer-Policy header. The header is not added if empty.")
+	SecurityHeadersContentSecurityPolicy = flag.String("security_headers_content_security_policy", "", "The value of the Content-Security-Policy header. The header is not added if empty.")
+	SecurityHeadersStrip                 = flag.String("security_headers_strip", "server,x-powered-by", `The backend response headers removed, separated by ','. The proxy does not add its own Server header if "server" is removed.`)
+
 	AddRequestHeaders = flag.String("add_request_headers", "", `Add HTTP headers to the request before sent to the upstream backend. Multiple headers are separated by ';'.
          For example --add_request_headers=key1=value1;key2=value2. If a header is already in the request, its value will be replaced with the new one.`)
 	AppendRequestHeaders = flag.String("append_request_headers", "", `Append HTTP headers to the request before sent to the upstream backend. Multiple headers are separated by ';'.
@@ -80,8 +110,11 @@ var (
 	// Flags for non_gcp deployment.
 	ServiceAccountKey = flag.String("service_account_key", "", `Use the service account key JSON file to access the service control and the
 	service management.  You can also set {creds_key} environment variable to the location of the service account credentials JSON file. If the option is
-  omitted, the proxy contacts the metadata service to fetch an access token`)
-	TokenAgentPort = flag.Uint("token_agent_port", 8791, "Port that configmanager use to setup server to provide envoy with access token using service account credential, for accessing servicecontrol.")
+  omitted, the proxy contacts the metadata service to fetch an access token. An external_account credential config of workload identity federation
+  is also accepted, with file or url sourced subject tokens exchanged through STS; it needs a service_account_impersonation_url for backend
+  authentication, whose ID tokens are generated by IAM for the impersonated service account`)
+	TokenAgentPort   = flag.Uint("token_agent_port", 8791, "Port that configmanager use to setup server to provide envoy with access token using service account credential, for accessing servicecontrol.")
+	TokenAgentSocket = flag.String("token_agent_socket", "", "If set, the token agent listens on this Unix domain socket instead of --token_agent_port.")
 
 	// Flags for external calls.
 	DisableOidcDiscovery = flag.Bool("disable_oidc_discovery", false, `Disable OpenID Connect Discovery. 
@@ -124,6 +157,42 @@ var (
 			If not provided, Envoy will decide the default value.`)
 
 	JwksCacheDurationInS = flag.Int("jwks_cache_duration_in_s", 300, "Specify JWT public key cache duration in seconds. The default is 5 minutes.")
+	JwksLocalFiles       = flag.String("jwks_local_files", "", `Read the JWKS of authentication providers from local files instead of their jwks_uri, for air-gapped deployments.
+	Multiple providers are separated by ';'. For example --jwks_local_files=provider1=/etc/jwks/provider1.json;provider2=/etc/jwks/provider2.json.
+	A jwks_uri of file:///etc/jwks/provider.json is read from the local file too. The files are watched for key rotation.`)
+	JwtCookieLocations = flag.String("jwt_cookie_locations", "", `Extract the JWT of authentication providers from cookies, in addition to their jwt_locations, for browser-facing APIs.
+	Multiple cookies are separated by ';'. For example --jwt_cookie_locations=provider1=session_token;provider2=id_token. The cookie names are matched exactly.`)
+	JwtClaimRulesFile = flag.String("jwt_claim_rules_file", "", `Path to a JSON file of the JWT claims required to call the operations, enforced after JWT authentication.
+	For example {"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.CreateBook", "claims": [{"name": "scope", "contains": "books.write"}, {"name": "tenant", "path_variable": "tenant"}]}]}.
+	A claim matches with one of "values", the word or list item in "contains", or the value of the single-segment "path_variable" of the request path.`)
+	JwtClaimsToHeaders = flag.String("jwt_claims_to_headers", "", `Forward claims of the verified JWT to the backend as request headers, for the operations requiring authentication.
+	Multiple claims are separated by ';'. For example --jwt_claims_to_headers=sub=X-Endpoint-Sub;org.id=X-Endpoint-Org-Id, where nested claims are separated by '.'.
+	Client-supplied headers with the same names are removed from all requests to prevent spoofing.`)
+	JwtProviderClaimsToHeaders = flag.String("jwt_provider_claims_to_headers", "", `Same as --jwt_claims_to_headers, but only for the operations requiring the provider of the claim.
+	For example --jwt_provider_claims_to_headers=google_id_token:email=X-Endpoint-Email;firebase:user_id=X-Endpoint-User-Id.`)
+
+	RateLimitServiceAddress = flag.String("rate_limit_service_address", "", `The address of an external rate limit service implementing the Envoy RLS v3 API, in format of grpc://HOST:PORT or grpcs://HOST:PORT.
+	If set, ESPv2 sends the operation name and the consumer identity of each request to the service, so the rate limits are shared across all of the ESPv2 instances.
+	Without service control, this is how the quota limits of the service config are enforced per consumer, such as by the rate limit emulator of ESPv2, which has one counter per consumer and quota metric.`)
+	RateLimitConsumer = flag.String("rate_limit_consumer", "client_ip", `The consumer identity sent to the rate limit service, one of "api_key", "jwt_subject" or "client_ip".
+	"api_key" is read from the API key headers of the operation, and "jwt_subject" from the "sub" claim of the verified JWT. Requests without the identity are not rate limited.`)
+
+	ExtAuthzAddress = flag.String("ext_authz_address", "", `The address of an external authorization service, which must approve the requests after JWT authentication.
+	In format of grpc://HOST:PORT or grpcs://HOST:PORT for the Envoy ext_authz gRPC API, or http(s)://HOST:PORT[/PATH_PREFIX] for an HTTP authorization service.`)
+	ExtAuthzTimeout          = flag.Duration("ext_authz_timeout", 200*time.Millisecond, "The timeout of the requests to the external authorization service.")
+	ExtAuthzFailureModeAllow = flag.Bool("ext_authz_failure_mode_allow", false, "Allow the requests when the external authorization service fails to respond. The requests are rejected by default.")
+	ExtAuthzSelectors        = flag.String("ext_authz_selectors", "", `The operation selectors checked by the external authorization service, separated by ','. All of the operations are checked if not set.`)
+	ExtAuthzAllowedHeaders   = flag.String("ext_authz_allowed_headers", "", `The request headers forwarded to the HTTP authorization service, separated by ','.
+	The JWT payload header is always forwarded. The gRPC authorization service receives all of the headers and the JWT payload metadata.`)
+
+	EnableRequestValidation = flag.Bool("enable_request_validation", false, `Validate the JSON request bodies of the HTTP operations against the request types in the service config.
+	Requests with unknown fields, mismatched field types or missing required fields are rejected with 400. The request bodies are buffered, up to --connection_buffer_limit_bytes.`)
+	RequestValidationMaxBodyBytes = flag.Int("request_validation_max_body_bytes", 1024*1024, `The size limit of the request bodies validated by --enable_request_validation. Larger request bodies are rejected with 413.`)
+
+	LocalReplyFormat = flag.String("local_reply_format", "json", `The body format of the error responses generated by the proxy. The options are "json" for {"code", "message"}, "google_rpc_status" for the google.rpc.Status JSON error envelope and "problem_json" for RFC 7807 application/problem+json.
+	The gRPC requests always get the plain error messages in the grpc-message trailers, while the gRPC-Web requests get the HTTP error responses.`)
+	LocalReplyMappersFile = flag.String("local_reply_mappers_file", "", `Path to a JSON file of the error response formats per status code and request content type, overriding --local_reply_format.
+	For example {"mappers": [{"status_code": 404, "request_content_type": "text/html", "text_format": "<h1>%LOCAL_REPLY_BODY%</h1>", "content_type": "text/html"}]}.`)
 
 	ScCheckTimeoutMs  = flag.Int("service_control_check_timeout_ms", 0, `Set the timeout in millisecond for service control Check request. Must be > 0 and the default is 1000 if not set.`)
 	ScQuotaTimeoutMs  = flag.Int("service_control_quota_timeout_ms", 0, `Set the timeout in millisecond for service control Quota request. Must be > 0 and the default is 1000 if not set.`)
@@ -159,6 +228,28 @@ var (
 	BackendRetryNum = flag.Uint("backend_retry_num", 1,
 		`The allowed number of retries. Must be >= 0 and defaults to 1. This retry
 	setting will be applied to all the backends if you have multiple ones.`)
+	BackendRetryMode = flag.String("backend_retry_mode", "global",
+		`How the retry conditions are chosen, "global" or "idempotent". "global" applies
+	--backend_retry_ons to all the routes. "idempotent" ignores --backend_retry_ons: the routes of
+	idempotent calls, by HTTP method (GET, HEAD, OPTIONS, PUT and DELETE) or by the gRPC
+	idempotency_level option (NO_SIDE_EFFECTS and IDEMPOTENT), retry on resets, 5xx and gRPC
+	UNAVAILABLE, while the other routes only retry when the request was not sent.`)
+	BackendRetryBaseInterval = flag.Duration("backend_retry_base_interval", 0,
+		"The base interval of the exponential backoff between the backend retries. Envoy's default of 25ms is used if not set.")
+	BackendRetryMaxInterval = flag.Duration("backend_retry_max_interval", 0,
+		"The maximum interval between the backend retries, 10 times --backend_retry_base_interval if not set.")
+	BackendRetriableStatusCodes = flag.String("backend_retriable_status_codes", "",
+		`The HTTP status codes of the backend responses to retry on, separated by ','. In the "global" mode they
+	only take effect if --backend_retry_ons includes "retriable-status-codes".`)
+	BackendRetryBudgetPercent = flag.Float64("backend_retry_budget_percent", 0,
+		"The limit of the concurrent retries to each backend, as a percentage of its active requests. No retry budget if 0.")
+	BackendRetryBudgetMinConcurrency = flag.Uint("backend_retry_budget_min_concurrency", 0,
+		"The minimum of the concurrent retries allowed by the retry budget. Envoy's default of 3 is used if 0.")
+	BackendRetryPreviousHosts = flag.Bool("backend_retry_previous_hosts", false,
+		"Retry the backend requests on other hosts than the ones already attempted, if the backends resolve to multiple hosts.")
+
+	// Used by the config manager server only, not in options.ConfigGeneratorOptions.
+	ExpvarLogInterval = flag.Duration("expvar_log_interval", 10*time.Minute, `the interval periodically to log the outcomes of the calls to the metadata server and other services, 0 to disable.`)
 )
 
 func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
@@ -176,6 +267,11 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		CorsAllowOriginRegex:                    *CorsAllowOriginRegex,
 		CorsExposeHeaders:                       *CorsExposeHeaders,
 		CorsPreset:                              *CorsPreset,
+		CorsAllowOrigins:                        *CorsAllowOrigins,
+		CorsAllowOriginSuffixes:                 *CorsAllowOriginSuffixes,
+		CorsMaxAge:                              *CorsMaxAge,
+		CorsAllowPrivateNetwork:                 *CorsAllowPrivateNetwork,
+		CorsPoliciesFile:                        *CorsPoliciesFile,
 		BackendDnsLookupFamily:                  *BackendDnsLookupFamily,
 		ClusterConnectTimeout:                   *ClusterConnectTimeout,
 		StreamIdleTimeout:                       *StreamIdleTimeout,
@@ -184,6 +280,7 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		ServiceControlURL:                       *ServiceControlURL,
 		ListenerPort:                            *ListenerPort,
 		Healthz:                                 *Healthz,
+		OpenApiDocPath:                          *OpenApiDocPath,
 		SslSidestreamClientRootCertsPath:        *SslSidestreamClientRootCertsPath,
 		SslBackendClientCertPath:                *SslBackendClientCertPath,
 		SslBackendClientRootCertsPath:           *SslBackendClientRootCertsPath,
@@ -193,6 +290,19 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		SslMinimumProtocol:                      *SslMinimumProtocol,
 		SslMaximumProtocol:                      *SslMaximumProtocol,
 		EnableHSTS:                              *EnableHSTS,
+		SslDownstreamClientRootCertsPath:        *SslDownstreamClientRootCertsPath,
+		SslDownstreamClientCertMode:             *SslDownstreamClientCertMode,
+		SslDownstreamClientAllowedSans:          *SslDownstreamClientAllowedSans,
+		SslDownstreamClientCertRulesFile:        *SslDownstreamClientCertRulesFile,
+		SslDownstreamClientForwardCertDetails:   *SslDownstreamClientForwardCertDetails,
+		EnableSdsCertificates:                   *EnableSdsCertificates,
+		EnableSecurityHeaders:                   *EnableSecurityHeaders,
+		SecurityHeadersHstsMaxAge:               *SecurityHeadersHstsMaxAge,
+		SecurityHeadersHstsPreload:              *SecurityHeadersHstsPreload,
+		SecurityHeadersFrameOptions:             *SecurityHeadersFrameOptions,
+		SecurityHeadersReferrerPolicy:           *SecurityHeadersReferrerPolicy,
+		SecurityHeadersContentSecurityPolicy:    *SecurityHeadersContentSecurityPolicy,
+		SecurityHeadersStrip:                    *SecurityHeadersStrip,
 		DnsResolverAddresses:                    *DnsResolverAddresses,
 		AddRequestHeaders:                       *AddRequestHeaders,
 		AppendRequestHeaders:                    *AppendRequestHeaders,
@@ -200,6 +310,7 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		AppendResponseHeaders:                   *AppendResponseHeaders,
 		ServiceAccountKey:                       *ServiceAccountKey,
 		TokenAgentPort:                          *TokenAgentPort,
+		TokenAgentSocket:                        *TokenAgentSocket,
 		DisableOidcDiscovery:                    *DisableOidcDiscovery,
 		DependencyErrorBehavior:                 *DependencyErrorBehavior,
 		SkipJwtAuthnFilter:                      *SkipJwtAuthnFilter,
@@ -216,14 +327,37 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		EnableGrpcForHttp1:                      *EnableGrpcForHttp1,
 		ConnectionBufferLimitBytes:              *ConnectionBufferLimitBytes,
 		JwksCacheDurationInS:                    *JwksCacheDurationInS,
+		JwksLocalFiles:                          *JwksLocalFiles,
+		JwtClaimRulesFile:                       *JwtClaimRulesFile,
+		JwtCookieLocations:                      *JwtCookieLocations,
+		JwtClaimsToHeaders:                      *JwtClaimsToHeaders,
+		JwtProviderClaimsToHeaders:              *JwtProviderClaimsToHeaders,
 		BackendRetryOns:                         *BackendRetryOns,
 		BackendRetryNum:                         *BackendRetryNum,
+		BackendRetryMode:                        *BackendRetryMode,
+		BackendRetryBaseInterval:                *BackendRetryBaseInterval,
+		BackendRetryMaxInterval:                 *BackendRetryMaxInterval,
+		BackendRetriableStatusCodes:             *BackendRetriableStatusCodes,
+		BackendRetryBudgetPercent:               *BackendRetryBudgetPercent,
+		BackendRetryBudgetMinConcurrency:        *BackendRetryBudgetMinConcurrency,
+		BackendRetryPreviousHosts:               *BackendRetryPreviousHosts,
 		ScCheckTimeoutMs:                        *ScCheckTimeoutMs,
 		ScQuotaTimeoutMs:                        *ScQuotaTimeoutMs,
 		ScReportTimeoutMs:                       *ScReportTimeoutMs,
 		ScCheckRetries:                          *ScCheckRetries,
 		ScQuotaRetries:                          *ScQuotaRetries,
 		ScReportRetries:                         *ScReportRetries,
+		RateLimitServiceAddress:                 *RateLimitServiceAddress,
+		RateLimitConsumer:                       *RateLimitConsumer,
+		ExtAuthzAddress:                         *ExtAuthzAddress,
+		ExtAuthzTimeout:                         *ExtAuthzTimeout,
+		ExtAuthzFailureModeAllow:                *ExtAuthzFailureModeAllow,
+		ExtAuthzSelectors:                       *ExtAuthzSelectors,
+		ExtAuthzAllowedHeaders:                  *ExtAuthzAllowedHeaders,
+		EnableRequestValidation:                 *EnableRequestValidation,
+		RequestValidationMaxBodyBytes:           *RequestValidationMaxBodyBytes,
+		LocalReplyFormat:                        *LocalReplyFormat,
+		LocalReplyMappersFile:                   *LocalReplyMappersFile,
 		TranscodingAlwaysPrintPrimitiveFields:   *TranscodingAlwaysPrintPrimitiveFields,
 		TranscodingAlwaysPrintEnumsAsInts:       *TranscodingAlwaysPrintEnumsAsInts,
 		TranscodingPreserveProtoFieldNames:      *TranscodingPreserveProtoFieldNames,
@@ -22,12 +22,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/tokengenerator"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
 
@@ -42,14 +44,24 @@ func main() {
 	// Create context that allows cancellation.
 	// Allows shutting down downstream servers gracefully.
 	ctx, cancel := context.WithCancel(context.Background())
+	util.StartExpvarLogger(ctx, *flags.ExpvarLogInterval)
 
 	var mf *metadata.MetadataFetcher
 	if !opts.NonGCP {
 		glog.Info("running on GCP, initializing metadata fetcher")
-		mf = metadata.NewMetadataFetcher(opts.CommonOptions)
+		mf = metadata.NewMetadataFetcher(ctx, opts.CommonOptions)
 	}
 
-	m, err := configmanager.NewConfigManager(mf, opts)
+	if opts.ServiceAccountKey != "" {
+		// Generated before any envoy config, which carries it to the token agent.
+		secret, err := tokengenerator.GenerateTokenAgentSecret()
+		if err != nil {
+			glog.Exitf("fail to initialize token agent: %v", err)
+		}
+		opts.TokenAgentSecret = secret
+	}
+
+	m, err := configmanager.NewConfigManager(ctx, mf, opts)
 	if err != nil {
 		glog.Exitf("fail to initialize config manager: %v", err)
 	}
@@ -77,10 +89,17 @@ func main() {
 	}()
 
 	if opts.ServiceAccountKey != "" {
+		// Keep the access token fresh for both the config manager and envoy.
+		tokengenerator.StartAccessTokenRefresher(ctx, opts.ServiceAccountKey)
+
 		// Setup token agent server
-		r := tokengenerator.MakeTokenAgentHandler(opts.ServiceAccountKey)
+		r := tokengenerator.MakeTokenAgentHandler(opts.ServiceAccountKey, opts.TokenAgentSecret)
+		agentLis, err := listenTokenAgent(opts.TokenAgentSocket, opts.TokenAgentPort)
+		if err != nil {
+			glog.Exitf("token agent fail to listen: %v", err)
+		}
 		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%v", opts.TokenAgentPort), r)
+			err := http.Serve(agentLis, r)
 
 			if err != nil {
 				glog.Errorf("token agent fail to serve: %v", err)
@@ -94,3 +113,29 @@ func main() {
 		glog.Exitf("Server fail to serve: %v", err)
 	}
 }
+
+// listenTokenAgent listens on the Unix domain socket if it is set, otherwise
+// on the port of the loopback interface only.
+func listenTokenAgent(socket string, port uint) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", fmt.Sprintf("%s:%v", util.LoopbackIPv4Addr, port))
+	}
+
+	// Abstract sockets, starting with "@", do not exist on the file system.
+	if !strings.HasPrefix(socket, "@") {
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("fail to remove stale socket %s: %v", socket, err)
+		}
+	}
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(socket, "@") {
+		if err := os.Chmod(socket, 0600); err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("fail to restrict permission of socket %s: %v", socket, err)
+		}
+	}
+	return lis, nil
+}
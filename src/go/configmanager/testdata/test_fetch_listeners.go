@@ -30,7 +30,25 @@ const (
                         "code": "%RESPONSE_CODE%",
                         "message":"%LOCAL_REPLY_BODY%"
                       }
-                    }
+                    },
+                    "mappers": [
+                      {
+                        "bodyFormatOverride": {
+                          "textFormat": "%LOCAL_REPLY_BODY%"
+                        },
+                        "filter": {
+                          "headerFilter": {
+                            "header": {
+                              "name": "content-type",
+                              "safeRegexMatch": {
+                                "googleRe2": {},
+                                "regex": "^application/grpc(\\+.*)?$"
+                              }
+                            }
+                          }
+                        }
+                      }
+                    ]
                   }`
 )
 
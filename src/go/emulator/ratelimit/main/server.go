@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The rate limit emulator serves the Envoy RLS v3 API locally, enforcing the
+// quota limits of the service config with in-memory counters.
+//
+// Point ESPv2 at it with `--rate_limit_service_address=grpc://HOST:PORT`.
+// The counters are not shared with other emulator instances.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/emulator/ratelimit"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+var (
+	port            = flag.Int("port", 8091, "Port the rate limit emulator listens on.")
+	serviceJsonPath = flag.String("service_json_path", "", "File path to the service config, in JSON. Quota limits and metric rules are read from its quota section.")
+)
+
+func main() {
+	flag.Parse()
+	if *serviceJsonPath == "" {
+		glog.Exitf("flag --service_json_path must be specified")
+	}
+
+	serviceFile, err := os.Open(*serviceJsonPath)
+	if err != nil {
+		glog.Exitf("fail to open service config file %s: %v", *serviceJsonPath, err)
+	}
+	serviceConfig, err := util.UnmarshalServiceConfig(serviceFile)
+	_ = serviceFile.Close()
+	if err != nil {
+		glog.Exitf("fail to unmarshal service config: %v", err)
+	}
+
+	s, err := ratelimit.NewServer(serviceConfig)
+	if err != nil {
+		glog.Exitf("fail to create rate limit emulator: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		glog.Exitf("rate limit emulator fail to listen on port %d: %v", *port, err)
+	}
+	grpcServer := grpc.NewServer()
+	rlspb.RegisterRateLimitServiceServer(grpcServer, s)
+
+	glog.Infof("rate limit emulator for service %s is running at port %d", serviceConfig.GetName(), *port)
+	if err := grpcServer.Serve(lis); err != nil {
+		glog.Exitf("rate limit emulator fail to serve: %v", err)
+	}
+}
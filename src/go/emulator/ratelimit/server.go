@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit implements a standalone Envoy rate limit service that
+// enforces the quota limits of a service config with in-memory counters.
+//
+// It reads the descriptors ESPv2 generates with --rate_limit_service_address:
+// the operation name, followed by the consumer identity. The operation is
+// charged the metric costs of its metric rules, per consumer.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/emulator/servicecontrol"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rlpb "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+// Server emulates a rate limit service for a single service.
+type Server struct {
+	serviceName string
+
+	// operation -> metric name -> cost of a request.
+	metricCosts   map[string]map[string]int64
+	quotaEnforcer *servicecontrol.QuotaEnforcer
+}
+
+// NewServer creates a Server for the service config.
+func NewServer(serviceConfig *confpb.Service) (*Server, error) {
+	if serviceConfig.GetName() == "" {
+		return nil, fmt.Errorf("service config must have a service name")
+	}
+
+	quotaEnforcer, err := servicecontrol.NewQuotaEnforcer(serviceConfig.GetQuota())
+	if err != nil {
+		return nil, fmt.Errorf("fail to process quota of service %s: %v", serviceConfig.GetName(), err)
+	}
+
+	metricCosts := make(map[string]map[string]int64)
+	for _, rule := range serviceConfig.GetQuota().GetMetricRules() {
+		metricCosts[rule.GetSelector()] = rule.GetMetricCosts()
+	}
+
+	return &Server{
+		serviceName:   serviceConfig.GetName(),
+		metricCosts:   metricCosts,
+		quotaEnforcer: quotaEnforcer,
+	}, nil
+}
+
+// ShouldRateLimit implements the RateLimitService of the Envoy RLS v3 API.
+//
+// Each descriptor is charged separately. The request is over the limit if any
+// of the descriptors is, and descriptors without an operation with metric
+// costs are not limited.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlspb.RateLimitRequest) (*rlspb.RateLimitResponse, error) {
+	if req.GetDomain() != s.serviceName {
+		return nil, status.Errorf(codes.InvalidArgument, "domain %q does not match service %q", req.GetDomain(), s.serviceName)
+	}
+
+	hits := int64(req.GetHitsAddend())
+	if hits == 0 {
+		hits = 1
+	}
+
+	resp := &rlspb.RateLimitResponse{
+		OverallCode: rlspb.RateLimitResponse_OK,
+	}
+	for _, descriptor := range req.GetDescriptors() {
+		code := rlspb.RateLimitResponse_OK
+		if op := s.quotaOperation(descriptor, hits); op != nil && len(s.quotaEnforcer.Allocate(op)) != 0 {
+			code = rlspb.RateLimitResponse_OVER_LIMIT
+			resp.OverallCode = rlspb.RateLimitResponse_OVER_LIMIT
+		}
+		resp.Statuses = append(resp.Statuses, &rlspb.RateLimitResponse_DescriptorStatus{
+			Code: code,
+		})
+	}
+	return resp, nil
+}
+
+// quotaOperation converts the descriptor to the QuotaOperation charging the
+// metric costs of the operation against the consumer. It returns nil if the
+// operation does not have metric costs.
+func (s *Server) quotaOperation(descriptor *rlpb.RateLimitDescriptor, hits int64) *scpb.QuotaOperation {
+	var operation string
+	var consumerIds []string
+	for _, entry := range descriptor.GetEntries() {
+		if entry.GetKey() == util.RateLimitOperationDescriptorKey {
+			operation = entry.GetValue()
+			continue
+		}
+		consumerIds = append(consumerIds, entry.GetKey()+":"+entry.GetValue())
+	}
+
+	costs, ok := s.metricCosts[operation]
+	if !ok {
+		return nil
+	}
+
+	op := &scpb.QuotaOperation{
+		MethodName: operation,
+		ConsumerId: strings.Join(consumerIds, "/"),
+	}
+	for metric, cost := range costs {
+		op.QuotaMetrics = append(op.QuotaMetrics, &scpb.MetricValueSet{
+			MetricName: metric,
+			MetricValues: []*scpb.MetricValue{
+				{
+					Value: &scpb.MetricValue_Int64Value{
+						Int64Value: cost * hits,
+					},
+				},
+			},
+		})
+	}
+	return op
+}
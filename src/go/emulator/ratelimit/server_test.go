@@ -0,0 +1,208 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+
+	rlpb "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+const (
+	testServiceName = "bookstore.endpoints.project123.cloud.goog"
+)
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer(&confpb.Service{
+		Name: testServiceName,
+		Quota: &confpb.Quota{
+			Limits: []*confpb.QuotaLimit{
+				{
+					Name:   "read-limit",
+					Metric: "read-requests",
+					Unit:   "1/d/{project}",
+					Values: map[string]int64{"STANDARD": 2},
+				},
+			},
+			MetricRules: []*confpb.MetricRule{
+				{
+					Selector:    "endpoints.examples.bookstore.Bookstore.ListShelves",
+					MetricCosts: map[string]int64{"read-requests": 1},
+				},
+				{
+					Selector:    "endpoints.examples.bookstore.Bookstore.GetShelf",
+					MetricCosts: map[string]int64{"read-requests": 2},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("fail to create server: %v", err)
+	}
+	return s
+}
+
+func descriptor(operation, consumerKey, consumerValue string) *rlpb.RateLimitDescriptor {
+	return &rlpb.RateLimitDescriptor{
+		Entries: []*rlpb.RateLimitDescriptor_Entry{
+			{
+				Key:   "operation",
+				Value: operation,
+			},
+			{
+				Key:   consumerKey,
+				Value: consumerValue,
+			},
+		},
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		serviceConfig *confpb.Service
+		wantError     bool
+	}{
+		{
+			desc: "Success",
+			serviceConfig: &confpb.Service{
+				Name: testServiceName,
+			},
+		},
+		{
+			desc:          "Fail without service name",
+			serviceConfig: &confpb.Service{},
+			wantError:     true,
+		},
+		{
+			desc: "Fail with unsupported quota unit",
+			serviceConfig: &confpb.Service{
+				Name: testServiceName,
+				Quota: &confpb.Quota{
+					Limits: []*confpb.QuotaLimit{
+						{
+							Name:   "read-limit",
+							Metric: "read-requests",
+							Unit:   "1/h/{project}",
+							Values: map[string]int64{"STANDARD": 2},
+						},
+					},
+				},
+			},
+			wantError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := NewServer(tc.serviceConfig)
+		if (err != nil) != tc.wantError {
+			t.Errorf("Test (%s): got error: %v, want error: %v", tc.desc, err, tc.wantError)
+		}
+	}
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	s := newTestServer(t)
+
+	testCases := []struct {
+		desc         string
+		descriptors  []*rlpb.RateLimitDescriptor
+		hitsAddend   uint32
+		wantCode     rlspb.RateLimitResponse_Code
+		wantStatuses []rlspb.RateLimitResponse_Code
+	}{
+		{
+			desc: "First call is within the limit",
+			descriptors: []*rlpb.RateLimitDescriptor{
+				descriptor("endpoints.examples.bookstore.Bookstore.ListShelves", "api_key", "key-1"),
+			},
+			wantCode:     rlspb.RateLimitResponse_OK,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OK},
+		},
+		{
+			desc: "Operation with a higher cost exceeds the limit of the same consumer",
+			descriptors: []*rlpb.RateLimitDescriptor{
+				descriptor("endpoints.examples.bookstore.Bookstore.GetShelf", "api_key", "key-1"),
+			},
+			wantCode:     rlspb.RateLimitResponse_OVER_LIMIT,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OVER_LIMIT},
+		},
+		{
+			desc: "Another consumer is counted separately",
+			descriptors: []*rlpb.RateLimitDescriptor{
+				descriptor("endpoints.examples.bookstore.Bookstore.GetShelf", "api_key", "key-2"),
+			},
+			wantCode:     rlspb.RateLimitResponse_OK,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OK},
+		},
+		{
+			desc: "Hits addend is multiplied by the cost",
+			descriptors: []*rlpb.RateLimitDescriptor{
+				descriptor("endpoints.examples.bookstore.Bookstore.ListShelves", "remote_address", "10.0.0.1"),
+			},
+			hitsAddend:   3,
+			wantCode:     rlspb.RateLimitResponse_OVER_LIMIT,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OVER_LIMIT},
+		},
+		{
+			desc: "Operation without metric costs is not limited",
+			descriptors: []*rlpb.RateLimitDescriptor{
+				descriptor("endpoints.examples.bookstore.Bookstore.CreateShelf", "api_key", "key-1"),
+				descriptor("endpoints.examples.bookstore.Bookstore.ListShelves", "api_key", "key-1"),
+			},
+			wantCode: rlspb.RateLimitResponse_OK,
+			wantStatuses: []rlspb.RateLimitResponse_Code{
+				rlspb.RateLimitResponse_OK,
+				rlspb.RateLimitResponse_OK,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		resp, err := s.ShouldRateLimit(context.Background(), &rlspb.RateLimitRequest{
+			Domain:      testServiceName,
+			Descriptors: tc.descriptors,
+			HitsAddend:  tc.hitsAddend,
+		})
+		if err != nil {
+			t.Fatalf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+
+		if resp.GetOverallCode() != tc.wantCode {
+			t.Errorf("Test (%s): got overall code %v, want %v", tc.desc, resp.GetOverallCode(), tc.wantCode)
+		}
+		if len(resp.GetStatuses()) != len(tc.wantStatuses) {
+			t.Fatalf("Test (%s): got %d statuses, want %d", tc.desc, len(resp.GetStatuses()), len(tc.wantStatuses))
+		}
+		for i, status := range resp.GetStatuses() {
+			if status.GetCode() != tc.wantStatuses[i] {
+				t.Errorf("Test (%s): got code %v for descriptor(%d), want %v", tc.desc, status.GetCode(), i, tc.wantStatuses[i])
+			}
+		}
+	}
+}
+
+func TestShouldRateLimitWrongDomain(t *testing.T) {
+	s := newTestServer(t)
+
+	if _, err := s.ShouldRateLimit(context.Background(), &rlspb.RateLimitRequest{
+		Domain: "other.endpoints.project123.cloud.goog",
+	}); err == nil {
+		t.Errorf("got no error for the domain of another service")
+	}
+}
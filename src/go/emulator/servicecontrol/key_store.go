@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicecontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+// ApiKey is a single entry of the local key store file.
+type ApiKey struct {
+	Key string `json:"key"`
+	// The project number of the consumer that owns the key.
+	// It is returned in the CheckResponse ConsumerInfo.
+	ProjectNumber int64 `json:"projectNumber"`
+	// Expired and blocked keys are rejected by Check and AllocateQuota.
+	Expired bool `json:"expired,omitempty"`
+	Blocked bool `json:"blocked,omitempty"`
+}
+
+// KeyStore holds all the API keys known to the emulator.
+//
+// The key store file is a JSON document in the format:
+// {
+//   "apiKeys": [
+//     {"key": "string", "projectNumber": int64, "expired": bool, "blocked": bool}
+//   ]
+// }
+type KeyStore struct {
+	keys map[string]*ApiKey
+}
+
+type keyStoreFile struct {
+	ApiKeys []*ApiKey `json:"apiKeys"`
+}
+
+// NewKeyStoreFromFile reads the key store from the JSON file at path.
+func NewKeyStoreFromFile(path string) (*KeyStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read key store file %s: %v", path, err)
+	}
+	return NewKeyStoreFromData(data)
+}
+
+// NewKeyStoreFromData parses the key store from JSON data.
+func NewKeyStoreFromData(data []byte) (*KeyStore, error) {
+	var f keyStoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal key store: %v", err)
+	}
+
+	ks := &KeyStore{
+		keys: make(map[string]*ApiKey),
+	}
+	for _, k := range f.ApiKeys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("key store has an entry with an empty key")
+		}
+		if _, ok := ks.keys[k.Key]; ok {
+			return nil, fmt.Errorf("key store has duplicated key: %s", k.Key)
+		}
+		ks.keys[k.Key] = k
+	}
+	return ks, nil
+}
+
+// Validate looks up the API key and returns the CheckError to send back if
+// the key cannot be used. A nil CheckError means the key is valid.
+func (ks *KeyStore) Validate(key string) (*ApiKey, *scpb.CheckError) {
+	k, ok := ks.keys[key]
+	switch {
+	case !ok:
+		return nil, &scpb.CheckError{
+			Code:   scpb.CheckError_API_KEY_INVALID,
+			Detail: "API key not valid. Please pass a valid API key.",
+		}
+	case k.Expired:
+		return k, &scpb.CheckError{
+			Code:   scpb.CheckError_API_KEY_EXPIRED,
+			Detail: "API key expired. Please renew the API key.",
+		}
+	case k.Blocked:
+		return k, &scpb.CheckError{
+			Code:   scpb.CheckError_API_TARGET_BLOCKED,
+			Detail: "Requests from this API key are blocked.",
+		}
+	}
+	return k, nil
+}
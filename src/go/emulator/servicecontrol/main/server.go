@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The service control emulator serves the Service Control Check, AllocateQuota
+// and Report APIs locally, so ESPv2 can keep API key and quota features
+// when it is deployed without access to Google Cloud.
+//
+// Point ESPv2 at it with `--service_control_url=http://HOST:PORT`.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/emulator/servicecontrol"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+)
+
+var (
+	port            = flag.Int("port", 8090, "Port the service control emulator listens on.")
+	serviceJsonPath = flag.String("service_json_path", "", "File path to the service config, in JSON. Quota limits are read from its quota section.")
+	keyStorePath    = flag.String("key_store_path", "", "File path to the JSON key store holding all the valid API keys.")
+	reportLogPath   = flag.String("report_log_path", "", "File path to append Report operations to as JSON lines. Reports are dropped if not set.")
+)
+
+func main() {
+	flag.Parse()
+	if *serviceJsonPath == "" {
+		glog.Exitf("flag --service_json_path must be specified")
+	}
+	if *keyStorePath == "" {
+		glog.Exitf("flag --key_store_path must be specified")
+	}
+
+	serviceFile, err := os.Open(*serviceJsonPath)
+	if err != nil {
+		glog.Exitf("fail to open service config file %s: %v", *serviceJsonPath, err)
+	}
+	serviceConfig, err := util.UnmarshalServiceConfig(serviceFile)
+	_ = serviceFile.Close()
+	if err != nil {
+		glog.Exitf("fail to unmarshal service config: %v", err)
+	}
+
+	keyStore, err := servicecontrol.NewKeyStoreFromFile(*keyStorePath)
+	if err != nil {
+		glog.Exitf("fail to load key store: %v", err)
+	}
+
+	var reportLogger *servicecontrol.ReportLogger
+	if *reportLogPath != "" {
+		reportFile, err := os.OpenFile(*reportLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			glog.Exitf("fail to open report log file %s: %v", *reportLogPath, err)
+		}
+		defer reportFile.Close()
+		reportLogger = servicecontrol.NewReportLogger(reportFile)
+	}
+
+	s, err := servicecontrol.NewServer(serviceConfig, keyStore, reportLogger)
+	if err != nil {
+		glog.Exitf("fail to create service control emulator: %v", err)
+	}
+
+	glog.Infof("service control emulator for service %s is running at port %d", serviceConfig.GetName(), *port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), s.Handler()); err != nil {
+		glog.Exitf("service control emulator fail to serve: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicecontrol
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+const (
+	// The tier used to read the limit value from QuotaLimit.values.
+	standardQuotaTier = "STANDARD"
+)
+
+// Supported QuotaLimit units, mapped to the length of their window.
+var quotaUnitWindows = map[string]time.Duration{
+	"1/min/{project}": time.Minute,
+	"1/d/{project}":   24 * time.Hour,
+}
+
+type quotaLimit struct {
+	name   string
+	metric string
+	limit  int64
+	window time.Duration
+}
+
+type quotaCounter struct {
+	windowStart time.Time
+	used        int64
+}
+
+// QuotaEnforcer enforces the limits in the Quota section of a service config.
+//
+// Usage is counted per consumer in fixed windows aligned to the unit of each
+// limit, matching how Service Control buckets per-minute and per-day quota.
+type QuotaEnforcer struct {
+	// metric name -> limits defined on the metric.
+	limits  map[string][]*quotaLimit
+	timeNow func() time.Time
+
+	mu sync.Mutex
+	// consumer id + limit name -> counter.
+	counters map[string]*quotaCounter
+}
+
+// NewQuotaEnforcer creates a QuotaEnforcer from the quota section of the service config.
+func NewQuotaEnforcer(quota *confpb.Quota) (*QuotaEnforcer, error) {
+	qe := &QuotaEnforcer{
+		limits:   make(map[string][]*quotaLimit),
+		timeNow:  time.Now,
+		counters: make(map[string]*quotaCounter),
+	}
+
+	for _, l := range quota.GetLimits() {
+		window, ok := quotaUnitWindows[l.GetUnit()]
+		if !ok {
+			return nil, fmt.Errorf("quota limit %q has unsupported unit %q", l.GetName(), l.GetUnit())
+		}
+		value, ok := l.GetValues()[standardQuotaTier]
+		if !ok {
+			return nil, fmt.Errorf("quota limit %q does not have a %s value", l.GetName(), standardQuotaTier)
+		}
+		if l.GetMetric() == "" {
+			return nil, fmt.Errorf("quota limit %q does not have a metric", l.GetName())
+		}
+
+		qe.limits[l.GetMetric()] = append(qe.limits[l.GetMetric()], &quotaLimit{
+			name:   l.GetName(),
+			metric: l.GetMetric(),
+			limit:  value,
+			window: window,
+		})
+	}
+	return qe, nil
+}
+
+// Allocate charges the quota metrics in the operation against the consumer.
+//
+// Either all the metrics are charged or none of them are: if any limit would be
+// exceeded, the returned QuotaErrors list every exhausted limit and no usage is recorded.
+func (qe *QuotaEnforcer) Allocate(op *scpb.QuotaOperation) []*scpb.QuotaError {
+	qe.mu.Lock()
+	defer qe.mu.Unlock()
+
+	now := qe.timeNow()
+	var errs []*scpb.QuotaError
+	var charges []func()
+	for _, valueSet := range op.GetQuotaMetrics() {
+		var cost int64
+		for _, v := range valueSet.GetMetricValues() {
+			cost += v.GetInt64Value()
+		}
+
+		for _, l := range qe.limits[valueSet.GetMetricName()] {
+			counter := qe.counter(op.GetConsumerId(), l, now)
+			if counter.used+cost > l.limit {
+				errs = append(errs, &scpb.QuotaError{
+					Code:    scpb.QuotaError_RESOURCE_EXHAUSTED,
+					Subject: op.GetConsumerId(),
+					Description: fmt.Sprintf("Quota exceeded for quota metric '%s' and limit '%s' of service, limit: %d",
+						l.metric, l.name, l.limit),
+				})
+				continue
+			}
+
+			c := cost
+			charges = append(charges, func() { counter.used += c })
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	for _, charge := range charges {
+		charge()
+	}
+	return nil
+}
+
+// counter returns the usage counter of the limit for the consumer, resetting it
+// when the current window has passed. The caller must hold qe.mu.
+func (qe *QuotaEnforcer) counter(consumerId string, l *quotaLimit, now time.Time) *quotaCounter {
+	key := strings.Join([]string{consumerId, l.name}, "/")
+	windowStart := now.Truncate(l.window)
+
+	counter, ok := qe.counters[key]
+	if !ok || !counter.windowStart.Equal(windowStart) {
+		counter = &quotaCounter{
+			windowStart: windowStart,
+		}
+		qe.counters[key] = counter
+	}
+	return counter
+}
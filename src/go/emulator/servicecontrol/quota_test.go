@@ -0,0 +1,207 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicecontrol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+func quotaOperation(consumerId string, costs map[string]int64) *scpb.QuotaOperation {
+	op := &scpb.QuotaOperation{
+		ConsumerId: consumerId,
+	}
+	for name, cost := range costs {
+		op.QuotaMetrics = append(op.QuotaMetrics, &scpb.MetricValueSet{
+			MetricName: name,
+			MetricValues: []*scpb.MetricValue{
+				{
+					Value: &scpb.MetricValue_Int64Value{
+						Int64Value: cost,
+					},
+				},
+			},
+		})
+	}
+	return op
+}
+
+func TestNewQuotaEnforcer(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		quota     *confpb.Quota
+		wantError string
+	}{
+		{
+			desc: "Success with per minute and per day limits",
+			quota: &confpb.Quota{
+				Limits: []*confpb.QuotaLimit{
+					{
+						Name:   "read-limit",
+						Metric: "read-requests",
+						Unit:   "1/min/{project}",
+						Values: map[string]int64{"STANDARD": 5},
+					},
+					{
+						Name:   "daily-read-limit",
+						Metric: "read-requests",
+						Unit:   "1/d/{project}",
+						Values: map[string]int64{"STANDARD": 100},
+					},
+				},
+			},
+		},
+		{
+			desc:  "Success with no quota",
+			quota: nil,
+		},
+		{
+			desc: "Fail with unsupported unit",
+			quota: &confpb.Quota{
+				Limits: []*confpb.QuotaLimit{
+					{
+						Name:   "read-limit",
+						Metric: "read-requests",
+						Unit:   "1/s/{project}",
+						Values: map[string]int64{"STANDARD": 5},
+					},
+				},
+			},
+			wantError: `quota limit "read-limit" has unsupported unit "1/s/{project}"`,
+		},
+		{
+			desc: "Fail without a STANDARD value",
+			quota: &confpb.Quota{
+				Limits: []*confpb.QuotaLimit{
+					{
+						Name:   "read-limit",
+						Metric: "read-requests",
+						Unit:   "1/min/{project}",
+						Values: map[string]int64{"PREMIUM": 5},
+					},
+				},
+			},
+			wantError: `quota limit "read-limit" does not have a STANDARD value`,
+		},
+		{
+			desc: "Fail without a metric",
+			quota: &confpb.Quota{
+				Limits: []*confpb.QuotaLimit{
+					{
+						Name:   "read-limit",
+						Unit:   "1/min/{project}",
+						Values: map[string]int64{"STANDARD": 5},
+					},
+				},
+			},
+			wantError: `quota limit "read-limit" does not have a metric`,
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := NewQuotaEnforcer(tc.quota)
+		if tc.wantError == "" && err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+		if tc.wantError != "" && (err == nil || !strings.Contains(err.Error(), tc.wantError)) {
+			t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+		}
+	}
+}
+
+func TestQuotaEnforcerAllocate(t *testing.T) {
+	qe, err := NewQuotaEnforcer(&confpb.Quota{
+		Limits: []*confpb.QuotaLimit{
+			{
+				Name:   "read-limit",
+				Metric: "read-requests",
+				Unit:   "1/min/{project}",
+				Values: map[string]int64{"STANDARD": 3},
+			},
+			{
+				Name:   "write-limit",
+				Metric: "write-requests",
+				Unit:   "1/min/{project}",
+				Values: map[string]int64{"STANDARD": 1},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("fail to create quota enforcer: %v", err)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	qe.timeNow = func() time.Time { return now }
+
+	testCases := []struct {
+		desc       string
+		advance    time.Duration
+		op         *scpb.QuotaOperation
+		wantErrors int
+	}{
+		{
+			desc: "First read is allowed",
+			op:   quotaOperation("api_key:key-1", map[string]int64{"read-requests": 2}),
+		},
+		{
+			desc:       "Read over the limit is rejected",
+			op:         quotaOperation("api_key:key-1", map[string]int64{"read-requests": 2}),
+			wantErrors: 1,
+		},
+		{
+			desc: "Read up to the limit is allowed",
+			op:   quotaOperation("api_key:key-1", map[string]int64{"read-requests": 1}),
+		},
+		{
+			desc: "Other consumers have their own quota",
+			op:   quotaOperation("api_key:key-2", map[string]int64{"read-requests": 3}),
+		},
+		{
+			desc: "Metrics without limits are not restricted",
+			op:   quotaOperation("api_key:key-1", map[string]int64{"list-requests": 100}),
+		},
+		{
+			desc:       "Nothing is charged when one of the metrics is exhausted",
+			op:         quotaOperation("api_key:key-1", map[string]int64{"read-requests": 1, "write-requests": 1}),
+			wantErrors: 1,
+		},
+		{
+			desc: "Write is allowed as the previous failed operation was not charged",
+			op:   quotaOperation("api_key:key-1", map[string]int64{"write-requests": 1}),
+		},
+		{
+			desc:    "Quota is refilled in the next window",
+			advance: time.Minute,
+			op:      quotaOperation("api_key:key-1", map[string]int64{"read-requests": 3}),
+		},
+	}
+
+	for _, tc := range testCases {
+		now = now.Add(tc.advance)
+		errs := qe.Allocate(tc.op)
+		if len(errs) != tc.wantErrors {
+			t.Errorf("Test (%s): got %d quota errors: %v, want %d", tc.desc, len(errs), errs, tc.wantErrors)
+		}
+		for _, e := range errs {
+			if e.GetCode() != scpb.QuotaError_RESOURCE_EXHAUSTED || e.GetSubject() != tc.op.GetConsumerId() {
+				t.Errorf("Test (%s): got unexpected quota error: %v", tc.desc, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicecontrol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/jsonpb"
+
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+// ReportLogger writes every operation of a ReportRequest to w as one line of JSON.
+type ReportLogger struct {
+	mu        sync.Mutex
+	w         *bufio.Writer
+	marshaler *jsonpb.Marshaler
+}
+
+// NewReportLogger creates a ReportLogger writing to w.
+func NewReportLogger(w io.Writer) *ReportLogger {
+	return &ReportLogger{
+		w:         bufio.NewWriter(w),
+		marshaler: &jsonpb.Marshaler{},
+	}
+}
+
+// Log writes the operations in the report request, flushing once all of them are written.
+func (rl *ReportLogger) Log(req *scpb.ReportRequest) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for _, op := range req.GetOperations() {
+		if err := rl.marshaler.Marshal(rl.w, op); err != nil {
+			return fmt.Errorf("fail to marshal report operation %s: %v", op.GetOperationId(), err)
+		}
+		if err := rl.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return rl.w.Flush()
+}
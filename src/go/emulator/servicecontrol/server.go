@@ -0,0 +1,204 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servicecontrol implements a standalone Service Control server for
+// deployments that cannot reach Google Service Control.
+//
+// It speaks the same Check, AllocateQuota and Report HTTP APIs that the ESPv2
+// service control filter calls, validating API keys against a local key store,
+// enforcing the quota limits of the service config and logging reports locally.
+package servicecontrol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+const (
+	apiKeyConsumerIdPrefix = "api_key:"
+)
+
+// Server emulates Service Control for a single service.
+type Server struct {
+	serviceName     string
+	serviceConfigId string
+
+	keyStore      *KeyStore
+	quotaEnforcer *QuotaEnforcer
+	reportLogger  *ReportLogger
+}
+
+// NewServer creates a Server for the service config.
+// The reportLogger is optional, reports are dropped when it is nil.
+func NewServer(serviceConfig *confpb.Service, keyStore *KeyStore, reportLogger *ReportLogger) (*Server, error) {
+	if serviceConfig.GetName() == "" {
+		return nil, fmt.Errorf("service config must have a service name")
+	}
+	if keyStore == nil {
+		return nil, fmt.Errorf("key store must be provided")
+	}
+
+	quotaEnforcer, err := NewQuotaEnforcer(serviceConfig.GetQuota())
+	if err != nil {
+		return nil, fmt.Errorf("fail to process quota of service %s: %v", serviceConfig.GetName(), err)
+	}
+
+	return &Server{
+		serviceName:     serviceConfig.GetName(),
+		serviceConfigId: serviceConfig.GetId(),
+		keyStore:        keyStore,
+		quotaEnforcer:   quotaEnforcer,
+		reportLogger:    reportLogger,
+	}, nil
+}
+
+// Handler returns the http.Handler serving the Service Control APIs.
+//
+// It follows the following scheme:
+// POST /v1/services/{service}:check
+// POST /v1/services/{service}:allocateQuota
+// POST /v1/services/{service}:report
+// with request and response bodies serialized as binary protobuf.
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	servicePath := "/v1/services/" + s.serviceName
+
+	r.Path(servicePath + ":check").Methods("POST").HandlerFunc(s.handleCheck)
+	r.Path(servicePath + ":allocateQuota").Methods("POST").HandlerFunc(s.handleAllocateQuota)
+	r.Path(servicePath + ":report").Methods("POST").HandlerFunc(s.handleReport)
+	return r
+}
+
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	req := &scpb.CheckRequest{}
+	if err := readRequest(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := &scpb.CheckResponse{
+		OperationId:     req.GetOperation().GetOperationId(),
+		ServiceConfigId: s.serviceConfigId,
+	}
+	if apiKey, ok := apiKeyFromConsumerId(req.GetOperation().GetConsumerId()); ok {
+		key, checkErr := s.keyStore.Validate(apiKey)
+		if checkErr != nil {
+			resp.CheckErrors = []*scpb.CheckError{checkErr}
+		} else {
+			resp.CheckInfo = &scpb.CheckResponse_CheckInfo{
+				ConsumerInfo: &scpb.CheckResponse_ConsumerInfo{
+					ProjectNumber:  key.ProjectNumber,
+					ConsumerNumber: key.ProjectNumber,
+					Type:           scpb.CheckResponse_ConsumerInfo_PROJECT,
+				},
+			}
+		}
+	}
+
+	writeResponse(w, resp)
+}
+
+func (s *Server) handleAllocateQuota(w http.ResponseWriter, r *http.Request) {
+	req := &scpb.AllocateQuotaRequest{}
+	if err := readRequest(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	op := req.GetAllocateOperation()
+	resp := &scpb.AllocateQuotaResponse{
+		OperationId:     op.GetOperationId(),
+		ServiceConfigId: s.serviceConfigId,
+	}
+	if apiKey, ok := apiKeyFromConsumerId(op.GetConsumerId()); ok {
+		if _, checkErr := s.keyStore.Validate(apiKey); checkErr != nil {
+			resp.AllocateErrors = []*scpb.QuotaError{
+				{
+					Code:        quotaErrorCode(checkErr.GetCode()),
+					Subject:     op.GetConsumerId(),
+					Description: checkErr.GetDetail(),
+				},
+			}
+			writeResponse(w, resp)
+			return
+		}
+	}
+
+	resp.AllocateErrors = s.quotaEnforcer.Allocate(op)
+	writeResponse(w, resp)
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	req := &scpb.ReportRequest{}
+	if err := readRequest(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.reportLogger != nil {
+		if err := s.reportLogger.Log(req); err != nil {
+			glog.Errorf("fail to log report request: %v", err)
+		}
+	}
+
+	writeResponse(w, &scpb.ReportResponse{
+		ServiceConfigId: s.serviceConfigId,
+	})
+}
+
+func readRequest(r *http.Request, req proto.Message) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("fail to read request body: %v", err)
+	}
+	if err := proto.Unmarshal(body, req); err != nil {
+		return fmt.Errorf("fail to unmarshal %T: %v", req, err)
+	}
+	return nil
+}
+
+func writeResponse(w http.ResponseWriter, resp proto.Message) {
+	body, err := proto.Marshal(resp)
+	if err != nil {
+		glog.Errorf("fail to marshal %T: %v", resp, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(body)
+}
+
+func apiKeyFromConsumerId(consumerId string) (string, bool) {
+	if !strings.HasPrefix(consumerId, apiKeyConsumerIdPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(consumerId, apiKeyConsumerIdPrefix), true
+}
+
+// quotaErrorCode converts the API key CheckError code to the matching QuotaError code.
+func quotaErrorCode(code scpb.CheckError_Code) scpb.QuotaError_Code {
+	if code == scpb.CheckError_API_KEY_EXPIRED {
+		return scpb.QuotaError_API_KEY_EXPIRED
+	}
+	return scpb.QuotaError_API_KEY_INVALID
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicecontrol
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+const (
+	testServiceName = "bookstore.endpoints.project123.cloud.goog"
+	testKeyStore    = `{
+  "apiKeys": [
+    {"key": "valid-key", "projectNumber": 123},
+    {"key": "expired-key", "projectNumber": 456, "expired": true},
+    {"key": "blocked-key", "projectNumber": 789, "blocked": true}
+  ]
+}`
+)
+
+func newTestServer(t *testing.T, reportLog *bytes.Buffer) *httptest.Server {
+	keyStore, err := NewKeyStoreFromData([]byte(testKeyStore))
+	if err != nil {
+		t.Fatalf("fail to create key store: %v", err)
+	}
+
+	s, err := NewServer(&confpb.Service{
+		Name: testServiceName,
+		Id:   "2020-01-01r0",
+		Quota: &confpb.Quota{
+			Limits: []*confpb.QuotaLimit{
+				{
+					Name:   "read-limit",
+					Metric: "read-requests",
+					Unit:   "1/min/{project}",
+					Values: map[string]int64{"STANDARD": 1},
+				},
+			},
+		},
+	}, keyStore, NewReportLogger(reportLog))
+	if err != nil {
+		t.Fatalf("fail to create server: %v", err)
+	}
+	return httptest.NewServer(s.Handler())
+}
+
+func callServer(t *testing.T, url string, req, resp proto.Message) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("fail to marshal %T: %v", req, err)
+	}
+	httpResp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("fail to call %s: %v", url, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatalf("call to %s returns %v", url, httpResp.Status)
+	}
+	respBody, _ := ioutil.ReadAll(httpResp.Body)
+	if err := proto.Unmarshal(respBody, resp); err != nil {
+		t.Fatalf("fail to unmarshal %T: %v", resp, err)
+	}
+}
+
+func TestNewKeyStoreFromData(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		data      string
+		wantError string
+	}{
+		{
+			desc: "Success",
+			data: testKeyStore,
+		},
+		{
+			desc:      "Fail with invalid json",
+			data:      `{"apiKeys": [`,
+			wantError: "fail to unmarshal key store",
+		},
+		{
+			desc:      "Fail with an empty key",
+			data:      `{"apiKeys": [{"projectNumber": 123}]}`,
+			wantError: "key store has an entry with an empty key",
+		},
+		{
+			desc:      "Fail with duplicated keys",
+			data:      `{"apiKeys": [{"key": "key-1"}, {"key": "key-1"}]}`,
+			wantError: "key store has duplicated key: key-1",
+		},
+	}
+
+	for _, tc := range testCases {
+		_, err := NewKeyStoreFromData([]byte(tc.data))
+		if tc.wantError == "" && err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+		}
+		if tc.wantError != "" && (err == nil || !strings.Contains(err.Error(), tc.wantError)) {
+			t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s := newTestServer(t, &bytes.Buffer{})
+	defer s.Close()
+
+	testCases := []struct {
+		desc              string
+		consumerId        string
+		wantCheckError    scpb.CheckError_Code
+		wantProjectNumber int64
+	}{
+		{
+			desc:              "Valid API key",
+			consumerId:        "api_key:valid-key",
+			wantProjectNumber: 123,
+		},
+		{
+			desc:           "Unknown API key",
+			consumerId:     "api_key:unknown-key",
+			wantCheckError: scpb.CheckError_API_KEY_INVALID,
+		},
+		{
+			desc:           "Expired API key",
+			consumerId:     "api_key:expired-key",
+			wantCheckError: scpb.CheckError_API_KEY_EXPIRED,
+		},
+		{
+			desc:           "Blocked API key",
+			consumerId:     "api_key:blocked-key",
+			wantCheckError: scpb.CheckError_API_TARGET_BLOCKED,
+		},
+		{
+			desc:       "No API key",
+			consumerId: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		resp := &scpb.CheckResponse{}
+		callServer(t, s.URL+"/v1/services/"+testServiceName+":check", &scpb.CheckRequest{
+			ServiceName: testServiceName,
+			Operation: &scpb.Operation{
+				OperationId: "operation-1",
+				ConsumerId:  tc.consumerId,
+			},
+		}, resp)
+
+		if resp.GetOperationId() != "operation-1" {
+			t.Errorf("Test (%s): got operation id %s, want operation-1", tc.desc, resp.GetOperationId())
+		}
+
+		var gotCheckError scpb.CheckError_Code
+		if len(resp.GetCheckErrors()) != 0 {
+			gotCheckError = resp.GetCheckErrors()[0].GetCode()
+		}
+		if gotCheckError != tc.wantCheckError {
+			t.Errorf("Test (%s): got check error %v, want %v", tc.desc, gotCheckError, tc.wantCheckError)
+		}
+
+		if got := resp.GetCheckInfo().GetConsumerInfo().GetProjectNumber(); got != tc.wantProjectNumber {
+			t.Errorf("Test (%s): got project number %v, want %v", tc.desc, got, tc.wantProjectNumber)
+		}
+	}
+}
+
+func TestAllocateQuota(t *testing.T) {
+	s := newTestServer(t, &bytes.Buffer{})
+	defer s.Close()
+
+	testCases := []struct {
+		desc           string
+		consumerId     string
+		wantQuotaError scpb.QuotaError_Code
+	}{
+		{
+			desc:       "First call is within the quota",
+			consumerId: "api_key:valid-key",
+		},
+		{
+			desc:           "Second call exceeds the quota",
+			consumerId:     "api_key:valid-key",
+			wantQuotaError: scpb.QuotaError_RESOURCE_EXHAUSTED,
+		},
+		{
+			desc:           "Unknown API key",
+			consumerId:     "api_key:unknown-key",
+			wantQuotaError: scpb.QuotaError_API_KEY_INVALID,
+		},
+		{
+			desc:           "Expired API key",
+			consumerId:     "api_key:expired-key",
+			wantQuotaError: scpb.QuotaError_API_KEY_EXPIRED,
+		},
+	}
+
+	for _, tc := range testCases {
+		resp := &scpb.AllocateQuotaResponse{}
+		callServer(t, s.URL+"/v1/services/"+testServiceName+":allocateQuota", &scpb.AllocateQuotaRequest{
+			ServiceName:       testServiceName,
+			AllocateOperation: quotaOperation(tc.consumerId, map[string]int64{"read-requests": 1}),
+		}, resp)
+
+		var gotQuotaError scpb.QuotaError_Code
+		if len(resp.GetAllocateErrors()) != 0 {
+			gotQuotaError = resp.GetAllocateErrors()[0].GetCode()
+		}
+		if gotQuotaError != tc.wantQuotaError {
+			t.Errorf("Test (%s): got quota error %v, want %v", tc.desc, gotQuotaError, tc.wantQuotaError)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	reportLog := &bytes.Buffer{}
+	s := newTestServer(t, reportLog)
+	defer s.Close()
+
+	resp := &scpb.ReportResponse{}
+	callServer(t, s.URL+"/v1/services/"+testServiceName+":report", &scpb.ReportRequest{
+		ServiceName: testServiceName,
+		Operations: []*scpb.Operation{
+			{
+				OperationId:   "operation-1",
+				OperationName: "ListShelves",
+			},
+			{
+				OperationId:   "operation-2",
+				OperationName: "GetShelf",
+			},
+		},
+	}, resp)
+
+	if resp.GetServiceConfigId() != "2020-01-01r0" {
+		t.Errorf("got service config id %s, want 2020-01-01r0", resp.GetServiceConfigId())
+	}
+
+	want := `{"operationId":"operation-1","operationName":"ListShelves"}
+{"operationId":"operation-2","operationName":"GetShelf"}
+`
+	if got := reportLog.String(); got != want {
+		t.Errorf("got report log: %s, want: %s", got, want)
+	}
+}
+
+func TestUnknownService(t *testing.T) {
+	s := newTestServer(t, &bytes.Buffer{})
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/v1/services/other-service:check", "application/x-protobuf", nil)
+	if err != nil {
+		t.Fatalf("fail to call server: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %v, want 404 Not Found", resp.Status)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The service management emulator serves service configs and rollouts from a
+// local directory, so the managed rollout flow of the config manager can be
+// exercised without a GCP project.
+//
+// Point the config manager at it with:
+// `--rollout_strategy=managed --service=SERVICE_NAME
+//  --service_management_url=http://HOST:PORT --service_control_url=http://HOST:PORT`
+// and create new rollouts with:
+// `curl -X POST http://HOST:PORT/admin/rollouts -d '{"percentages": {"CONFIG_ID": 100}}'`
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/emulator/servicemanagement"
+	"github.com/golang/glog"
+)
+
+var (
+	port            = flag.Int("port", 8091, "Port the service management emulator listens on.")
+	configDir       = flag.String("config_dir", "", "Directory of the service config JSON files. Each file must be a service config with a unique id.")
+	initialConfigId = flag.String("initial_config_id", "", "The service config id of the initial rollout. If not set, the greatest config id is used.")
+)
+
+func main() {
+	flag.Parse()
+	if *configDir == "" {
+		glog.Exitf("flag --config_dir must be specified")
+	}
+
+	s, err := servicemanagement.NewServer(*configDir, *initialConfigId)
+	if err != nil {
+		glog.Exitf("fail to create service management emulator: %v", err)
+	}
+
+	glog.Infof("service management emulator for service %s is running at port %d, latest rollout: %s",
+		s.ServiceName(), *port, s.LatestRolloutId())
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), s.Handler()); err != nil {
+		glog.Exitf("service management emulator fail to serve: %v", err)
+	}
+}
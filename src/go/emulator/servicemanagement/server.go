@@ -0,0 +1,323 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servicemanagement implements a standalone Service Management server
+// to exercise the managed rollout flow of the config manager without a GCP project.
+//
+// Service configs are loaded from a local directory, and rollouts are created
+// through a small admin API. The latest rollout ID is also returned from the
+// Service Control Report API, which is what the config manager polls to detect
+// new rollouts.
+package servicemanagement
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/mux"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+)
+
+const (
+	rolloutCreatedBy = "servicemanagement-emulator"
+)
+
+// Server emulates Service Management for a single service.
+type Server struct {
+	serviceName string
+	configDir   string
+	timeNow     func() time.Time
+
+	mu sync.RWMutex
+	// config id -> service config.
+	configs map[string]*confpb.Service
+	// All the rollouts, the latest one first.
+	rollouts []*smpb.Rollout
+}
+
+// NewServer creates a Server serving the service configs in configDir.
+//
+// Every `*.json` file in configDir must be a service config of the same service,
+// with a unique `id`. An initial rollout is created for initialConfigId, or for the
+// config with the greatest ID if initialConfigId is empty.
+func NewServer(configDir, initialConfigId string) (*Server, error) {
+	s := &Server{
+		configDir: configDir,
+		timeNow:   time.Now,
+		configs:   make(map[string]*confpb.Service),
+	}
+	if err := s.loadConfigs(); err != nil {
+		return nil, err
+	}
+
+	if initialConfigId == "" {
+		initialConfigId = s.latestConfigId()
+	}
+	if _, err := s.CreateRollout(map[string]float64{initialConfigId: 100}); err != nil {
+		return nil, fmt.Errorf("fail to create the initial rollout: %v", err)
+	}
+	return s, nil
+}
+
+// ServiceName returns the name of the service emulated by the server.
+func (s *Server) ServiceName() string {
+	return s.serviceName
+}
+
+// loadConfigs reads all the service configs in the config directory.
+// Configs that were already loaded are kept as is.
+func (s *Server) loadConfigs() error {
+	paths, err := filepath.Glob(filepath.Join(s.configDir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("fail to list service configs in %s: %v", s.configDir, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, path := range paths {
+		config, err := readServiceConfig(path)
+		if err != nil {
+			return err
+		}
+
+		if config.GetId() == "" {
+			return fmt.Errorf("service config %s does not have an id", path)
+		}
+		if s.serviceName == "" {
+			s.serviceName = config.GetName()
+		}
+		if config.GetName() != s.serviceName {
+			return fmt.Errorf("service config %s is for service %q, want %q", path, config.GetName(), s.serviceName)
+		}
+		if _, ok := s.configs[config.GetId()]; ok {
+			continue
+		}
+		s.configs[config.GetId()] = config
+	}
+
+	if len(s.configs) == 0 {
+		return fmt.Errorf("no service config found in %s", s.configDir)
+	}
+	return nil
+}
+
+func readServiceConfig(path string) (*confpb.Service, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open service config %s: %v", path, err)
+	}
+	defer f.Close()
+
+	config, err := util.UnmarshalServiceConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (s *Server) latestConfigId() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for id := range s.configs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids[len(ids)-1]
+}
+
+// CreateRollout creates a new rollout with the traffic percentages of each config id.
+// The config directory is re-read first, so new config files can be rolled out
+// without restarting the server.
+func (s *Server) CreateRollout(percentages map[string]float64) (*smpb.Rollout, error) {
+	if err := s.loadConfigs(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(percentages) == 0 {
+		return nil, fmt.Errorf("rollout must have at least one traffic percentage")
+	}
+	total := 0.
+	for configId, percent := range percentages {
+		if _, ok := s.configs[configId]; !ok {
+			return nil, fmt.Errorf("service config %q is not found", configId)
+		}
+		if percent < 0 {
+			return nil, fmt.Errorf("traffic percentage of service config %q must not be negative", configId)
+		}
+		total += percent
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("traffic percentages must add up to 100, got %v", total)
+	}
+
+	now := s.timeNow()
+	createTime, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, err
+	}
+
+	rollout := &smpb.Rollout{
+		RolloutId:   s.newRolloutId(now),
+		CreateTime:  createTime,
+		CreatedBy:   rolloutCreatedBy,
+		Status:      smpb.Rollout_SUCCESS,
+		ServiceName: s.serviceName,
+		Strategy: &smpb.Rollout_TrafficPercentStrategy_{
+			TrafficPercentStrategy: &smpb.Rollout_TrafficPercentStrategy{
+				Percentages: percentages,
+			},
+		},
+	}
+	s.rollouts = append([]*smpb.Rollout{rollout}, s.rollouts...)
+
+	glog.Infof("created rollout %s for service %s: %v", rollout.GetRolloutId(), s.serviceName, percentages)
+	return rollout, nil
+}
+
+// newRolloutId generates rollout IDs in the same `{date}r{revision}` format as
+// Service Management. The caller must hold s.mu.
+func (s *Server) newRolloutId(now time.Time) string {
+	date := now.UTC().Format("2006-01-02")
+	revision := 0
+	for _, r := range s.rollouts {
+		if strings.HasPrefix(r.GetRolloutId(), date+"r") {
+			revision++
+		}
+	}
+	return fmt.Sprintf("%sr%d", date, revision)
+}
+
+// LatestRolloutId returns the ID of the latest rollout.
+func (s *Server) LatestRolloutId() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rollouts[0].GetRolloutId()
+}
+
+// Handler returns the http.Handler serving the emulated APIs.
+//
+// It follows the following scheme:
+// GET  /v1/services/{service}/configs/{configId}: the service config, in binary protobuf.
+// GET  /v1/services/{service}/rollouts: a ListServiceRolloutsResponse, in binary protobuf.
+// POST /v1/services/{service}:report: a ReportResponse with the latest rollout ID, in binary protobuf.
+// POST /admin/rollouts: creates a rollout from the JSON body
+//   {"percentages": {"configId": float}}
+// and responds with the created Rollout in JSON.
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	servicePath := "/v1/services/" + s.serviceName
+
+	r.Path(servicePath + "/configs/{configId}").Methods("GET").HandlerFunc(s.handleGetConfig)
+	r.Path(servicePath + "/rollouts").Methods("GET").HandlerFunc(s.handleListRollouts)
+	r.Path(servicePath + ":report").Methods("POST").HandlerFunc(s.handleReport)
+	r.Path("/admin/rollouts").Methods("POST").HandlerFunc(s.handleCreateRollout)
+	return r
+}
+
+func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	configId := mux.Vars(r)["configId"]
+
+	s.mu.RLock()
+	config, ok := s.configs[configId]
+	s.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("service config %q is not found", configId), http.StatusNotFound)
+		return
+	}
+	writeResponse(w, config)
+}
+
+func (s *Server) handleListRollouts(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	resp := &smpb.ListServiceRolloutsResponse{
+		Rollouts: s.rollouts,
+	}
+	s.mu.RUnlock()
+
+	writeResponse(w, resp)
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, &scpb.ReportResponse{
+		ServiceRolloutId: s.LatestRolloutId(),
+	})
+}
+
+type createRolloutRequest struct {
+	Percentages map[string]float64 `json:"percentages"`
+}
+
+func (s *Server) handleCreateRollout(w http.ResponseWriter, r *http.Request) {
+	var req createRolloutRequest
+	if err := readJsonRequest(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rollout, err := s.CreateRollout(req.Percentages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := (&jsonpb.Marshaler{}).Marshal(w, rollout); err != nil {
+		glog.Errorf("fail to marshal rollout: %v", err)
+	}
+}
+
+func readJsonRequest(r *http.Request, req interface{}) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("fail to read request body: %v", err)
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		return fmt.Errorf("fail to unmarshal request body: %v", err)
+	}
+	return nil
+}
+
+func writeResponse(w http.ResponseWriter, resp proto.Message) {
+	body, err := proto.Marshal(resp)
+	if err != nil {
+		glog.Errorf("fail to marshal %T: %v", resp, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,262 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicemanagement
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
+)
+
+const (
+	testServiceName = "bookstore.endpoints.project123.cloud.goog"
+)
+
+func writeServiceConfig(t *testing.T, dir, serviceName, configId string) {
+	config := fmt.Sprintf(`{"name": "%s", "id": "%s", "apis": [{"name": "endpoints.examples.bookstore.Bookstore"}]}`, serviceName, configId)
+	if err := ioutil.WriteFile(filepath.Join(dir, configId+".json"), []byte(config), 0644); err != nil {
+		t.Fatalf("fail to write service config: %v", err)
+	}
+}
+
+func fakeAccessToken() (string, time.Duration, error) {
+	return "ya29.fake", time.Hour, nil
+}
+
+func TestNewServer(t *testing.T) {
+	testCases := []struct {
+		desc                string
+		configs             map[string]string
+		initialConfigId     string
+		wantError           string
+		wantRolloutConfigId string
+	}{
+		{
+			desc: "Success, the greatest config id is rolled out",
+			configs: map[string]string{
+				"2020-01-01r0": testServiceName,
+				"2020-01-02r0": testServiceName,
+			},
+			wantRolloutConfigId: "2020-01-02r0",
+		},
+		{
+			desc: "Success, the initial config id is rolled out",
+			configs: map[string]string{
+				"2020-01-01r0": testServiceName,
+				"2020-01-02r0": testServiceName,
+			},
+			initialConfigId:     "2020-01-01r0",
+			wantRolloutConfigId: "2020-01-01r0",
+		},
+		{
+			desc:      "Fail without service configs",
+			configs:   map[string]string{},
+			wantError: "no service config found",
+		},
+		{
+			desc: "Fail with configs of different services",
+			configs: map[string]string{
+				"2020-01-01r0": testServiceName,
+				"2020-01-02r0": "other-service",
+			},
+			wantError: "want \"bookstore.endpoints.project123.cloud.goog\"",
+		},
+		{
+			desc: "Fail with unknown initial config id",
+			configs: map[string]string{
+				"2020-01-01r0": testServiceName,
+			},
+			initialConfigId: "2020-01-05r0",
+			wantError:       `service config "2020-01-05r0" is not found`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "servicemanagement")
+			if err != nil {
+				t.Fatalf("fail to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			for configId, serviceName := range tc.configs {
+				writeServiceConfig(t, dir, serviceName, configId)
+			}
+
+			s, err := NewServer(dir, tc.initialConfigId)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("got error: %v, want error: %s", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+
+			if got := s.rollouts[0].GetTrafficPercentStrategy().GetPercentages(); got[tc.wantRolloutConfigId] != 100 {
+				t.Errorf("got rollout percentages: %v, want 100%% to %s", got, tc.wantRolloutConfigId)
+			}
+		})
+	}
+}
+
+func TestManagedRollout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicemanagement")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeServiceConfig(t, dir, testServiceName, "2020-01-01r0")
+
+	s, err := NewServer(dir, "")
+	if err != nil {
+		t.Fatalf("fail to create server: %v", err)
+	}
+	s.timeNow = func() time.Time {
+		return time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	fetcher := serviceconfig.NewServiceConfigFetcher(http.DefaultClient, ts.URL, testServiceName, fakeAccessToken)
+
+	configId, err := fetcher.LoadConfigIdFromRollouts(context.Background())
+	if err != nil || configId != "2020-01-01r0" {
+		t.Fatalf("got config id: %s, error: %v, want 2020-01-01r0", configId, err)
+	}
+
+	// A new config file is picked up when a rollout is created through the admin API.
+	writeServiceConfig(t, dir, testServiceName, "2020-01-02r0")
+	resp, err := http.Post(ts.URL+"/admin/rollouts", "application/json",
+		strings.NewReader(`{"percentages": {"2020-01-02r0": 100}}`))
+	if err != nil {
+		t.Fatalf("fail to create rollout: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"rolloutId":"2020-01-02r0"`) {
+		t.Fatalf("got create rollout response: %v %s", resp.Status, body)
+	}
+
+	// The config manager detects the new rollout from the Report response.
+	reportResp := &scpb.ReportResponse{}
+	if err := util.CallGoogleapis(context.Background(), http.DefaultClient, util.FetchRolloutIdURL(ts.URL, testServiceName), util.POST,
+		fakeAccessToken, nil, reportResp); err != nil {
+		t.Fatalf("fail to call report: %v", err)
+	}
+	if got := reportResp.GetServiceRolloutId(); got != "2020-01-02r0" {
+		t.Errorf("got rollout id in report response: %s, want 2020-01-02r0", got)
+	}
+
+	configId, err = fetcher.LoadConfigIdFromRollouts(context.Background())
+	if err != nil || configId != "2020-01-02r0" {
+		t.Fatalf("got config id: %s, error: %v, want 2020-01-02r0", configId, err)
+	}
+
+	config, err := fetcher.FetchConfig(context.Background(), configId)
+	if err != nil {
+		t.Fatalf("fail to fetch config: %v", err)
+	}
+	if config.GetId() != "2020-01-02r0" || config.GetName() != testServiceName {
+		t.Errorf("got service config: %v", config)
+	}
+
+	if _, err := fetcher.FetchConfig(context.Background(), "2020-01-05r0"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got error %v when fetching unknown config, want 404", err)
+	}
+}
+
+func TestCreateRollout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicemanagement")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeServiceConfig(t, dir, testServiceName, "2020-01-01r0")
+	writeServiceConfig(t, dir, testServiceName, "2020-01-02r0")
+
+	s, err := NewServer(dir, "")
+	if err != nil {
+		t.Fatalf("fail to create server: %v", err)
+	}
+	s.timeNow = func() time.Time {
+		return time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		desc          string
+		percentages   map[string]float64
+		wantRolloutId string
+		wantError     string
+	}{
+		{
+			desc:          "Success with a single config",
+			percentages:   map[string]float64{"2020-01-01r0": 100},
+			wantRolloutId: "2020-01-03r0",
+		},
+		{
+			desc:          "Success with split traffic, the revision is incremented",
+			percentages:   map[string]float64{"2020-01-01r0": 40, "2020-01-02r0": 60},
+			wantRolloutId: "2020-01-03r1",
+		},
+		{
+			desc:        "Fail with percentages not adding up to 100",
+			percentages: map[string]float64{"2020-01-01r0": 40},
+			wantError:   "traffic percentages must add up to 100, got 40",
+		},
+		{
+			desc:        "Fail with unknown config",
+			percentages: map[string]float64{"2020-01-05r0": 100},
+			wantError:   `service config "2020-01-05r0" is not found`,
+		},
+		{
+			desc:      "Fail without percentages",
+			wantError: "rollout must have at least one traffic percentage",
+		},
+	}
+
+	for _, tc := range testCases {
+		rollout, err := s.CreateRollout(tc.percentages)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if rollout.GetRolloutId() != tc.wantRolloutId {
+			t.Errorf("Test (%s): got rollout id: %s, want: %s", tc.desc, rollout.GetRolloutId(), tc.wantRolloutId)
+		}
+		if got := s.LatestRolloutId(); got != tc.wantRolloutId {
+			t.Errorf("Test (%s): got latest rollout id: %s, want: %s", tc.desc, got, tc.wantRolloutId)
+		}
+	}
+}
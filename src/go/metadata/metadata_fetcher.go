@@ -15,10 +15,12 @@
 package metadata
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -26,14 +28,39 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v9/http/service_control"
 )
 
 const (
 	tokenExpiry = 3599
+
+	// Environment variables set by the serverless platforms and Kubernetes.
+	cloudRunServiceEnv       = "K_SERVICE"
+	cloudFunctionsTargetEnv  = "FUNCTION_TARGET"
+	gaeEnv                   = "GAE_ENV"
+	kubernetesServiceHostEnv = "KUBERNETES_SERVICE_HOST"
+
+	// The node names of GKE Autopilot clusters start with it.
+	gkeAutopilotNodePrefix = "gk3-"
+)
+
+var (
+	// Outcomes of metadata lookups, logged every --expvar_log_interval:
+	// - cache_hit: the value is served from the cache without a call.
+	// Outcomes of the calls are published under the "metadata" endpoint of
+	// http_client_calls.
+	metadataCallOutcomes = expvar.NewMap("metadata_fetcher_calls")
 )
 
+// Metadata of the instance that never changes during its life, cached once fetched.
+var immutableMetadataPaths = map[string]bool{
+	util.ProjectIDPath: true,
+	util.RegionPath:    true,
+	util.ZonePath:      true,
+}
+
 type tokenInfo struct {
 	accessToken  string
 	tokenTimeout time.Time
@@ -45,9 +72,26 @@ type metadataTokenResponse struct {
 }
 
 type MetadataFetcher struct {
+	// Cancels the calls to the metadata server. context.Background() if nil.
+	ctx     context.Context
 	client  http.Client
 	baseUrl string
 	timeNow func() time.Time
+	// Looks up the environment variables for platform detection. No
+	// environment variable is found if nil.
+	lookupEnv func(key string) (string, bool)
+
+	// How a metadata call is retried on transient errors. No retry if nil.
+	retryPolicy *util.RetryPolicy
+	// Whether the platform is Anthos when the metadata server is not reached
+	// on Kubernetes.
+	anthosWithoutMetadataServer bool
+
+	cacheMux sync.Mutex
+	// path -> response, for immutableMetadataPaths.
+	immutableCache map[string]string
+	// Cached once all of the attributes are fetched.
+	gcpAttributes *scpb.GcpAttributes
 
 	mux sync.Mutex
 	// metadata updates and stores Metadata from GCE.
@@ -58,13 +102,22 @@ type MetadataFetcher struct {
 
 // Allows for unit tests to inject a mock constructor
 var (
-	NewMetadataFetcher = func(opts options.CommonOptions) *MetadataFetcher {
+	NewMetadataFetcher = func(ctx context.Context, opts options.CommonOptions) *MetadataFetcher {
+		retryPolicy := *util.MetadataRetryPolicy
+		retryPolicy.MaxRetries = opts.MetadataFetchRetries
+		retryPolicy.InitialInterval = opts.MetadataFetchRetryBaseInterval
+
 		return &MetadataFetcher{
+			ctx: ctx,
 			client: http.Client{
 				Timeout: opts.HttpRequestTimeout,
 			},
-			baseUrl: opts.MetadataURL,
-			timeNow: time.Now,
+			baseUrl:     opts.MetadataURL,
+			timeNow:     time.Now,
+			lookupEnv:   os.LookupEnv,
+			retryPolicy: &retryPolicy,
+
+			anthosWithoutMetadataServer: opts.AnthosWithoutMetadataServer,
 		}
 	}
 )
@@ -73,18 +126,33 @@ func (mf *MetadataFetcher) createUrl(suffix string) string {
 	return mf.baseUrl + suffix
 }
 
-func (mf *MetadataFetcher) getMetadata(path string) ([]byte, error) {
-	req, _ := http.NewRequest("GET", path, nil)
-	req.Header.Add("Metadata-Flavor", "Google")
-	resp, err := mf.client.Do(req)
-	if err != nil {
-		return nil, err
+func newMetadataRequest(path string) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Metadata-Flavor", "Google")
+		return req, nil
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(`failed fetching metadata: %v, status code %v"`, path, resp.StatusCode)
+}
+
+func (mf *MetadataFetcher) context() context.Context {
+	if mf.ctx == nil {
+		return context.Background()
 	}
-	return ioutil.ReadAll(resp.Body)
+	return mf.ctx
+}
+
+func (mf *MetadataFetcher) getMetadata(path string) ([]byte, error) {
+	return util.DoWithRetry(mf.context(), &mf.client, nil, newMetadataRequest(path))
+}
+
+// getMetadataWithRetry retries the call on transient errors: connection
+// errors, timeouts, 429 and 5xx. Other statuses, such as the 404 of a path
+// not supported on the platform, are returned immediately.
+func (mf *MetadataFetcher) getMetadataWithRetry(path string) ([]byte, error) {
+	return util.DoWithRetry(mf.context(), &mf.client, mf.retryPolicy, newMetadataRequest(path))
 }
 
 func (mf *MetadataFetcher) FetchAccessToken() (string, time.Duration, error) {
@@ -97,7 +165,7 @@ func (mf *MetadataFetcher) FetchAccessToken() (string, time.Duration, error) {
 		return mf.tokenInfo.accessToken, mf.tokenInfo.tokenTimeout.Sub(now), nil
 	}
 
-	tokenBody, err := mf.getMetadata(mf.createUrl(util.AccessTokenPath))
+	tokenBody, err := mf.getMetadataWithRetry(mf.createUrl(util.AccessTokenPath))
 	if err != nil {
 		return "", 0, err
 	}
@@ -113,13 +181,34 @@ func (mf *MetadataFetcher) FetchAccessToken() (string, time.Duration, error) {
 	return mf.tokenInfo.accessToken, expires, nil
 }
 
-// TODO(kyuc): perhaps we need some retry logic and timeout?
 func (mf *MetadataFetcher) fetchMetadata(key string) (string, error) {
-	body, err := mf.getMetadata(mf.createUrl(key))
+	if !immutableMetadataPaths[key] {
+		body, err := mf.getMetadataWithRetry(mf.createUrl(key))
+		if err != nil {
+			return "", err
+		}
+		return string(body), nil
+	}
+
+	mf.cacheMux.Lock()
+	value, ok := mf.immutableCache[key]
+	mf.cacheMux.Unlock()
+	if ok {
+		metadataCallOutcomes.Add("cache_hit", 1)
+		return value, nil
+	}
+
+	body, err := mf.getMetadataWithRetry(mf.createUrl(key))
 	if err != nil {
 		return "", err
 	}
 
+	mf.cacheMux.Lock()
+	defer mf.cacheMux.Unlock()
+	if mf.immutableCache == nil {
+		mf.immutableCache = make(map[string]string)
+	}
+	mf.immutableCache[key] = string(body)
 	return string(body), nil
 }
 
@@ -162,8 +251,25 @@ func (mf *MetadataFetcher) FetchIdentityJWTToken(audience string) (string, time.
 }
 
 func (mf *MetadataFetcher) FetchGCPAttributes() (*scpb.GcpAttributes, error) {
+	mf.cacheMux.Lock()
+	cached := mf.gcpAttributes
+	mf.cacheMux.Unlock()
+	if cached != nil {
+		metadataCallOutcomes.Add("cache_hit", 1)
+		return proto.Clone(cached).(*scpb.GcpAttributes), nil
+	}
+
 	// Checking if metadata server is reachable.
 	if _, err := mf.fetchMetadata(""); err != nil {
+		// Anthos clusters outside of GCP have no metadata server, only the
+		// platform is known. Not cached, the metadata server may be back.
+		// Opted in, as the metadata server of GKE may be down as well.
+		if mf.anthosWithoutMetadataServer && mf.hasEnv(kubernetesServiceHostEnv) {
+			glog.Warningf("metadata server was not reached on Kubernetes, assuming %s: %v", util.Anthos, err)
+			return &scpb.GcpAttributes{
+				Platform: util.Anthos,
+			}, nil
+		}
 		return nil, err
 	}
 
@@ -176,7 +282,19 @@ func (mf *MetadataFetcher) FetchGCPAttributes() (*scpb.GcpAttributes, error) {
 		attrs.Zone = location
 	}
 
-	attrs.Platform = mf.fetchPlatform()
+	platform, platformErr := mf.fetchPlatform()
+	if platformErr != nil {
+		glog.Warningf("fail to detect platform, fall back to %s: %v", util.GCE, platformErr)
+		platform = util.GCE
+	}
+	attrs.Platform = platform
+
+	// Partial attributes are not cached, so the missing ones are fetched again next time.
+	if attrs.ProjectId != "" && attrs.Zone != "" && platformErr == nil {
+		mf.cacheMux.Lock()
+		mf.gcpAttributes = proto.Clone(attrs).(*scpb.GcpAttributes)
+		mf.cacheMux.Unlock()
+	}
 	return attrs, nil
 }
 
@@ -206,14 +324,81 @@ func (mf *MetadataFetcher) fetchLocation() (string, error) {
 	return locationPath[index+1:], nil
 }
 
-func (mf *MetadataFetcher) fetchPlatform() string {
-	if _, err := mf.fetchMetadata(util.GAEServerSoftwarePath); err == nil {
-		return util.GAEFlex
+// fetchPlatform detects the platform with the environment variables set by
+// the serverless platforms first, then with the metadata only available on
+// some platforms.
+func (mf *MetadataFetcher) fetchPlatform() (string, error) {
+	// Cloud Functions are served by Cloud Run, which sets K_SERVICE as well.
+	if mf.hasEnv(cloudFunctionsTargetEnv) {
+		return util.CloudFunctions, nil
+	}
+	if mf.hasEnv(cloudRunServiceEnv) {
+		return util.CloudRun, nil
+	}
+	if env, _ := mf.getEnv(gaeEnv); env == "standard" {
+		return util.GAEStandard, nil
+	}
+
+	found, err := mf.metadataExists(util.GAEServerSoftwarePath)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return util.GAEFlex, nil
 	}
 
-	if _, err := mf.fetchMetadata(util.KubeEnvPath); err == nil {
-		return util.GKE
+	// Only the serverless platforms are regional.
+	found, err = mf.metadataExists(util.RegionPath)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return util.CloudRun, nil
 	}
 
-	return util.GCE
+	// kube-env is hidden by the GKE metadata server of Workload Identity,
+	// which is always enabled on Autopilot, while cluster-name is not.
+	isGKE, err := mf.metadataExists(util.KubeEnvPath)
+	if err != nil {
+		return "", err
+	}
+	if !isGKE {
+		if isGKE, err = mf.metadataExists(util.ClusterNamePath); err != nil {
+			return "", err
+		}
+	}
+	if isGKE {
+		nodeName, err := mf.fetchMetadata(util.InstanceNamePath)
+		if err == nil && strings.HasPrefix(nodeName, gkeAutopilotNodePrefix) {
+			return util.GKEAutopilot, nil
+		}
+		return util.GKE, nil
+	}
+
+	return util.GCE, nil
+}
+
+func (mf *MetadataFetcher) getEnv(key string) (string, bool) {
+	if mf.lookupEnv == nil {
+		return "", false
+	}
+	return mf.lookupEnv(key)
+}
+
+func (mf *MetadataFetcher) hasEnv(key string) bool {
+	value, _ := mf.getEnv(key)
+	return value != ""
+}
+
+// metadataExists tells if the metadata server has the key. An error is
+// returned if it cannot be told, e.g. the metadata server is unavailable.
+func (mf *MetadataFetcher) metadataExists(key string) (bool, error) {
+	_, err := mf.fetchMetadata(key)
+	if err == nil {
+		return true, nil
+	}
+	if statusErr, ok := err.(*util.HttpStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
 }
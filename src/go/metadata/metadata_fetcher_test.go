@@ -15,7 +15,13 @@
 package metadata
 
 import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -199,9 +205,11 @@ func TestFetchConfigId(t *testing.T) {
 
 func TestFetchGCPAttributes(t *testing.T) {
 	testData := []struct {
-		desc                  string
-		mockedResp            map[string]string
-		expectedGCPAttributes *scpb.GcpAttributes
+		desc                        string
+		mockedResp                  map[string]string
+		env                         map[string]string
+		anthosWithoutMetadataServer bool
+		expectedGCPAttributes       *scpb.GcpAttributes
 	}{
 		{
 			desc: "ProjectID",
@@ -292,9 +300,107 @@ func TestFetchGCPAttributes(t *testing.T) {
 			},
 			expectedGCPAttributes: &scpb.GcpAttributes{
 				Zone:     fakeRegion,
-				Platform: util.GCE,
+				Platform: util.CloudRun,
+			},
+		},
+		{
+			desc: "Platform - GKE with Workload Identity",
+			mockedResp: map[string]string{
+				util.ClusterNamePath:  "cluster",
+				util.InstanceNamePath: "gke-cluster-default-pool-1234",
+			},
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Platform: util.GKE,
+			},
+		},
+		{
+			desc: "Platform - GKE Autopilot",
+			mockedResp: map[string]string{
+				util.ClusterNamePath:  "cluster",
+				util.InstanceNamePath: "gk3-cluster-default-pool-1234",
+			},
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Platform: util.GKEAutopilot,
+			},
+		},
+		{
+			desc: "Platform - Cloud Run",
+			mockedResp: map[string]string{
+				util.RegionPath: fakeRegionPath,
+			},
+			env: map[string]string{
+				"K_SERVICE":  "bookstore",
+				"K_REVISION": "bookstore-00001",
+			},
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Zone:     fakeRegion,
+				Platform: util.CloudRun,
+			},
+		},
+		{
+			desc: "Platform - Cloud Functions",
+			mockedResp: map[string]string{
+				util.RegionPath: fakeRegionPath,
+			},
+			env: map[string]string{
+				"K_SERVICE":       "bookstore",
+				"FUNCTION_TARGET": "HelloWorld",
+			},
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Zone:     fakeRegion,
+				Platform: util.CloudFunctions,
+			},
+		},
+		{
+			desc: "Platform - GAE_STANDARD",
+			mockedResp: map[string]string{
+				util.RegionPath: fakeRegionPath,
+			},
+			env: map[string]string{
+				"GAE_ENV": "standard",
+			},
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Zone:     fakeRegion,
+				Platform: util.GAEStandard,
+			},
+		},
+		{
+			desc: "Platform - GKE is not mistaken for Anthos",
+			mockedResp: map[string]string{
+				util.KubeEnvPath: "foo",
+			},
+			env: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+			},
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Platform: util.GKE,
 			},
 		},
+		{
+			desc:       "Platform - Anthos without MetadataServer",
+			mockedResp: nil,
+			env: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+			},
+			anthosWithoutMetadataServer: true,
+			expectedGCPAttributes: &scpb.GcpAttributes{
+				Platform: util.Anthos,
+			},
+		},
+		{
+			desc:       "Platform - Kubernetes without MetadataServer fails unless Anthos is opted in",
+			mockedResp: nil,
+			env: map[string]string{
+				"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+			},
+			expectedGCPAttributes: nil,
+		},
+		{
+			desc:                        "Platform - Anthos is not assumed outside of Kubernetes",
+			mockedResp:                  nil,
+			anthosWithoutMetadataServer: true,
+			expectedGCPAttributes:       nil,
+		},
 	}
 
 	errorTmpl := "Test: %s\n  Expected: %v\n  Actual: %v"
@@ -308,13 +414,22 @@ func TestFetchGCPAttributes(t *testing.T) {
 		}
 
 		mf := NewMockMetadataFetcher(mockBaseUrl, time.Now())
+		mf.anthosWithoutMetadataServer = tc.anthosWithoutMetadataServer
+		env := tc.env
+		mf.lookupEnv = func(key string) (string, bool) {
+			value, ok := env[key]
+			return value, ok
+		}
 
 		attrs, err := mf.FetchGCPAttributes()
 		if err != nil && tc.expectedGCPAttributes != nil {
 			t.Errorf(errorTmpl, tc.desc, nil, err)
 			continue
 		}
-		if tc.expectedGCPAttributes == nil && attrs == nil {
+		if tc.expectedGCPAttributes == nil {
+			if err == nil {
+				t.Errorf(errorTmpl, tc.desc, "error", attrs)
+			}
 			continue
 		}
 
@@ -333,7 +448,7 @@ func TestFetchGCPAttributes(t *testing.T) {
 func TestMetadataFetcherTimeout(t *testing.T) {
 	opts := options.DefaultCommonOptions()
 	opts.HttpRequestTimeout = 1 * time.Second
-	mf := NewMetadataFetcher(opts)
+	mf := NewMetadataFetcher(context.Background(), opts)
 	server := util.InitMockServer(`{}`)
 	_, err := mf.getMetadata(server.GetURL())
 	if err != nil {
@@ -345,3 +460,172 @@ func TestMetadataFetcherTimeout(t *testing.T) {
 		t.Errorf("TestMetadataFetcherTimeout: the metadata fetcher get the config but should get timeout error")
 	}
 }
+
+// Returns a metadata server responding with failStatus to the first numFails
+// requests of each path, and with the pathResp afterwards.
+func newFlakyMetadataServer(pathResp map[string]string, numFails int, failStatus int, reqCnt *int32) *httptest.Server {
+	var mu sync.Mutex
+	failCnt := make(map[string]int)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(reqCnt, 1)
+		mu.Lock()
+		fail := failCnt[r.URL.Path] < numFails
+		failCnt[r.URL.Path]++
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(failStatus)
+			return
+		}
+		if r.URL.Path == "" || r.URL.Path == "/" {
+			return
+		}
+		if resp, ok := pathResp[r.URL.Path]; ok {
+			_, _ = w.Write([]byte(resp))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func metadataCallOutcome(outcome string) int64 {
+	if v, ok := metadataCallOutcomes.Get(outcome).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestFetchMetadataWithRetry(t *testing.T) {
+	testData := []struct {
+		desc        string
+		numFails    int
+		failStatus  int
+		wantValue   string
+		wantError   string
+		wantReqCnt  int32
+		wantRetries int64
+	}{
+		{
+			desc:        "Success after transient 503 errors",
+			numFails:    2,
+			failStatus:  http.StatusServiceUnavailable,
+			wantValue:   fakeServiceName,
+			wantReqCnt:  3,
+			wantRetries: 2,
+		},
+		{
+			desc:        "Success after transient 429 errors",
+			numFails:    1,
+			failStatus:  http.StatusTooManyRequests,
+			wantValue:   fakeServiceName,
+			wantReqCnt:  2,
+			wantRetries: 1,
+		},
+		{
+			desc:        "Fail when retries are exhausted",
+			numFails:    5,
+			failStatus:  http.StatusInternalServerError,
+			wantError:   "500 Internal Server Error",
+			wantReqCnt:  4,
+			wantRetries: 3,
+		},
+		{
+			desc:       "Fail without retry on permanent errors",
+			numFails:   1,
+			failStatus: http.StatusForbidden,
+			wantError:  "403 Forbidden",
+			wantReqCnt: 1,
+		},
+	}
+
+	for _, tc := range testData {
+		var reqCnt int32
+		ts := newFlakyMetadataServer(map[string]string{util.ServiceNamePath: fakeServiceName}, tc.numFails, tc.failStatus, &reqCnt)
+
+		opts := options.DefaultCommonOptions()
+		opts.MetadataURL = ts.URL
+		opts.MetadataFetchRetryBaseInterval = time.Millisecond
+		mf := NewMetadataFetcher(context.Background(), opts)
+
+		retriesBefore := util.HttpCallOutcome("metadata", "retry")
+		value, err := mf.FetchServiceName()
+		ts.Close()
+
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+		} else if err != nil || value != tc.wantValue {
+			t.Errorf("Test (%s): got value: %s, error: %v, want value: %s", tc.desc, value, err, tc.wantValue)
+		}
+
+		if reqCnt != tc.wantReqCnt {
+			t.Errorf("Test (%s): got %d requests, want %d", tc.desc, reqCnt, tc.wantReqCnt)
+		}
+		if got := util.HttpCallOutcome("metadata", "retry") - retriesBefore; got != tc.wantRetries {
+			t.Errorf("Test (%s): got %d retries in metrics, want %d", tc.desc, got, tc.wantRetries)
+		}
+	}
+}
+
+func TestFetchGCPAttributesCache(t *testing.T) {
+	var reqCnt int32
+	ts := newFlakyMetadataServer(map[string]string{
+		util.ProjectIDPath: fakeProjectID,
+		util.ZonePath:      fakeZonePath,
+		util.KubeEnvPath:   "foo",
+	}, 0, 0, &reqCnt)
+	defer ts.Close()
+
+	mf := NewMockMetadataFetcher(ts.URL, time.Now())
+	want := &scpb.GcpAttributes{
+		ProjectId: fakeProjectID,
+		Zone:      fakeZone,
+		Platform:  util.GKE,
+	}
+
+	attrs, err := mf.FetchGCPAttributes()
+	if err != nil || !proto.Equal(attrs, want) {
+		t.Fatalf("got attributes: %v, error: %v, want: %v", attrs, err, want)
+	}
+	firstReqCnt := atomic.LoadInt32(&reqCnt)
+
+	cacheHitsBefore := metadataCallOutcome("cache_hit")
+	attrs, err = mf.FetchGCPAttributes()
+	if err != nil || !proto.Equal(attrs, want) {
+		t.Fatalf("got cached attributes: %v, error: %v, want: %v", attrs, err, want)
+	}
+	if got := atomic.LoadInt32(&reqCnt); got != firstReqCnt {
+		t.Errorf("got %d requests after fetching cached attributes, want %d", got, firstReqCnt)
+	}
+	if got := metadataCallOutcome("cache_hit") - cacheHitsBefore; got != 1 {
+		t.Errorf("got %d cache hits in metrics, want 1", got)
+	}
+
+	// The project ID is served from the cache too.
+	if projectID, err := mf.FetchProjectId(); err != nil || projectID != fakeProjectID {
+		t.Errorf("got project id: %s, error: %v, want: %s", projectID, err, fakeProjectID)
+	}
+	if got := atomic.LoadInt32(&reqCnt); got != firstReqCnt {
+		t.Errorf("got %d requests after fetching cached project id, want %d", got, firstReqCnt)
+	}
+}
+
+func TestFetchGCPAttributesNotCachedOnError(t *testing.T) {
+	var reqCnt int32
+	// The zone is not available, so the attributes are fetched again.
+	ts := newFlakyMetadataServer(map[string]string{
+		util.ProjectIDPath: fakeProjectID,
+	}, 0, 0, &reqCnt)
+	defer ts.Close()
+
+	mf := NewMockMetadataFetcher(ts.URL, time.Now())
+	for i := 0; i < 2; i++ {
+		before := atomic.LoadInt32(&reqCnt)
+		if _, err := mf.FetchGCPAttributes(); err != nil {
+			t.Fatalf("got unexpected error: %v", err)
+		}
+		if atomic.LoadInt32(&reqCnt) == before {
+			t.Errorf("call %d: got no request to the metadata server, want partial attributes not cached", i)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package metadata
 
 import (
+	"context"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
@@ -33,8 +34,9 @@ func NewMockMetadataFetcher(baseUrl string, now time.Time) *MetadataFetcher {
 // Injects the mock constructor into source code. Mock metadata fetcher only created
 // when source code calls constructor.
 func SetMockMetadataFetcher(baseUrl string, now time.Time) {
-	NewMetadataFetcher = func(opts options.CommonOptions) *MetadataFetcher {
+	NewMetadataFetcher = func(ctx context.Context, opts options.CommonOptions) *MetadataFetcher {
 		return &MetadataFetcher{
+			ctx:     ctx,
 			baseUrl: baseUrl,
 			timeNow: func() time.Time {
 				return now
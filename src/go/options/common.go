@@ -45,6 +45,13 @@ type CommonOptions struct {
 	HttpRequestTimeout time.Duration
 	MetadataURL        string
 	IamURL             string
+	// Retries of metadata calls on transient errors, with exponential backoff
+	// and jitter starting from MetadataFetchRetryBaseInterval.
+	MetadataFetchRetries           int
+	MetadataFetchRetryBaseInterval time.Duration
+	// Reports the Anthos platform when the metadata server is not reached on
+	// Kubernetes, for Anthos clusters outside of GCP.
+	AnthosWithoutMetadataServer bool
 	// Configures the identity used when making requests to Service Control.
 	ServiceControlCredentials *IAMCredentialsOptions
 	// Configures the identity used when making requests to backends.
@@ -84,6 +91,9 @@ func DefaultCommonOptions() CommonOptions {
 		// b/148454048: This should be at least 20s due to IMDS latency issues with k8s workload identities.
 		HttpRequestTimeout: 30 * time.Second,
 
+		MetadataFetchRetries:           3,
+		MetadataFetchRetryBaseInterval: 100 * time.Millisecond,
+
 		Node:                       "ESPv2",
 		TracingSamplingRate:        0.001,
 		TracingMaxNumAttributes:    32,
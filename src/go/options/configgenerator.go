@@ -36,6 +36,13 @@ type ConfigGeneratorOptions struct {
 	CorsAllowOriginRegex string
 	CorsExposeHeaders    string
 	CorsPreset           string
+	// Lists of the exact and suffix-matched origins, separated by ','.
+	CorsAllowOrigins        string
+	CorsAllowOriginSuffixes string
+	CorsMaxAge              time.Duration
+	CorsAllowPrivateNetwork bool
+	// Path to the JSON file of the CORS policies per operation.
+	CorsPoliciesFile string
 
 	// Backend routing configurations.
 	BackendDnsLookupFamily string
@@ -51,6 +58,7 @@ type ConfigGeneratorOptions struct {
 	// Network related configurations.
 	ListenerAddress                  string
 	Healthz                          string
+	OpenApiDocPath                   string
 	ServiceManagementURL             string
 	ServiceControlURL                string
 	ListenerPort                     int
@@ -65,6 +73,32 @@ type ConfigGeneratorOptions struct {
 	SslBackendClientCipherSuites     string
 	DnsResolverAddresses             string
 
+	// Downstream mutual TLS, enabled by the root certificates of the client
+	// certificates. The mode is "require" or "optional". The allowed SANs are
+	// separated by ',' and matched by prefix if ending with '*', and the
+	// client certificate details forwarded to the backends in the
+	// x-forwarded-client-cert header are separated by ','.
+	SslDownstreamClientRootCertsPath      string
+	SslDownstreamClientCertMode           string
+	SslDownstreamClientAllowedSans        string
+	SslDownstreamClientCertRulesFile      string
+	SslDownstreamClientForwardCertDetails string
+
+	// Serve the TLS certificates of the listener and the clusters as SDS
+	// secrets from the config manager, which pushes the rotated certificate
+	// files.
+	EnableSdsCertificates bool
+
+	// The security headers added to all the responses unless set by the
+	// backends, and the backend response headers removed, separated by ','.
+	EnableSecurityHeaders                bool
+	SecurityHeadersHstsMaxAge            time.Duration
+	SecurityHeadersHstsPreload           bool
+	SecurityHeadersFrameOptions          string
+	SecurityHeadersReferrerPolicy        string
+	SecurityHeadersContentSecurityPolicy string
+	SecurityHeadersStrip                 string
+
 	// Headers manipulation:
 	AddRequestHeaders     string
 	AppendRequestHeaders  string
@@ -74,6 +108,10 @@ type ConfigGeneratorOptions struct {
 	// Flags for non_gcp deployment.
 	ServiceAccountKey string
 	TokenAgentPort    uint
+	TokenAgentSocket  string
+	// The shared secret envoy presents to the token agent. It is generated
+	// by the config manager at startup, not set by a flag.
+	TokenAgentSecret string
 
 	// Flags for external calls.
 	DisableOidcDiscovery    bool
@@ -102,6 +140,12 @@ type ConfigGeneratorOptions struct {
 	ConnectionBufferLimitBytes    int
 
 	JwksCacheDurationInS int
+	JwksLocalFiles       string
+	JwtClaimRulesFile    string
+	JwtCookieLocations   string
+	JwtClaimsToHeaders   string
+	// Claims to headers of the individual providers, prefixed by provider ID.
+	JwtProviderClaimsToHeaders string
 
 	ScCheckTimeoutMs  int
 	ScQuotaTimeoutMs  int
@@ -113,6 +157,39 @@ type ConfigGeneratorOptions struct {
 	ScQuotaRetries  int
 	ScReportRetries int
 
+	// "global" applies BackendRetryOns to all the routes, "idempotent"
+	// derives the retry conditions from the HTTP methods and the gRPC
+	// idempotency levels.
+	BackendRetryMode                 string
+	BackendRetryBaseInterval         time.Duration
+	BackendRetryMaxInterval          time.Duration
+	BackendRetriableStatusCodes      string
+	BackendRetryBudgetPercent        float64
+	BackendRetryBudgetMinConcurrency uint
+	BackendRetryPreviousHosts        bool
+
+	// Global rate limiting with an external rate limit service.
+	RateLimitServiceAddress string
+	RateLimitConsumer       string
+
+	// External authorization configurations.
+	ExtAuthzAddress          string
+	ExtAuthzTimeout          time.Duration
+	ExtAuthzFailureModeAllow bool
+	ExtAuthzSelectors        string
+	ExtAuthzAllowedHeaders   string
+
+	// Validate the JSON request bodies against the service config types, up
+	// to the size limit.
+	EnableRequestValidation       bool
+	RequestValidationMaxBodyBytes int
+
+	// Format of the local replies, "json", "google_rpc_status" or
+	// "problem_json", and the path to the JSON file of the local reply
+	// mappers overriding it.
+	LocalReplyFormat      string
+	LocalReplyMappersFile string
+
 	ComputePlatformOverride string
 
 	TranscodingAlwaysPrintPrimitiveFields   bool
@@ -151,8 +228,20 @@ func DefaultConfigGeneratorOptions() ConfigGeneratorOptions {
 		ServiceControlURL:                "https://servicecontrol.googleapis.com",
 		BackendRetryNum:                  1,
 		BackendRetryOns:                  "reset,connect-failure,refused-stream",
+		BackendRetryMode:                 "global",
 		ScCheckRetries:                   -1,
 		ScQuotaRetries:                   -1,
 		ScReportRetries:                  -1,
+		RateLimitConsumer:                "client_ip",
+		ExtAuthzTimeout:                  200 * time.Millisecond,
+		RequestValidationMaxBodyBytes:    1024 * 1024,
+		LocalReplyFormat:                 "json",
+		SecurityHeadersHstsMaxAge:        365 * 24 * time.Hour,
+		SecurityHeadersFrameOptions:      "DENY",
+		SecurityHeadersReferrerPolicy:    "strict-origin-when-cross-origin",
+		SecurityHeadersStrip:             "server,x-powered-by",
+
+		SslDownstreamClientCertMode:           "require",
+		SslDownstreamClientForwardCertDetails: "subject,uri",
 	}
 }
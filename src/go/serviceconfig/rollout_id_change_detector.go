@@ -15,6 +15,7 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -44,23 +45,33 @@ func NewRolloutIdChangeDetector(client *http.Client, serviceControlUrl, serviceN
 
 }
 
-func (c *RolloutIdChangeDetector) fetchLatestRolloutId() (string, error) {
+func (c *RolloutIdChangeDetector) fetchLatestRolloutId(ctx context.Context) (string, error) {
 	reportResponse := new(scpb.ReportResponse)
 	fetchRolloutIdUrl := util.FetchRolloutIdURL(c.serviceControlUrl, c.serviceName)
-	if err := util.CallGoogleapis(c.client, fetchRolloutIdUrl, util.POST, c.accessToken, nil, reportResponse); err != nil {
+	if err := util.CallGoogleapis(ctx, c.client, fetchRolloutIdUrl, util.POST, c.accessToken, util.ServiceControlRetryPolicy, reportResponse); err != nil {
 		return "", fmt.Errorf("fail to fetch new rollout id, %v", err)
 	}
 
 	return reportResponse.ServiceRolloutId, nil
 }
 
-func (c *RolloutIdChangeDetector) SetDetectRolloutIdChangeTimer(interval time.Duration, callback func()) {
+// SetDetectRolloutIdChangeTimer checks the latest rollout id every interval
+// until ctx is done, and calls callback when it is changed.
+func (c *RolloutIdChangeDetector) SetDetectRolloutIdChangeTimer(ctx context.Context, interval time.Duration, callback func()) {
 	go func() {
 		glog.Infof("start detect latest rollout id every %v", interval)
 		c.detectRolloutIdTicker = time.NewTicker(interval)
+		defer c.detectRolloutIdTicker.Stop()
 
-		for range c.detectRolloutIdTicker.C {
-			latestRolloutId, err := c.fetchLatestRolloutId()
+		for {
+			select {
+			case <-c.detectRolloutIdTicker.C:
+			case <-ctx.Done():
+				glog.Infof("stop detecting latest rollout id: %v", ctx.Err())
+				return
+			}
+
+			latestRolloutId, err := c.fetchLatestRolloutId(ctx)
 			if err != nil {
 				glog.Errorf("error occurred when checking new rollout id, %v", err)
 				continue
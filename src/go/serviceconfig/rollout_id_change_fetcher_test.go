@@ -15,8 +15,10 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -34,7 +36,7 @@ func genFakeReport(serviceRolloutId string) string {
 	return string(reportRespBytes)
 }
 
-type getCallGoogleapisFunc func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error
+type getCallGoogleapisFunc func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, policy *util.RetryPolicy, output proto.Message) error
 
 func TestFetchLatestRolloutId(t *testing.T) {
 	serviceRolloutId := "service-config-id"
@@ -58,7 +60,7 @@ func TestFetchLatestRolloutId(t *testing.T) {
 		},
 		{
 			desc: "failure due to call googleapis",
-			callGoogleapis: func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
+			callGoogleapis: func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, policy *util.RetryPolicy, output proto.Message) error {
 				return fmt.Errorf("error-from-CallGoogleapis")
 			},
 			wantError: "fail to fetch new rollout id, error-from-CallGoogleapis",
@@ -66,7 +68,7 @@ func TestFetchLatestRolloutId(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		util.CallGoogleapis = tc.callGoogleapis
-		rolloutId, err := cif.fetchLatestRolloutId()
+		rolloutId, err := cif.fetchLatestRolloutId(context.Background())
 		if tc.wantRolloutId != "" && tc.wantRolloutId != rolloutId {
 			t.Errorf("Test(%s): fail in fetchLatestRolloutId, want rolloutId %s, get rolloutId %s", tc.desc, tc.wantRolloutId, rolloutId)
 		}
@@ -93,7 +95,7 @@ func TestSetDetectRolloutIdChangeTimer(t *testing.T) {
 	wantCnt = 3
 
 	wantRolloutId := fmt.Sprintf("test-rollout-id-%v", wantCnt)
-	cif.SetDetectRolloutIdChangeTimer(time.Millisecond*50, func() {
+	cif.SetDetectRolloutIdChangeTimer(context.Background(), time.Millisecond*50, func() {
 		atomic.AddInt32(&cnt, 1)
 
 		// Update rolloutId so the callback will be called.
@@ -115,3 +117,30 @@ func TestSetDetectRolloutIdChangeTimer(t *testing.T) {
 		t.Errorf("want curRolloutId: %s, get curRolloutId: %s", wantRolloutId, cif.curRolloutId)
 	}
 }
+
+func TestSetDetectRolloutIdChangeTimerStopsWithContext(t *testing.T) {
+	var reqCnt int32
+	serviceControlServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqCnt, 1)
+		_, _ = w.Write([]byte(genFakeReport(fmt.Sprintf("test-rollout-id-%v", atomic.LoadInt32(&reqCnt)))))
+	}))
+	defer serviceControlServer.Close()
+	accessToken := func() (string, time.Duration, error) { return "token", time.Duration(60), nil }
+	cif := NewRolloutIdChangeDetector(&http.Client{}, serviceControlServer.URL, "service-name", accessToken)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cif.SetDetectRolloutIdChangeTimer(ctx, time.Millisecond*50, func() {})
+	time.Sleep(time.Millisecond * 200)
+	cancel()
+
+	// Wait for the detection in flight, if any.
+	time.Sleep(time.Millisecond * 100)
+	stoppedCnt := atomic.LoadInt32(&reqCnt)
+	if stoppedCnt == 0 {
+		t.Fatalf("want the rollout id detected before the context is cancelled, get no detection")
+	}
+	time.Sleep(time.Millisecond * 300)
+	if got := atomic.LoadInt32(&reqCnt); got != stoppedCnt {
+		t.Errorf("want no detection after the context is cancelled, get %v more", got-stoppedCnt)
+	}
+}
@@ -15,9 +15,9 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
@@ -30,14 +30,7 @@ type ServiceConfigFetcher struct {
 	serviceName          string
 	client               *http.Client
 	accessToken          util.GetAccessTokenFunc
-	retryConfigs         map[int]util.RetryConfig
-}
-
-var SmRetryConfigs = map[int]util.RetryConfig{
-	http.StatusTooManyRequests: util.RetryConfig{
-		RetryNum:      30,
-		RetryInterval: time.Second * 10,
-	},
+	retryPolicy          *util.RetryPolicy
 }
 
 func NewServiceConfigFetcher(client *http.Client, serviceManagementUrl,
@@ -48,15 +41,15 @@ func NewServiceConfigFetcher(client *http.Client, serviceManagementUrl,
 		serviceName:          serviceName,
 		serviceManagementUrl: serviceManagementUrl,
 		accessToken:          accessToken,
-		retryConfigs:         SmRetryConfigs,
+		retryPolicy:          util.ServiceManagementRetryPolicy,
 	}
 }
 
 // Fetch the service config by given configId.
-func (s *ServiceConfigFetcher) FetchConfig(configId string) (*confpb.Service, error) {
+func (s *ServiceConfigFetcher) FetchConfig(ctx context.Context, configId string) (*confpb.Service, error) {
 	serviceConfig := new(confpb.Service)
 	fetchConfigUrl := util.FetchConfigURL(s.serviceManagementUrl, s.serviceName, configId)
-	if err := util.CallGoogleapis(s.client, fetchConfigUrl, util.GET, s.accessToken, s.retryConfigs, serviceConfig); err != nil {
+	if err := util.CallGoogleapis(ctx, s.client, fetchConfigUrl, util.GET, s.accessToken, s.retryPolicy, serviceConfig); err != nil {
 		return nil, err
 	}
 
@@ -65,10 +58,10 @@ func (s *ServiceConfigFetcher) FetchConfig(configId string) (*confpb.Service, er
 
 // Fetch all the rollouts and use the latest success rollout. Among its all
 // service configs, pick up the one with highest traffic percentage.
-func (s *ServiceConfigFetcher) LoadConfigIdFromRollouts() (string, error) {
+func (s *ServiceConfigFetcher) LoadConfigIdFromRollouts(ctx context.Context) (string, error) {
 	rollouts := new(smpb.ListServiceRolloutsResponse)
 	fetchRolloutUrl := util.FetchRolloutsURL(s.serviceManagementUrl, s.serviceName)
-	if err := util.CallGoogleapis(s.client, fetchRolloutUrl, util.GET, s.accessToken, s.retryConfigs, rollouts); err != nil {
+	if err := util.CallGoogleapis(ctx, s.client, fetchRolloutUrl, util.GET, s.accessToken, s.retryPolicy, rollouts); err != nil {
 		return "", err
 	}
 
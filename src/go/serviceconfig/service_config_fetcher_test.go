@@ -15,6 +15,7 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -109,13 +110,13 @@ func TestServiceConfigFetcherFetchConfig(t *testing.T) {
 		_test := func(desc string, callGoogleapisOverridden bool, configId string, wantServiceConfig *confpb.Service, wantError string) {
 			if callGoogleapisOverridden {
 				oldCallGoogleapis := util.CallGoogleapis
-				util.CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
+				util.CallGoogleapis = func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, policy *util.RetryPolicy, output proto.Message) error {
 					return fmt.Errorf("error-from-CallGoogleapis")
 				}
 				defer func() { util.CallGoogleapis = oldCallGoogleapis }()
 			}
 
-			getConfig, err := scf.FetchConfig(configId)
+			getConfig, err := scf.FetchConfig(context.Background(), configId)
 			if err != nil {
 				if wantError == "" {
 					t.Fatalf("test(%s), fail to fetch config: %v", desc, err)
@@ -199,7 +200,7 @@ func TestServiceConfigFetcherLoadConfigIdFromRollouts(t *testing.T) {
 		_test := func(desc string, callGoogleapisOverridden bool, serviceRollouts []*smpb.Rollout, wantConfigId string, wantError string) {
 			if callGoogleapisOverridden {
 				oldCallGoogleapis := util.CallGoogleapis
-				util.CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
+				util.CallGoogleapis = func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, policy *util.RetryPolicy, output proto.Message) error {
 					return fmt.Errorf("error-from-CallGoogleapis")
 				}
 				defer func() { util.CallGoogleapis = oldCallGoogleapis }()
@@ -211,7 +212,7 @@ func TestServiceConfigFetcherLoadConfigIdFromRollouts(t *testing.T) {
 				defer func() { listServiceRolloutsResponse.Rollouts = oldserviceRollouts }()
 			}
 
-			getConfigId, err := scf.LoadConfigIdFromRollouts()
+			getConfigId, err := scf.LoadConfigIdFromRollouts(context.Background())
 
 			if err != nil {
 				if err.Error() != wantError {
@@ -0,0 +1,360 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	externalAccountCredentialsType = "external_account"
+
+	stsGrantType          = "urn:ietf:params:oauth:grant-type:token-exchange"
+	stsRequestedTokenType = "urn:ietf:params:oauth:token-type:access_token"
+
+	// The scope of the federated token to impersonate a service account, which
+	// IAM requires to generate the access token of the requested scopes.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// The IAM methods of the impersonated service account.
+	generateAccessTokenMethod = ":generateAccessToken"
+	generateIdTokenMethod     = ":generateIdToken"
+)
+
+var (
+	externalAccountHttpClient = &http.Client{
+		Timeout: 30 * time.Second,
+	}
+)
+
+// externalAccountConfig is the external_account credential config used by
+// workload identity federation. A subject token from the external identity
+// provider is exchanged for a Google access token through STS, optionally
+// followed by service account impersonation.
+type externalAccountConfig struct {
+	Type                           string           `json:"type"`
+	Audience                       string           `json:"audience"`
+	SubjectTokenType               string           `json:"subject_token_type"`
+	TokenURL                       string           `json:"token_url"`
+	ServiceAccountImpersonationURL string           `json:"service_account_impersonation_url"`
+	CredentialSource               credentialSource `json:"credential_source"`
+}
+
+// credentialSource tells where to read the subject token from, either a file
+// or a URL. The token is read as plain text, or from a field of a JSON object.
+type credentialSource struct {
+	File          string            `json:"file"`
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers"`
+	EnvironmentID string            `json:"environment_id"`
+	Format        struct {
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+// isExternalAccount returns true if the credential JSON is an external_account config.
+func isExternalAccount(keyData []byte) bool {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(keyData, &f); err != nil {
+		return false
+	}
+	return f.Type == externalAccountCredentialsType
+}
+
+func parseExternalAccountConfig(keyData []byte) (*externalAccountConfig, error) {
+	c := &externalAccountConfig{}
+	if err := json.Unmarshal(keyData, c); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal external_account credentials: %v", err)
+	}
+	if c.Audience == "" {
+		return nil, fmt.Errorf("external_account credentials must have an audience")
+	}
+	if c.SubjectTokenType == "" {
+		return nil, fmt.Errorf("external_account credentials must have a subject_token_type")
+	}
+	if c.TokenURL == "" {
+		return nil, fmt.Errorf("external_account credentials must have a token_url")
+	}
+
+	cs := c.CredentialSource
+	if cs.EnvironmentID != "" {
+		return nil, fmt.Errorf("external_account credential_source with environment_id %q is not supported", cs.EnvironmentID)
+	}
+	if (cs.File == "") == (cs.URL == "") {
+		return nil, fmt.Errorf("external_account credential_source must have exactly one of file or url")
+	}
+	switch cs.Format.Type {
+	case "", "text":
+	case "json":
+		if cs.Format.SubjectTokenFieldName == "" {
+			return nil, fmt.Errorf("external_account credential_source with json format must have a subject_token_field_name")
+		}
+	default:
+		return nil, fmt.Errorf("external_account credential_source has unsupported format type %q", cs.Format.Type)
+	}
+	return c, nil
+}
+
+func generateExternalAccountToken(keyData []byte, scopes []string) (*oauth2.Token, error) {
+	c, err := parseExternalAccountConfig(keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	subjectToken, err := c.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ServiceAccountImpersonationURL == "" {
+		return c.exchangeToken(subjectToken, scopes)
+	}
+
+	token, err := c.exchangeToken(subjectToken, []string{cloudPlatformScope})
+	if err != nil {
+		return nil, err
+	}
+	return c.impersonate(token, scopes)
+}
+
+// generateExternalAccountIdentityToken mints an identity token of the
+// impersonated service account with IAM generateIdToken, as the federated
+// token has no identity of its own.
+func generateExternalAccountIdentityToken(keyData []byte, audience string) (*oauth2.Token, error) {
+	c, err := parseExternalAccountConfig(keyData)
+	if err != nil {
+		return nil, err
+	}
+	if c.ServiceAccountImpersonationURL == "" {
+		return nil, fmt.Errorf("external_account credentials must have a service_account_impersonation_url to generate identity tokens")
+	}
+	if !strings.HasSuffix(c.ServiceAccountImpersonationURL, generateAccessTokenMethod) {
+		return nil, fmt.Errorf("external_account service_account_impersonation_url must end with %s to generate identity tokens", generateAccessTokenMethod)
+	}
+
+	subjectToken, err := c.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.exchangeToken(subjectToken, []string{cloudPlatformScope})
+	if err != nil {
+		return nil, err
+	}
+
+	var iamResp struct {
+		Token string `json:"token"`
+	}
+	idTokenURL := strings.TrimSuffix(c.ServiceAccountImpersonationURL, generateAccessTokenMethod) + generateIdTokenMethod
+	if err := callIam(idTokenURL, token, map[string]interface{}{
+		"audience":     audience,
+		"includeEmail": true,
+	}, &iamResp); err != nil {
+		return nil, fmt.Errorf("fail to generate identity token: %v", err)
+	}
+
+	expiry, err := identityTokenExpiry(iamResp.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: iamResp.Token,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// identityTokenExpiry reads the exp claim of the identity token, which IAM
+// does not return separately.
+func identityTokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("identity token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("fail to decode identity token payload: %v", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("identity token payload does not have an exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+func (c *externalAccountConfig) subjectToken() (string, error) {
+	cs := c.CredentialSource
+
+	var data []byte
+	if cs.File != "" {
+		var err error
+		if data, err = ioutil.ReadFile(cs.File); err != nil {
+			return "", fmt.Errorf("fail to read subject token file: %v", err)
+		}
+	} else {
+		req, err := http.NewRequest("GET", cs.URL, nil)
+		if err != nil {
+			return "", fmt.Errorf("fail to create subject token request: %v", err)
+		}
+		for k, v := range cs.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := externalAccountHttpClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("fail to fetch subject token: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return "", fmt.Errorf("fail to read subject token response: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("fail to fetch subject token, status: %v, body: %s", resp.Status, data)
+		}
+	}
+
+	if cs.Format.Type == "json" {
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return "", fmt.Errorf("fail to unmarshal subject token JSON: %v", err)
+		}
+		token, ok := fields[cs.Format.SubjectTokenFieldName].(string)
+		if !ok || token == "" {
+			return "", fmt.Errorf("subject token JSON does not have field %q", cs.Format.SubjectTokenFieldName)
+		}
+		return token, nil
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("subject token is empty")
+	}
+	return token, nil
+}
+
+// exchangeToken exchanges the subject token for a Google access token through STS.
+func (c *externalAccountConfig) exchangeToken(subjectToken string, scopes []string) (*oauth2.Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", stsGrantType)
+	form.Set("audience", c.Audience)
+	form.Set("scope", strings.Join(scopes, " "))
+	form.Set("requested_token_type", stsRequestedTokenType)
+	form.Set("subject_token", subjectToken)
+	form.Set("subject_token_type", c.SubjectTokenType)
+
+	resp, err := externalAccountHttpClient.PostForm(c.TokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("fail to exchange token with STS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read STS response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fail to exchange token with STS, status: %v, body: %s", resp.Status, body)
+	}
+
+	var stsResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &stsResp); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal STS response: %v", err)
+	}
+	if stsResp.AccessToken == "" {
+		return nil, fmt.Errorf("STS response does not have an access_token")
+	}
+
+	return &oauth2.Token{
+		AccessToken: stsResp.AccessToken,
+		TokenType:   stsResp.TokenType,
+		Expiry:      time.Now().Add(time.Duration(stsResp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// impersonate exchanges the federated token for an access token of the service account.
+func (c *externalAccountConfig) impersonate(token *oauth2.Token, scopes []string) (*oauth2.Token, error) {
+	var iamResp struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+	}
+	if err := callIam(c.ServiceAccountImpersonationURL, token, map[string]interface{}{
+		"scope":    scopes,
+		"lifetime": "3600s",
+	}, &iamResp); err != nil {
+		return nil, fmt.Errorf("fail to impersonate service account: %v", err)
+	}
+	expiry, err := time.Parse(time.RFC3339, iamResp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse impersonated token expireTime: %v", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: iamResp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
+
+// callIam calls a method of the impersonated service account with the
+// federated token, and unmarshals the response.
+func callIam(url string, token *oauth2.Token, reqBody map[string]interface{}, iamResp interface{}) error {
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("fail to create IAM request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err := externalAccountHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fail to read IAM response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status: %v, body: %s", resp.Status, body)
+	}
+	if err := json.Unmarshal(body, iamResp); err != nil {
+		return fmt.Errorf("fail to unmarshal IAM response: %v", err)
+	}
+	return nil
+}
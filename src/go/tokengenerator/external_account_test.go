@@ -0,0 +1,347 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokengenerator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/components"
+	"golang.org/x/oauth2"
+)
+
+const (
+	fakeAudience     = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+	fakeSubjectToken = "fake-subject-token"
+)
+
+func TestGenerateExternalAccountToken(t *testing.T) {
+	sts := components.NewMockStsServer(fakeSubjectToken, "ya29.federated", time.Hour)
+	defer sts.Close()
+
+	subjectTokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "True" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/json" {
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"access_token": "%s"}`, fakeSubjectToken)))
+			return
+		}
+		_, _ = w.Write([]byte(fakeSubjectToken))
+	}))
+	defer subjectTokenServer.Close()
+
+	iamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.federated" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Scope []string `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.Join(req.Scope, " ") != strings.Join(_GOOGLE_API_SCOPE, " ") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": {"message": "unexpected scope"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"accessToken": "ya29.impersonated", "expireTime": "2099-01-01T00:00:00Z"}`))
+	}))
+	defer iamServer.Close()
+
+	dir, err := ioutil.TempDir("", "external_account")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	textFile := filepath.Join(dir, "token.txt")
+	if err := ioutil.WriteFile(textFile, []byte(fakeSubjectToken+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(dir, "token.json")
+	if err := ioutil.WriteFile(jsonFile, []byte(fmt.Sprintf(`{"id_token": "%s"}`, fakeSubjectToken)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	makeConfig := func(tokenURL, impersonationURL, credentialSource string) string {
+		return fmt.Sprintf(`{
+  "type": "external_account",
+  "audience": "%s",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "%s",
+  "service_account_impersonation_url": "%s",
+  "credential_source": %s
+}`, fakeAudience, tokenURL, impersonationURL, credentialSource)
+	}
+
+	googleApiScope := strings.Join(_GOOGLE_API_SCOPE, " ")
+	testCases := []struct {
+		desc         string
+		config       string
+		wantToken    string
+		wantStsScope string
+		wantError    string
+	}{
+		{
+			desc:      "Success with a file-sourced text subject token",
+			config:    makeConfig(sts.GetTokenURL(), "", fmt.Sprintf(`{"file": "%s"}`, textFile)),
+			wantToken: "ya29.federated",
+		},
+		{
+			desc: "Success with a file-sourced json subject token",
+			config: makeConfig(sts.GetTokenURL(), "",
+				fmt.Sprintf(`{"file": "%s", "format": {"type": "json", "subject_token_field_name": "id_token"}}`, jsonFile)),
+			wantToken: "ya29.federated",
+		},
+		{
+			desc: "Success with a url-sourced text subject token",
+			config: makeConfig(sts.GetTokenURL(), "",
+				fmt.Sprintf(`{"url": "%s/text", "headers": {"Metadata": "True"}}`, subjectTokenServer.URL)),
+			wantToken: "ya29.federated",
+		},
+		{
+			desc: "Success with a url-sourced json subject token",
+			config: makeConfig(sts.GetTokenURL(), "",
+				fmt.Sprintf(`{"url": "%s/json", "headers": {"Metadata": "True"}, "format": {"type": "json", "subject_token_field_name": "access_token"}}`, subjectTokenServer.URL)),
+			wantToken: "ya29.federated",
+		},
+		{
+			desc: "Success with service account impersonation",
+			config: makeConfig(sts.GetTokenURL(), iamServer.URL+"/v1/projects/-/serviceAccounts/sa@project.iam.gserviceaccount.com:generateAccessToken",
+				fmt.Sprintf(`{"file": "%s"}`, textFile)),
+			wantToken:    "ya29.impersonated",
+			wantStsScope: cloudPlatformScope,
+		},
+		{
+			desc: "Fail when the url-sourced subject token is rejected",
+			config: makeConfig(sts.GetTokenURL(), "",
+				fmt.Sprintf(`{"url": "%s/text"}`, subjectTokenServer.URL)),
+			wantError: "fail to fetch subject token, status: 403 Forbidden",
+		},
+		{
+			desc: "Fail when STS rejects the subject token",
+			config: makeConfig(sts.GetTokenURL(), "",
+				fmt.Sprintf(`{"url": "%s/json", "headers": {"Metadata": "True"}}`, subjectTokenServer.URL)),
+			wantError: "fail to exchange token with STS, status: 401 Unauthorized",
+		},
+		{
+			desc:      "Fail with a missing subject token file",
+			config:    makeConfig(sts.GetTokenURL(), "", fmt.Sprintf(`{"file": "%s"}`, filepath.Join(dir, "nonexistent"))),
+			wantError: "fail to read subject token file",
+		},
+		{
+			desc:      "Fail with both file and url credential sources",
+			config:    makeConfig(sts.GetTokenURL(), "", fmt.Sprintf(`{"file": "%s", "url": "%s"}`, textFile, subjectTokenServer.URL)),
+			wantError: "external_account credential_source must have exactly one of file or url",
+		},
+		{
+			desc:      "Fail with an AWS credential source",
+			config:    makeConfig(sts.GetTokenURL(), "", `{"environment_id": "aws1"}`),
+			wantError: `external_account credential_source with environment_id "aws1" is not supported`,
+		},
+		{
+			desc:      "Fail with json format without a field name",
+			config:    makeConfig(sts.GetTokenURL(), "", fmt.Sprintf(`{"file": "%s", "format": {"type": "json"}}`, jsonFile)),
+			wantError: "external_account credential_source with json format must have a subject_token_field_name",
+		},
+	}
+
+	for _, tc := range testCases {
+		if !isExternalAccount([]byte(tc.config)) {
+			t.Errorf("Test (%s): config is not detected as external_account", tc.desc)
+			continue
+		}
+
+		token, err := generateExternalAccountToken([]byte(tc.config), _GOOGLE_API_SCOPE)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if token.AccessToken != tc.wantToken || token.Expiry.Before(time.Now().Add(50*time.Minute)) {
+			t.Errorf("Test (%s): got token: %s, expiry: %v, want token: %s", tc.desc, token.AccessToken, token.Expiry, tc.wantToken)
+		}
+		wantStsScope := tc.wantStsScope
+		if wantStsScope == "" {
+			wantStsScope = googleApiScope
+		}
+		if got := sts.GetLastScope(); got != wantStsScope {
+			t.Errorf("Test (%s): got STS scope: %s, want: %s", tc.desc, got, wantStsScope)
+		}
+	}
+}
+
+func TestGenerateExternalAccountIdentityToken(t *testing.T) {
+	tokenMux.Lock()
+	identityTokenCache = make(map[string]*oauth2.Token)
+	tokenMux.Unlock()
+
+	sts := components.NewMockStsServer(fakeSubjectToken, "ya29.federated", time.Hour)
+	defer sts.Close()
+
+	idToken := fakeIdentityToken("https://backend.com", time.Now().Add(time.Hour))
+	iamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.federated" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Audience     string `json:"audience"`
+			IncludeEmail bool   `json:"includeEmail"`
+		}
+		if !strings.HasSuffix(r.URL.Path, ":generateIdToken") || json.NewDecoder(r.Body).Decode(&req) != nil ||
+			req.Audience != "https://backend.com" || !req.IncludeEmail {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": {"message": "unexpected request"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"token": "%s"}`, idToken)))
+	}))
+	defer iamServer.Close()
+
+	dir, err := ioutil.TempDir("", "external_account")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	textFile := filepath.Join(dir, "token.txt")
+	if err := ioutil.WriteFile(textFile, []byte(fakeSubjectToken), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	makeConfig := func(impersonationURL string) string {
+		return fmt.Sprintf(`{
+  "type": "external_account",
+  "audience": "%s",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "%s",
+  "service_account_impersonation_url": "%s",
+  "credential_source": {"file": "%s"}
+}`, fakeAudience, sts.GetTokenURL(), impersonationURL, textFile)
+	}
+
+	testCases := []struct {
+		desc      string
+		config    string
+		wantToken string
+		wantError string
+	}{
+		{
+			desc:      "Success with service account impersonation",
+			config:    makeConfig(iamServer.URL + "/v1/projects/-/serviceAccounts/sa@project.iam.gserviceaccount.com:generateAccessToken"),
+			wantToken: idToken,
+		},
+		{
+			desc:      "Fail without service account impersonation",
+			config:    makeConfig(""),
+			wantError: "external_account credentials must have a service_account_impersonation_url to generate identity tokens",
+		},
+		{
+			desc:      "Fail with an impersonation url of another method",
+			config:    makeConfig(iamServer.URL + "/v1/projects/-/serviceAccounts/sa@project.iam.gserviceaccount.com:signJwt"),
+			wantError: "external_account service_account_impersonation_url must end with :generateAccessToken",
+		},
+	}
+
+	for _, tc := range testCases {
+		token, duration, err := generateIdentityToken([]byte(tc.config), "https://backend.com")
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if token != tc.wantToken || duration < 59*time.Minute {
+			t.Errorf("Test (%s): got token: %s, duration: %v, want token: %s", tc.desc, token, duration, tc.wantToken)
+		}
+		if got := sts.GetLastScope(); got != cloudPlatformScope {
+			t.Errorf("Test (%s): got STS scope: %s, want: %s", tc.desc, got, cloudPlatformScope)
+		}
+	}
+}
+
+func TestStartAccessTokenRefresher(t *testing.T) {
+	// The token expires in 3s and is refreshed 2s before it expires.
+	sts := components.NewMockStsServer(fakeSubjectToken, "ya29.federated", 3*time.Second)
+	defer sts.Close()
+
+	oldMargin, oldRetryInterval := accessTokenRefreshMargin, accessTokenRefreshRetryInterval
+	accessTokenRefreshMargin, accessTokenRefreshRetryInterval = 2*time.Second, 100*time.Millisecond
+	defer func() {
+		accessTokenRefreshMargin, accessTokenRefreshRetryInterval = oldMargin, oldRetryInterval
+		tokenMux.Lock()
+		tokenCache = make(map[string]*oauth2.Token)
+		tokenMux.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "external_account")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	textFile := filepath.Join(dir, "token.txt")
+	if err := ioutil.WriteFile(textFile, []byte(fakeSubjectToken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	credsFile := filepath.Join(dir, "creds.json")
+	if err := ioutil.WriteFile(credsFile, []byte(fmt.Sprintf(`{
+  "type": "external_account",
+  "audience": "%s",
+  "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+  "token_url": "%s",
+  "credential_source": {"file": "%s"}
+}`, fakeAudience, sts.GetTokenURL(), textFile)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartAccessTokenRefresher(ctx, credsFile)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sts.GetReqCnt() < 2 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if got := sts.GetReqCnt(); got < 2 {
+		t.Fatalf("got %d token exchanges, want the token to be refreshed before it expires", got)
+	}
+
+	tokenMux.Lock()
+	defer tokenMux.Unlock()
+	if got := tokenCache[scopesKey(_GOOGLE_API_SCOPE)].AccessToken; got != "ya29.federated" {
+		t.Errorf("got cached access token: %s, want ya29.federated", got)
+	}
+}
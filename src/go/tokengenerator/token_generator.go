@@ -15,9 +15,15 @@
 package tokengenerator
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -35,80 +41,227 @@ var (
 		// Call servicecontrol to get latest rollout id.
 		"https://www.googleapis.com/auth/servicecontrol",
 	}
-	tokenCache = &oauth2.Token{}
+	// Access tokens cached by scopes, guarded by tokenMux.
+	tokenCache = make(map[string]*oauth2.Token)
 	tokenMux   = sync.Mutex{}
+
+	// Identity tokens cached by audience, guarded by tokenMux.
+	identityTokenCache = make(map[string]*oauth2.Token)
+)
+
+var (
+	// The access token is refreshed in background this long before it expires.
+	accessTokenRefreshMargin = 5 * time.Minute
+	// The interval to retry when the background refresh fails.
+	accessTokenRefreshRetryInterval = 10 * time.Second
+	// A cached identity token is refreshed this long before it expires. Envoy
+	// caps the expiry of the served token by its `exp` claim.
+	identityTokenRefreshMargin = 5 * time.Minute
 )
 
 var GenerateAccessTokenFromFile = func(saFilePath string) (string, time.Duration, error) {
-	if token, duration := activeAccessToken(); token != "" {
-		return token, duration, nil
-	}
+	return GenerateAccessTokenWithScopesFromFile(saFilePath, _GOOGLE_API_SCOPE)
+}
 
-	data, err := ioutil.ReadFile(saFilePath)
-	if err != nil {
-		return "", 0, err
+var GenerateAccessTokenWithScopesFromFile = func(saFilePath string, scopes []string) (string, time.Duration, error) {
+	if token, duration := activeAccessToken(scopes); token != "" {
+		return token, duration, nil
 	}
 
-	return generateAccessToken(data)
+	return generateAccessTokenFromFile(saFilePath, scopes)
 }
 
-// A test-friendly version of `GenerateAccessTokenFromFile`
-func generateAccessTokenFromData(saData []byte) (string, time.Duration, error) {
-	if token, duration := activeAccessToken(); token != "" {
+// A test-friendly version of `GenerateAccessTokenWithScopesFromFile`
+func generateAccessTokenFromData(saData []byte, scopes []string) (string, time.Duration, error) {
+	if token, duration := activeAccessToken(scopes); token != "" {
 		return token, duration, nil
 	}
 
-	return generateAccessToken(saData)
+	return generateAccessToken(saData, scopes)
 }
 
-func activeAccessToken() (string, time.Duration) {
+// The cache key of the scopes, independent of their order.
+func scopesKey(scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func activeAccessToken(scopes []string) (string, time.Duration) {
 	now := time.Now()
 	tokenMux.Lock()
 	defer tokenMux.Unlock()
 
 	// Follow the similar logic as GCE metadata server, where returned token will be valid for at
 	// least 60s.
-	if tokenCache.AccessToken == "" || now.After(tokenCache.Expiry.Add(-time.Second*60)) {
+	token, ok := tokenCache[scopesKey(scopes)]
+	if !ok || now.After(token.Expiry.Add(-time.Second*60)) {
 		return "", 0
 
 	}
 
-	return tokenCache.AccessToken, tokenCache.Expiry.Sub(now)
+	return token.AccessToken, token.Expiry.Sub(now)
+}
+
+func generateAccessToken(keyData []byte, scopes []string) (string, time.Duration, error) {
+	var token *oauth2.Token
+	if isExternalAccount(keyData) {
+		var err error
+		if token, err = generateExternalAccountToken(keyData, scopes); err != nil {
+			return "", 0, err
+		}
+	} else {
+		creds, err := google.CredentialsFromJSON(oauth2.NoContext, keyData, scopes...)
+		if err != nil {
+			return "", 0, err
+		}
+
+		if token, err = creds.TokenSource.Token(); err != nil {
+			return "", 0, err
+		}
+	}
+
+	tokenMux.Lock()
+	defer tokenMux.Unlock()
+
+	tokenCache[scopesKey(scopes)] = token
+	return token.AccessToken, token.Expiry.Sub(time.Now()), nil
 }
 
-func generateAccessToken(keyData []byte) (string, time.Duration, error) {
-	creds, err := google.CredentialsFromJSON(oauth2.NoContext, keyData, _GOOGLE_API_SCOPE...)
+// StartAccessTokenRefresher refreshes the cached access token of the default scopes in the background
+// before it expires, so neither the config manager nor envoy waits for a token
+// exchange with a remote server.
+func StartAccessTokenRefresher(ctx context.Context, saFilePath string) {
+	go func() {
+		for {
+			wait := accessTokenRefreshRetryInterval
+			_, expire, err := generateAccessTokenFromFile(saFilePath, _GOOGLE_API_SCOPE)
+			if err != nil {
+				glog.Errorf("fail to refresh access token, retry in %v: %v", wait, err)
+			} else if expire-accessTokenRefreshMargin > wait {
+				wait = expire - accessTokenRefreshMargin
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+func generateAccessTokenFromFile(saFilePath string, scopes []string) (string, time.Duration, error) {
+	data, err := ioutil.ReadFile(saFilePath)
 	if err != nil {
 		return "", 0, err
 	}
 
-	token, err := creds.TokenSource.Token()
+	return generateAccessToken(data, scopes)
+}
+
+var GenerateIdentityTokenFromFile = func(saFilePath, audience string) (string, time.Duration, error) {
+	if token, duration := activeIdentityToken(audience); token != "" {
+		return token, duration, nil
+	}
+
+	data, err := ioutil.ReadFile(saFilePath)
 	if err != nil {
 		return "", 0, err
 	}
 
+	return generateIdentityToken(data, audience)
+}
+
+// A test-friendly version of `GenerateIdentityTokenFromFile`
+func generateIdentityTokenFromData(saData []byte, audience string) (string, time.Duration, error) {
+	if token, duration := activeIdentityToken(audience); token != "" {
+		return token, duration, nil
+	}
+
+	return generateIdentityToken(saData, audience)
+}
+
+func activeIdentityToken(audience string) (string, time.Duration) {
+	now := time.Now()
 	tokenMux.Lock()
 	defer tokenMux.Unlock()
 
-	tokenCache = token
+	token, ok := identityTokenCache[audience]
+	if !ok || now.After(token.Expiry.Add(-identityTokenRefreshMargin)) {
+		return "", 0
+	}
+
+	return token.AccessToken, token.Expiry.Sub(now)
+}
+
+func generateIdentityToken(keyData []byte, audience string) (string, time.Duration, error) {
+	var token *oauth2.Token
+	if isExternalAccount(keyData) {
+		var err error
+		if token, err = generateExternalAccountIdentityToken(keyData, audience); err != nil {
+			return "", 0, err
+		}
+	} else {
+		conf, err := google.JWTConfigFromJSON(keyData)
+		if err != nil {
+			return "", 0, err
+		}
+		conf.PrivateClaims = map[string]interface{}{"target_audience": audience}
+		conf.UseIDToken = true
+
+		if token, err = conf.TokenSource(oauth2.NoContext).Token(); err != nil {
+			return "", 0, err
+		}
+	}
+
+	tokenMux.Lock()
+	defer tokenMux.Unlock()
+
+	identityTokenCache[audience] = token
 	return token.AccessToken, token.Expiry.Sub(time.Now()), nil
 }
 
+// GenerateTokenAgentSecret generates a random shared secret that envoy
+// presents to the token agent.
+func GenerateTokenAgentSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("fail to generate token agent secret: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // Create the token agent handler to provide envoy with access
 // token generated by the service account credential.
 //
 // It follows the following scheme:
-// Request: GET /local/access_token.
+// Request: GET /local/access_token[?scopes=<comma separated scopes>].
 // Response: access token response is a JSON payload in the format:
 // {
 //   "access_token": "string",
 //   "expires_in": uint
 // }
-func MakeTokenAgentHandler(serviceAccountKey string) http.Handler {
+//
+// It also provides envoy with identity tokens for backend authentication,
+// in the same format as the instance metadata server:
+// Request: GET /local/identity_token?audience=<audience>.
+// Response: the identity token as plain text.
+//
+// If the secret is not empty, requests must present it in the
+// X-Token-Agent-Secret header.
+func MakeTokenAgentHandler(serviceAccountKey, secret string) http.Handler {
 	r := mux.NewRouter()
 
 	r.PathPrefix(util.TokenAgentAccessTokenPath).Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, expire, err := GenerateAccessTokenFromFile(serviceAccountKey)
+		var token string
+		var expire time.Duration
+		var err error
+		if scopes := r.URL.Query().Get("scopes"); scopes != "" {
+			token, expire, err = GenerateAccessTokenWithScopesFromFile(serviceAccountKey, strings.Split(scopes, ","))
+		} else {
+			token, expire, err = GenerateAccessTokenFromFile(serviceAccountKey)
+		}
 
 		if err != nil {
 			glog.Errorf("local access token agent had error: %v", err)
@@ -119,5 +272,37 @@ func MakeTokenAgentHandler(serviceAccountKey string) http.Handler {
 		_, _ = w.Write([]byte(fmt.Sprintf(`{"access_token": "%s", "expires_in": %v}`, token, int(expire.Seconds()))))
 	})
 
-	return r
+	r.Path(util.TokenAgentIdentityTokenPath).Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		audience := r.URL.Query().Get("audience")
+		if audience == "" {
+			http.Error(w, "missing audience query parameter", 400)
+			return
+		}
+
+		token, _, err := GenerateIdentityTokenFromFile(serviceAccountKey, audience)
+		if err != nil {
+			glog.Errorf("local identity token agent had error for audience %s: %v", audience, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		_, _ = w.Write([]byte(token))
+	})
+
+	return requireSecret(secret, r)
+}
+
+func requireSecret(secret string, next http.Handler) http.Handler {
+	if secret == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(util.TokenAgentSecretHeader)), []byte(secret)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "missing or invalid token agent secret", 403)
+	})
 }
@@ -15,6 +15,7 @@
 package tokengenerator
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http/httptest"
 	"strings"
@@ -25,6 +26,7 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/testdata"
 	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
 	"github.com/GoogleCloudPlatform/esp-v2/tests/utils"
+	"golang.org/x/oauth2"
 )
 
 func TestGenerateAccessToken(t *testing.T) {
@@ -36,7 +38,7 @@ func TestGenerateAccessToken(t *testing.T) {
 	fakeKey := strings.Replace(testdata.FakeServiceAccountKeyData, "FAKE-TOKEN-URI", mockTokenServer.GetURL(), 1)
 	fakeKeyData := []byte(fakeKey)
 
-	token, duration, err := generateAccessTokenFromData(fakeKeyData)
+	token, duration, err := generateAccessTokenFromData(fakeKeyData, _GOOGLE_API_SCOPE)
 	if token != "ya29.new" || duration.Seconds() < 3598 || err != nil {
 		t.Errorf("Test : Fail to make access token, got token: %s, duration: %v, err: %v", token, duration, err)
 	}
@@ -44,24 +46,90 @@ func TestGenerateAccessToken(t *testing.T) {
 	latestFakeToken := `{"access_token": "ya29.latest", "expires_in":3599, "token_type":"Bearer"}`
 	mockTokenServer.SetResp(latestFakeToken)
 
-	// The token is cached so the old token gets returned.
-	token, duration, err = generateAccessTokenFromData([]byte("Invalid data, not a service account"))
+	// The token is cached so the old token gets returned, regardless of the order of scopes.
+	token, duration, err = generateAccessTokenFromData([]byte("Invalid data, not a service account"),
+		[]string{_GOOGLE_API_SCOPE[1], _GOOGLE_API_SCOPE[0]})
 	if token != "ya29.new" || err != nil {
 		t.Errorf("Test : Fail to make access token, got token: %s, duration: %v, err: %v", token, duration, err)
 	}
+
+	// Tokens are cached per scopes, so a new token is generated for other scopes.
+	token, duration, err = generateAccessTokenFromData(fakeKeyData, []string{"https://www.googleapis.com/auth/cloud-platform"})
+	if token != "ya29.latest" || err != nil {
+		t.Errorf("Test : Fail to make access token, got token: %s, duration: %v, err: %v", token, duration, err)
+	}
+}
+
+func fakeIdentityToken(audience string, expiry time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":"%s","exp":%d}`, audience, expiry.Unix())))
+	return header + "." + payload + ".signature"
+}
+
+func TestGenerateIdentityToken(t *testing.T) {
+	tokenMux.Lock()
+	identityTokenCache = make(map[string]*oauth2.Token)
+	tokenMux.Unlock()
+
+	fooToken := fakeIdentityToken("foo.com", time.Now().Add(time.Hour))
+	mockTokenServer := util.InitMockServer(fmt.Sprintf(`{"id_token": "%s"}`, fooToken))
+	defer mockTokenServer.Close()
+
+	fakeKey := strings.Replace(testdata.FakeServiceAccountKeyData, "FAKE-TOKEN-URI", mockTokenServer.GetURL(), 1)
+	fakeKeyData := []byte(fakeKey)
+
+	token, duration, err := generateIdentityTokenFromData(fakeKeyData, "foo.com")
+	if token != fooToken || duration.Seconds() < 3598 || err != nil {
+		t.Errorf("Test : Fail to make identity token, got token: %s, duration: %v, err: %v", token, duration, err)
+	}
+
+	barToken := fakeIdentityToken("bar.com", time.Now().Add(time.Hour))
+	mockTokenServer.SetResp(fmt.Sprintf(`{"id_token": "%s"}`, barToken))
+
+	// The token is cached per audience so the old token gets returned for the same audience.
+	token, duration, err = generateIdentityTokenFromData([]byte("Invalid data, not a service account"), "foo.com")
+	if token != fooToken || err != nil {
+		t.Errorf("Test : Fail to make identity token, got token: %s, duration: %v, err: %v", token, duration, err)
+	}
+
+	// A new token is minted for another audience.
+	token, duration, err = generateIdentityTokenFromData(fakeKeyData, "bar.com")
+	if token != barToken || err != nil {
+		t.Errorf("Test : Fail to make identity token, got token: %s, duration: %v, err: %v", token, duration, err)
+	}
+
+	// A cached token is served within its validity window.
+	tokenMux.Lock()
+	identityTokenCache["foo.com"].Expiry = time.Now().Add(30 * time.Minute)
+	tokenMux.Unlock()
+	token, duration, err = generateIdentityTokenFromData(fakeKeyData, "foo.com")
+	if token != fooToken || duration > 30*time.Minute || duration < 29*time.Minute || err != nil {
+		t.Errorf("Test : Fail to make identity token, got token: %s, duration: %v, err: %v", token, duration, err)
+	}
+
+	// A cached token within the refresh margin is not reused.
+	tokenMux.Lock()
+	identityTokenCache["foo.com"].Expiry = time.Now().Add(identityTokenRefreshMargin - time.Second)
+	tokenMux.Unlock()
+	token, duration, err = generateIdentityTokenFromData(fakeKeyData, "foo.com")
+	if token != barToken || err != nil {
+		t.Errorf("Test : Fail to make identity token, got token: %s, duration: %v, err: %v", token, duration, err)
+	}
 }
 
 func TestMakeTokenAgentHandler(t *testing.T) {
 
-	s := httptest.NewServer(MakeTokenAgentHandler(platform.GetFilePath(platform.FakeServiceAccountFile)))
+	s := httptest.NewServer(MakeTokenAgentHandler(platform.GetFilePath(platform.FakeServiceAccountFile), ""))
 
 	testCases := []struct {
-		desc                   string
-		path                   string
-		genAccessTokenFromFile func(saFilePath string) (string, time.Duration, error)
-		method                 string
-		wantResp               string
-		wantError              string
+		desc                     string
+		path                     string
+		genAccessTokenFromFile   func(saFilePath string) (string, time.Duration, error)
+		genScopedTokenFromFile   func(saFilePath string, scopes []string) (string, time.Duration, error)
+		genIdentityTokenFromFile func(saFilePath, audience string) (string, time.Duration, error)
+		method                   string
+		wantResp                 string
+		wantError                string
 	}{
 		{
 			desc: "success, get access token",
@@ -72,6 +140,15 @@ func TestMakeTokenAgentHandler(t *testing.T) {
 			method:   "GET",
 			wantResp: `{"access_token": "ya29.new", "expires_in": 100}`,
 		},
+		{
+			desc: "success, get access token with scopes",
+			genScopedTokenFromFile: func(saFilePath string, scopes []string) (string, time.Duration, error) {
+				return "ya29." + strings.Join(scopes, "+"), time.Duration(time.Second * 100), nil
+			},
+			path:     "/local/access_token?scopes=scope-a,scope-b",
+			method:   "GET",
+			wantResp: `{"access_token": "ya29.scope-a+scope-b", "expires_in": 100}`,
+		},
 		{
 			desc: "fail, error in generating access token",
 			genAccessTokenFromFile: func(saFilePath string) (string, time.Duration, error) {
@@ -81,6 +158,33 @@ func TestMakeTokenAgentHandler(t *testing.T) {
 			method:    "GET",
 			wantError: "500 Internal Server Error, gen-access-token-error",
 		},
+		{
+			desc: "success, get identity token",
+			genIdentityTokenFromFile: func(saFilePath, audience string) (string, time.Duration, error) {
+				return "id-token-for-" + audience, time.Duration(time.Second * 100), nil
+			},
+			path:     "/local/identity_token?format=standard&audience=foo.com",
+			method:   "GET",
+			wantResp: "id-token-for-foo.com",
+		},
+		{
+			desc: "fail, missing audience for identity token",
+			genIdentityTokenFromFile: func(saFilePath, audience string) (string, time.Duration, error) {
+				return "id-token-for-" + audience, time.Duration(time.Second * 100), nil
+			},
+			path:      "/local/identity_token",
+			method:    "GET",
+			wantError: "400 Bad Request, missing audience query parameter",
+		},
+		{
+			desc: "fail, error in generating identity token",
+			genIdentityTokenFromFile: func(saFilePath, audience string) (string, time.Duration, error) {
+				return "", 0, fmt.Errorf("gen-identity-token-error")
+			},
+			path:      "/local/identity_token?audience=foo.com",
+			method:    "GET",
+			wantError: "500 Internal Server Error, gen-identity-token-error",
+		},
 		{
 			desc: "fail, wrong path",
 			genAccessTokenFromFile: func(saFilePath string) (string, time.Duration, error) {
@@ -94,6 +198,8 @@ func TestMakeTokenAgentHandler(t *testing.T) {
 
 	for _, tc := range testCases {
 		GenerateAccessTokenFromFile = tc.genAccessTokenFromFile
+		GenerateIdentityTokenFromFile = tc.genIdentityTokenFromFile
+		GenerateAccessTokenWithScopesFromFile = tc.genScopedTokenFromFile
 		_, resp, err := utils.DoWithHeaders(s.URL+tc.path, "GET", "", nil)
 		if tc.wantError != "" {
 			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
@@ -108,3 +214,59 @@ func TestMakeTokenAgentHandler(t *testing.T) {
 
 	}
 }
+
+func TestMakeTokenAgentHandlerWithSecret(t *testing.T) {
+	GenerateAccessTokenFromFile = func(saFilePath string) (string, time.Duration, error) {
+		return "ya29.new", time.Duration(time.Second * 100), nil
+	}
+	s := httptest.NewServer(MakeTokenAgentHandler(platform.GetFilePath(platform.FakeServiceAccountFile), "fake-secret"))
+	defer s.Close()
+
+	testCases := []struct {
+		desc      string
+		path      string
+		headers   map[string]string
+		wantResp  string
+		wantError string
+	}{
+		{
+			desc:     "success, secret in the header",
+			path:     "/local/access_token",
+			headers:  map[string]string{"X-Token-Agent-Secret": "fake-secret"},
+			wantResp: `{"access_token": "ya29.new", "expires_in": 100}`,
+		},
+		{
+			desc:      "fail, no secret",
+			path:      "/local/access_token",
+			wantError: "403 Forbidden",
+		},
+		{
+			desc:      "fail, wrong secret in the header",
+			path:      "/local/access_token",
+			headers:   map[string]string{"X-Token-Agent-Secret": "wrong-secret"},
+			wantError: "403 Forbidden",
+		},
+		{
+			desc:      "fail, secret in the path",
+			path:      "/fake-secret/local/access_token",
+			wantError: "403 Forbidden",
+		},
+	}
+
+	for _, tc := range testCases {
+		_, resp, err := utils.DoWithHeaders(s.URL+tc.path, "GET", "", tc.headers)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("test(%s): get error: %v, want error: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test(%s): get unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if tc.wantResp != string(resp) {
+			t.Errorf("test(%s): get resp: %s, want resp %s", tc.desc, string(resp), tc.wantResp)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package tracing
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"strings"
@@ -67,7 +68,7 @@ func getTracingProjectId(opts options.CommonOptions) (string, error) {
 		return "", fmt.Errorf("tracing_project_id was not specified and can not be fetched from GCP Metadata server on non-GCP runtime")
 	}
 
-	return metadata.NewMetadataFetcher(opts).FetchProjectId()
+	return metadata.NewMetadataFetcher(context.Background(), opts).FetchProjectId()
 }
 
 func createOpenCensusConfig(opts options.CommonOptions) (*tracepb.OpenCensusConfig, error) {
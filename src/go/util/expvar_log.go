@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// StartExpvarLogger logs the published expvar variables, such as the call
+// outcomes in http_client_calls, every interval until the context is done.
+// The config manager serves no /debug/vars, so the logs are where they are
+// found. It does nothing if the interval is not positive.
+func StartExpvarLogger(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				glog.Infof("expvar: %s", formatExpvars())
+			}
+		}
+	}()
+}
+
+// formatExpvars formats the expvar variables sorted by name, skipping the
+// command line and the memory stats published by the expvar package itself.
+func formatExpvars() string {
+	var vars []string
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" || kv.Key == "memstats" {
+			return
+		}
+		vars = append(vars, fmt.Sprintf("%s=%s", kv.Key, kv.Value.String()))
+	})
+	return strings.Join(vars, ", ")
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatExpvars(t *testing.T) {
+	addHttpCallOutcome("expvar-test", "success")
+
+	got := formatExpvars()
+	if want := `http_client_calls={`; !strings.Contains(got, want) {
+		t.Errorf("got expvars: %s, want containing: %s", got, want)
+	}
+	if want := `"expvar-test": {"success": 1}`; !strings.Contains(got, want) {
+		t.Errorf("got expvars: %s, want containing: %s", got, want)
+	}
+	for _, skipped := range []string{"cmdline=", "memstats="} {
+		if strings.Contains(got, skipped) {
+			t.Errorf("got expvars: %s, want no %s", got, skipped)
+		}
+	}
+}
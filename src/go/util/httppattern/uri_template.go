@@ -17,6 +17,7 @@ package httppattern
 import (
 	"bytes"
 	"fmt"
+	"strings"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -149,8 +150,32 @@ func (u *UriTemplate) IsExactMatch() bool {
 
 // Generate regular expression of the current uri template.
 func (u *UriTemplate) Regex() string {
+	return "^" + segmentsRegex(u.Segments) + u.suffixRegex() + "$"
+}
+
+// RegexAroundVariable splits the regular expression of the current uri
+// template around the segment bound to the variable of the field path, such
+// as "shelf_id" or "book.id". The suffix is not anchored to the end, so that
+// a query string may follow. It returns false unless the variable binds
+// exactly one `*` segment.
+func (u *UriTemplate) RegexAroundVariable(fieldPath string) (string, string, bool) {
+	for _, v := range u.Variables {
+		if strings.Join(v.FieldPath, ".") != fieldPath {
+			continue
+		}
+		if v.HasDoubleWildCard || v.EndSegment != v.StartSegment+1 || u.Segments[v.StartSegment] != SingleWildCardKey {
+			return "", "", false
+		}
+		prefix := "^" + segmentsRegex(u.Segments[:v.StartSegment]) + "/"
+		suffix := segmentsRegex(u.Segments[v.EndSegment:]) + u.suffixRegex()
+		return prefix, suffix, true
+	}
+	return "", "", false
+}
+
+func segmentsRegex(segments []string) string {
 	regex := bytes.Buffer{}
-	for _, segment := range u.Segments {
+	for _, segment := range segments {
 		regex.WriteByte('/')
 		switch segment {
 		case SingleWildCardKey:
@@ -161,13 +186,14 @@ func (u *UriTemplate) Regex() string {
 			regex.WriteString(segment)
 		}
 	}
-	regex.WriteString(optionalTrailingSlashRegex)
+	return regex.String()
+}
 
+func (u *UriTemplate) suffixRegex() string {
 	if u.Verb != "" {
-		regex.WriteString(":" + u.Verb)
+		return optionalTrailingSlashRegex + ":" + u.Verb
 	}
-
-	return "^" + regex.String() + "$"
+	return optionalTrailingSlashRegex
 }
 
 // `generateVariableBindingSyntax` tries to recover the following syntax with
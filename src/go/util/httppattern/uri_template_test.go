@@ -291,3 +291,68 @@ func TestUriTemplateRegex(t *testing.T) {
 		})
 	}
 }
+
+func TestUriTemplateRegexAroundVariable(t *testing.T) {
+	testData := []struct {
+		desc       string
+		uri        string
+		fieldPath  string
+		wantPrefix string
+		wantSuffix string
+		wantOk     bool
+	}{
+		{
+			desc:       "Variable in the middle",
+			uri:        "/v1/tenants/{tenant}/books/{book.id}",
+			fieldPath:  "tenant",
+			wantPrefix: `^/v1/tenants/`,
+			wantSuffix: `/books/[^\/]+\/?`,
+			wantOk:     true,
+		},
+		{
+			desc:       "Variable with nested field path and verb",
+			uri:        "/v1/tenants/{tenant}/books/{book.id}:checkout",
+			fieldPath:  "book.id",
+			wantPrefix: `^/v1/tenants/[^\/]+/books/`,
+			wantSuffix: `\/?:checkout`,
+			wantOk:     true,
+		},
+		{
+			desc:       "Variable with single wildcard segment binding",
+			uri:        "/{tenant=*}/books",
+			fieldPath:  "tenant",
+			wantPrefix: `^/`,
+			wantSuffix: `/books\/?`,
+			wantOk:     true,
+		},
+		{
+			desc:      "Variable binding multiple segments",
+			uri:       "/v1/{name=tenants/*}",
+			fieldPath: "name",
+		},
+		{
+			desc:      "Variable with double wildcard",
+			uri:       "/v1/{name=**}",
+			fieldPath: "name",
+		},
+		{
+			desc:      "Unknown variable",
+			uri:       "/v1/tenants/{tenant}",
+			fieldPath: "shelf",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			uriTemplate, _ := ParseUriTemplate(tc.uri)
+			if uriTemplate == nil {
+				t.Fatalf("fail to parse uri template %s", tc.uri)
+			}
+
+			prefix, suffix, ok := uriTemplate.RegexAroundVariable(tc.fieldPath)
+			if ok != tc.wantOk || prefix != tc.wantPrefix || suffix != tc.wantSuffix {
+				t.Errorf("Test (%v): got (%v, %v, %v), want (%v, %v, %v)", tc.desc, prefix, suffix, ok, tc.wantPrefix, tc.wantSuffix, tc.wantOk)
+			}
+		})
+	}
+}
@@ -101,6 +101,10 @@ var Resolver = FuncResolver(func(url string) (proto.Message, error) {
 		return new(routerpb.Router), nil
 	case "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext":
 		return new(tlspb.UpstreamTlsContext), nil
+	case "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext":
+		return new(tlspb.DownstreamTlsContext), nil
+	case "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret":
+		return new(tlspb.Secret), nil
 	case "type.googleapis.com/envoy.extensions.access_loggers.file.v3.FileAccessLog":
 		return new(accessfilepb.FileAccessLog), nil
 	case "type.googleapis.com/envoy.extensions.access_loggers.grpc.v3.HttpGrpcAccessLogConfig":
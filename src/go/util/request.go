@@ -15,78 +15,244 @@
 package util
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 )
 
-type RetryConfig struct {
-	RetryNum      int
-	RetryInterval time.Duration
+// RetryPolicy tells how an HTTP call is retried on transient failures:
+// connection errors, 429 and 5xx. The interval between retries grows
+// exponentially with jitter, unless the server asks for a longer one with
+// Retry-After.
+type RetryPolicy struct {
+	// Name of the policy, also the endpoint label of the call metrics.
+	Name string
+	// Retries after the first attempt. No retry if 0.
+	MaxRetries      int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Deadline of the call including all of the retries. No deadline if 0.
+	Timeout time.Duration
 }
 
-func callWithAccessToken(client *http.Client, path, method, token string) ([]byte, int, error) {
-	req, _ := http.NewRequest(method, path, nil)
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/x-protobuf")
+var (
+	// Policy for calls to Service Management, which throttles with 429 when
+	// many proxies fetch the service config at the same time.
+	ServiceManagementRetryPolicy = &RetryPolicy{
+		Name:            "servicemanagement",
+		MaxRetries:      30,
+		InitialInterval: time.Second,
+		MaxInterval:     10 * time.Second,
+		Timeout:         6 * time.Minute,
+	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, http.StatusOK, err
+	// Policy for the periodic calls to Service Control, which are tried
+	// again on the next tick anyway.
+	ServiceControlRetryPolicy = &RetryPolicy{
+		Name:            "servicecontrol",
+		MaxRetries:      3,
+		InitialInterval: time.Second,
+		MaxInterval:     10 * time.Second,
+		Timeout:         30 * time.Second,
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, resp.StatusCode, fmt.Errorf("http call to %s %s returns not 200 OK: %v", method, path, resp.Status)
+	// Policy for calls to the metadata server, where the retries are
+	// overridden by the flags.
+	MetadataRetryPolicy = &RetryPolicy{
+		Name:            "metadata",
+		MaxRetries:      3,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     5 * time.Second,
+		Timeout:         30 * time.Second,
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, http.StatusOK, fmt.Errorf("fail to read response body: %s", err)
+	// Outcomes of HTTP calls per endpoint, logged every --expvar_log_interval:
+	// - success: the call succeeded, possibly after retries.
+	// - retry: the call failed with a transient error and is retried.
+	// - failure: the call failed after all retries or with a permanent error.
+	httpCallOutcomes = expvar.NewMap("http_client_calls")
+	// Guards creating the map of an endpoint in httpCallOutcomes.
+	httpCallOutcomesMux sync.Mutex
+)
+
+// HttpStatusError is returned when the server responds with a non-200 status.
+type HttpStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// Parsed from the Retry-After header, 0 if absent.
+	RetryAfter time.Duration
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("http call to %s %s returns not 200 OK: %v", e.Method, e.URL, e.Status)
+}
+
+// HttpCallOutcome returns the number of calls to the endpoint with the outcome.
+func HttpCallOutcome(endpoint, outcome string) int64 {
+	m, ok := httpCallOutcomes.Get(endpoint).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	if v, ok := m.Get(outcome).(*expvar.Int); ok {
+		return v.Value()
 	}
+	return 0
+}
 
-	return body, http.StatusOK, nil
+func addHttpCallOutcome(endpoint, outcome string) {
+	httpCallOutcomesMux.Lock()
+	m, ok := httpCallOutcomes.Get(endpoint).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		httpCallOutcomes.Set(endpoint, m)
+	}
+	httpCallOutcomesMux.Unlock()
+	m.Add(outcome, 1)
 }
 
-// Method to call servicecontrol for latest service rolloutId and servicecontrol for service rollout and service config.
-var CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc GetAccessTokenFunc, retryConfigs map[int]RetryConfig, output proto.Message) error {
-	token, _, err := getTokenFunc()
-	if err != nil {
-		return fmt.Errorf("fail to get access token: %v", err)
+// DoWithRetry sends the request made by newRequest and returns the response
+// body of 200 OK, retrying per the policy. A new request is made for each
+// attempt with the context, which carries the deadline of the policy.
+func DoWithRetry(ctx context.Context, client *http.Client, policy *RetryPolicy, newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, error) {
+	if policy == nil {
+		policy = &RetryPolicy{Name: "default"}
+	}
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
 	}
 
-	var respBytes []byte
-	var statusCode int
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = policy.InitialInterval
+	bo.MaxInterval = policy.MaxInterval
+	// The retries are bounded by MaxRetries and the context instead.
+	bo.MaxElapsedTime = 0
+	bo.Reset()
+
+	for retries := 0; ; retries++ {
+		req, err := newRequest(ctx)
+		if err != nil {
+			addHttpCallOutcome(policy.Name, "failure")
+			return nil, fmt.Errorf("fail to create request: %v", err)
+		}
+
+		body, err := doOnce(client, req)
+		if err == nil {
+			addHttpCallOutcome(policy.Name, "success")
+			return body, nil
+		}
+		if retries >= policy.MaxRetries || !isTransientError(ctx, err) {
+			addHttpCallOutcome(policy.Name, "failure")
+			return nil, err
+		}
+
+		wait := bo.NextBackOff()
+		if statusErr, ok := err.(*HttpStatusError); ok && statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			addHttpCallOutcome(policy.Name, "failure")
+			return nil, fmt.Errorf("no time left to retry before the deadline: %v", err)
+		}
+
+		addHttpCallOutcome(policy.Name, "retry")
+		glog.Warningf("after %v failures, retrying http call in %v: %v", retries+1, wait, err)
 
-	callStatusCnts := map[int]int{}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			addHttpCallOutcome(policy.Name, "failure")
+			return nil, fmt.Errorf("%v, last error: %v", ctx.Err(), err)
+		}
+	}
+}
 
-	for {
-		respBytes, statusCode, err = callWithAccessToken(client, path, method, token)
-		if retryConfigs == nil {
-			break
-		} else if retryConfig, ok := retryConfigs[statusCode]; !ok {
-			break
-		} else if retryConfig.RetryNum <= callStatusCnts[statusCode] {
-			break
-		} else {
-			callStatusCnts[statusCode] += 1
-			glog.Warningf("after %v failures on status %v, retrying http call %s with %v remaining chances", callStatusCnts[statusCode], statusCode, path, retryConfig.RetryNum-callStatusCnts[statusCode])
+func doOnce(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-			time.Sleep(retryConfig.RetryInterval)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HttpStatusError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
 		}
 	}
 
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("fail to read response body: %s", err)
 	}
+	return body, nil
+}
 
-	err = UnmarshalBytesToPbMessage(respBytes, output)
+// isTransientError tells if the call may succeed when retried. Errors other
+// than non-200 statuses are connection errors, unless the context is done.
+func isTransientError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if statusErr, ok := err.(*HttpStatusError); ok {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+// parseRetryAfter parses Retry-After in either delay-seconds or HTTP-date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// Method to call servicecontrol for latest service rolloutId and servicecontrol for service rollout and service config.
+// The access token is fetched for each attempt, as it may expire during the
+// retries.
+var CallGoogleapis = func(ctx context.Context, client *http.Client, path, method string, getTokenFunc GetAccessTokenFunc, policy *RetryPolicy, output proto.Message) error {
+	respBytes, err := DoWithRetry(ctx, client, policy, func(ctx context.Context) (*http.Request, error) {
+		token, _, err := getTokenFunc()
+		if err != nil {
+			return nil, fmt.Errorf("fail to get access token: %v", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return UnmarshalBytesToPbMessage(respBytes, output)
 }
@@ -15,20 +15,23 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 )
 
-func initServerForTestCallWithAccessToken(t *testing.T, desc, wantMethod, wantToken string, respBody []byte, respStatusCode, rejectTimes int, silentInterval time.Duration) *httptest.Server {
+func initServerForTestCallWithAccessToken(t *testing.T, desc, wantMethod, wantToken string, respBody []byte, respStatusCode, rejectTimes int, retryAfter string, silentInterval time.Duration, reqCnt *int) *httptest.Server {
 	rejectCnt := 0
 	var lastCallTime time.Time
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*reqCnt += 1
 
 		if got := r.Method; got != wantMethod {
 			t.Errorf("test(%v) fail, want Method: %s, get Method: %s", desc, wantMethod, got)
@@ -43,6 +46,9 @@ func initServerForTestCallWithAccessToken(t *testing.T, desc, wantMethod, wantTo
 		}
 
 		if respStatusCode != 0 && rejectCnt < rejectTimes {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
 			w.WriteHeader(respStatusCode)
 			rejectCnt += 1
 			lastCallTime = time.Now()
@@ -68,6 +74,16 @@ func initServerForTestCallWithAccessToken(t *testing.T, desc, wantMethod, wantTo
 	}))
 }
 
+func testRetryPolicy(maxRetries int, initialInterval time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		Name:            "test",
+		MaxRetries:      maxRetries,
+		InitialInterval: initialInterval,
+		MaxInterval:     time.Second,
+		Timeout:         5 * time.Second,
+	}
+}
+
 func TestCallGoogleapis(t *testing.T) {
 	normalTokenFunc := func() (string, time.Duration, error) { return "this-is-token", time.Duration(100), nil }
 	testCase := []struct {
@@ -77,16 +93,19 @@ func TestCallGoogleapis(t *testing.T) {
 		respBody       []byte
 		respStatus     int
 		rejectTimes    int
+		retryAfter     string
 		silentInterval time.Duration
 		unmarshalFunc  func(input []byte, output proto.Message) error
-		retryConfigs   map[int]RetryConfig
+		policy         *RetryPolicy
 		wantError      string
+		wantReqCnt     int
 	}{
 		{
-			desc:     "success",
-			method:   "GET",
-			token:    normalTokenFunc,
-			respBody: []byte("this-is-resp-body"),
+			desc:       "success",
+			method:     "GET",
+			token:      normalTokenFunc,
+			respBody:   []byte("this-is-resp-body"),
+			wantReqCnt: 1,
 		},
 		{
 			desc:   "fail to get access token",
@@ -94,14 +113,17 @@ func TestCallGoogleapis(t *testing.T) {
 			token: func() (string, time.Duration, error) {
 				return "", time.Duration(100), fmt.Errorf("fail to talk to imds")
 			},
-			wantError: "fail to get access token: fail to talk to imds",
+			wantError: "fail to create request: fail to get access token: fail to talk to imds",
 		},
 		{
-			desc:       "fail to talk to googleapis service",
-			method:     "GET",
-			token:      normalTokenFunc,
-			respStatus: http.StatusForbidden,
-			wantError:  "http call to GET %URL returns not 200 OK: 403 Forbidden",
+			desc:        "fail to talk to googleapis service, 403 is not retried",
+			method:      "GET",
+			token:       normalTokenFunc,
+			respStatus:  http.StatusForbidden,
+			rejectTimes: 1,
+			policy:      testRetryPolicy(3, time.Millisecond),
+			wantError:   "http call to GET %URL returns not 200 OK: 403 Forbidden",
+			wantReqCnt:  1,
 		},
 		{
 			desc:   "fail to unmarshal response",
@@ -110,49 +132,57 @@ func TestCallGoogleapis(t *testing.T) {
 			unmarshalFunc: func(input []byte, output proto.Message) error {
 				return fmt.Errorf("fail to unmarshal")
 			},
-			wantError: "fail to unmarshal",
+			wantError:  "fail to unmarshal",
+			wantReqCnt: 1,
 		},
 		{
-			desc:        "fail, server rejects 3 times",
+			desc:        "fail, server rejects more times than the retries",
 			method:      "GET",
 			token:       normalTokenFunc,
 			respStatus:  http.StatusTooManyRequests,
-			rejectTimes: 3,
-			retryConfigs: map[int]RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      3,
-					RetryInterval: time.Millisecond * 100,
-				},
-			},
-			wantError: "http call to GET %URL returns not 200 OK: 429 Too Many Requests",
+			rejectTimes: 4,
+			policy:      testRetryPolicy(3, time.Millisecond),
+			wantError:   "http call to GET %URL returns not 200 OK: 429 Too Many Requests",
+			wantReqCnt:  4,
 		},
 		{
-			desc:        "fail, server rejects with different error status",
+			desc:        "fail, server rejects with 400, which is not retried",
 			method:      "GET",
 			token:       normalTokenFunc,
 			respStatus:  http.StatusBadRequest,
 			rejectTimes: 1,
-			retryConfigs: map[int]RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      3,
-					RetryInterval: time.Millisecond * 100,
-				},
-			},
-			wantError: "http call to GET %URL returns not 200 OK: 400 Bad Request",
+			policy:      testRetryPolicy(3, time.Millisecond),
+			wantError:   "http call to GET %URL returns not 200 OK: 400 Bad Request",
+			wantReqCnt:  1,
+		},
+		{
+			desc:        "fail, no retry without a policy",
+			method:      "GET",
+			token:       normalTokenFunc,
+			respStatus:  http.StatusServiceUnavailable,
+			rejectTimes: 1,
+			wantError:   "http call to GET %URL returns not 200 OK: 503 Service Unavailable",
+			wantReqCnt:  1,
 		},
 		{
-			desc:        "success, server returns 200 in the end",
+			desc:        "success, server returns 200 after 429s",
 			method:      "GET",
 			token:       normalTokenFunc,
 			respStatus:  http.StatusTooManyRequests,
 			rejectTimes: 2,
 			respBody:    []byte("this-is-resp-body"),
-			retryConfigs: map[int]RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      3,
-					RetryInterval: time.Millisecond * 100,
-				},
-			},
+			policy:      testRetryPolicy(3, time.Millisecond),
+			wantReqCnt:  3,
+		},
+		{
+			desc:        "success, server returns 200 after 503s",
+			method:      "POST",
+			token:       normalTokenFunc,
+			respStatus:  http.StatusServiceUnavailable,
+			rejectTimes: 2,
+			respBody:    []byte("this-is-resp-body"),
+			policy:      testRetryPolicy(3, time.Millisecond),
+			wantReqCnt:  3,
 		},
 		{
 			desc:           "fail, retry interval is too short",
@@ -162,34 +192,40 @@ func TestCallGoogleapis(t *testing.T) {
 			rejectTimes:    1,
 			silentInterval: time.Millisecond * 500,
 			respBody:       []byte("this-is-resp-body"),
-			retryConfigs: map[int]RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      2,
-					RetryInterval: time.Millisecond * 100,
-				},
-			},
-			wantError: "http call to GET %URL returns not 200 OK: 500 Internal Server Error",
+			policy:         testRetryPolicy(1, time.Millisecond*10),
+			wantError:      "http call to GET %URL returns not 200 OK: 500 Internal Server Error",
+			wantReqCnt:     2,
 		},
 		{
-			desc:           "success, retry interval is long enough",
+			desc:           "success, Retry-After is longer than the retry interval",
 			method:         "GET",
 			token:          normalTokenFunc,
 			respStatus:     http.StatusTooManyRequests,
 			rejectTimes:    1,
-			silentInterval: time.Millisecond * 100,
+			retryAfter:     "1",
+			silentInterval: time.Millisecond * 500,
 			respBody:       []byte("this-is-resp-body"),
-			retryConfigs: map[int]RetryConfig{
-				http.StatusTooManyRequests: {
-					RetryNum:      2,
-					RetryInterval: time.Millisecond * 500,
-				},
-			},
+			policy:         testRetryPolicy(1, time.Millisecond*10),
+			wantReqCnt:     2,
+		},
+		{
+			desc:        "fail, Retry-After is beyond the deadline",
+			method:      "GET",
+			token:       normalTokenFunc,
+			respStatus:  http.StatusTooManyRequests,
+			rejectTimes: 1,
+			retryAfter:  "10",
+			respBody:    []byte("this-is-resp-body"),
+			policy:      testRetryPolicy(1, time.Millisecond*10),
+			wantError:   "no time left to retry before the deadline: http call to GET %URL returns not 200 OK: 429 Too Many Requests",
+			wantReqCnt:  1,
 		},
 	}
 
 	for _, tc := range testCase {
 		token, _, _ := tc.token()
-		s := initServerForTestCallWithAccessToken(t, tc.desc, tc.method, token, tc.respBody, tc.respStatus, tc.rejectTimes, tc.silentInterval)
+		reqCnt := 0
+		s := initServerForTestCallWithAccessToken(t, tc.desc, tc.method, token, tc.respBody, tc.respStatus, tc.rejectTimes, tc.retryAfter, tc.silentInterval, &reqCnt)
 		if tc.unmarshalFunc == nil {
 			UnmarshalBytesToPbMessage = func(gotBody []byte, output proto.Message) error {
 				if string(gotBody) != string(tc.respBody) {
@@ -201,7 +237,12 @@ func TestCallGoogleapis(t *testing.T) {
 			UnmarshalBytesToPbMessage = tc.unmarshalFunc
 		}
 
-		err := CallGoogleapis(&http.Client{}, s.URL, tc.method, tc.token, tc.retryConfigs, nil)
+		err := CallGoogleapis(context.Background(), &http.Client{}, s.URL, tc.method, tc.token, tc.policy, nil)
+		s.Close()
+
+		if reqCnt != tc.wantReqCnt {
+			t.Errorf("test(%v) fail, want %d requests, get %d requests", tc.desc, tc.wantReqCnt, reqCnt)
+		}
 
 		if err != nil {
 			if tc.wantError == "" {
@@ -213,7 +254,141 @@ func TestCallGoogleapis(t *testing.T) {
 			if err.Error() != tc.wantError {
 				t.Errorf("test(%v) fail, want response error: %v, get response error: %v", tc.desc, tc.wantError, err)
 			}
-			continue
+		} else if tc.wantError != "" {
+			t.Errorf("test(%v) fail, want response error: %v, get no error", tc.desc, tc.wantError)
+		}
+	}
+}
+
+func TestCallGoogleapisTokenPerAttempt(t *testing.T) {
+	// The token expires after the first attempt.
+	tokens := []string{"expired-token", "fresh-token"}
+	tokenCnt := 0
+	tokenFunc := func() (string, time.Duration, error) {
+		token := tokens[tokenCnt]
+		tokenCnt++
+		return token, time.Second, nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh-token" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("this-is-resp-body"))
+	}))
+	defer s.Close()
+
+	UnmarshalBytesToPbMessage = func(gotBody []byte, output proto.Message) error {
+		return nil
+	}
+	if err := CallGoogleapis(context.Background(), &http.Client{}, s.URL, "GET", tokenFunc, testRetryPolicy(1, time.Millisecond), nil); err != nil {
+		t.Fatalf("got error: %v, want the retry to succeed with the fresh token", err)
+	}
+	if tokenCnt != 2 {
+		t.Errorf("got the token fetched %d times, want once per attempt", tokenCnt)
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	newRequest := func(url string) func(ctx context.Context) (*http.Request, error) {
+		return func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", url, nil)
+		}
+	}
+
+	t.Run("connection errors are retried", func(t *testing.T) {
+		s := httptest.NewServer(http.NotFoundHandler())
+		url := s.URL
+		s.Close()
+
+		policy := testRetryPolicy(2, time.Millisecond)
+		policy.Name = "test-connection-error"
+		if _, err := DoWithRetry(context.Background(), &http.Client{}, policy, newRequest(url)); err == nil {
+			t.Fatalf("got no error, want connection error")
+		}
+		if got := HttpCallOutcome(policy.Name, "retry"); got != 2 {
+			t.Errorf("got %d retries in metrics, want 2", got)
+		}
+		if got := HttpCallOutcome(policy.Name, "failure"); got != 1 {
+			t.Errorf("got %d failures in metrics, want 1", got)
+		}
+	})
+
+	t.Run("cancelled context stops the retries", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer s.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		policy := testRetryPolicy(100, 50*time.Millisecond)
+		policy.Name = "test-cancel"
+
+		start := time.Now()
+		_, err := DoWithRetry(ctx, &http.Client{}, policy, newRequest(s.URL))
+		if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") {
+			t.Errorf("got error: %v, want the last 503 error", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("got call returned after %v, want it to return soon after the context is done", elapsed)
+		}
+		if got := HttpCallOutcome(policy.Name, "success"); got != 0 {
+			t.Errorf("got %d successes in metrics, want 0", got)
 		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		value string
+		want  time.Duration
+	}{
+		{
+			desc: "empty",
+		},
+		{
+			desc:  "delay seconds",
+			value: "120",
+			want:  2 * time.Minute,
+		},
+		{
+			desc:  "date in the past",
+			value: "Wed, 21 Oct 2015 07:28:00 GMT",
+		},
+		{
+			desc:  "invalid value",
+			value: "soon",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := parseRetryAfter(tc.value); got != tc.want {
+			t.Errorf("test(%v) fail, want: %v, get: %v", tc.desc, tc.want, got)
+		}
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("test(date in the future) fail, want about 1h, get: %v", got)
+	}
+}
+
+func TestAddHttpCallOutcomeConcurrently(t *testing.T) {
+	const callers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addHttpCallOutcome("test-concurrent", "success")
+		}()
+	}
+	wg.Wait()
+
+	if got := HttpCallOutcome("test-concurrent", "success"); got != callers {
+		t.Errorf("got %d successes in metrics, want %d", got, callers)
 	}
 }
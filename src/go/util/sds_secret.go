@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+)
+
+const (
+	// The SDS secret names are the file paths with these prefixes, so the
+	// secrets are loaded from the names referenced by the transport sockets.
+	tlsCertificateSecretPrefix    = "tls_certificate:"
+	validationContextSecretPrefix = "validation_context:"
+)
+
+// TlsCertificateSecretName is the name of the SDS secret of the certificate
+// chain "<sslPath>.crt" and the private key "<sslPath>.key".
+func TlsCertificateSecretName(sslPath string) string {
+	return tlsCertificateSecretPrefix + sslPath
+}
+
+// ValidationContextSecretName is the name of the SDS secret of the trusted CA
+// in the root certificates file.
+func ValidationContextSecretName(rootCertsPath string) string {
+	return validationContextSecretPrefix + rootCertsPath
+}
+
+// makeSdsSecretConfig references the SDS secret served by the config manager
+// through ADS.
+func makeSdsSecretConfig(name string) *tlspb.SdsSecretConfig {
+	return &tlspb.SdsSecretConfig{
+		Name: name,
+		SdsConfig: &corepb.ConfigSource{
+			ConfigSourceSpecifier: &corepb.ConfigSource_Ads{
+				Ads: &corepb.AggregatedConfigSource{},
+			},
+			ResourceApiVersion: corepb.ApiVersion_V3,
+		},
+	}
+}
+
+// MakeSdsSecret loads the SDS secret of the name from its files, inlined so
+// that the secret is changed when the files are.
+func MakeSdsSecret(name string) (*tlspb.Secret, error) {
+	switch {
+	case strings.HasPrefix(name, tlsCertificateSecretPrefix):
+		sslPath := strings.TrimPrefix(name, tlsCertificateSecretPrefix)
+		certificateChain, err := readInlineBytes(sslPath + ".crt")
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := readInlineBytes(sslPath + ".key")
+		if err != nil {
+			return nil, err
+		}
+		return &tlspb.Secret{
+			Name: name,
+			Type: &tlspb.Secret_TlsCertificate{
+				TlsCertificate: &tlspb.TlsCertificate{
+					CertificateChain: certificateChain,
+					PrivateKey:       privateKey,
+				},
+			},
+		}, nil
+	case strings.HasPrefix(name, validationContextSecretPrefix):
+		trustedCa, err := readInlineBytes(strings.TrimPrefix(name, validationContextSecretPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return &tlspb.Secret{
+			Name: name,
+			Type: &tlspb.Secret_ValidationContext{
+				ValidationContext: &tlspb.CertificateValidationContext{
+					TrustedCa: trustedCa,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown SDS secret name: %s", name)
+	}
+}
+
+// SdsSecretNames returns the names of the SDS secrets referenced by the TLS
+// transport socket.
+func SdsSecretNames(transportSocket *corepb.TransportSocket) ([]string, error) {
+	if transportSocket.GetName() != TLSTransportSocket {
+		return nil, nil
+	}
+
+	var commonTls *tlspb.CommonTlsContext
+	typedConfig := transportSocket.GetTypedConfig()
+	switch {
+	case ptypes.Is(typedConfig, &tlspb.UpstreamTlsContext{}):
+		upstreamTls := &tlspb.UpstreamTlsContext{}
+		if err := ptypes.UnmarshalAny(typedConfig, upstreamTls); err != nil {
+			return nil, err
+		}
+		commonTls = upstreamTls.GetCommonTlsContext()
+	case ptypes.Is(typedConfig, &tlspb.DownstreamTlsContext{}):
+		downstreamTls := &tlspb.DownstreamTlsContext{}
+		if err := ptypes.UnmarshalAny(typedConfig, downstreamTls); err != nil {
+			return nil, err
+		}
+		commonTls = downstreamTls.GetCommonTlsContext()
+	default:
+		return nil, fmt.Errorf("unexpected TLS transport socket config: %s", typedConfig.GetTypeUrl())
+	}
+
+	var names []string
+	for _, sdsConfig := range commonTls.GetTlsCertificateSdsSecretConfigs() {
+		names = append(names, sdsConfig.GetName())
+	}
+	if sdsConfig := commonTls.GetCombinedValidationContext().GetValidationContextSdsSecretConfig(); sdsConfig != nil {
+		names = append(names, sdsConfig.GetName())
+	}
+	return names, nil
+}
+
+func readInlineBytes(path string) (*corepb.DataSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read TLS file of SDS secret: %v", err)
+	}
+	return &corepb.DataSource{
+		Specifier: &corepb.DataSource_InlineBytes{
+			InlineBytes: data,
+		},
+	}, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+func TestMakeSdsSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sds_secret")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"server.crt": "server-cert",
+		"server.key": "server-key",
+		"ca.pem":     "root-certs",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testData := []struct {
+		desc       string
+		name       string
+		wantSecret string
+		wantErr    string
+	}{
+		{
+			desc: "TLS certificate secret",
+			name: TlsCertificateSecretName(filepath.Join(dir, "server")),
+			wantSecret: `{
+				"name": "tls_certificate:` + filepath.Join(dir, "server") + `",
+				"tlsCertificate": {
+					"certificateChain": {
+						"inlineBytes": "c2VydmVyLWNlcnQ="
+					},
+					"privateKey": {
+						"inlineBytes": "c2VydmVyLWtleQ=="
+					}
+				}
+			}`,
+		},
+		{
+			desc: "Validation context secret",
+			name: ValidationContextSecretName(filepath.Join(dir, "ca.pem")),
+			wantSecret: `{
+				"name": "validation_context:` + filepath.Join(dir, "ca.pem") + `",
+				"validationContext": {
+					"trustedCa": {
+						"inlineBytes": "cm9vdC1jZXJ0cw=="
+					}
+				}
+			}`,
+		},
+		{
+			desc:    "Missing file",
+			name:    TlsCertificateSecretName(filepath.Join(dir, "client")),
+			wantErr: "fail to read TLS file of SDS secret",
+		},
+		{
+			desc:    "Unknown secret name",
+			name:    "server",
+			wantErr: "unknown SDS secret name: server",
+		},
+	}
+
+	for _, tc := range testData {
+		secret, err := MakeSdsSecret(tc.name)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotSecret, err := marshaler.MarshalToString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := JsonEqual(tc.wantSecret, gotSecret); err != nil {
+			t.Errorf("Test (%s): MakeSdsSecret failed, %v", tc.desc, err)
+		}
+	}
+}
+
+func TestSdsSecretNames(t *testing.T) {
+	upstream, err := CreateUpstreamTransportSocket("example.com", "/etc/ssl/certs/ca-certificates.crt", "/etc/endpoints/ssl", nil, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downstream, err := CreateDownstreamTransportSocket("/etc/ssl/endpoints", "", "", "", "", false, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileUpstream, err := CreateUpstreamTransportSocket("example.com", "/etc/ssl/certs/ca-certificates.crt", "", nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		desc            string
+		transportSocket *corepb.TransportSocket
+		wantNames       []string
+	}{
+		{
+			desc:            "Upstream TLS certificate and validation context",
+			transportSocket: upstream,
+			wantNames:       []string{"tls_certificate:/etc/endpoints/ssl/client", "validation_context:/etc/ssl/certs/ca-certificates.crt"},
+		},
+		{
+			desc:            "Downstream TLS certificate",
+			transportSocket: downstream,
+			wantNames:       []string{"tls_certificate:/etc/ssl/endpoints/server"},
+		},
+		{
+			desc:            "Files without SDS",
+			transportSocket: fileUpstream,
+		},
+	}
+
+	for _, tc := range testData {
+		names, err := SdsSecretNames(tc.transportSocket)
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, tc.wantNames) {
+			t.Errorf("Test (%s): got SDS secret names: %v, want: %v", tc.desc, names, tc.wantNames)
+		}
+	}
+}
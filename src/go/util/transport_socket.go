@@ -22,6 +22,8 @@ import (
 
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	tlspb "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 const (
@@ -38,8 +40,9 @@ var (
 	}
 )
 
-// CreateUpstreamTransportSocket creates a TransportSocket for Upstream
-func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string, alpnProtocols []string, cipherSuites string) (*corepb.TransportSocket, error) {
+// CreateUpstreamTransportSocket creates a TransportSocket for Upstream. The
+// certificates are referenced as SDS secrets if useSds is set.
+func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string, alpnProtocols []string, cipherSuites string, useSds bool) (*corepb.TransportSocket, error) {
 	if rootCertsPath == "" {
 		return nil, fmt.Errorf("root certs path cannot be empty.")
 	}
@@ -50,7 +53,7 @@ func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string
 		sslFileName = "backend"
 	}
 
-	commonTls, err := createCommonTlsContext(rootCertsPath, sslClientPath, sslFileName, "", "", cipherSuites)
+	commonTls, err := createCommonTlsContext(rootCertsPath, sslClientPath, sslFileName, "", "", cipherSuites, useSds)
 	if err != nil {
 		return nil, err
 	}
@@ -74,8 +77,11 @@ func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string
 	}, nil
 }
 
-// CreateDownstreamTransportSocket creates a TransportSocket for Downstream
-func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaximumProtocol string, cipherSuites string) (*corepb.TransportSocket, error) {
+// CreateDownstreamTransportSocket creates a TransportSocket for Downstream.
+// The client certificates are validated against clientRootCertsPath if set,
+// and must have one of the allowedClientSans if not empty. The certificates
+// are referenced as SDS secrets if useSds is set.
+func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaximumProtocol string, cipherSuites string, clientRootCertsPath string, requireClientCert bool, allowedClientSans []string, useSds bool) (*corepb.TransportSocket, error) {
 	if sslServerPath == "" {
 		return nil, fmt.Errorf("SSL path cannot be empty.")
 	}
@@ -86,15 +92,31 @@ func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaxim
 		sslFileName = "nginx"
 	}
 
-	commonTls, err := createCommonTlsContext("", sslServerPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol, cipherSuites)
+	commonTls, err := createCommonTlsContext(clientRootCertsPath, sslServerPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol, cipherSuites, useSds)
 	if err != nil {
 		return nil, err
 	}
 	commonTls.AlpnProtocols = []string{"h2", "http/1.1"}
-	tlsContext, err := ptypes.MarshalAny(&tlspb.DownstreamTlsContext{
+	downstreamTls := &tlspb.DownstreamTlsContext{
 		CommonTlsContext: commonTls,
-	},
-	)
+	}
+
+	if clientRootCertsPath != "" {
+		downstreamTls.RequireClientCertificate = &wrapperspb.BoolValue{
+			Value: requireClientCert,
+		}
+		validationContext := commonTls.GetValidationContext()
+		if useSds {
+			validationContext = commonTls.GetCombinedValidationContext().GetDefaultValidationContext()
+		}
+		for _, san := range allowedClientSans {
+			validationContext.MatchSubjectAltNames = append(validationContext.MatchSubjectAltNames, MakeSubjectAltNameMatcher(san))
+		}
+	} else if requireClientCert || len(allowedClientSans) > 0 {
+		return nil, fmt.Errorf("client root certs path cannot be empty to validate client certificates.")
+	}
+
+	tlsContext, err := ptypes.MarshalAny(downstreamTls)
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +128,24 @@ func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaxim
 	}, nil
 }
 
-func createCommonTlsContext(rootCertsPath, sslPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol string, cipherSuites string) (*tlspb.CommonTlsContext, error) {
+// MakeSubjectAltNameMatcher matches the subject alternative name of a
+// certificate, by prefix if the name ends with '*'.
+func MakeSubjectAltNameMatcher(san string) *matcher.StringMatcher {
+	if strings.HasSuffix(san, "*") {
+		return &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Prefix{
+				Prefix: strings.TrimSuffix(san, "*"),
+			},
+		}
+	}
+	return &matcher.StringMatcher{
+		MatchPattern: &matcher.StringMatcher_Exact{
+			Exact: san,
+		},
+	}
+}
+
+func createCommonTlsContext(rootCertsPath, sslPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol string, cipherSuites string, useSds bool) (*tlspb.CommonTlsContext, error) {
 	commonTls := &tlspb.CommonTlsContext{}
 	// Add TLS certificate
 	if sslPath != "" && sslFileName != "" {
@@ -114,24 +153,38 @@ func createCommonTlsContext(rootCertsPath, sslPath, sslFileName, sslMinimumProto
 			sslPath = fmt.Sprintf("%s/", sslPath)
 		}
 
-		commonTls.TlsCertificates = []*tlspb.TlsCertificate{
-			{
-				CertificateChain: &corepb.DataSource{
-					Specifier: &corepb.DataSource_Filename{
-						Filename: fmt.Sprintf("%s%s.crt", sslPath, sslFileName),
+		if useSds {
+			commonTls.TlsCertificateSdsSecretConfigs = []*tlspb.SdsSecretConfig{
+				makeSdsSecretConfig(TlsCertificateSecretName(sslPath + sslFileName)),
+			}
+		} else {
+			commonTls.TlsCertificates = []*tlspb.TlsCertificate{
+				{
+					CertificateChain: &corepb.DataSource{
+						Specifier: &corepb.DataSource_Filename{
+							Filename: fmt.Sprintf("%s%s.crt", sslPath, sslFileName),
+						},
 					},
-				},
-				PrivateKey: &corepb.DataSource{
-					Specifier: &corepb.DataSource_Filename{
-						Filename: fmt.Sprintf("%s%s.key", sslPath, sslFileName),
+					PrivateKey: &corepb.DataSource{
+						Specifier: &corepb.DataSource_Filename{
+							Filename: fmt.Sprintf("%s%s.key", sslPath, sslFileName),
+						},
 					},
 				},
-			},
+			}
 		}
 	}
 
 	// Add Validation Context
-	if rootCertsPath != "" {
+	if rootCertsPath != "" && useSds {
+		// The validation options other than the trusted CA are not rotated.
+		commonTls.ValidationContextType = &tlspb.CommonTlsContext_CombinedValidationContext{
+			CombinedValidationContext: &tlspb.CommonTlsContext_CombinedCertificateValidationContext{
+				DefaultValidationContext:         &tlspb.CertificateValidationContext{},
+				ValidationContextSdsSecretConfig: makeSdsSecretConfig(ValidationContextSecretName(rootCertsPath)),
+			},
+		}
+	} else if rootCertsPath != "" {
 		commonTls.ValidationContextType = &tlspb.CommonTlsContext_ValidationContext{
 			ValidationContext: &tlspb.CertificateValidationContext{
 				TrustedCa: &corepb.DataSource{
@@ -28,6 +28,7 @@ func TestCreateUpstreamTransportSocket(t *testing.T) {
 		sslBackendPath      string
 		alpnProtocols       []string
 		cipherSuites        string
+		useSds              bool
 		wantTransportSocket string
 	}{
 		{
@@ -132,12 +133,49 @@ func TestCreateUpstreamTransportSocket(t *testing.T) {
       "sni":"https://echo-http-12345-uc.a.run.app"
    }
 }
+`,
+		},
+		{
+			desc:           "Upstream Transport Socket for mTLS, with SDS secrets",
+			hostName:       "https://echo-http-12345-uc.a.run.app",
+			rootCertsPath:  "/etc/ssl/certs/ca-certificates.crt",
+			sslBackendPath: "/etc/endpoints/ssl",
+			useSds:         true,
+			wantTransportSocket: `
+{
+   "name":"envoy.transport_sockets.tls",
+   "typedConfig":{
+      "@type":"type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+      "commonTlsContext":{
+         "tlsCertificateSdsSecretConfigs":[
+            {
+               "name":"tls_certificate:/etc/endpoints/ssl/client",
+               "sdsConfig":{
+                  "ads":{},
+                  "resourceApiVersion":"V3"
+               }
+            }
+         ],
+         "combinedValidationContext":{
+            "defaultValidationContext":{},
+            "validationContextSdsSecretConfig":{
+               "name":"validation_context:/etc/ssl/certs/ca-certificates.crt",
+               "sdsConfig":{
+                  "ads":{},
+                  "resourceApiVersion":"V3"
+               }
+            }
+         }
+      },
+      "sni":"https://echo-http-12345-uc.a.run.app"
+   }
+}
 `,
 		},
 	}
 
 	for i, tc := range testData {
-		gotTransportSocket, err := CreateUpstreamTransportSocket(tc.hostName, tc.rootCertsPath, tc.sslBackendPath, tc.alpnProtocols, tc.cipherSuites)
+		gotTransportSocket, err := CreateUpstreamTransportSocket(tc.hostName, tc.rootCertsPath, tc.sslBackendPath, tc.alpnProtocols, tc.cipherSuites, tc.useSds)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -159,6 +197,10 @@ func TestCreateDownstreamTransportSocket(t *testing.T) {
 		sslMinimumProtocol  string
 		sslMaximumProtocol  string
 		cipherSuites        string
+		clientRootCertsPath string
+		requireClientCert   bool
+		allowedClientSans   []string
+		useSds              bool
 		wantTransportSocket string
 	}{
 		{
@@ -249,10 +291,123 @@ func TestCreateDownstreamTransportSocket(t *testing.T) {
 				}
 			}`,
 		},
+		{
+			desc:                "Downstream Transport Socket for mutual TLS, with allowed SANs",
+			sslPath:             "/etc/ssl/endpoints/",
+			clientRootCertsPath: "/etc/ssl/clients/ca.pem",
+			requireClientCert:   true,
+			allowedClientSans:   []string{"spiffe://example.org/ns/prod/*", "client.example.com"},
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2","http/1.1"],
+						"tlsCertificates":[
+							{
+								"certificateChain":{
+									"filename":"/etc/ssl/endpoints/server.crt"
+								},
+								"privateKey":{
+									"filename":"/etc/ssl/endpoints/server.key"
+								}
+							}
+						],
+						"validationContext":{
+							"matchSubjectAltNames":[
+								{
+									"prefix":"spiffe://example.org/ns/prod/"
+								},
+								{
+									"exact":"client.example.com"
+								}
+							],
+							"trustedCa":{
+								"filename":"/etc/ssl/clients/ca.pem"
+							}
+						}
+					},
+					"requireClientCertificate":true
+				}
+			}`,
+		},
+		{
+			desc:                "Downstream Transport Socket for mutual TLS, with SDS secrets",
+			sslPath:             "/etc/ssl/endpoints/",
+			clientRootCertsPath: "/etc/ssl/clients/ca.pem",
+			requireClientCert:   true,
+			allowedClientSans:   []string{"client.example.com"},
+			useSds:              true,
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2","http/1.1"],
+						"tlsCertificateSdsSecretConfigs":[
+							{
+								"name":"tls_certificate:/etc/ssl/endpoints/server",
+								"sdsConfig":{
+									"ads":{},
+									"resourceApiVersion":"V3"
+								}
+							}
+						],
+						"combinedValidationContext":{
+							"defaultValidationContext":{
+								"matchSubjectAltNames":[
+									{
+										"exact":"client.example.com"
+									}
+								]
+							},
+							"validationContextSdsSecretConfig":{
+								"name":"validation_context:/etc/ssl/clients/ca.pem",
+								"sdsConfig":{
+									"ads":{},
+									"resourceApiVersion":"V3"
+								}
+							}
+						}
+					},
+					"requireClientCertificate":true
+				}
+			}`,
+		},
+		{
+			desc:                "Downstream Transport Socket for optional mutual TLS",
+			sslPath:             "/etc/ssl/endpoints/",
+			clientRootCertsPath: "/etc/ssl/clients/ca.pem",
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2","http/1.1"],
+						"tlsCertificates":[
+							{
+								"certificateChain":{
+									"filename":"/etc/ssl/endpoints/server.crt"
+								},
+								"privateKey":{
+									"filename":"/etc/ssl/endpoints/server.key"
+								}
+							}
+						],
+						"validationContext":{
+							"trustedCa":{
+								"filename":"/etc/ssl/clients/ca.pem"
+							}
+						}
+					},
+					"requireClientCertificate":false
+				}
+			}`,
+		},
 	}
 
 	for i, tc := range testData {
-		gotTransportSocket, err := CreateDownstreamTransportSocket(tc.sslPath, tc.sslMinimumProtocol, tc.sslMaximumProtocol, tc.cipherSuites)
+		gotTransportSocket, err := CreateDownstreamTransportSocket(tc.sslPath, tc.sslMinimumProtocol, tc.sslMaximumProtocol, tc.cipherSuites, tc.clientRootCertsPath, tc.requireClientCert, tc.allowedClientSans, tc.useSds)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -44,6 +44,7 @@ const (
 
 	// Metadata suffix
 
+	ClusterNamePath       = "/computeMetadata/v1/instance/attributes/cluster-name"
 	ConfigIDPath          = "/computeMetadata/v1/instance/attributes/endpoints-service-version"
 	GAEServerSoftwarePath = "/computeMetadata/v1/instance/attributes/gae_server_software"
 	KubeEnvPath           = "/computeMetadata/v1/instance/attributes/kube-env"
@@ -54,6 +55,9 @@ const (
 	IdentityTokenPath = "/computeMetadata/v1/instance/service-accounts/default/identity"
 	ProjectIDPath     = "/computeMetadata/v1/project/project-id"
 
+	// On GKE, the name of the node the pod is running on.
+	InstanceNamePath = "/computeMetadata/v1/instance/name"
+
 	// Cloud Run platform is regional, use the region path.
 	RegionPath = "/computeMetadata/v1/instance/region"
 
@@ -63,14 +67,29 @@ const (
 	// The path of getting access token from token agent server
 	TokenAgentAccessTokenPath = "/local/access_token"
 
+	// The path of getting identity token from token agent server
+	TokenAgentIdentityTokenPath = "/local/identity_token"
+
+	// The request header of the shared secret of token agent server
+	TokenAgentSecretHeader = "X-Token-Agent-Secret"
+
 	// b/147591854: This string must NOT have a trailing slash
 	OpenIDDiscoveryCfgURLSuffix = "/.well-known/openid-configuration"
 
+	// The jwks_uri with it points to a local JWKS file.
+	FileScheme = "file://"
+
 	// Platforms
 	GAEFlex = "GAE_FLEX(ESPv2)"
 	GKE     = "GKE(ESPv2)"
 	GCE     = "GCE(ESPv2)"
 
+	GAEStandard    = "GAE_STANDARD(ESPv2)"
+	CloudRun       = "CLOUD_RUN(ESPv2)"
+	CloudFunctions = "CLOUD_FUNCTIONS(ESPv2)"
+	GKEAutopilot   = "GKE_AUTOPILOT(ESPv2)"
+	Anthos         = "ANTHOS(ESPv2)"
+
 	// System Parameter Name
 	ApiKeyParameterName = "api_key"
 
@@ -92,6 +111,24 @@ const (
 	DefaultJwtHeaderNameXGoogleIapJwtAssertion = "X-Goog-Iap-Jwt-Assertion"
 	DefaultJwtQueryParamAccessToken            = "access_token"
 
+	// The tier of quota limit values that applies to all of the consumers.
+	QuotaLimitStandardTier = "STANDARD"
+
+	// The descriptor entry keys of the requests to the rate limit service.
+	RateLimitOperationDescriptorKey  = "operation"
+	RateLimitApiKeyDescriptorKey     = "api_key"
+	RateLimitJwtSubjectDescriptorKey = "jwt_subject"
+
+	// The header of the API key, when the operation has no custom API key locations.
+	DefaultApiKeyHeaderName = "x-api-key"
+
+	// The route metadata key of the request body schema, under the Lua filter.
+	RequestBodySchemaMetadataKey = "request_body_schema"
+
+	// The JWT in a cookie is copied to the header of this prefix and the cookie
+	// name, which is read by the jwtAuthn filter.
+	JwtCookieHeaderPrefix = "X-Endpoint-Jwt-Cookie-"
+
 	// The suffix of jwtAuthn filter header to forward payload
 	JwtAuthnForwardPayloadHeaderSuffix = "API-UserInfo"
 
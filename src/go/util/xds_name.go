@@ -37,10 +37,20 @@ const (
 	HTTPConnectionManager = "envoy.filters.network.http_connection_manager"
 	// JwtAuthn filter.
 	JwtAuthn = "envoy.filters.http.jwt_authn"
+	// RBAC HTTP filter
+	RBAC = "envoy.filters.http.rbac"
+	// Rate limit HTTP filter, calling an external rate limit service
+	RateLimit = "envoy.filters.http.ratelimit"
+	// External authorization HTTP filter
+	ExtAuthz = "envoy.filters.http.ext_authz"
+	// Lua HTTP filter, running the request validation script
+	Lua = "envoy.filters.http.lua"
 	// TLSTransportSocket is Envoy TLS Transport Socket name.
 	TLSTransportSocket = "envoy.transport_sockets.tls"
 	// AccessFileLogger filter name
 	AccessFileLogger = "envoy.access_loggers.file"
+	// Retry host predicate avoiding the hosts already attempted
+	PreviousHostsRetryPredicate = "envoy.retry_host_predicates.previous_hosts"
 
 	// ESPv2 custom http filters.
 
@@ -65,6 +75,12 @@ const (
 	// The service control server cluster name.
 	ServiceControlClusterName = "service-control-cluster"
 
+	// The rate limit service cluster name.
+	RateLimitServiceClusterName = "rate-limit-service-cluster"
+
+	// The external authorization service cluster name.
+	ExtAuthzClusterName = "ext-authz-cluster"
+
 	IngressListenerName  = "ingress_listener"
 	LoopbackListenerName = "loopback_listener"
 )
@@ -244,7 +244,7 @@ var makeGRPCCall = func(addr, method, token string, header http.Header) (string,
 
 	if err != nil {
 		statusErr := status.Convert(err)
-		return "", fmt.Errorf("%v got unexpected error: code = %v, message = %v", method, statusErr.Code(), utils.RpcStatusDeterministicJsonFormat([]byte(statusErr.Message())))
+		return "", fmt.Errorf("%v got unexpected error: code = %v, message = %v", method, statusErr.Code(), statusErr.Message())
 	}
 
 	var marshaler jsonpb.Marshaler
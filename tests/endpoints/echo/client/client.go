@@ -176,6 +176,15 @@ func DoCorsPreflightRequest(url, origin, requestMethod, requestHeader, referer s
 
 // DoHttpsGet performs a HTTPS Get request to a specified url
 func DoHttpsGet(url string, httpVersion int, certPath string) (http.Header, []byte, error) {
+	return doHttpsGet(url, httpVersion, certPath, nil)
+}
+
+// DoHttpsGetWithClientCert presents the client certificate for the mutual TLS.
+func DoHttpsGetWithClientCert(url string, certPath string, clientCert *tls.Certificate) (http.Header, []byte, error) {
+	return doHttpsGet(url, 1, certPath, []tls.Certificate{*clientCert})
+}
+
+func doHttpsGet(url string, httpVersion int, certPath string, clientCerts []tls.Certificate) (http.Header, []byte, error) {
 	client := &http.Client{}
 	caCert, err := ioutil.ReadFile(certPath)
 	if err != nil {
@@ -185,7 +194,8 @@ func DoHttpsGet(url string, httpVersion int, certPath string) (http.Header, []by
 	caCertPool.AppendCertsFromPEM(caCert)
 	// Create TLS configuration with the certificate of the server
 	tlsConfig := &tls.Config{
-		RootCAs: caCertPool,
+		RootCAs:      caCertPool,
+		Certificates: clientCerts,
 	}
 
 	// Use the proper transport in the client
@@ -19,12 +19,14 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net"
+	"net/url"
 	"time"
 )
 
@@ -37,6 +39,44 @@ var (
 
 // GenerateCert generates a certificate from the root cert and key pair.
 func GenerateCert(certPath, keyPath string) (*tls.Certificate, error) {
+	addrs := []net.IP{}
+	for _, ip := range serverIPs {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid IP: %s", ip)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return generateChildCert(certPath, keyPath, func(template *x509.Certificate) {
+		template.IPAddresses = addrs
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+}
+
+// GenerateClientCert generates a client certificate with the DNS and URI
+// subject alternative names, in the given order, from the root cert and key
+// pair.
+func GenerateClientCert(certPath, keyPath string, dnsNames, uris []string) (*tls.Certificate, error) {
+	var parsedUris []*url.URL
+	for _, uri := range uris {
+		parsedUri, err := url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URI: %s", uri)
+		}
+		parsedUris = append(parsedUris, parsedUri)
+	}
+
+	return generateChildCert(certPath, keyPath, func(template *x509.Certificate) {
+		// Unlike the root, so the client certificate is not taken as self-signed.
+		template.Subject = pkix.Name{CommonName: "esp-test-client"}
+		template.DNSNames = dnsNames
+		template.URIs = parsedUris
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	})
+}
+
+func generateChildCert(certPath, keyPath string, setTemplate func(template *x509.Certificate)) (*tls.Certificate, error) {
 	rootCert, err := ioutil.ReadFile(certPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read cert file: %v", err)
@@ -59,15 +99,6 @@ func GenerateCert(certPath, keyPath string) (*tls.Certificate, error) {
 		return nil, fmt.Errorf("failed to parse certificate: %v", err)
 	}
 
-	addrs := []net.IP{}
-	for _, ip := range serverIPs {
-		addr := net.ParseIP(ip)
-		if addr == nil {
-			return nil, fmt.Errorf("invalid IP: %s", ip)
-		}
-		addrs = append(addrs, addr)
-	}
-
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
@@ -79,11 +110,10 @@ func GenerateCert(certPath, keyPath string) (*tls.Certificate, error) {
 		Subject:               cacert.Subject,
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().Add(defaultDuration),
-		IPAddresses:           addrs,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
+	setTemplate(template)
 
 	der, err := x509.CreateCertificate(rand.Reader, template, cacert, cacert.PublicKey, data.PrivateKey)
 	if err != nil {
@@ -0,0 +1,113 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	StsTokenPath = "/v1/token"
+)
+
+// MockStsServer mocks the Security Token Service, which exchanges subject
+// tokens of external identity providers for Google access tokens.
+type MockStsServer struct {
+	s                *httptest.Server
+	wantSubjectToken string
+	accessToken      string
+	expiresIn        time.Duration
+	reqCnt           int32
+
+	mu        sync.Mutex
+	lastScope string
+}
+
+// NewMockStsServer creates a new HTTP server that exchanges wantSubjectToken
+// for accessToken, which expires in expiresIn.
+func NewMockStsServer(wantSubjectToken, accessToken string, expiresIn time.Duration) *MockStsServer {
+	m := &MockStsServer{
+		wantSubjectToken: wantSubjectToken,
+		accessToken:      accessToken,
+		expiresIn:        expiresIn,
+	}
+	m.s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		glog.Infof("Fake STS handling request: %v %v", r.Method, r.URL)
+		atomic.AddInt32(&m.reqCnt, 1)
+
+		if r.URL.Path != StsTokenPath || r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:token-exchange" ||
+			r.PostForm.Get("audience") == "" || r.PostForm.Get("subject_token_type") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_request"}`))
+			return
+		}
+		m.mu.Lock()
+		m.lastScope = r.PostForm.Get("scope")
+		m.mu.Unlock()
+		if r.PostForm.Get("subject_token") != m.wantSubjectToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fmt.Sprintf(`{"access_token": "%s", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer", "expires_in": %d}`,
+			m.accessToken, int(m.expiresIn.Seconds()))))
+	}))
+	fmt.Println("started STS server at " + m.GetURL())
+	return m
+}
+
+// GetURL returns the URL of the MockStsServer.
+func (m *MockStsServer) GetURL() string {
+	return m.s.URL
+}
+
+// GetTokenURL returns the token exchange URL, to be used as the token_url of external_account credentials.
+func (m *MockStsServer) GetTokenURL() string {
+	return m.s.URL + StsTokenPath
+}
+
+// GetReqCnt returns the number of requests received.
+func (m *MockStsServer) GetReqCnt() int {
+	return int(atomic.LoadInt32(&m.reqCnt))
+}
+
+// GetLastScope returns the scope of the last token exchange request.
+func (m *MockStsServer) GetLastScope() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastScope
+}
+
+// Close shuts down the server.
+func (m *MockStsServer) Close() {
+	m.s.Close()
+}
@@ -53,6 +53,7 @@ const (
 	TestDifferentOriginPreflightCors
 	TestDifferentOriginSimpleCors
 	TestDnsResolver
+	TestDownstreamClientCertRules
 	TestDynamicBackendRoutingMutualTLS
 	TestDynamicBackendRoutingTLS
 	TestDynamicGrpcBackendTLS
@@ -70,6 +71,7 @@ const (
 	TestGRPCInteropMiniStress
 	TestGRPCInterops
 	TestGRPCJwt
+	TestGRPCLocalReplyFormat
 	TestGRPCMetadata
 	TestGRPCMinistress
 	TestGRPCStreaming
@@ -91,6 +93,7 @@ const (
 	TestMethodOverrideBackendMethod
 	TestMethodOverrideScReport
 	TestMultiGrpcServices
+	TestOAuthCanonicalScopes
 	TestProxyHandlesCorsPreflightRequestsBasic
 	TestPreflightRequestWithAllowCors
 	TestReportGCPAttributes
@@ -110,6 +110,11 @@ var (
 				},
 			},
 		},
+		{
+			Id:     OAuthScopesProvider,
+			Issuer: OAuthScopesIssuer,
+			Keys:   OAuthScopesPubKeys,
+		},
 	}
 )
 
@@ -129,6 +134,7 @@ const (
 	ServiceControlProvider       string = "service_control_jwt_payload_auth"
 	X509Provider                 string = "x509_jwt_provider"
 	CustomJwtLocationProvider    string = "custom_jwt_location_provider"
+	OAuthScopesProvider          string = "oauth_scopes_provider"
 )
 
 // Issuers
@@ -141,6 +147,7 @@ const (
 	InvalidIssuer         string = "invalid_jwks_provider"
 	NonexistentIssuer     string = "nonexist_jwks_provider"
 	FakeIssuer            string = "fake.issuer"
+	OAuthScopesIssuer     string = "oauth-scopes-issuer"
 )
 
 // Keys and tokens
@@ -435,4 +442,52 @@ const (
 		"41G8sbg5JVarjYAnYCQbSnqtKxQVhuQ_Lrwf3mcrnSqeRAPummfK1RB6lp2l9SW3A9IqX_" +
 		"NZGEelQRvYU8fo8x5rlCK_UI9oIAlEiMStLQ7AntkXwE6yX_yw4pqlh7NtEiphcBDkXect" +
 		"qm8FGi5udDWS7dvUXf01VokK9g"
+
+	OAuthScopesPubKeys = `{
+		"keys": [
+		{
+			"kty": "RSA",
+			"alg": "RS256",
+			"e": "AQAB",
+			"kid": "oauth-scopes-key",
+			"n": "kGt3aNur8J6WnTMejfxqduDmVejRwxb2RJqt72bOE1wORFJjD_Ckc6ifQeAQCfzv9BKBFYaRmm3WwAM2GmF6Q7vrQX-tDfE0F_9RljEWFQJRALj36BYtqObWTqB07O25by2UsI-LvAZJATm5cCtlI0lZE1pWqRuZQ4V4NU8yDyCANxCUXzQ0cNN4YVd8bLCrBi8Ced9xrslbLEiS9VFsQaFv41Qf_C3OP6aodnOzT4R5YNFbX-1jgBE29RbJUpJWdTo2-YrXe_i_EsGFKc_cbr2i4zoInqXqx7bMxoL8LdSJ3h28kdB5lA7qwKcVKgqerLuKUwkVv5Y7sshe0Z8iKQ"
+		}
+		]
+	}`
+
+	// Payload: {"aud":"ok_audience","exp":4703162488,"iat":1581724566,"iss":"oauth-scopes-issuer","sub":"oauth-scopes-subject","scope":"https://www.googleapis.com/auth/books.read https://www.googleapis.com/auth/books.write"}
+	FakeOAuthScopesReadWriteToken = "eyJhbGciOiJSUzI1NiIsImtpZCI6Im9hdXRoLXNjb3Blcy1rZXkiLCJ0eXAiOiJKV1QifQ" +
+		".eyJhdWQiOiJva19hdWRpZW5jZSIsImV4cCI6NDcwMzE2MjQ4OCwiaWF0IjoxNTgxNzI0N" +
+		"TY2LCJpc3MiOiJvYXV0aC1zY29wZXMtaXNzdWVyIiwic3ViIjoib2F1dGgtc2NvcGVzLXN" +
+		"1YmplY3QiLCJzY29wZSI6Imh0dHBzOi8vd3d3Lmdvb2dsZWFwaXMuY29tL2F1dGgvYm9va" +
+		"3MucmVhZCBodHRwczovL3d3dy5nb29nbGVhcGlzLmNvbS9hdXRoL2Jvb2tzLndyaXRlIn0" +
+		".kEaw1KjkyjdF6JYoUC2CBRE27YYOy0hmBluLtcB6IlDCAqkGAlhLAygOOWjB19n-OnbEW" +
+		"V6dYvmP6nDLc6dZUkhTJFXTHxPG-KdvCAMes7rIMXrorzBbflnNGG9D_1KItGnsJirrFmk" +
+		"cC4clSw2uyfQylOpWAoTFgmlfLvwanji4VngCIB5D7wOMI6EPGsq3Xw6maIj8odLzjiiPh" +
+		"8BjIzqX1DoLuYeIvbK4l05ROM2lowgeJOvo9EvhHiGCvDEgLDDBbqYMY8qorknuuyo3_UL" +
+		"HAhbTBYvpeOC1_6oyKoLFMLWYeqsQgSd2cT4Sg9woOtbzuD1qn0XKcqWUTf-BBw"
+
+	// Payload: {"aud":"ok_audience","exp":4703162488,"iat":1581724566,"iss":"oauth-scopes-issuer","sub":"oauth-scopes-subject","scp":["https://www.googleapis.com/auth/books.read"]}
+	FakeOAuthScopesScpReadToken = "eyJhbGciOiJSUzI1NiIsImtpZCI6Im9hdXRoLXNjb3Blcy1rZXkiLCJ0eXAiOiJKV1QifQ" +
+		".eyJhdWQiOiJva19hdWRpZW5jZSIsImV4cCI6NDcwMzE2MjQ4OCwiaWF0IjoxNTgxNzI0N" +
+		"TY2LCJpc3MiOiJvYXV0aC1zY29wZXMtaXNzdWVyIiwic3ViIjoib2F1dGgtc2NvcGVzLXN" +
+		"1YmplY3QiLCJzY3AiOlsiaHR0cHM6Ly93d3cuZ29vZ2xlYXBpcy5jb20vYXV0aC9ib29rc" +
+		"y5yZWFkIl19.WaRmHO8e6_G2O4fm02v3x87bvJUOWP6zhY5iIRNF1Uq_FQFvcR0fn1jl-p" +
+		"1GAL3Z7aG4RWGblKwxXch1NlkTEIZctaxU7JdN7eeiHSVvGOAHkEbR3wBJrPHalvuYts7b" +
+		"QpD7s7CdVzg_UViLJCmYyskoAe06WP5m0_yPjUs3FgFtlxknU_YHWgupvX2Y-g6qn_noLX" +
+		"e1T3zyBVwJFz9vkcLr_3kxhOx9GCwbzc5voo7e5tfznpfuoSxkMk00nySFrYFTkLcMyrN0" +
+		"jtLfWwETCeMmdxqTWR12_L-KaaAhImojHXyPlmJR6YroY6X7AWhBF8t6lfaSeqG9F0E-Yz" +
+		"J9dQ"
+
+	// Payload: {"aud":"ok_audience","exp":4703162488,"iat":1581724566,"iss":"oauth-scopes-issuer","sub":"oauth-scopes-subject","scope":"https://www.googleapis.com/auth/calendar"}
+	FakeOAuthScopesCalendarToken = "eyJhbGciOiJSUzI1NiIsImtpZCI6Im9hdXRoLXNjb3Blcy1rZXkiLCJ0eXAiOiJKV1QifQ" +
+		".eyJhdWQiOiJva19hdWRpZW5jZSIsImV4cCI6NDcwMzE2MjQ4OCwiaWF0IjoxNTgxNzI0N" +
+		"TY2LCJpc3MiOiJvYXV0aC1zY29wZXMtaXNzdWVyIiwic3ViIjoib2F1dGgtc2NvcGVzLXN" +
+		"1YmplY3QiLCJzY29wZSI6Imh0dHBzOi8vd3d3Lmdvb2dsZWFwaXMuY29tL2F1dGgvY2FsZ" +
+		"W5kYXIifQ.TA5meo7XWnv3BDCBZZdusXMqKZ8NAJ16Pn1hCZZrDrJECHgXBdyBT46-3SML" +
+		"1CqoHpTOGzi8fOjHxM_00B5NZZUk7hz5Yrs8Pvv5p51cy5vj_JMGwVwdpx5FLRpmrau-yA" +
+		"YSVa-_Rsnol0aR84wsp_kSi_mYq-jBY_XEoQ3C4QusU4cmgj1Q2iz28tYHJpxWGL_XlR70" +
+		"ja4E_xmyuPJtRp38Ho8zFTxs_RtYtWCVYOhEhH2-n3tWTvPBvvKzGqyL4YiMP_p_dIv7pV" +
+		"733LMS2ununK8Uosv0wvwLbIK3T4JlRCkujAYtpKZk9tToSsKUk0kDp1ZFO9uPotLcojA1" +
+		"hA"
 )
@@ -324,7 +324,7 @@ func TestGRPCJwt(t *testing.T) {
 			desc:             "Fail for gRPC client, without valid JWT token",
 			clientProtocol:   "grpc",
 			method:           "ListShelves",
-			wantError:        `code = Unauthenticated, message = {"code":401,"message":"Jwt is missing"}`,
+			wantError:        `code = Unauthenticated, message = Jwt is missing`,
 			wantGRPCWebError: `401 Unauthorized, {"code":401,"message":"Jwt is missing"}`,
 		},
 		{
@@ -346,7 +346,7 @@ func TestGRPCJwt(t *testing.T) {
 			clientProtocol:   "grpc",
 			method:           "ListShelves",
 			token:            testdata.FakeBadToken,
-			wantError:        `code = Unauthenticated, message = {"code":401,"message":"Jwt issuer is not configured"}`,
+			wantError:        `code = Unauthenticated, message = Jwt issuer is not configured`,
 			wantGRPCWebError: `401 Unauthorized, {"code":401,"message":"Jwt issuer is not configured"}`,
 		},
 		{
@@ -436,7 +436,7 @@ func TestGRPCJwt(t *testing.T) {
 			clientProtocol:   "grpc",
 			method:           "ListShelves",
 			token:            testdata.FakeCloudToken,
-			wantError:        `code = PermissionDenied, message = {"code":403,"message":"Audiences in Jwt are not allowed"}`,
+			wantError:        `code = PermissionDenied, message = Audiences in Jwt are not allowed`,
 			wantGRPCWebError: `403 Forbidden, {"code":403,"message":"Audiences in Jwt are not allowed"}`,
 		},
 		{
@@ -452,7 +452,7 @@ func TestGRPCJwt(t *testing.T) {
 			clientProtocol:   "grpc",
 			method:           "ListShelves",
 			token:            testdata.FakeCloudTokenSingleAudience2,
-			wantError:        `code = PermissionDenied, message = {"code":403,"message":"Audiences in Jwt are not allowed"}`,
+			wantError:        `code = PermissionDenied, message = Audiences in Jwt are not allowed`,
 			wantGRPCWebError: `403 Forbidden, {"code":403,"message":"Audiences in Jwt are not allowed"}`,
 		},
 		{
@@ -559,6 +559,83 @@ func TestGRPCJwt(t *testing.T) {
 	}
 }
 
+func TestGRPCLocalReplyFormat(t *testing.T) {
+	t.Parallel()
+
+	configID := "test-config-id"
+	args := []string{"--service_config_id=" + configID,
+		"--rollout_strategy=fixed", "--local_reply_format=google_rpc_status"}
+
+	s := env.NewTestEnv(platform.TestGRPCLocalReplyFormat, platform.GrpcBookstoreSidecar)
+	defer s.TearDown(t)
+	if err := s.Setup(args); err != nil {
+		t.Fatalf("fail to setup test env, %v", err)
+	}
+
+	tests := []struct {
+		desc           string
+		clientProtocol string
+		method         string
+		token          string
+		header         http.Header
+		wantResp       string
+		wantError      string
+	}{
+		{
+			desc:           "The gRPC client gets the grpc-status and the plain grpc-message of the local reply",
+			clientProtocol: "grpc",
+			method:         "ListShelves",
+			wantError:      `code = Unauthenticated, message = Jwt is missing`,
+		},
+		{
+			desc:           "The gRPC client gets the grpc-status and the plain grpc-message of the JWT error",
+			clientProtocol: "grpc",
+			method:         "ListShelves",
+			token:          testdata.FakeCloudTokenSingleAudience2,
+			wantError:      `code = PermissionDenied, message = Audiences in Jwt are not allowed`,
+		},
+		{
+			desc:           "The gRPC-Web client gets the local reply in the HTTP response",
+			clientProtocol: "grpc-web",
+			method:         "ListShelves",
+			wantError:      `401 Unauthorized`,
+		},
+		{
+			desc:           "Succeed for gRPC client, with valid JWT token",
+			clientProtocol: "grpc",
+			method:         "CreateShelf",
+			token:          testdata.FakeCloudGrpcBookstoreDefaultToken,
+			header:         http.Header{"x-api-key": []string{"api-key"}},
+			wantResp:       `{"id":"14785","theme":"New Shelf"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		addr := fmt.Sprintf("%v:%v", platform.GetLoopbackAddress(), s.Ports().ListenerPort)
+		var resp string
+		var err error
+		if tc.clientProtocol == "grpc-web" {
+			resp, _, err = client.MakeGRPCWebCall(addr, tc.method, tc.token, tc.header)
+		} else {
+			resp, err = client.MakeCall(tc.clientProtocol, addr, "", tc.method, tc.token, tc.header)
+		}
+
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): failed,\n expected err: %v,\n got: %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected error: %v", tc.desc, err)
+			continue
+		}
+		if !strings.Contains(resp, tc.wantResp) {
+			t.Errorf("Test (%s): failed,\n expected: %s,\n got: %s", tc.desc, tc.wantResp, resp)
+		}
+	}
+}
+
 func TestGRPCMetadata(t *testing.T) {
 	t.Parallel()
 
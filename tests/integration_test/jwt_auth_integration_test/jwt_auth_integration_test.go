@@ -457,3 +457,73 @@ func TestFrontendAndBackendAuthHeaders(t *testing.T) {
 		}
 	}
 }
+
+func TestOAuthCanonicalScopes(t *testing.T) {
+	t.Parallel()
+
+	configID := "test-config-id"
+	args := []string{"--service_config_id=" + configID,
+		"--rollout_strategy=fixed"}
+
+	s := env.NewTestEnv(platform.TestOAuthCanonicalScopes, platform.GrpcBookstoreSidecar)
+	s.OverrideAuthentication(&confpb.Authentication{
+		Rules: []*confpb.AuthenticationRule{
+			{
+				Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+				Oauth: &confpb.OAuthRequirements{
+					CanonicalScopes: "https://www.googleapis.com/auth/books.read, https://www.googleapis.com/auth/books.admin",
+				},
+				Requirements: []*confpb.AuthRequirement{
+					{
+						ProviderId: testdata.OAuthScopesProvider,
+						Audiences:  "ok_audience",
+					},
+				},
+			},
+		},
+	})
+	defer s.TearDown(t)
+	if err := s.Setup(args); err != nil {
+		t.Fatalf("fail to setup test env, %v", err)
+	}
+
+	tests := []struct {
+		desc      string
+		token     string
+		wantResp  string
+		wantError string
+	}{
+		{
+			desc:     "Succeeded, one of the canonical scopes is in the scope claim",
+			token:    testdata.FakeOAuthScopesReadWriteToken,
+			wantResp: `{"shelves":[{"id":"100","theme":"Kids"},{"id":"200","theme":"Classic"}]}`,
+		},
+		{
+			desc:     "Succeeded, one of the canonical scopes is in the scp claim",
+			token:    testdata.FakeOAuthScopesScpReadToken,
+			wantResp: `{"shelves":[{"id":"100","theme":"Kids"},{"id":"200","theme":"Classic"}]}`,
+		},
+		{
+			desc:      "Failed, none of the canonical scopes is granted",
+			token:     testdata.FakeOAuthScopesCalendarToken,
+			wantError: `403 Forbidden, {"code":403,"message":"Request had insufficient authentication scopes"}`,
+		},
+		{
+			desc:      "Failed, no JWT passed in",
+			wantError: `401 Unauthorized, {"code":401,"message":"Jwt is missing"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		addr := fmt.Sprintf("%v:%v", platform.GetLoopbackAddress(), s.Ports().ListenerPort)
+		resp, err := client.MakeCall("http", addr, "GET", "/v1/shelves?key=api-key", tc.token, nil)
+
+		if tc.wantError != "" && (err == nil || !strings.Contains(err.Error(), tc.wantError)) {
+			t.Errorf("Test (%s): failed, expected err: %v, got: %v", tc.desc, tc.wantError, err)
+		} else if tc.wantError == "" && err != nil {
+			t.Errorf("Test (%s): failed, expected no error, got error: %s", tc.desc, err)
+		} else if !strings.Contains(resp, tc.wantResp) {
+			t.Errorf("Test (%s): failed, expected: %s, got: %s", tc.desc, tc.wantResp, resp)
+		}
+	}
+}
@@ -31,7 +31,8 @@ func TestJwtLocations(t *testing.T) {
 	t.Parallel()
 	configID := "test-config-id"
 	args := []string{"--service_config_id=" + configID,
-		"--rollout_strategy=fixed"}
+		"--rollout_strategy=fixed",
+		"--jwt_cookie_locations=" + testdata.CustomJwtLocationProvider + "=jwt-cookie-foo"}
 
 	s := env.NewTestEnv(platform.TestJwtLocations, platform.GrpcBookstoreSidecar)
 	s.OverrideAuthentication(&confpb.Authentication{
@@ -133,6 +134,46 @@ func TestJwtLocations(t *testing.T) {
 			method:         "/v1/shelves/100?key=api-key&jwt-param-bar=" + testdata.Rs256Token,
 			wantResp:       `{"id":"100","theme":"Kids"}`,
 		},
+		{
+			desc:           "Success. Jwt token is passed in cookie jwt-cookie-foo with other cookies",
+			clientProtocol: "http",
+			httpMethod:     "GET",
+			method:         "/v1/shelves/100?key=api-key",
+			headers: map[string][]string{
+				"Cookie": {"theme=dark; jwt-cookie-foo=" + testdata.Rs256Token + "; lang=en"},
+			},
+			wantResp: `{"id":"100","theme":"Kids"}`,
+		},
+		{
+			desc:           "Failure. Jwt token is passed in an unknown cookie",
+			clientProtocol: "http",
+			httpMethod:     "GET",
+			method:         "/v1/shelves/100?key=api-key",
+			headers: map[string][]string{
+				"Cookie": {"jwt-cookie-bar=" + testdata.Rs256Token},
+			},
+			wantError: `401 Unauthorized, {"code":401,"message":"Jwt is missing"}`,
+		},
+		{
+			desc:           "Failure. Jwt token is passed in a cookie whose name ends with jwt-cookie-foo",
+			clientProtocol: "http",
+			httpMethod:     "GET",
+			method:         "/v1/shelves/100?key=api-key",
+			headers: map[string][]string{
+				"Cookie": {"old-jwt-cookie-foo=" + testdata.Rs256Token},
+			},
+			wantError: `401 Unauthorized, {"code":401,"message":"Jwt is missing"}`,
+		},
+		{
+			desc:           "Failure. Jwt token is passed in the internal header of cookie jwt-cookie-foo",
+			clientProtocol: "http",
+			httpMethod:     "GET",
+			method:         "/v1/shelves/100?key=api-key",
+			headers: map[string][]string{
+				"X-Endpoint-Jwt-Cookie-jwt-cookie-foo": {testdata.Rs256Token},
+			},
+			wantError: `401 Unauthorized, {"code":401,"message":"Jwt is missing"}`,
+		},
 		{
 			desc:           "Failure. Jwt token is passed in default \"Authorization: Bearer\" header for the customized jwt locations",
 			clientProtocol: "http",
@@ -16,6 +16,9 @@ package transport_security_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -285,3 +288,83 @@ func TestHSTS(t *testing.T) {
 		}
 	}
 }
+
+func TestDownstreamClientCertRules(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "client_cert_rules")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rulesPath := filepath.Join(dir, "rules.json")
+	rules := `{"rules": [{"selector": "1.echo_api_endpoints_cloudesf_testing_cloud_goog.Simpleget", "allowed_sans": ["spiffe://example.org/ns/prod/sa/admin"]}]}`
+	if err := ioutil.WriteFile(rulesPath, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := utils.CommonArgs()
+	args = append(args, fmt.Sprintf("--ssl_server_cert_path=%v", platform.GetFilePath(platform.TestDataFolder)))
+	args = append(args, fmt.Sprintf("--ssl_downstream_client_root_certs_path=%v", platform.GetFilePath(platform.ProxyCert)))
+	args = append(args, fmt.Sprintf("--ssl_downstream_client_cert_rules_file=%v", rulesPath))
+
+	s := env.NewTestEnv(platform.TestDownstreamClientCertRules, platform.EchoSidecar)
+	defer s.TearDown(t)
+	if err := s.Setup(args); err != nil {
+		t.Fatalf("fail to setup test env, %v", err)
+	}
+
+	testData := []struct {
+		desc      string
+		dnsNames  []string
+		uris      []string
+		wantResp  string
+		wantError string
+	}{
+		{
+			desc:     "Succeed, the URI SAN is allowed",
+			uris:     []string{"spiffe://example.org/ns/prod/sa/admin"},
+			wantResp: `simple get message`,
+		},
+		{
+			desc:     "Succeed, the URI SAN is compared before the DNS SAN",
+			dnsNames: []string{"client.example.org"},
+			uris:     []string{"spiffe://example.org/ns/prod/sa/admin"},
+			wantResp: `simple get message`,
+		},
+		{
+			desc:      "Fail, only the first URI SAN is compared",
+			uris:      []string{"spiffe://example.org/ns/dev/sa/admin", "spiffe://example.org/ns/prod/sa/admin"},
+			wantError: "403 Forbidden",
+		},
+		{
+			desc:      "Fail, the certificate has no URI SAN",
+			dnsNames:  []string{"admin.example.org"},
+			wantError: "403 Forbidden",
+		},
+	}
+
+	for _, tc := range testData {
+		clientCert, err := comp.GenerateClientCert(platform.GetFilePath(platform.ProxyCert), platform.GetFilePath(platform.ProxyKey), tc.dnsNames, tc.uris)
+		if err != nil {
+			t.Fatalf("Test (%s): fail to generate client cert: %v", tc.desc, err)
+		}
+
+		// FIXME: Use of localhost. Difficult to generate certs with ip addresses.
+		url := fmt.Sprintf("https://%v:%v/simpleget?key=api-key", platform.GetLocalhost(), s.Ports().ListenerPort)
+		_, resp, err := client.DoHttpsGetWithClientCert(url, platform.GetFilePath(platform.ServerCert), clientCert)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got err: %v, want err: %s", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got unexpected err: %v", tc.desc, err)
+			continue
+		}
+		if !strings.Contains(string(resp), tc.wantResp) {
+			t.Errorf("Test (%s): got resp: %s, want: %s", tc.desc, string(resp), tc.wantResp)
+		}
+	}
+}
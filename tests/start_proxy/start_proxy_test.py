@@ -278,6 +278,27 @@ class TestStartProxy(unittest.TestCase):
               '--cors_expose_headers', 'Content-Length,Content-Range',
               '--service_account_key', '/tmp/service_accout_key', '--non_gcp',
               ]),
+            # token agent over the Unix domain socket
+            (['--service=test_bookstore.gloud.run',
+              '--backend=https://127.0.0.1', '--non_gcp',
+              '--service_account_key', '/tmp/service_accout_key',
+              '--token_agent_socket', '/tmp/token_agent.sock'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'https://127.0.0.1', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--disable_tracing',
+              '--service_account_key', '/tmp/service_accout_key',
+              '--token_agent_socket', '/tmp/token_agent.sock', '--non_gcp',
+              ]),
+            # Anthos outside of GCP
+            (['--service=test_bookstore.gloud.run',
+              '--backend=https://127.0.0.1',
+              '--anthos_without_metadata_server'],
+             ['bin/configmanager', '--logtostderr', '--rollout_strategy', 'fixed',
+              '--backend_address', 'https://127.0.0.1', '--v', '0',
+              '--service', 'test_bookstore.gloud.run',
+              '--anthos_without_metadata_server',
+              ]),
             # backend routing (with deprecated flag)
             (['--backend=https://127.0.0.1:8000', '--enable_backend_routing',
               '--service_json_path=/tmp/service.json',